@@ -0,0 +1,475 @@
+package archiver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gtfierro/giles2/common"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Alert rules (see common.AlertRule) are evaluated by the broker against the
+// readings of each incoming message, and every alertInterval for rules that
+// must hold for a while or that watch for missing data. An alert for a stream
+// is pending while its condition holds for less than the For of the rule,
+// firing once it has held for longer and resolved once it no longer holds.
+// No data rules count the silence of a stream from its last reading, which
+// may have been stored before the archiver started. Sinks are told when an
+// alert fires and when it resolves, once each.
+
+// how often pending alerts and no data rules are checked
+var alertInterval = time.Second
+
+// alert states
+const (
+	ALERT_PENDING  = "pending"
+	ALERT_FIRING   = "firing"
+	ALERT_RESOLVED = "resolved"
+)
+
+// Alert is the state of an alert rule for one stream. Sinks are sent the
+// alert as it fires and resolves
+type Alert struct {
+	Rule  string
+	UUID  common.UUID
+	State string
+	// when the condition began to hold
+	Since time.Time
+	// when the alert last changed state
+	Changed time.Time
+	// the latest reading the rule was evaluated on; absent for no data rules
+	Value *float64 `json:",omitempty"`
+}
+
+// AlertNotifier sends an alert to the target of a sink
+type AlertNotifier func(target string, alert Alert) error
+
+// comparisons of threshold rules
+var (
+	conditionPattern = regexp.MustCompile(`^value\s*(>=|<=|!=|>|<|=)\s*(\S+)$`)
+	comparisons      = map[string]func(value, threshold float64) bool{
+		">":  func(v, t float64) bool { return v > t },
+		">=": func(v, t float64) bool { return v >= t },
+		"<":  func(v, t float64) bool { return v < t },
+		"<=": func(v, t float64) bool { return v <= t },
+		"=":  func(v, t float64) bool { return v == t },
+		"!=": func(v, t float64) bool { return v != t },
+	}
+)
+
+type alertRule struct {
+	common.AlertRule
+	where common.Dict
+	// how long the condition must hold before the alert fires
+	hold time.Duration
+	// nil for no data rules
+	compare   func(value, threshold float64) bool
+	threshold float64
+}
+
+// alertEngine holds the alert rules and the state of their alerts
+type alertEngine struct {
+	rules map[string]*alertRule
+	// rule name -> uuid -> alert
+	alerts    map[string]map[common.UUID]*Alert
+	notifiers map[string]AlertNotifier
+	sync.Mutex
+}
+
+func newAlertEngine() *alertEngine {
+	return &alertEngine{
+		rules:  make(map[string]*alertRule),
+		alerts: make(map[string]map[common.UUID]*Alert),
+		notifiers: map[string]AlertNotifier{
+			"log":     logAlert,
+			"webhook": postAlert,
+		},
+	}
+}
+
+func logAlert(target string, alert Alert) error {
+	log.Warningf("Alert %v for %v is %v (since %v)", alert.Rule, alert.UUID, alert.State, alert.Since)
+	return nil
+}
+
+// POSTs the alert as JSON to the target URL. Like webhook batches, an alert
+// that is not acknowledged with a 2xx is sent again, waiting longer after each
+// failure, and dropped after webhookAttempts tries
+func postAlert(target string, alert Alert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	go func() {
+		client := &http.Client{Timeout: 10 * time.Second}
+		timer := NewExponentialTimer(webhookMaxBackoff)
+		for attempt := 1; ; attempt++ {
+			err := postAlertBody(client, target, body)
+			if err == nil {
+				return
+			}
+			if attempt == webhookAttempts {
+				log.Errorf("Dropping alert %v after %v attempts to send it to %v (%v)", alert.Rule, attempt, target, err)
+				return
+			}
+			log.Warningf("Could not send alert %v to %v (%v)", alert.Rule, target, err)
+			timer.Wait(false)
+		}
+	}()
+	return nil
+}
+
+func postAlertBody(client *http.Client, target string, body []byte) error {
+	resp, err := client.Post(target, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("POST %v returned %v", target, resp.Status)
+	}
+	return nil
+}
+
+// checks and parses an alert rule
+func (a *Archiver) newAlertRule(rule common.AlertRule) (*alertRule, error) {
+	var err error
+	r := &alertRule{AlertRule: rule}
+	if rule.Name == "" {
+		return nil, fmt.Errorf("Alert rule needs a name")
+	}
+	parsed := a.qp.Parse("select uuid where " + rule.Where)
+	if parsed.Err != nil {
+		return nil, fmt.Errorf("Error (%v) in where clause \"%v\" of alert rule %v (error at %v)", parsed.Err, rule.Where, rule.Name, parsed.ErrPos)
+	}
+	r.where = parsed.Where
+	if rule.For != "" {
+		if r.hold, err = common.ParseDuration(rule.For); err != nil || r.hold < 0 {
+			return nil, fmt.Errorf("Invalid For %v of alert rule %v (%v)", rule.For, rule.Name, err)
+		}
+	}
+	if condition := strings.TrimSpace(rule.Condition); condition == "no data" {
+		if r.hold == 0 {
+			return nil, fmt.Errorf("No data rule %v needs a For", rule.Name)
+		}
+	} else if match := conditionPattern.FindStringSubmatch(condition); match != nil {
+		r.compare = comparisons[match[1]]
+		if r.threshold, err = strconv.ParseFloat(match[2], 64); err != nil {
+			return nil, fmt.Errorf("Invalid threshold %v of alert rule %v (%v)", match[2], rule.Name, err)
+		}
+	} else {
+		return nil, fmt.Errorf("Invalid condition \"%v\" of alert rule %v (expected e.g. \"value > 30\" or \"no data\")", rule.Condition, rule.Name)
+	}
+	a.broker.alerts.Lock()
+	defer a.broker.alerts.Unlock()
+	for _, sink := range rule.Sinks {
+		if _, found := a.broker.alerts.notifiers[sink.Type]; !found {
+			return nil, fmt.Errorf("Unknown alert sink %v of alert rule %v", sink.Type, rule.Name)
+		}
+	}
+	return r, nil
+}
+
+// registers the alert rules saved in the metadata store
+func (a *Archiver) loadAlertRules() {
+	rules, err := a.mdStore.GetAlertRules()
+	if err != nil {
+		log.Errorf("Could not load alert rules (%v)", err)
+		return
+	}
+	for _, rule := range rules {
+		r, err := a.newAlertRule(rule)
+		if err != nil {
+			log.Errorf("Could not load alert rule %v (%v)", rule.Name, err)
+			continue
+		}
+		a.broker.alerts.Lock()
+		a.broker.alerts.rules[rule.Name] = r
+		a.broker.alerts.Unlock()
+	}
+}
+
+// checks the alert rules every alertInterval
+func (a *Archiver) startAlerts() {
+	go func() {
+		for now := range time.Tick(alertInterval) {
+			a.broker.checkAlerts(now)
+		}
+	}()
+}
+
+// RegisterAlertSink lets alert rules send alerts to sinks of the given type,
+// e.g. plugins that can deliver them
+func (a *Archiver) RegisterAlertSink(sinkType string, notify AlertNotifier) {
+	a.broker.alerts.Lock()
+	a.broker.alerts.notifiers[sinkType] = notify
+	a.broker.alerts.Unlock()
+}
+
+// SaveAlertRule adds the alert rule, replacing the one of the same name and
+// forgetting its alerts. The change is recorded in the audit log as made by
+// caller
+func (a *Archiver) SaveAlertRule(caller string, rule common.AlertRule) error {
+	r, err := a.newAlertRule(rule)
+	if err != nil {
+		return err
+	}
+	if err = a.mdStore.SaveAlertRule(&rule); err != nil {
+		return err
+	}
+	a.broker.alerts.Lock()
+	a.broker.alerts.rules[rule.Name] = r
+	delete(a.broker.alerts.alerts, rule.Name)
+	a.broker.alerts.Unlock()
+	a.audit(caller, "define alert "+rule.Name, nil)
+	return nil
+}
+
+// RemoveAlertRule removes the named alert rule and its alerts. The change is
+// recorded in the audit log as made by caller
+func (a *Archiver) RemoveAlertRule(caller, name string) error {
+	a.broker.alerts.Lock()
+	_, found := a.broker.alerts.rules[name]
+	a.broker.alerts.Unlock()
+	if !found {
+		return fmt.Errorf("No alert rule named %v", name)
+	}
+	if err := a.mdStore.RemoveAlertRule(name); err != nil {
+		return err
+	}
+	a.broker.alerts.Lock()
+	delete(a.broker.alerts.rules, name)
+	delete(a.broker.alerts.alerts, name)
+	a.broker.alerts.Unlock()
+	a.audit(caller, "remove alert "+name, nil)
+	return nil
+}
+
+// AlertRules returns the alert rules ordered by name
+func (a *Archiver) AlertRules() []common.AlertRule {
+	a.broker.alerts.Lock()
+	defer a.broker.alerts.Unlock()
+	rules := make([]common.AlertRule, 0, len(a.broker.alerts.rules))
+	for _, r := range a.broker.alerts.rules {
+		rules = append(rules, r.AlertRule)
+	}
+	sort.Sort(rulesByName(rules))
+	return rules
+}
+
+// ActiveAlerts returns the pending and firing alerts ordered by rule and uuid
+func (a *Archiver) ActiveAlerts() []Alert {
+	a.broker.alerts.Lock()
+	defer a.broker.alerts.Unlock()
+	active := []Alert{}
+	for _, alerts := range a.broker.alerts.alerts {
+		for _, alert := range alerts {
+			active = append(active, *alert)
+		}
+	}
+	sort.Sort(alertList(active))
+	return active
+}
+
+type rulesByName []common.AlertRule
+
+func (rn rulesByName) Len() int           { return len(rn) }
+func (rn rulesByName) Swap(i, j int)      { rn[i], rn[j] = rn[j], rn[i] }
+func (rn rulesByName) Less(i, j int) bool { return rn[i].Name < rn[j].Name }
+
+type alertList []Alert
+
+func (al alertList) Len() int      { return len(al) }
+func (al alertList) Swap(i, j int) { al[i], al[j] = al[j], al[i] }
+func (al alertList) Less(i, j int) bool {
+	return al[i].Rule < al[j].Rule || (al[i].Rule == al[j].Rule && al[i].UUID < al[j].UUID)
+}
+
+// returns true if the rule applies to the stream
+func (b *Broker) alertMatches(r *alertRule, uuid common.UUID) bool {
+	matched, err := b.uuids.getUUIDs(b.a.mdStore, r.where)
+	if err != nil {
+		log.Errorf("Could not evaluate alert rule %v (%v)", r.Name, err)
+		return false
+	}
+	for _, m := range matched {
+		if m == uuid {
+			return true
+		}
+	}
+	return false
+}
+
+// returns the current alert rules, so their streams can be looked up without
+// holding the lock
+func (e *alertEngine) currentRules() []*alertRule {
+	e.Lock()
+	defer e.Unlock()
+	rules := make([]*alertRule, 0, len(e.rules))
+	for _, r := range e.rules {
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// evaluates the alert rules against the readings of the message
+func (b *Broker) evaluateAlerts(msg *common.SmapMessage) {
+	if len(msg.Readings) == 0 {
+		return
+	}
+	var (
+		now      = time.Now()
+		changed  []Alert
+		matching []*alertRule
+	)
+	e := b.alerts
+	for _, r := range e.currentRules() {
+		if b.alertMatches(r, msg.UUID) {
+			matching = append(matching, r)
+		}
+	}
+	if len(matching) == 0 {
+		return
+	}
+	e.Lock()
+	for _, r := range matching {
+		// the rule was replaced or removed while its streams were looked up
+		if e.rules[r.Name] != r {
+			continue
+		}
+		if r.compare == nil {
+			// the stream has data again
+			if alert := e.alerts[r.Name][msg.UUID]; alert != nil {
+				changed = append(changed, e.resolve(r, alert, now, nil))
+			}
+			continue
+		}
+		for _, rdg := range msg.Readings {
+			value, ok := rdg.GetValue().(float64)
+			if !ok {
+				continue
+			}
+			alert := e.alerts[r.Name][msg.UUID]
+			switch {
+			case r.compare(value, r.threshold) && alert == nil:
+				alert = &Alert{Rule: r.Name, UUID: msg.UUID, State: ALERT_PENDING, Since: now, Changed: now, Value: &value}
+				if e.alerts[r.Name] == nil {
+					e.alerts[r.Name] = make(map[common.UUID]*Alert)
+				}
+				e.alerts[r.Name][msg.UUID] = alert
+				if r.hold == 0 {
+					changed = append(changed, e.fire(alert, now, &value))
+				}
+			case r.compare(value, r.threshold) && alert.State == ALERT_PENDING:
+				alert.Value = &value
+				if now.Sub(alert.Since) >= r.hold {
+					changed = append(changed, e.fire(alert, now, &value))
+				}
+			case !r.compare(value, r.threshold) && alert != nil:
+				if alert.State == ALERT_FIRING {
+					changed = append(changed, e.resolve(r, alert, now, &value))
+				} else {
+					delete(e.alerts[r.Name], msg.UUID)
+				}
+			}
+		}
+	}
+	e.Unlock()
+	b.notifyAlerts(changed)
+}
+
+// fires the pending alerts that have held long enough and the no data rules
+// of streams that have been quiet too long
+func (b *Broker) checkAlerts(now time.Time) {
+	var (
+		changed []Alert
+		rules   = b.alerts.currentRules()
+		matched = make(map[*alertRule][]common.UUID)
+	)
+	for _, r := range rules {
+		if r.compare != nil {
+			continue
+		}
+		uuids, err := b.uuids.getUUIDs(b.a.mdStore, r.where)
+		if err != nil {
+			log.Errorf("Could not evaluate alert rule %v (%v)", r.Name, err)
+			continue
+		}
+		// silence is counted from the last stored reading
+		b.trackLiveness(uuids, now)
+		matched[r] = uuids
+	}
+	e := b.alerts
+	e.Lock()
+	for _, r := range rules {
+		if e.rules[r.Name] != r {
+			continue
+		}
+		if r.compare != nil {
+			for _, alert := range e.alerts[r.Name] {
+				if alert.State == ALERT_PENDING && now.Sub(alert.Since) >= r.hold {
+					changed = append(changed, e.fire(alert, now, alert.Value))
+				}
+			}
+			continue
+		}
+		for _, uuid := range matched[r] {
+			last := b.liveness.lastSeen(uuid)
+			if now.Sub(last) < r.hold || e.alerts[r.Name][uuid] != nil {
+				continue
+			}
+			alert := &Alert{Rule: r.Name, UUID: uuid, State: ALERT_PENDING, Since: last}
+			if e.alerts[r.Name] == nil {
+				e.alerts[r.Name] = make(map[common.UUID]*Alert)
+			}
+			e.alerts[r.Name][uuid] = alert
+			changed = append(changed, e.fire(alert, now, nil))
+		}
+	}
+	e.Unlock()
+	b.notifyAlerts(changed)
+}
+
+// marks the alert as firing and returns a copy to send to the sinks
+func (e *alertEngine) fire(alert *Alert, now time.Time, value *float64) Alert {
+	alert.State = ALERT_FIRING
+	alert.Changed = now
+	alert.Value = value
+	return *alert
+}
+
+// forgets the alert and returns a resolved copy to send to the sinks
+func (e *alertEngine) resolve(r *alertRule, alert *Alert, now time.Time, value *float64) Alert {
+	delete(e.alerts[r.Name], alert.UUID)
+	resolved := *alert
+	resolved.State = ALERT_RESOLVED
+	resolved.Changed = now
+	resolved.Value = value
+	return resolved
+}
+
+// sends the alerts to the sinks of their rules
+func (b *Broker) notifyAlerts(alerts []Alert) {
+	for _, alert := range alerts {
+		b.alerts.Lock()
+		r := b.alerts.rules[alert.Rule]
+		var notifiers []AlertNotifier
+		if r != nil {
+			for _, sink := range r.Sinks {
+				notifiers = append(notifiers, b.alerts.notifiers[sink.Type])
+			}
+		}
+		b.alerts.Unlock()
+		for i, notify := range notifiers {
+			if err := notify(r.Sinks[i].Target, alert); err != nil {
+				log.Errorf("Could not send alert %v to %v %v (%v)", alert.Rule, r.Sinks[i].Type, r.Sinks[i].Target, err)
+			}
+		}
+	}
+}
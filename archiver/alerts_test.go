@@ -0,0 +1,148 @@
+package archiver
+
+import (
+	"encoding/json"
+	"github.com/gtfierro/giles2/common"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAlertRules(t *testing.T) {
+	a, _, _ := newFakeArchiver()
+	var sent []Alert
+	a.RegisterAlertSink("test", func(target string, alert Alert) error {
+		assert.Equal(t, "target", target)
+		sent = append(sent, alert)
+		return nil
+	})
+	sinks := []common.AlertSink{{Type: "test", Target: "target"}}
+	for _, bad := range []common.AlertRule{
+		{Name: "bad", Where: `Metadata/Type = "Temperature"`, Condition: "value >> 30", Sinks: sinks},
+		{Name: "bad", Where: `Metadata/Type = "Temperature"`, Condition: "no data", Sinks: sinks},
+		{Name: "bad", Where: `Metadata/Type = "Temperature"`, Condition: "value > 30", Sinks: []common.AlertSink{{Type: "pager"}}},
+	} {
+		assert.Error(t, a.SaveAlertRule("test", bad), bad.Condition)
+	}
+	assert.NoError(t, a.SaveAlertRule("test", common.AlertRule{Name: "hot", Where: `Metadata/Type = "Temperature"`, Condition: "value > 30", For: "5min", Sinks: sinks}))
+	assert.NoError(t, a.SaveAlertRule("test", common.AlertRule{Name: "freezing", Where: `Metadata/Type = "Temperature"`, Condition: "value <= 0", Sinks: sinks}))
+	assert.NoError(t, a.SaveAlertRule("test", common.AlertRule{Name: "quiet", Where: `Metadata/Type = "Temperature"`, Condition: "no data", For: "10min", Sinks: sinks}))
+	assert.Len(t, a.AlertRules(), 3)
+
+	var (
+		room  = common.NewUUID()
+		other = common.NewUUID()
+		now   = time.Now()
+	)
+	add := func(uuid common.UUID, value float64) {
+		msg := &common.SmapMessage{Path: "/" + string(uuid), UUID: uuid, Metadata: common.Dict{"Type": "Temperature"},
+			Readings: []common.Reading{&common.SmapNumberReading{Time: uint64(time.Now().UnixNano() / 1e6), Value: value}}}
+		if uuid == other {
+			msg.Metadata = common.Dict{"Type": "Humidity"}
+		}
+		assert.NoError(t, a.AddData("test", msg))
+	}
+
+	// conditions that hold for a while are pending until they have held long enough
+	add(room, 35)
+	add(other, 80)
+	assert.Empty(t, sent)
+	if active := a.ActiveAlerts(); assert.Len(t, active, 1) {
+		assert.Equal(t, ALERT_PENDING, active[0].State)
+	}
+	add(room, 36)
+	a.broker.checkAlerts(now.Add(time.Minute))
+	assert.Empty(t, sent)
+	a.broker.checkAlerts(now.Add(6 * time.Minute))
+	if assert.Len(t, sent, 1) {
+		assert.Equal(t, "hot", sent[0].Rule)
+		assert.Equal(t, room, sent[0].UUID)
+		assert.Equal(t, ALERT_FIRING, sent[0].State)
+		assert.Equal(t, 36.0, *sent[0].Value)
+	}
+	// firing alerts are sent once
+	add(room, 37)
+	a.broker.checkAlerts(now.Add(7 * time.Minute))
+	assert.Len(t, sent, 1)
+
+	// and resolve when the condition no longer holds. Conditions without a
+	// For fire right away
+	add(room, -1)
+	if assert.Len(t, sent, 3) {
+		states := map[string]string{sent[1].Rule: sent[1].State, sent[2].Rule: sent[2].State}
+		assert.Equal(t, map[string]string{"hot": ALERT_RESOLVED, "freezing": ALERT_FIRING}, states)
+	}
+	add(room, 20)
+	assert.Len(t, sent, 4)
+	assert.Empty(t, a.ActiveAlerts())
+
+	// streams without readings for a while
+	sent = nil
+	a.broker.checkAlerts(time.Now().Add(11 * time.Minute))
+	if assert.Len(t, sent, 1) {
+		assert.Equal(t, "quiet", sent[0].Rule)
+		assert.Equal(t, room, sent[0].UUID)
+		assert.Nil(t, sent[0].Value)
+	}
+	a.broker.checkAlerts(time.Now().Add(12 * time.Minute))
+	assert.Len(t, sent, 1)
+	add(room, 20)
+	if assert.Len(t, sent, 2) {
+		assert.Equal(t, ALERT_RESOLVED, sent[1].State)
+	}
+
+	assert.NoError(t, a.RemoveAlertRule("test", "quiet"))
+	assert.Error(t, a.RemoveAlertRule("test", "quiet"))
+	assert.Len(t, a.AlertRules(), 2)
+}
+
+func TestPostAlert(t *testing.T) {
+	received := make(chan Alert, 2)
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var alert Alert
+		assert.NoError(t, json.NewDecoder(req.Body).Decode(&alert))
+		// the first attempt fails
+		if attempts++; attempts == 1 {
+			rw.WriteHeader(503)
+		}
+		received <- alert
+	}))
+	defer srv.Close()
+
+	assert.NoError(t, postAlert(srv.URL, Alert{Rule: "hot", State: ALERT_FIRING}))
+	for i := 0; i < 2; i++ {
+		select {
+		case alert := <-received:
+			assert.Equal(t, "hot", alert.Rule)
+		case <-time.After(5 * time.Second):
+			t.Fatal("the alert should be sent again after it fails")
+		}
+	}
+}
+
+func TestNoDataSinceStored(t *testing.T) {
+	a, ts, _ := newFakeArchiver()
+	var sent []Alert
+	a.RegisterAlertSink("test", func(target string, alert Alert) error {
+		sent = append(sent, alert)
+		return nil
+	})
+	assert.NoError(t, a.SaveAlertRule("test", common.AlertRule{Name: "quiet", Where: `Metadata/Type = "Temperature"`, Condition: "no data", For: "1h", Sinks: []common.AlertSink{{Type: "test"}}}))
+
+	// a stream whose last reading was stored before the archiver started
+	room := common.NewUUID()
+	last := time.Now().Add(-2 * time.Hour).Truncate(time.Millisecond)
+	msg := &common.SmapMessage{Path: "/room", UUID: room, Metadata: common.Dict{"Type": "Temperature"},
+		Readings: []common.Reading{&common.SmapNumberReading{Time: uint64(last.UnixNano() / 1e6), Value: 20}}}
+	assert.NoError(t, a.prepareMessage("test", msg))
+	assert.NoError(t, ts.AddMessage(msg))
+
+	a.broker.checkAlerts(time.Now())
+	if assert.Len(t, sent, 1) {
+		assert.Equal(t, room, sent[0].UUID)
+		assert.True(t, last.Equal(sent[0].Since), "silence should count from %v, not %v", last, sent[0].Since)
+	}
+}
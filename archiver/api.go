@@ -1,14 +1,22 @@
 package archiver
 
 import (
+	"fmt"
 	"github.com/gtfierro/giles2/common"
+	"strings"
 )
 
 func (a *Archiver) SelectTags(params *common.TagParams) (QueryResult, error) {
+	if !params.AsOf.IsZero() {
+		return a.mdStore.GetTagsAsOf(params.Tags, params.Where.ToBson(), params.AsOf)
+	}
 	return a.mdStore.GetTags(params.Tags, params.Where.ToBson())
 }
 
 func (a *Archiver) DistinctTag(params *common.DistinctParams) (QueryResult, error) {
+	if !params.AsOf.IsZero() {
+		return a.mdStore.GetDistinctAsOf(params.Tag, params.Where.ToBson(), params.AsOf)
+	}
 	return a.mdStore.GetDistinct(params.Tag, params.Where.ToBson())
 }
 
@@ -30,7 +38,7 @@ func (a *Archiver) SelectDataRange(params *common.DataParams) (common.SmapMessag
 	}
 
 	// fetch readings
-	readings, err = a.tsStore.GetData(params.UUIDs, params.Begin, params.End)
+	readings, err = a.getData(params.UUIDs, params.Begin, params.End)
 	if err != nil {
 		return result, err
 	}
@@ -47,7 +55,7 @@ func (a *Archiver) SelectDataBefore(params *common.DataParams) (result common.Sm
 	if err = a.prepareDataParams(params); err != nil {
 		return
 	}
-	readings, err = a.tsStore.Prev(params.UUIDs, params.Begin)
+	readings, err = a.prev(params.UUIDs, params.Begin)
 	result = a.packResults(params, readings)
 	return
 }
@@ -58,16 +66,18 @@ func (a *Archiver) SelectDataAfter(params *common.DataParams) (result common.Sma
 	if err = a.prepareDataParams(params); err != nil {
 		return
 	}
-	readings, err = a.tsStore.Next(params.UUIDs, params.Begin)
+	readings, err = a.next(params.UUIDs, params.Begin)
 	result = a.packResults(params, readings)
 	return
 }
 
+// virtual streams are left out of statistical and window queries
 func (a *Archiver) SelectStatisticalData(params *common.DataParams) (result common.SmapMessageList, err error) {
 	var readings []common.StatisticalNumbersResponse
 	if err = a.prepareDataParams(params); err != nil {
 		return
 	}
+	params.UUIDs, _ = a.virtuals.split(params.UUIDs)
 	// switch order so its consistent
 	if params.End < params.Begin {
 		params.Begin, params.End = params.End, params.Begin
@@ -81,7 +91,68 @@ func (a *Archiver) SelectStatisticalData(params *common.DataParams) (result comm
 	return
 }
 
-func (a *Archiver) DeleteData(params *common.DataParams) (err error) {
+// selects the data timestamped after [since] (in nanoseconds) for all
+// streams matching the where clause of the given query
+func (a *Archiver) SelectDataSince(querystring string, since uint64) (common.SmapMessageList, error) {
+	parsed := a.qp.Parse(querystring)
+	if parsed.Err != nil {
+		return common.SmapMessageList{}, fmt.Errorf("Error (%v) in query \"%v\" (error at %v)\n", parsed.Err, querystring, parsed.ErrPos)
+	}
+	params := &common.DataParams{
+		Where:         parsed.Where,
+		StreamLimit:   -1,
+		DataLimit:     -1,
+		Begin:         since + 1,
+		End:           common.GetNow(common.UOT_NS),
+		ConvertToUnit: common.UOT_MS,
+	}
+	return a.SelectDataRange(params)
+}
+
+// returns when the message was committed (see journal.go); found is false if
+// the message is not journaled, e.g. because it has been dropped. Subscription
+// transports use this to tell a client how far it has got
+func (a *Archiver) Committed(msg *common.SmapMessage) (committed uint64, found bool) {
+	return a.broker.journal.committed(msg)
+}
+
+// returns when the newest message was committed. Subscription transports use
+// this as the position of a client that starts with the initial results of
+// its query
+func (a *Archiver) LastCommitted() uint64 {
+	return a.broker.journal.newest()
+}
+
+// selects the readings committed after [since] (a commit time, see
+// Committed) for all streams matching the where clause of the given query.
+// Subscription transports use this to catch up a client that reconnects.
+// If the journal no longer reaches back to [since], the readings timestamped
+// after it are selected instead
+func (a *Archiver) SelectCommittedSince(querystring string, since uint64) (common.SmapMessageList, error) {
+	parsed := a.qp.Parse(querystring)
+	if parsed.Err != nil {
+		return common.SmapMessageList{}, fmt.Errorf("Error (%v) in query \"%v\" (error at %v)\n", parsed.Err, querystring, parsed.ErrPos)
+	}
+	uuids, err := a.broker.uuids.getUUIDs(a.mdStore, parsed.Where)
+	if err != nil {
+		return common.SmapMessageList{}, err
+	}
+	streams := make(map[common.UUID]bool, len(uuids))
+	for _, uuid := range uuids {
+		streams[uuid] = true
+	}
+	missed, complete := a.broker.journal.since(since, streams)
+	if !complete {
+		log.Warningf("Journal does not reach back to %v; selecting readings by timestamp", since)
+		return a.SelectDataSince(querystring, since)
+	}
+	return missed, nil
+}
+
+// deletes the readings of the matching streams between Begin and End. The
+// summary only reports the matched streams; we do not know which of them had
+// readings in range
+func (a *Archiver) DeleteData(params *common.DataParams) (summary common.MutationSummary, err error) {
 	if err = a.prepareDataParams(params); err != nil {
 		return
 	}
@@ -89,33 +160,56 @@ func (a *Archiver) DeleteData(params *common.DataParams) (err error) {
 	if params.End < params.Begin {
 		params.Begin, params.End = params.End, params.Begin
 	}
-	return a.tsStore.DeleteData(params.UUIDs, params.Begin, params.End)
+	summary.Matched = params.UUIDs
+	err = a.tsStore.DeleteData(params.UUIDs, params.Begin, params.End)
+	return
 }
 
-func (a *Archiver) DeleteTags(params *common.TagParams) (err error) {
+func (a *Archiver) DeleteTags(params *common.TagParams) (summary common.MutationSummary, err error) {
 	if len(params.Tags) > 0 {
 		log.Debugf("Removing tags %v docs where %v", params.Tags, params.Where)
-		return a.mdStore.RemoveTags(params.Tags, params.Where.ToBson())
+		defer a.broker.uuids.invalidate(params.Tags)
+		summary, err = a.mdStore.RemoveTags(params.Tags, params.Where.ToBson())
+		// streams without a formula are no longer virtual
+		for _, tag := range params.Tags {
+			if tag == "Formula" {
+				a.virtuals.remove(summary.Modified)
+			}
+		}
+		return
 	}
 	log.Debugf("Removing all docs where %v", params.Where)
-	return a.mdStore.RemoveDocs(params.Where.ToBson())
+	defer a.broker.uuids.clear()
+	summary, err = a.mdStore.RemoveDocs(params.Where.ToBson())
+	a.virtuals.remove(summary.Removed)
+	a.forgetInherited(summary.Removed)
+	return
 }
 
-func (a *Archiver) SetTags(params *common.SetParams) (err error) {
+func (a *Archiver) SetTags(params *common.SetParams) (common.MutationSummary, error) {
 	log.Debugf("Apply updates %v where %v", params.Set, params.Where)
 	if len(params.Set) == 0 {
-		return nil
+		return common.MutationSummary{}, nil
 	}
+	// formulas are checked and registered by DefineVirtual
+	for key := range params.Set.ToBson() {
+		if key == "Formula" || strings.HasPrefix(key, "Formula.") {
+			return common.MutationSummary{}, fmt.Errorf("Formula cannot be set by a query; define virtual streams with DefineVirtual (POST /api/virtual)")
+		}
+	}
+	defer a.broker.uuids.invalidate(whereKeys(params.Set.ToBson()))
 	return a.mdStore.UpdateDocs(params.Set.ToBson(), params.Where.ToBson())
 }
 
 func (a *Archiver) prepareDataParams(params *common.DataParams) (err error) {
 	// parse and evaluate the where clause if we need to
-	if len(params.Where) > 0 {
-		params.UUIDs, err = a.mdStore.GetUUIDs(params.Where.ToBson())
-		if err != nil {
-			return err
-		}
+	if !params.AsOf.IsZero() {
+		params.UUIDs, err = a.mdStore.GetUUIDsAsOf(params.Where.ToBson(), params.AsOf)
+	} else if len(params.Where) > 0 {
+		params.UUIDs, err = a.broker.uuids.getUUIDs(a.mdStore, params.Where)
+	}
+	if err != nil {
+		return err
 	}
 
 	// apply the streamlimit if it exists
@@ -9,6 +9,7 @@ import (
 	"github.com/pkg/errors"
 	"net"
 	"os"
+	"sync"
 	"time"
 )
 
@@ -36,6 +37,23 @@ type Archiver struct {
 	broker *Broker
 	// metrics
 	metrics metricMap
+	// streams that have been given what they inherit from their collections
+	inherited     map[common.UUID]struct{}
+	inheritedLock sync.Mutex
+	// streams computed from other streams
+	virtuals virtualStreams
+	// retention policies, and a lock so that they are enforced one run at a time
+	retention         []*retentionPolicy
+	retentionLock     sync.Mutex
+	retentionInterval time.Duration
+	// window queries kept running
+	continuous continuousQueries
+	// subscriptions delivered by POSTing their results
+	webhooks webhooks
+	// subscriptions kept across restarts
+	durable durableSubscriptions
+	// log the number of adds every few seconds
+	periodicReport bool
 }
 
 // Returns a new archiver object from a configuration. Will Fatal out of the
@@ -94,17 +112,48 @@ func NewArchiver(c *Config) (a *Archiver) {
 
 	a.qp = querylang.NewQueryProcessor()
 
-	a.broker = NewBroker(a)
-
 	a.metrics = make(metricMap)
 	a.metrics.addMetric("adds")
 
-	if c.Archiver.PeriodicReport {
-		a.startReport()
+	a.broker = NewBroker(a)
+
+	a.loadVirtuals()
+	a.loadContinuousQueries()
+	a.loadAlertRules()
+
+	if err := a.loadRetention(c.Retention); err != nil {
+		log.Fatalf("Error loading retention policies: %v", err)
 	}
+	a.retentionInterval = time.Hour
+	if c.Archiver.RetentionInterval != nil {
+		var err error
+		if a.retentionInterval, err = common.ParseDuration(*c.Archiver.RetentionInterval); err != nil || a.retentionInterval <= 0 {
+			log.Fatalf("Invalid RetentionInterval %v (%v)", *c.Archiver.RetentionInterval, err)
+		}
+	}
+
+	a.periodicReport = c.Archiver.PeriodicReport
 	return
 }
 
+// Start runs the work the archiver does in the background: continuous
+// queries, alerts, liveness, webhooks, saving the cursors of durable
+// subscriptions, retention and the periodic report. Commands that only use
+// the stores, like export and import, do not start it
+func (a *Archiver) Start() {
+	a.startContinuousQueries()
+	a.startAlerts()
+	a.startLiveness()
+	a.loadWebhooks()
+	a.startDurableCursors()
+	if len(a.retention) > 0 {
+		a.startRetention(a.retentionInterval)
+	}
+	if a.periodicReport {
+		a.startReport()
+	}
+}
+
 func (a *Archiver) startReport() {
 	go func() {
 		t := time.NewTicker(5 * time.Second)
@@ -120,12 +169,37 @@ func (a *Archiver) startReport() {
 //  - Saves the attached metadata (if any) to the metadata store
 //  - Reevaluates any dynamic subscriptions and pushes to republish clients
 //  - Saves the attached readings (if any) to the timeseries database
-func (a *Archiver) AddData(msg *common.SmapMessage) (err error) {
+// Changes to metadata are recorded in the audit log as made by caller
+func (a *Archiver) AddData(caller string, msg *common.SmapMessage) (err error) {
+	if err = a.prepareMessage(caller, msg); err != nil {
+		return err
+	}
+
+	//save timeseries data
+	a.metrics["adds"].Mark(1)
+	a.tsStore.AddMessage(msg)
+	a.broker.HandleMessage(msg)
+	a.updateVirtuals(msg)
+	return err
+}
+
+// saves the metadata attached to the message and fills in the units of time
+// and measure for the stream if they are missing
+func (a *Archiver) prepareMessage(caller string, msg *common.SmapMessage) (err error) {
 	// save metadata
-	err = a.mdStore.SaveTags(msg)
+	changed, err := a.mdStore.SaveTags(msg)
+	if err != nil {
+		return err
+	}
+	// cached UUIDs for where clauses on the changed keys may now be wrong
+	a.broker.uuids.invalidate(changed)
+	inherited, err := a.inherit(caller, msg)
 	if err != nil {
 		return err
 	}
+	if len(changed) > 0 || inherited {
+		a.audit(caller, "add "+msg.Path, []common.UUID{msg.UUID})
+	}
 
 	// fix inconsistencies
 	var (
@@ -148,33 +222,49 @@ func (a *Archiver) AddData(msg *common.SmapMessage) (err error) {
 			msg.Properties = &common.SmapProperties{StreamType: common.NUMERIC_STREAM}
 		}
 		msg.Properties.UnitOfMeasure = "n/a"
-		err = a.mdStore.SaveTags(msg)
+		// a placeholder rather than a unit set on the stream, so that one
+		// inherited from a collection can still replace it
+		changed, err = a.mdStore.SaveInherited(msg.UUID, caller, &common.SmapMessage{UUID: msg.UUID, Properties: msg.Properties})
 		if err != nil {
 			return err
 		}
+		a.broker.uuids.invalidate(changed)
 	} else if err != nil {
 		return err
 	}
-
-	//save timeseries data
-	a.metrics["adds"].Mark(1)
-	a.tsStore.AddMessage(msg)
-	a.broker.HandleMessage(msg)
-	return err
+	return nil
 }
 
 // Need to think about how to transfer the results of these queries to the handlers that are
 // asking for them and need to transform them into their own internal representations (e.g.
 // JSON, MsgPack, etc). What are the data patterns we are seeing?
 // Basically everything fits into common.SmapMessageList
-func (a *Archiver) HandleQuery(querystring string) (QueryResult, error) {
+// Queries that change the archive are recorded in the audit log as made by
+// caller
+func (a *Archiver) HandleQuery(caller, querystring string) (QueryResult, error) {
 	var result QueryResult
 	// parse the query
+	start := time.Now()
 	parsed := a.qp.Parse(querystring)
 	if parsed.Err != nil {
 		return result, fmt.Errorf("Error (%v) in query \"%v\" (error at %v)\n", parsed.Err, querystring, parsed.ErrPos)
 	}
-	return a.evaluateQuery(parsed)
+	if parsed.Explain {
+		return a.explain(parsed, time.Since(start))
+	}
+	switch parsed.QueryType {
+	case querylang.CREATE_TYPE:
+		return a.CreateContinuousQuery(caller, parsed)
+	case querylang.DROP_TYPE:
+		return a.DropContinuousQuery(caller, parsed.Name)
+	case querylang.LIST_TYPE:
+		return a.ListContinuousQueries(), nil
+	}
+	result, err := a.evaluateQuery(parsed)
+	if summary, ok := result.(common.MutationSummary); ok && err == nil {
+		a.audit(caller, querystring, summary.Matched)
+	}
+	return result, err
 }
 
 func (a *Archiver) evaluateQuery(parsed *querylang.ParsedQuery) (QueryResult, error) {
@@ -191,34 +281,57 @@ func (a *Archiver) evaluateQuery(parsed *querylang.ParsedQuery) (QueryResult, er
 		params := parsed.GetParams()
 		switch t := params.(type) {
 		case *common.TagParams:
-			return result, a.DeleteTags(t)
+			return a.DeleteTags(t)
 		case *common.DataParams:
-			return result, a.DeleteData(t)
+			return a.DeleteData(t)
 		default:
 			return result, errors.New("Invalid DELETE type")
 		}
 	case querylang.SET_TYPE:
 		params := parsed.GetParams().(*common.SetParams)
-		return result, a.SetTags(params)
+		return a.SetTags(params)
+	case querylang.AUDIT_TYPE:
+		params := parsed.GetParams().(*common.AuditParams)
+		return a.SelectAudit(params)
+	case querylang.STALE_TYPE:
+		params := parsed.GetParams().(*common.StaleParams)
+		return a.SelectStale(params)
 	case querylang.DATA_TYPE:
 		params := parsed.GetParams().(*common.DataParams)
-		if params.IsStatistical || params.IsWindow {
-			return a.SelectStatisticalData(params)
-		}
-		switch parsed.Data.Dtype {
-		case querylang.IN_TYPE:
-			return a.SelectDataRange(params)
-		case querylang.BEFORE_TYPE:
-			return a.SelectDataBefore(params)
-		case querylang.AFTER_TYPE:
-			return a.SelectDataAfter(params)
-		}
-
+		return a.selectData(parsed.Data.Dtype, params)
 	}
 	return result, nil
 }
 
+func (a *Archiver) selectData(dtype querylang.DataQueryType, params *common.DataParams) (common.SmapMessageList, error) {
+	if params.IsStatistical || params.IsWindow {
+		return a.SelectStatisticalData(params)
+	}
+	switch dtype {
+	case querylang.BEFORE_TYPE:
+		return a.SelectDataBefore(params)
+	case querylang.AFTER_TYPE:
+		return a.SelectDataAfter(params)
+	}
+	return a.SelectDataRange(params)
+}
+
+// CheckQuery returns the error HandleNewSubscriber would give for a query
+// that does not parse, so transports can reject a subscription before
+// acknowledging it
+func (a *Archiver) CheckQuery(querystring string) error {
+	if parsed := a.qp.Parse(querystring); parsed.Err != nil {
+		return fmt.Errorf("Error (%v) in query \"%v\" (error at %v)\n", parsed.Err, querystring, parsed.ErrPos)
+	}
+	return nil
+}
+
 func (a *Archiver) HandleNewSubscriber(subscriber *Subscriber, querystring string) error {
 	subscriber.query = a.qp.Parse(querystring)
+	if subscriber.query.Err != nil {
+		err := fmt.Errorf("Error (%v) in query \"%v\" (error at %v)\n", subscriber.query.Err, querystring, subscriber.query.ErrPos)
+		subscriber.SendError(err)
+		return err
+	}
 	return a.broker.NewSubscriber(subscriber)
 }
@@ -1,3 +1,5 @@
+// +build mongo
+
 package archiver
 
 import (
@@ -16,7 +18,6 @@ func BenchmarkArchiverAddNoMetadata(b *testing.B) {
 		},
 		Readings: make([]common.Reading, 1),
 	}
-	ek := common.NewEphemeralKey()
 	rdg := &common.SmapNumberReading{Time: 0, Value: 0}
 	msg.Readings[0] = rdg
 	offset := time.Now().UnixNano()
@@ -25,7 +26,7 @@ func BenchmarkArchiverAddNoMetadata(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		rdg.Time = uint64(offset + int64(i))
 		msg.Readings[0] = rdg
-		testArchiver.AddData(msg, ek)
+		testArchiver.AddData("bench", msg)
 		msg.Properties = nil
 	}
 
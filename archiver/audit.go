@@ -0,0 +1,65 @@
+package archiver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/gtfierro/giles2/common"
+	"time"
+)
+
+// Every change to the archive is recorded in an append-only audit log: set
+// and delete queries with the streams they matched, and adds that change the
+// metadata of a stream (including creating it). Entries say who made the
+// change; plugins identify callers with Caller, or KeyCaller for callers with
+// an API key, which is recorded by its KeyID so that reading the log does not
+// reveal the key. The log is read with
+//    select audit where uuid = "<uuid>"
+//    select audit where Caller = "http/<key ID>"
+
+// Caller identifies who made a change as the plugin it came through followed
+// by the VK or address used, if known
+func Caller(plugin, id string) string {
+	if id == "" {
+		return plugin
+	}
+	return plugin + "/" + id
+}
+
+// KeyCaller identifies a caller by the API key it used, if any, without
+// recording the key itself
+func KeyCaller(plugin, key string) string {
+	if key == "" {
+		return plugin
+	}
+	return Caller(plugin, KeyID(key))
+}
+
+// KeyID names an API key by the first 16 hex digits of its SHA-256
+func KeyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// callers for changes the archiver makes on its own behalf
+const (
+	importCaller  = "import"
+	restoreCaller = "restore"
+	// the scheduled enforcement of retention policies
+	retentionCaller = "retention"
+	// the streams written by continuous queries
+	continuousCaller = "continuous"
+)
+
+// SelectAudit returns the audit entries matching the where clause, oldest first
+func (a *Archiver) SelectAudit(params *common.AuditParams) (common.AuditLog, error) {
+	return a.mdStore.GetAudit(params.Where.ToBson())
+}
+
+// records the change. The change has already been made, so failing to record
+// it is logged rather than returned
+func (a *Archiver) audit(caller, query string, uuids []common.UUID) {
+	entry := &common.AuditEntry{Time: time.Now(), Caller: caller, Query: query, UUIDs: uuids}
+	if err := a.mdStore.SaveAudit(entry); err != nil {
+		log.Errorf("Could not record %v by %v in the audit log (%v)", query, caller, err)
+	}
+}
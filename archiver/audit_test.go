@@ -0,0 +1,40 @@
+package archiver
+
+import (
+	"github.com/gtfierro/giles2/common"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestAudit(t *testing.T) {
+	a, _, md := newFakeArchiver()
+
+	// creating a stream and changing its metadata are recorded, adding more
+	// readings is not
+	msg := &common.SmapMessage{Path: "/s0", UUID: "s0", Metadata: common.Dict{"Zone": "3"}, Readings: reading(1351043674000)}
+	assert.NoError(t, a.AddData(KeyCaller("http", "mykey"), msg))
+	msg.Readings = reading(1351043675000)
+	assert.NoError(t, a.AddData(KeyCaller("http", "mykey"), msg))
+	msg.Metadata = common.Dict{"Zone": "4"}
+	assert.NoError(t, a.AddData(Caller("mqtt", ""), msg))
+
+	_, err := a.HandleQuery(Caller("bosswave", "vk"), `set Metadata/Zone = "5" where uuid = "s0"`)
+	assert.NoError(t, err)
+	_, err = a.HandleQuery(Caller("bosswave", "vk"), `select * where uuid = "s0"`)
+	assert.NoError(t, err)
+
+	res, err := a.HandleQuery("", `select audit where uuid = "s0"`)
+	if assert.NoError(t, err) && assert.Len(t, res, 3) {
+		log := res.(common.AuditLog)
+		// API keys are recorded by their ID
+		assert.Equal(t, "http/"+KeyID("mykey"), log[0].Caller)
+		assert.NotContains(t, log[0].Caller, "mykey")
+		assert.Len(t, KeyID("mykey"), 16)
+		assert.Equal(t, "add /s0", log[0].Query)
+		assert.Equal(t, []common.UUID{"s0"}, log[0].UUIDs)
+		assert.Equal(t, "mqtt", log[1].Caller)
+		assert.Equal(t, "bosswave/vk", log[2].Caller)
+		assert.Equal(t, `set Metadata/Zone = "5" where uuid = "s0"`, log[2].Query)
+	}
+	assert.Len(t, md.audit, 3)
+}
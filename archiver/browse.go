@@ -0,0 +1,49 @@
+package archiver
+
+import (
+	"github.com/gtfierro/giles2/common"
+	"sort"
+	"strings"
+)
+
+// PathNode is one level of the sMAP path hierarchy
+type PathNode struct {
+	// last segment of the path
+	Name string `json:",omitempty"`
+	Path string
+	// number of streams at or beneath this path
+	Streams int
+	// set if this path is itself a stream
+	UUID     common.UUID `json:"uuid,omitempty"`
+	Children []PathNode  `json:",omitempty"`
+}
+
+// Browse returns the node at the given path prefix with its immediate
+// children, so the hierarchy can be walked one level at a time. The metadata
+// store counts the streams beneath each child, so browsing does not load the
+// streams themselves
+func (a *Archiver) Browse(prefix string) (*PathNode, error) {
+	prefix = "/" + strings.Trim(prefix, "/")
+	counts, err := a.mdStore.CountPaths(prefix)
+	if err != nil {
+		return nil, err
+	}
+	node := &PathNode{Path: prefix}
+	for _, child := range counts {
+		node.Streams += child.Streams
+		if child.Name == "" {
+			node.UUID = child.UUID
+			continue
+		}
+		child.Path = strings.TrimSuffix(prefix, "/") + "/" + child.Name
+		node.Children = append(node.Children, child)
+	}
+	sort.Sort(pathNodes(node.Children))
+	return node, nil
+}
+
+type pathNodes []PathNode
+
+func (pn pathNodes) Len() int           { return len(pn) }
+func (pn pathNodes) Swap(i, j int)      { pn[i], pn[j] = pn[j], pn[i] }
+func (pn pathNodes) Less(i, j int) bool { return pn[i].Name < pn[j].Name }
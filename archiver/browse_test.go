@@ -0,0 +1,40 @@
+package archiver
+
+import (
+	"github.com/gtfierro/giles2/common"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestBrowse(t *testing.T) {
+	a, _, _ := newFakeArchiver()
+	for _, path := range []string{"/building1/floor1/s0", "/building1/floor2/s0", "/building1/floor2/s1", "/building10/s0", "/building1"} {
+		assert.NoError(t, a.AddData("test", &common.SmapMessage{Path: path, UUID: common.UUID(path), Readings: reading(1351043674000)}))
+	}
+
+	root, err := a.Browse("/")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 5, root.Streams)
+		if assert.Len(t, root.Children, 2) {
+			assert.Equal(t, PathNode{Name: "building1", Path: "/building1", Streams: 4, UUID: "/building1"}, root.Children[0])
+			assert.Equal(t, "building10", root.Children[1].Name)
+		}
+	}
+
+	building, err := a.Browse("building1/")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "/building1", building.Path)
+		assert.Equal(t, 4, building.Streams)
+		assert.Equal(t, common.UUID("/building1"), building.UUID)
+		if assert.Len(t, building.Children, 2) {
+			assert.Equal(t, PathNode{Name: "floor1", Path: "/building1/floor1", Streams: 1}, building.Children[0])
+			assert.Equal(t, PathNode{Name: "floor2", Path: "/building1/floor2", Streams: 2}, building.Children[1])
+		}
+	}
+
+	empty, err := a.Browse("/nothing")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 0, empty.Streams)
+		assert.Empty(t, empty.Children)
+	}
+}
@@ -0,0 +1,143 @@
+package archiver
+
+import (
+	"github.com/gtfierro/giles2/common"
+	"gopkg.in/mgo.v2/bson"
+	"regexp"
+	"strings"
+)
+
+// sMAP objects describe a tree of collections: paths that are not streams but
+// carry Metadata, Properties or Actuator for every stream beneath them.
+// Collections are saved to the metadata store, and what they carry is written
+// onto the documents of their descendant streams, both when a stream is
+// written and when a collection changes, so it can be queried like any other
+// tag. A stream keeps the keys it sets itself, or that are set on it with a
+// set query; otherwise the deepest collection defining a key wins. Keys
+// removed from a collection are not removed from its streams.
+//
+// Drivers describe their own trees, so collections belong to the caller that
+// saved them (e.g. the API key a driver delivers with), and a stream inherits
+// only from the collections of the caller that last wrote it.
+
+// AddTiered adds a sMAP object which may contain collections as well as
+// streams on behalf of caller. Returns the number of streams added
+func (a *Archiver) AddTiered(caller string, messages common.TieredSmapMessage) (added int, err error) {
+	for path, msg := range messages {
+		if msg.IsTimeseries() || !msg.HasMetadata() {
+			continue
+		}
+		msg.Path = path
+		if err = a.SaveCollection(caller, msg); err != nil {
+			return
+		}
+	}
+	for _, msg := range messages {
+		if !msg.IsTimeseries() {
+			continue
+		}
+		if err = a.AddData(caller, msg); err != nil {
+			return
+		}
+		added++
+	}
+	return
+}
+
+// SaveCollection saves the collection at msg.Path of caller and, if it
+// changed, updates the streams of caller beneath it with what they now
+// inherit. The streams that change are recorded in the audit log as changed by
+// caller
+func (a *Archiver) SaveCollection(caller string, msg *common.SmapMessage) error {
+	if changed, err := a.mdStore.SaveCollection(caller, msg); err != nil || !changed {
+		return err
+	}
+
+	prefix := strings.TrimSuffix(msg.Path, "/")
+	descendants, err := a.mdStore.GetTags([]string{"uuid", "Path"}, bson.M{
+		"Path":    bson.M{"$regex": "^" + regexp.QuoteMeta(prefix) + "/"},
+		"_source": caller,
+	})
+	if err != nil {
+		return err
+	}
+	// streams in the same collection inherit from the same collections
+	fetched := make(map[string]common.SmapMessageList)
+	var changed []common.UUID
+	for _, doc := range descendants {
+		if doc.UUID == "" {
+			continue
+		}
+		parent := doc.Path[:strings.LastIndex(doc.Path, "/")+1]
+		collections, found := fetched[parent]
+		if !found {
+			if collections, err = a.mdStore.GetCollections(caller, common.GetPrefixes(doc.Path)); err != nil {
+				return err
+			}
+			fetched[parent] = collections
+		}
+		inherited, err := a.saveInherited(doc.UUID, caller, doc.Path, collections)
+		if err != nil {
+			return err
+		}
+		if inherited {
+			changed = append(changed, doc.UUID)
+		}
+	}
+	if len(changed) > 0 {
+		a.audit(caller, "add "+msg.Path, changed)
+	}
+	return nil
+}
+
+// applies the collections of caller above the stream to it, once per stream
+// (SaveCollection keeps the streams it has seen up to date). Returns true if
+// the stream changed
+func (a *Archiver) inherit(caller string, msg *common.SmapMessage) (bool, error) {
+	if msg.Path == "" || a.isInherited(msg.UUID) {
+		return false, nil
+	}
+	collections, err := a.mdStore.GetCollections(caller, common.GetPrefixes(msg.Path))
+	if err != nil {
+		return false, err
+	}
+	changed, err := a.saveInherited(msg.UUID, caller, msg.Path, collections)
+	if err != nil {
+		return false, err
+	}
+	a.inheritedLock.Lock()
+	a.inherited[msg.UUID] = struct{}{}
+	a.inheritedLock.Unlock()
+	return changed, nil
+}
+
+func (a *Archiver) saveInherited(uuid common.UUID, source, path string, collections common.SmapMessageList) (bool, error) {
+	inherited := common.Inherit(path, collections)
+	if inherited == nil {
+		// still record the source of the stream
+		inherited = &common.SmapMessage{Path: path}
+	}
+	inherited.UUID = uuid
+	changed, err := a.mdStore.SaveInherited(uuid, source, inherited)
+	a.broker.uuids.invalidate(changed)
+	return len(changed) > 0, err
+}
+
+func (a *Archiver) isInherited(uuid common.UUID) bool {
+	a.inheritedLock.Lock()
+	defer a.inheritedLock.Unlock()
+	if a.inherited == nil {
+		a.inherited = make(map[common.UUID]struct{})
+	}
+	_, found := a.inherited[uuid]
+	return found
+}
+
+// forgets the removed streams, so they inherit again if they are recreated
+func (a *Archiver) forgetInherited(uuids []common.UUID) {
+	a.inheritedLock.Lock()
+	for _, uuid := range uuids {
+		delete(a.inherited, uuid)
+	}
+	a.inheritedLock.Unlock()
+}
@@ -0,0 +1,93 @@
+package archiver
+
+import (
+	"github.com/gtfierro/giles2/common"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func reading(time uint64) []common.Reading {
+	return []common.Reading{&common.SmapNumberReading{Time: time, Value: 1}}
+}
+
+func TestCollectionInheritance(t *testing.T) {
+	a, _, md := newFakeArchiver()
+
+	added, err := a.AddTiered("test", common.TieredSmapMessage{
+		"/": {Path: "/", Contents: []string{"building"}, Metadata: common.Dict{"Site": "Berkeley", "Owner": "UCB"}},
+		"/building": {Path: "/building", Contents: []string{"s0", "s1"}, UUID: "collection",
+			Metadata:   common.Dict{"Site": "Soda"},
+			Properties: &common.SmapProperties{UnitOfMeasure: "W", Timezone: "America/Los_Angeles"}},
+		"/building/s0": {Path: "/building/s0", UUID: "s0", Metadata: common.Dict{"Room": "410"}, Readings: reading(1351043674000)},
+		"/building/s1": {Path: "/building/s1", UUID: "s1", Metadata: common.Dict{"Site": "Cory"}, Readings: reading(1351043674000)},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, added)
+	assert.Nil(t, md.docs["collection"], "collections are not streams")
+
+	s0, s1 := md.docs["s0"], md.docs["s1"]
+	assert.Equal(t, "Soda", s0["Metadata.Site"], "the deepest collection wins")
+	assert.Equal(t, "UCB", s0["Metadata.Owner"])
+	assert.Equal(t, "410", s0["Metadata.Room"])
+	assert.Equal(t, "W", s0["Properties.UnitofMeasure"])
+	assert.Equal(t, "America/Los_Angeles", s0["Properties.Timezone"])
+	assert.Equal(t, "Cory", s1["Metadata.Site"], "the stream's own tags win")
+
+	// a later change to the collection reaches existing streams
+	assert.NoError(t, a.SaveCollection("test", &common.SmapMessage{Path: "/building", Metadata: common.Dict{"Site": "Etcheverry", "Floor": "2"}}))
+	assert.Equal(t, "Etcheverry", s0["Metadata.Site"])
+	assert.Equal(t, "2", s0["Metadata.Floor"])
+	assert.Equal(t, "Cory", s1["Metadata.Site"])
+	assert.Equal(t, "2", s1["Metadata.Floor"])
+
+	// and new streams inherit when they are first written
+	assert.NoError(t, a.AddData("test", &common.SmapMessage{Path: "/building/s2", UUID: "s2", Readings: reading(1351043675000)}))
+	assert.Equal(t, "Etcheverry", md.docs["s2"]["Metadata.Site"])
+	assert.Equal(t, "W", md.docs["s2"]["Properties.UnitofMeasure"], "inherited units replace the n/a placeholder")
+
+	// streams outside the collection are untouched
+	assert.NoError(t, a.AddData("test", &common.SmapMessage{Path: "/elsewhere/s3", UUID: "s3", Readings: reading(1351043675000)}))
+	assert.Equal(t, "Berkeley", md.docs["s3"]["Metadata.Site"])
+	assert.Nil(t, md.docs["s3"]["Metadata.Floor"])
+
+	// saving an unchanged collection does not revisit its streams
+	scans := md.pathScans
+	assert.NoError(t, a.SaveCollection("test", &common.SmapMessage{Path: "/building", Metadata: common.Dict{"Site": "Etcheverry"}}))
+	assert.Equal(t, scans, md.pathScans)
+
+	// keys set with a query are kept when the collection changes
+	_, err = a.HandleQuery("test", `set Metadata/Site = "Sutardja Dai" where uuid = "s2"`)
+	assert.NoError(t, err)
+	assert.NoError(t, a.SaveCollection("test", &common.SmapMessage{Path: "/building", Metadata: common.Dict{"Site": "Hearst"}}))
+	assert.Equal(t, "Sutardja Dai", md.docs["s2"]["Metadata.Site"])
+	assert.Equal(t, "Hearst", s0["Metadata.Site"])
+}
+
+func TestCollectionSources(t *testing.T) {
+	a, _, md := newFakeArchiver()
+	building := func(site string) common.TieredSmapMessage {
+		return common.TieredSmapMessage{
+			"/": {Path: "/", Contents: []string{"s0"}, Metadata: common.Dict{"Site": site}},
+		}
+	}
+	_, err := a.AddTiered("http/a", building("Soda"))
+	assert.NoError(t, err)
+	assert.NoError(t, a.AddData("http/a", &common.SmapMessage{Path: "/s0", UUID: "a0", Readings: reading(1351043674000)}))
+	_, err = a.AddTiered("http/b", building("Cory"))
+	assert.NoError(t, err)
+	assert.NoError(t, a.AddData("http/b", &common.SmapMessage{Path: "/s0", UUID: "b0", Readings: reading(1351043674000)}))
+
+	// each driver's root collection applies only to its own streams
+	assert.Equal(t, "Soda", md.docs["a0"]["Metadata.Site"])
+	assert.Equal(t, "Cory", md.docs["b0"]["Metadata.Site"])
+	_, err = a.AddTiered("http/b", building("Hearst"))
+	assert.NoError(t, err)
+	assert.Equal(t, "Soda", md.docs["a0"]["Metadata.Site"])
+	assert.Equal(t, "Hearst", md.docs["b0"]["Metadata.Site"])
+
+	// removed streams inherit again when they are recreated
+	_, err = a.HandleQuery("test", `delete where uuid = "a0"`)
+	assert.NoError(t, err)
+	assert.NoError(t, a.AddData("http/a", &common.SmapMessage{Path: "/s0", UUID: "a0", Readings: reading(1351043675000)}))
+	assert.Equal(t, "Soda", md.docs["a0"]["Metadata.Site"])
+}
@@ -13,6 +13,36 @@ type BOSSWAVE struct {
 	ListenNS   []string
 }
 
+// Bridges an MQTT broker into the archiver. Messages on each Topic filter are
+// archived using the UUID, Time and Value objectbuilder expressions (as in a
+// BOSSWAVE ArchiveRequest). Each Republish entry is "<topic> <where clause>":
+// readings of matching streams are published as JSON to <topic>/<uuid>
+type MQTT struct {
+	Enabled   bool
+	Broker    string
+	ClientID  string
+	Username  string
+	Password  string
+	QoS       int
+	Topic     []string
+	UUID      string
+	Time      string
+	TimeParse string
+	Value     string
+	Republish []string
+}
+
+// Ages out the readings of the streams matching Where. Readings older than
+// Raw are rolled up into windows Rollup wide (kept for KeepRollup) and then
+// deleted; without a Rollup they are just deleted. Durations are a number and
+// a unit, e.g. 90d, 15min or 5y
+type Retention struct {
+	Where      string
+	Raw        string
+	Rollup     string
+	KeepRollup string
+}
+
 type Config struct {
 	Archiver struct {
 		TimeseriesStore *string
@@ -20,6 +50,8 @@ type Config struct {
 		Objects         *string
 		LogLevel        *string
 		PeriodicReport  bool
+		// how often retention policies are enforced, e.g. 1h
+		RetentionInterval *string
 	}
 
 	ReadingDB struct {
@@ -60,6 +92,11 @@ type Config struct {
 		Port    *int
 	}
 
+	MsgPackTCP struct {
+		Enabled bool
+		Port    *int
+	}
+
 	TCPJSON struct {
 		Enabled       bool
 		AddPort       *int
@@ -67,6 +104,16 @@ type Config struct {
 		SubscribePort *int
 	}
 
+	Influx struct {
+		Enabled  bool
+		HTTPPort *int
+		UDPPort  *int
+	}
+
+	MQTT MQTT
+
+	Retention map[string]*Retention
+
 	Profile struct {
 		CpuProfile     *string
 		MemProfile     *string
@@ -0,0 +1,233 @@
+package archiver
+
+import (
+	"fmt"
+	"github.com/gtfierro/giles2/archiver/internal/querylang"
+	"github.com/gtfierro/giles2/common"
+	"github.com/satori/go.uuid"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Continuous queries are window queries the archiver keeps running:
+//    create query power15 as select window(15min) data in (now -1d, now) where Metadata/Type = "Power"
+// materializes the 15 minute windows of each matching stream from the start
+// of the range, and then each window as it completes; the end of the range is
+// ignored. Like retention rollups, the Min, Mean, Max and Count of each window
+// are written through AddData to a new stream each beneath /_derived, with
+// the lineage
+//    Metadata/ContinuousQuery = "power15"
+//    Metadata/DerivedFrom = "<uuid of the source stream>"
+//    Metadata/Statistic = "min", "mean", "max" or "count"
+// Continuous queries and retention policies leave out these derived streams,
+// so they do not materialize or age out each other's output. Windows are
+// written once, so readings that arrive after their window has been written
+// are left out of it. "list queries" returns the continuous queries and "drop
+// query power15" stops one, keeping the streams it wrote.
+
+// streams written by continuous queries get a UUIDv3 of the source uuid, query
+// name and statistic under this namespace
+var CONTINUOUS_NAMESPACE_UUID = uuid.FromStringOrNil("8a3f6c2e-3b2e-11e7-a919-92ebcb67fe33")
+
+// how often continuous queries are checked for completed windows
+var continuousQueryInterval = 10 * time.Second
+
+type continuousQuery struct {
+	common.ContinuousQuery
+	// matches the source streams, leaving out derived streams
+	where common.Dict
+	width uint64
+}
+
+// continuousQueries are the continuous queries known to the archiver. The
+// lock guards the map and how far each query has run (Through); it is not
+// held while the queries read and write readings
+type continuousQueries struct {
+	queries map[string]*continuousQuery
+	sync.Mutex
+}
+
+// checks and parses the create statement of a continuous query
+func (a *Archiver) newContinuousQuery(cq common.ContinuousQuery) (*continuousQuery, error) {
+	parsed := a.qp.Parse(cq.Query)
+	if parsed.Err != nil {
+		return nil, fmt.Errorf("Error (%v) in query \"%v\" (error at %v)", parsed.Err, cq.Query, parsed.ErrPos)
+	}
+	if parsed.QueryType != querylang.CREATE_TYPE || parsed.Name != cq.Name {
+		return nil, fmt.Errorf("\"%v\" does not create continuous query %v", cq.Query, cq.Name)
+	}
+	if !parsed.Data.IsWindow || parsed.Data.Width == 0 {
+		return nil, fmt.Errorf("Continuous query %v must select window data", cq.Name)
+	}
+	return &continuousQuery{
+		ContinuousQuery: cq,
+		where:           notDerived(parsed.Where),
+		width:           parsed.Data.Width,
+	}, nil
+}
+
+// registers the continuous queries saved in the metadata store
+func (a *Archiver) loadContinuousQueries() {
+	saved, err := a.mdStore.GetContinuousQueries()
+	if err != nil {
+		log.Errorf("Could not load continuous queries (%v)", err)
+		return
+	}
+	a.continuous.Lock()
+	defer a.continuous.Unlock()
+	a.continuous.queries = make(map[string]*continuousQuery)
+	for _, cq := range saved {
+		if q, err := a.newContinuousQuery(cq); err != nil {
+			log.Errorf("Could not load continuous query %v (%v)", cq.Name, err)
+		} else {
+			a.continuous.queries[cq.Name] = q
+		}
+	}
+}
+
+// runs the continuous queries every continuousQueryInterval
+func (a *Archiver) startContinuousQueries() {
+	go func() {
+		for now := range time.Tick(continuousQueryInterval) {
+			a.runContinuousQueries(now)
+		}
+	}()
+}
+
+// CreateContinuousQuery starts the continuous query defined by the parsed
+// create statement. Its windows are written by the next run. The creation is
+// recorded in the audit log as made by caller
+func (a *Archiver) CreateContinuousQuery(caller string, parsed *querylang.ParsedQuery) (common.ContinuousQueries, error) {
+	cq := common.ContinuousQuery{
+		Name:    parsed.Name,
+		Query:   strings.TrimSuffix(strings.TrimSpace(parsed.Querystring), ";"),
+		Created: time.Now(),
+	}
+	q, err := a.newContinuousQuery(cq)
+	if err != nil {
+		return nil, err
+	}
+	start := uint64(parsed.Data.Start.UnixNano())
+	q.Through = start - start%q.width
+
+	a.continuous.Lock()
+	defer a.continuous.Unlock()
+	if _, found := a.continuous.queries[cq.Name]; found {
+		return nil, fmt.Errorf("Continuous query %v already exists", cq.Name)
+	}
+	if err = a.mdStore.SaveContinuousQuery(&q.ContinuousQuery); err != nil {
+		return nil, err
+	}
+	if a.continuous.queries == nil {
+		a.continuous.queries = make(map[string]*continuousQuery)
+	}
+	a.continuous.queries[cq.Name] = q
+	a.audit(caller, "create query "+cq.Name, nil)
+	return common.ContinuousQueries{q.ContinuousQuery}, nil
+}
+
+// DropContinuousQuery stops the named continuous query. The streams it wrote
+// are kept. The drop is recorded in the audit log as made by caller
+func (a *Archiver) DropContinuousQuery(caller, name string) (common.ContinuousQueries, error) {
+	a.continuous.Lock()
+	defer a.continuous.Unlock()
+	q, found := a.continuous.queries[name]
+	if !found {
+		return nil, fmt.Errorf("No continuous query named %v", name)
+	}
+	if err := a.mdStore.RemoveContinuousQuery(name); err != nil {
+		return nil, err
+	}
+	delete(a.continuous.queries, name)
+	a.audit(caller, "drop query "+name, nil)
+	return common.ContinuousQueries{q.ContinuousQuery}, nil
+}
+
+// ListContinuousQueries returns the continuous queries ordered by name
+func (a *Archiver) ListContinuousQueries() common.ContinuousQueries {
+	a.continuous.Lock()
+	defer a.continuous.Unlock()
+	ret := make(common.ContinuousQueries, 0, len(a.continuous.queries))
+	for _, q := range a.continuous.queries {
+		ret = append(ret, q.ContinuousQuery)
+	}
+	sort.Sort(queriesByName(ret))
+	return ret
+}
+
+type queriesByName common.ContinuousQueries
+
+func (qn queriesByName) Len() int           { return len(qn) }
+func (qn queriesByName) Swap(i, j int)      { qn[i], qn[j] = qn[j], qn[i] }
+func (qn queriesByName) Less(i, j int) bool { return qn[i].Name < qn[j].Name }
+
+// writes the windows of each continuous query completed by now
+func (a *Archiver) runContinuousQueries(now time.Time) {
+	a.continuous.Lock()
+	queries := make([]*continuousQuery, 0, len(a.continuous.queries))
+	for _, q := range a.continuous.queries {
+		queries = append(queries, q)
+	}
+	a.continuous.Unlock()
+	for _, q := range queries {
+		if err := a.runContinuousQuery(q, uint64(now.UnixNano())); err != nil {
+			log.Errorf("Could not run continuous query %v (%v)", q.Name, err)
+		}
+	}
+}
+
+func (a *Archiver) runContinuousQuery(q *continuousQuery, now uint64) error {
+	a.continuous.Lock()
+	through := q.Through
+	a.continuous.Unlock()
+	end := now - now%q.width
+	if end <= through {
+		return nil
+	}
+	matched, err := a.broker.uuids.getUUIDs(a.mdStore, q.where)
+	if err != nil {
+		return err
+	}
+	// virtual streams are left out of window queries
+	stored, _ := a.virtuals.split(matched)
+	if len(stored) > 0 {
+		windows, err := a.tsStore.WindowData(stored, q.width, through, end)
+		if err != nil {
+			return err
+		}
+		for _, resp := range windows {
+			var written []*common.StatisticalNumberReading
+			for _, window := range resp.Readings {
+				if window.Count > 0 {
+					written = append(written, window)
+				}
+			}
+			source := resp.UUID
+			err = a.saveStatistics(continuousCaller, source, written, func(path, stat string) *common.SmapMessage {
+				return &common.SmapMessage{
+					UUID: derivedUUID(CONTINUOUS_NAMESPACE_UUID, source, q.Name, stat),
+					Path: derivedRoot + path + "/" + q.Name + "/" + stat,
+					Metadata: common.Dict{
+						"ContinuousQuery": q.Name,
+						"DerivedFrom":     string(source),
+						"Statistic":       stat,
+						"Width":           time.Duration(q.width).String(),
+					},
+				}
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	a.continuous.Lock()
+	defer a.continuous.Unlock()
+	// the query was dropped while it ran
+	if a.continuous.queries[q.Name] != q {
+		return nil
+	}
+	q.Through = end
+	return a.mdStore.SaveContinuousQuery(&q.ContinuousQuery)
+}
@@ -0,0 +1,83 @@
+package archiver
+
+import (
+	"github.com/gtfierro/giles2/common"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestContinuousQueries(t *testing.T) {
+	a, _, _ := newFakeArchiver()
+	var (
+		meter   = common.NewUUID()
+		width   = uint64(15 * time.Minute)
+		now     = time.Now()
+		current = uint64(now.UnixNano()) / width * width
+		// the start of the window an hour ago, in milliseconds
+		old = (current - 4*width) / 1e6
+	)
+	reading := func(time uint64, value float64) []common.Reading {
+		return []common.Reading{&common.SmapNumberReading{Time: time, Value: value}}
+	}
+	for _, rdg := range [][2]float64{{float64(old + 60e3), 1}, {float64(old + 120e3), 3}, {float64(old + 16*60e3), 5}} {
+		assert.NoError(t, a.AddData("test", &common.SmapMessage{Path: "/meter", UUID: meter, Metadata: common.Dict{"Type": "Power"}, Readings: reading(uint64(rdg[0]), rdg[1])}))
+	}
+
+	_, err := a.HandleQuery("test", `create query power15 as select data before now where Metadata/Type = "Power"`)
+	assert.Error(t, err, "continuous queries select windows")
+	res, err := a.HandleQuery("test", `create query power15 as select window(15min) data in (now -2h, now) where Metadata/Type = "Power"`)
+	assert.NoError(t, err)
+	assert.Len(t, res, 1)
+	_, err = a.HandleQuery("test", `create query power15 as select window(15min) data in (now -2h, now) where Metadata/Type = "Power"`)
+	assert.Error(t, err, "names are unique")
+
+	values := func(stat string) (ret []float64) {
+		res, err := a.HandleQuery("test", `select data in (now -1d, now +1d) where Metadata/ContinuousQuery = "power15" and Metadata/Statistic = "`+stat+`"`)
+		assert.NoError(t, err)
+		for _, msg := range res.(common.SmapMessageList) {
+			for _, rdg := range msg.Readings {
+				ret = append(ret, rdg.GetValue().(float64))
+			}
+		}
+		return
+	}
+	a.runContinuousQueries(now)
+	assert.Equal(t, []float64{2, 5}, values("mean"))
+	assert.Equal(t, []float64{2, 1}, values("count"))
+	// the query does not pick up the streams it writes
+	a.runContinuousQueries(now.Add(time.Duration(width)))
+	assert.Equal(t, []float64{2, 5}, values("mean"))
+	// nor does another, even one matching every stream
+	_, err = a.HandleQuery("test", `create query all15 as select window(15min) data in (now -2h, now) where has uuid`)
+	assert.NoError(t, err)
+	a.runContinuousQueries(now.Add(time.Duration(width)))
+	res, err = a.HandleQuery("test", `select distinct Path where Metadata/ContinuousQuery = "all15"`)
+	assert.NoError(t, err)
+	assert.Equal(t, common.DistinctResult{"/_derived/meter/all15/count", "/_derived/meter/all15/max", "/_derived/meter/all15/mean", "/_derived/meter/all15/min"}, res)
+	_, err = a.HandleQuery("test", `drop query all15`)
+	assert.NoError(t, err)
+
+	// windows are written as they complete
+	assert.NoError(t, a.AddData("test", &common.SmapMessage{UUID: meter, Readings: reading((current+width)/1e6+1000, 9)}))
+	a.runContinuousQueries(now.Add(2 * time.Duration(width)))
+	assert.Equal(t, []float64{2, 5, 9}, values("mean"))
+
+	res, err = a.HandleQuery("test", `list queries`)
+	assert.NoError(t, err)
+	if listed := res.(common.ContinuousQueries); assert.Len(t, listed, 1) {
+		assert.Equal(t, "power15", listed[0].Name)
+		assert.Equal(t, current+2*width, listed[0].Through)
+	}
+
+	// queries are kept in the metadata store
+	a.loadContinuousQueries()
+	assert.Len(t, a.ListContinuousQueries(), 1)
+
+	_, err = a.HandleQuery("test", `drop query power15`)
+	assert.NoError(t, err)
+	_, err = a.HandleQuery("test", `drop query power15`)
+	assert.Error(t, err)
+	assert.Empty(t, a.ListContinuousQueries())
+	assert.Equal(t, []float64{2, 5, 9}, values("mean"), "dropping a query keeps its streams")
+}
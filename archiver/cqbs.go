@@ -4,6 +4,7 @@ import (
 	"github.com/gtfierro/giles2/archiver/internal/querylang"
 	"github.com/gtfierro/giles2/common"
 	"sync"
+	"time"
 )
 
 type UUIDSTATE uint
@@ -18,6 +19,16 @@ type QueryResult interface {
 	IsResult()
 }
 
+// Delivered to the subscribers of a query when the set of streams matching
+// its where clause changes
+type SubscriptionDiff struct {
+	Query   string
+	Added   []common.UUID `json:",omitempty"`
+	Removed []common.UUID `json:",omitempty"`
+}
+
+func (diff SubscriptionDiff) IsResult() {}
+
 type Query struct {
 	// query string
 	Query string
@@ -84,6 +95,18 @@ type Broker struct {
 	// key -> list of queries
 	keys     map[string]*queryList
 	keysLock sync.RWMutex
+
+	// where clause -> matching UUIDs, dropped as keys change
+	uuids *uuidCache
+
+	// alert rules evaluated against incoming readings
+	alerts *alertEngine
+
+	// when each stream last sent readings and whether it has gone quiet
+	liveness *livenessTracker
+
+	// recently committed messages, to catch up resuming subscribers
+	journal *journal
 }
 
 func NewBroker(a *Archiver) *Broker {
@@ -92,6 +115,10 @@ func NewBroker(a *Archiver) *Broker {
 		queries:     make(map[string]*Query),
 		subscribers: make(map[common.UUID]*subscriberList),
 		keys:        make(map[string]*queryList),
+		uuids:       newUUIDCache(),
+		alerts:      newAlertEngine(),
+		liveness:    newLivenessTracker(),
+		journal:     newJournal(),
 	}
 }
 
@@ -113,7 +140,7 @@ func (b *Broker) GetQuery(pq *querylang.ParsedQuery) (*Query, error) {
 	// it hasn't been evaluated. So, we evaluate it to get
 	// the initial UUIDs
 	q = NewQuery(pq)
-	uuids, err := b.a.mdStore.GetUUIDs(q.WhereClause.ToBson())
+	uuids, err := b.uuids.getUUIDs(b.a.mdStore, q.WhereClause)
 	if err != nil {
 		return q, err
 	}
@@ -157,53 +184,25 @@ func (b *Broker) GetQuery(pq *querylang.ParsedQuery) (*Query, error) {
 // first adjust all subscriptions based on metadata in this message,
 // then forward it out to all subscribed clients
 func (b *Broker) HandleMessage(msg *common.SmapMessage) {
-	var toReevaluate = make(map[*Query]bool)
-	b.keysLock.RLock()
-	if msg.Metadata != nil {
-		for key, _ := range msg.Metadata {
-			if queries, found := b.keys["Metadata."+key]; found {
-				for _, query := range *queries {
-					toReevaluate[query] = true
-				}
-			}
-		}
-	}
-	if msg.Actuator != nil {
-		for key, _ := range msg.Actuator {
-			if queries, found := b.keys["Actuator."+key]; found {
-				for _, query := range *queries {
-					toReevaluate[query] = true
-				}
-			}
+	var (
+		toReevaluate = make(map[*Query]bool)
+		keys         = messageKeys(msg)
+	)
+	if len(msg.Readings) > 0 {
+		b.journal.record(msg, time.Now())
+		if change := b.liveness.observe(msg.UUID, time.Now()); change != nil {
+			b.publishLiveness([]LivenessChange{*change})
 		}
 	}
-	if msg.Properties != nil {
-		if queries, found := b.keys["Properties.UnitofMeasure"]; found {
-			for _, query := range *queries {
-				toReevaluate[query] = true
-			}
-		}
-		if queries, found := b.keys["Properties.UnitofTime"]; found {
-			for _, query := range *queries {
-				toReevaluate[query] = true
-			}
-		}
-		if queries, found := b.keys["Properties.StreamType"]; found {
+	b.evaluateAlerts(msg)
+	b.keysLock.RLock()
+	for _, key := range keys {
+		if queries, found := b.keys[key]; found {
 			for _, query := range *queries {
 				toReevaluate[query] = true
 			}
 		}
 	}
-	if queries, found := b.keys["uuid"]; found {
-		for _, query := range *queries {
-			toReevaluate[query] = true
-		}
-	}
-	if queries, found := b.keys["Path"]; found {
-		for _, query := range *queries {
-			toReevaluate[query] = true
-		}
-	}
 	b.keysLock.RUnlock()
 	for query, _ := range toReevaluate {
 		b.reevaluateQuery(query)
@@ -222,7 +221,7 @@ func (b *Broker) reevaluateQuery(q *Query) {
 		found bool
 	)
 	log.Debugf("reevalute %v", q)
-	uuids, err := b.a.mdStore.GetUUIDs(q.WhereClause.ToBson())
+	uuids, err := b.uuids.getUUIDs(b.a.mdStore, q.WhereClause)
 	if err != nil {
 		log.Criticalf("Error fetching UUIDs for (%v) from metadata store (%v)", q.WhereClause, err)
 		return
@@ -256,6 +255,18 @@ func (b *Broker) reevaluateQuery(q *Query) {
 		}
 	}
 
+	// let the subscribers know which streams came and went
+	if len(added) > 0 || len(removed) > 0 {
+		diff := SubscriptionDiff{Query: q.Query, Added: added, Removed: removed}
+		for _, sub := range *q.subscribers {
+			if !sub.events {
+				continue
+			}
+			if err := sub.QueueToSend(diff); err != nil {
+				log.Warningf("Could not deliver diff to subscriber (%v)", err)
+			}
+		}
+	}
 }
 
 func (b *Broker) NewSubscriber(sub *Subscriber) error {
@@ -264,6 +275,18 @@ func (b *Broker) NewSubscriber(sub *Subscriber) error {
 		sub.errorHandler(err)
 		return err
 	}
+	// queries relative to now are shared by their subscribers, but each needs
+	// results as of when it subscribed
+	relative := sub.query.Data != nil && (sub.query.Data.StartRef.Relative || sub.query.Data.EndRef.Relative)
+	if relative && sub.query.Data.IsRolling() && sub.events {
+		sub.window = newRollingWindow(sub.query.Querystring, sub.query.Data.StartRef.Offset)
+	}
+	// the cursors of a resumed durable subscription before it is sent
+	// anything, as live readings delivered from here on move them
+	var resumed common.DurableSubscription
+	if sub.durable != nil {
+		resumed = sub.durable.snapshot()
+	}
 	log.Debugf("NEW Subscriber %v with query %v", sub, sub.query)
 	query.subscribers.addSubscriber(sub)
 	for uuid, _ := range query.Streams {
@@ -271,10 +294,49 @@ func (b *Broker) NewSubscriber(sub *Subscriber) error {
 	}
 
 	// send initial results of query
-	log.Debugf("SEND INIT %v", query.Initial)
-	sub.BlockSend(query.Initial)
+	initial := query.Initial
+	if relative {
+		sub.query.Data.Resolve(time.Now())
+		if initial, err = b.a.evaluateQuery(sub.query); err != nil {
+			sub.errorHandler(err)
+			b.removeSubscriber(sub)
+			return err
+		}
+	}
+	var tick <-chan time.Time
+	if sub.window != nil {
+		sub.window.add(initial)
+		ticker := time.NewTicker(windowInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	log.Debugf("SEND INIT %v", initial)
+	sub.BlockSend(initial)
+	if sub.since > 0 {
+		missed, err := b.a.SelectDataSince(sub.query.Querystring, sub.since)
+		if err == nil && sub.durable != nil {
+			missed = undelivered(resumed, missed)
+		}
+		if err != nil {
+			sub.errorHandler(err)
+		} else if len(missed) > 0 {
+			sub.BlockSend(missed)
+		}
+	}
 	log.Debug("waiting for client to leave...")
-	<-sub.closed
+	for waiting := true; waiting; {
+		select {
+		case <-sub.closed:
+			waiting = false
+		case now := <-tick:
+			// let the subscriber know which readings have left its range
+			if expiry := sub.window.expire(now); expiry != nil {
+				if err := sub.QueueToSend(*expiry); err != nil {
+					log.Warningf("Could not deliver expiry to subscriber (%v)", err)
+				}
+			}
+		}
+	}
 	b.removeSubscriber(sub)
 	log.Debug("client left!")
 
@@ -341,8 +403,22 @@ func (b *Broker) ForwardMessage(msg *common.SmapMessage) {
 			return
 		}
 		log.Debugf("Found list of subscribers for msg %v (%v)", msg, list)
+		now := time.Now()
 		for _, sub := range *list {
-			sub.QueueToSend(msg)
+			forward := sub.inRange(msg, now)
+			if forward == nil {
+				continue
+			}
+			if forward != msg {
+				// the copy was committed with the message
+				b.journal.alias(forward, msg)
+			}
+			if sub.QueueToSend(forward) != nil {
+				continue
+			}
+			if sub.window != nil {
+				sub.window.add(forward)
+			}
 		}
 	} else {
 		b.subscribersLock.RUnlock()
@@ -0,0 +1,307 @@
+package archiver
+
+import (
+	"fmt"
+	"github.com/gtfierro/giles2/archiver/internal/querylang"
+	"github.com/gtfierro/giles2/common"
+	"github.com/satori/go.uuid"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Durable subscriptions (see common.DurableSubscription) are kept in the
+// metadata store so that they survive restarts of the archiver. A plugin that
+// can reach its clients without them reconnecting, like BOSSWAVE, which
+// publishes on signals derived from the VK of the client, registers a
+// SubscriptionTransport. The broker then restores the durable subscriptions
+// of that transport and resumes delivering to them: first the initial results
+// of their query, then the readings after their cursors that they missed while
+// the archiver was down. Each stream has its own cursor, which the transport
+// moves past the readings it has delivered by calling Subscriber.Delivered,
+// so readings that were queued but never delivered are sent again. Cursors are
+// saved every durableSaveInterval, so a restart may deliver the readings of
+// the last interval again.
+// Subscriptions over connections that do not outlive the archiver (HTTP
+// republish, SSE, websockets) are not durable; webhooks (see webhooks.go) are
+// the durable way to subscribe over HTTP.
+
+// durable subscriptions get a UUIDv3 of their transport, target, nonce and
+// query under this namespace, so subscribing again finds the same one
+var DURABLE_NAMESPACE_UUID = uuid.FromStringOrNil("b7d04f5e-3b2e-11e7-a919-92ebcb67fe33")
+
+// how often the cursors of durable subscriptions are saved
+var durableSaveInterval = 10 * time.Second
+
+// SubscriptionTransport returns a subscriber that delivers the results of the
+// durable subscription to its target. The subscriber must be created with the
+// given closed channel, on which the archiver ends the subscription
+type SubscriptionTransport func(sub common.DurableSubscription, closed <-chan bool) *Subscriber
+
+type durableSubscription struct {
+	common.DurableSubscription
+	closed chan bool
+	// the cursor has moved since it was saved
+	dirty bool
+	sync.Mutex
+}
+
+// durableSubscriptions are the durable subscriptions being delivered, by ID,
+// and the transports that deliver them
+type durableSubscriptions struct {
+	subs       map[string]*durableSubscription
+	transports map[string]SubscriptionTransport
+	sync.Mutex
+}
+
+// moves the cursor of the stream of the message past its readings
+func (ds *durableSubscription) advance(msg *common.SmapMessage) {
+	ds.Lock()
+	defer ds.Unlock()
+	for _, rdg := range msg.Readings {
+		t, err := common.ConvertTime(rdg.GetTime(), common.GuessTimeUnit(rdg.GetTime()), common.UOT_NS)
+		if err == nil && t > ds.cursor(msg.UUID) {
+			if ds.Cursors == nil {
+				ds.Cursors = make(map[string]uint64)
+			}
+			ds.Cursors[string(msg.UUID)] = t
+			ds.dirty = true
+		}
+	}
+}
+
+// the time up to which the readings of the stream have been delivered. The
+// caller holds the lock
+func (ds *durableSubscription) cursor(uuid common.UUID) uint64 {
+	return cursorOf(ds.DurableSubscription, uuid)
+}
+
+func cursorOf(sub common.DurableSubscription, uuid common.UUID) uint64 {
+	if cursor, found := sub.Cursors[string(uuid)]; found {
+		return cursor
+	}
+	return sub.Cursor
+}
+
+// the earliest cursor of the streams
+func (ds *durableSubscription) earliest() uint64 {
+	ds.Lock()
+	defer ds.Unlock()
+	earliest := ds.Cursor
+	for _, cursor := range ds.Cursors {
+		if cursor < earliest {
+			earliest = cursor
+		}
+	}
+	return earliest
+}
+
+// leaves out the readings of the messages that are not after the cursors of
+// their streams in sub
+func undelivered(sub common.DurableSubscription, msgs common.SmapMessageList) common.SmapMessageList {
+	var ret common.SmapMessageList
+	for _, msg := range msgs {
+		var readings []common.Reading
+		for _, rdg := range msg.Readings {
+			t, err := common.ConvertTime(rdg.GetTime(), common.GuessTimeUnit(rdg.GetTime()), common.UOT_NS)
+			if err == nil && t > cursorOf(sub, msg.UUID) {
+				readings = append(readings, rdg)
+			}
+		}
+		if len(readings) > 0 {
+			undelivered := *msg
+			undelivered.Readings = readings
+			ret = append(ret, &undelivered)
+		}
+	}
+	return ret
+}
+
+// returns a copy of the subscription that does not share its cursors
+func (ds *durableSubscription) snapshot() common.DurableSubscription {
+	ds.Lock()
+	defer ds.Unlock()
+	sub := ds.DurableSubscription
+	if ds.Cursors != nil {
+		sub.Cursors = make(map[string]uint64, len(ds.Cursors))
+		for uuid, cursor := range ds.Cursors {
+			sub.Cursors[uuid] = cursor
+		}
+	}
+	return sub
+}
+
+// RegisterSubscriptionTransport lets durable subscriptions be delivered by
+// the named transport, and resumes those saved for it
+func (a *Archiver) RegisterSubscriptionTransport(transport string, start SubscriptionTransport) {
+	a.durable.Lock()
+	if a.durable.transports == nil {
+		a.durable.transports = make(map[string]SubscriptionTransport)
+	}
+	a.durable.transports[transport] = start
+	a.durable.Unlock()
+
+	saved, err := a.mdStore.GetSubscriptions()
+	if err != nil {
+		log.Errorf("Could not load durable subscriptions (%v)", err)
+		return
+	}
+	for _, sub := range saved {
+		if sub.Transport != transport {
+			continue
+		}
+		if err := a.checkSubscriptionQuery(sub.Query); err != nil {
+			log.Errorf("Could not resume durable subscription %v (%v)", sub.ID, err)
+			continue
+		}
+		a.durable.Lock()
+		if _, running := a.durable.subs[sub.ID]; !running {
+			log.Noticef("Resuming durable subscription %v to %v", sub.ID, sub.Target)
+			a.startDurable(sub, true)
+		}
+		a.durable.Unlock()
+	}
+}
+
+func (a *Archiver) checkSubscriptionQuery(query string) error {
+	parsed := a.qp.Parse(query)
+	if parsed.Err != nil {
+		return fmt.Errorf("Error (%v) in query \"%v\" (error at %v)", parsed.Err, query, parsed.ErrPos)
+	}
+	if parsed.Explain || (parsed.QueryType != querylang.SELECT_TYPE && parsed.QueryType != querylang.DATA_TYPE) {
+		return fmt.Errorf("Can only subscribe to select queries, not \"%v\"", query)
+	}
+	return nil
+}
+
+// SubscribeDurable subscribes the target to the query through the transport,
+// and keeps the subscription until Unsubscribe. Subscribing again with the
+// same transport, target, query and nonce returns the existing subscription.
+// The subscription is recorded in the audit log as made by caller
+func (a *Archiver) SubscribeDurable(caller, transport, target, query string, nonce uint32) (common.DurableSubscription, error) {
+	sub := common.DurableSubscription{
+		ID:        uuid.NewV3(DURABLE_NAMESPACE_UUID, fmt.Sprintf("%v/%v/%v/%v", transport, target, nonce, query)).String(),
+		Transport: transport,
+		Target:    target,
+		Query:     query,
+		Nonce:     nonce,
+		Cursor:    uint64(time.Now().UnixNano()),
+		Created:   time.Now(),
+	}
+	if err := a.checkSubscriptionQuery(query); err != nil {
+		return sub, err
+	}
+	a.durable.Lock()
+	defer a.durable.Unlock()
+	if _, registered := a.durable.transports[transport]; !registered {
+		return sub, fmt.Errorf("No subscription transport %v", transport)
+	}
+	if existing, found := a.durable.subs[sub.ID]; found {
+		return existing.snapshot(), nil
+	}
+	if err := a.mdStore.SaveSubscription(&sub); err != nil {
+		return sub, err
+	}
+	a.startDurable(sub, false)
+	a.audit(caller, "subscribe "+sub.ID, nil)
+	return sub, nil
+}
+
+// Unsubscribe ends the durable subscription and forgets it. The change is
+// recorded in the audit log as made by caller
+func (a *Archiver) Unsubscribe(caller, id string) error {
+	a.durable.Lock()
+	defer a.durable.Unlock()
+	ds, found := a.durable.subs[id]
+	if !found {
+		return fmt.Errorf("No durable subscription %v", id)
+	}
+	if err := a.mdStore.RemoveSubscription(id); err != nil {
+		return err
+	}
+	delete(a.durable.subs, id)
+	ds.closed <- true
+	a.audit(caller, "unsubscribe "+id, nil)
+	return nil
+}
+
+// DurableSubscriptions returns the durable subscriptions being delivered,
+// ordered by ID
+func (a *Archiver) DurableSubscriptions() []common.DurableSubscription {
+	a.durable.Lock()
+	defer a.durable.Unlock()
+	ret := make([]common.DurableSubscription, 0, len(a.durable.subs))
+	for _, ds := range a.durable.subs {
+		ret = append(ret, ds.snapshot())
+	}
+	sort.Sort(subscriptionsByID(ret))
+	return ret
+}
+
+type subscriptionsByID []common.DurableSubscription
+
+func (si subscriptionsByID) Len() int           { return len(si) }
+func (si subscriptionsByID) Swap(i, j int)      { si[i], si[j] = si[j], si[i] }
+func (si subscriptionsByID) Less(i, j int) bool { return si[i].ID < si[j].ID }
+
+// starts delivering the durable subscription through its transport. Resumed
+// subscriptions are sent the readings after their cursors. If the query
+// cannot be run, the subscription is stopped but kept in the metadata store,
+// to be resumed when the archiver restarts or subscribed to again. The caller
+// holds the lock of a.durable
+func (a *Archiver) startDurable(sub common.DurableSubscription, resume bool) {
+	ds := &durableSubscription{DurableSubscription: sub, closed: make(chan bool, 1)}
+	if a.durable.subs == nil {
+		a.durable.subs = make(map[string]*durableSubscription)
+	}
+	a.durable.subs[sub.ID] = ds
+
+	subscriber := a.durable.transports[sub.Transport](sub, ds.closed)
+	subscriber.durable = ds
+	if resume {
+		subscriber.since = ds.earliest()
+	}
+	go func() {
+		// returns once the subscription ends
+		if err := a.HandleNewSubscriber(subscriber, sub.Query); err != nil {
+			log.Errorf("Could not deliver durable subscription %v (%v)", sub.ID, err)
+			a.durable.Lock()
+			if a.durable.subs[sub.ID] == ds {
+				delete(a.durable.subs, sub.ID)
+			}
+			a.durable.Unlock()
+		}
+	}()
+}
+
+// saves the cursors of the durable subscriptions every durableSaveInterval
+func (a *Archiver) startDurableCursors() {
+	go func() {
+		for range time.Tick(durableSaveInterval) {
+			a.saveCursors()
+		}
+	}()
+}
+
+// saves the cursors that have moved since they were last saved
+func (a *Archiver) saveCursors() {
+	// held throughout, so that unsubscribed subscriptions are not saved again
+	a.durable.Lock()
+	defer a.durable.Unlock()
+	for _, ds := range a.durable.subs {
+		ds.Lock()
+		dirty := ds.dirty
+		ds.dirty = false
+		ds.Unlock()
+		if !dirty {
+			continue
+		}
+		sub := ds.snapshot()
+		if err := a.mdStore.SaveSubscription(&sub); err != nil {
+			log.Errorf("Could not save cursor of durable subscription %v (%v)", sub.ID, err)
+			ds.Lock()
+			ds.dirty = true
+			ds.Unlock()
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package archiver
+
+import (
+	"github.com/gtfierro/giles2/common"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestDurableSubscriptions(t *testing.T) {
+	delivered := make(chan QueryResult, 10)
+	transport := func(sub common.DurableSubscription, closed <-chan bool) *Subscriber {
+		assert.Equal(t, "client", sub.Target)
+		s := NewSubscriber(closed, 10, func(err error) { t.Error(err) })
+		go func() {
+			for val := range s.C {
+				delivered <- val
+				s.Delivered(val)
+			}
+		}()
+		return s
+	}
+	// a transport that loses what it is sent
+	lossy := func(sub common.DurableSubscription, closed <-chan bool) *Subscriber {
+		s := NewSubscriber(closed, 10, func(err error) {})
+		go func() {
+			for val := range s.C {
+				delivered <- val
+			}
+		}()
+		return s
+	}
+	next := func() QueryResult {
+		select {
+		case val := <-delivered:
+			return val
+		case <-time.After(5 * time.Second):
+			t.Fatal("nothing delivered")
+		}
+		return nil
+	}
+
+	a, ts, md := newFakeArchiver()
+	room := common.NewUUID()
+	assert.NoError(t, a.AddData("test", &common.SmapMessage{Path: "/room", UUID: room, Metadata: common.Dict{"Type": "Temperature"}}))
+	hall := common.NewUUID()
+	assert.NoError(t, a.AddData("test", &common.SmapMessage{Path: "/hall", UUID: hall, Metadata: common.Dict{"Type": "Temperature"}}))
+	query := `select data before now where Metadata/Type = "Temperature"`
+	_, err := a.SubscribeDurable("test", "pigeon", "client", query, 1)
+	assert.Error(t, err, "the transport must be registered")
+	a.RegisterSubscriptionTransport("test", transport)
+	_, err = a.SubscribeDurable("test", "test", "client", `set Metadata/Type = "Power"`, 1)
+	assert.Error(t, err)
+
+	sub, err := a.SubscribeDurable("test", "test", "client", query, 1)
+	assert.NoError(t, err)
+	next()
+	again, err := a.SubscribeDurable("test", "test", "client", query, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, sub.ID, again.ID, "subscribing again finds the same subscription")
+	assert.Len(t, a.DurableSubscriptions(), 1)
+
+	// each stream has its own cursor, which follows the delivered readings
+	// and is saved
+	reading := func(uuid common.UUID, value float64) (*common.SmapMessage, uint64) {
+		// readings are in milliseconds, so leave one between them
+		time.Sleep(2 * time.Millisecond)
+		ms := uint64(time.Now().UnixNano() / 1e6)
+		return &common.SmapMessage{UUID: uuid, Readings: []common.Reading{&common.SmapNumberReading{Time: ms, Value: value}}}, ms * 1e6
+	}
+	first, cursor := reading(room, 1)
+	assert.NoError(t, a.AddData("test", first))
+	assert.IsType(t, &common.SmapMessage{}, next())
+	a.saveCursors()
+	assert.Equal(t, cursor, md.subs[sub.ID].Cursors[string(room)])
+	_, hallCursor := md.subs[sub.ID].Cursors[string(hall)]
+	assert.False(t, hallCursor, "the cursor of the other stream does not move")
+
+	// results the transport does not deliver leave the cursor where it is
+	a.RegisterSubscriptionTransport("lossy", lossy)
+	lost, err := a.SubscribeDurable("test", "lossy", "client", query, 1)
+	assert.NoError(t, err)
+	next()
+	lostReading, _ := reading(hall, 5)
+	assert.NoError(t, a.AddData("test", lostReading))
+	next()
+	next()
+	for _, ds := range a.DurableSubscriptions() {
+		if ds.ID == lost.ID {
+			assert.Empty(t, ds.Cursors)
+		}
+	}
+	assert.NoError(t, a.Unsubscribe("test", lost.ID))
+
+	// after a restart, the subscription is resumed once its transport is
+	// registered, and sent the readings it missed
+	restarted := &Archiver{tsStore: ts, mdStore: md, qp: a.qp, metrics: a.metrics}
+	restarted.broker = NewBroker(restarted)
+	second, cursor := reading(room, 2)
+	ts.AddMessage(second)
+	restarted.RegisterSubscriptionTransport("test", transport)
+	next()
+	// the cursors were last saved before the reading of the hall, so it is
+	// sent again
+	missed, ok := next().(common.SmapMessageList)
+	if assert.True(t, ok) && assert.Len(t, missed, 2) {
+		values := map[common.UUID]float64{}
+		for _, msg := range missed {
+			if assert.Len(t, msg.Readings, 1) {
+				values[msg.UUID] = msg.Readings[0].GetValue().(float64)
+			}
+		}
+		assert.Equal(t, map[common.UUID]float64{room: 2, hall: 5}, values)
+	}
+	if resumed := restarted.DurableSubscriptions(); assert.Len(t, resumed, 1) {
+		assert.Equal(t, cursor, resumed[0].Cursors[string(room)])
+	}
+
+	assert.NoError(t, restarted.Unsubscribe("test", sub.ID))
+	assert.Error(t, restarted.Unsubscribe("test", sub.ID))
+	assert.Empty(t, restarted.DurableSubscriptions())
+	assert.Empty(t, md.subs)
+}
+
+func TestDurableSubscriptionQueryFails(t *testing.T) {
+	a, ts, md := newFakeArchiver()
+	// a subscription whose query no longer runs, e.g. saved by an older version
+	broken := common.DurableSubscription{ID: "broken", Transport: "test", Target: "client", Query: `set Metadata/Type = "Power"`}
+	assert.NoError(t, md.SaveSubscription(&broken))
+	restarted := &Archiver{tsStore: ts, mdStore: md, qp: a.qp, metrics: a.metrics}
+	restarted.broker = NewBroker(restarted)
+	restarted.RegisterSubscriptionTransport("test", func(sub common.DurableSubscription, closed <-chan bool) *Subscriber {
+		return NewSubscriber(closed, 10, func(err error) {})
+	})
+	for i := 0; i < 100 && len(restarted.DurableSubscriptions()) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Empty(t, restarted.DurableSubscriptions(), "the subscription is stopped")
+	assert.Contains(t, md.subs, "broken", "and kept to be resumed later")
+}
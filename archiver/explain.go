@@ -0,0 +1,173 @@
+package archiver
+
+import (
+	"fmt"
+	"github.com/gtfierro/giles2/archiver/internal/querylang"
+	"github.com/gtfierro/giles2/common"
+	"gopkg.in/mgo.v2/bson"
+	"time"
+)
+
+// QueryPlan is the result of "explain <query>": how the query was evaluated
+// and how long each stage took. Select queries (including select audit and
+// select stale) are run and their results counted; set and delete queries are
+// not run, and Mutation reports what they would change. The statements that
+// manage continuous queries have no plan and cannot be explained
+type QueryPlan struct {
+	Query string
+	// the where clause as given to the metadata store
+	Filter bson.M
+	AsOf   *time.Time `json:",omitempty"`
+	// how the metadata store evaluates the filter, e.g. the index it uses
+	MetadataPlan string `json:",omitempty"`
+	// number of streams (or documents, or distinct values) matched
+	Matched int
+	// for data queries, the TimeseriesStore method and its time bounds in
+	// nanoseconds
+	Timeseries string `json:",omitempty"`
+	Begin      uint64 `json:",omitempty"`
+	End        uint64 `json:",omitempty"`
+	// number of readings a data query returned
+	Readings int                     `json:",omitempty"`
+	Mutation *common.MutationSummary `json:",omitempty"`
+	Stages   []PlanStage
+}
+
+func (plan QueryPlan) IsResult() {}
+
+type PlanStage struct {
+	Name string
+	Took string
+}
+
+// records a stage that began at start
+func (plan *QueryPlan) stage(name string, start time.Time) {
+	plan.Stages = append(plan.Stages, PlanStage{Name: name, Took: time.Since(start).String()})
+}
+
+func (a *Archiver) explain(parsed *querylang.ParsedQuery, parsing time.Duration) (QueryResult, error) {
+	var (
+		plan   = QueryPlan{Query: parsed.Querystring, Stages: []PlanStage{{Name: "parse", Took: parsing.String()}}}
+		params = parsed.GetParams()
+		start  = time.Now()
+		err    error
+	)
+	switch parsed.QueryType {
+	case querylang.CREATE_TYPE, querylang.DROP_TYPE, querylang.LIST_TYPE:
+		return nil, fmt.Errorf("Cannot explain \"%v\": only select, set and delete queries have plans", parsed.Querystring)
+	}
+	if !parsed.AsOf.IsZero() {
+		plan.AsOf = &parsed.AsOf
+	}
+	// the audit log is not kept with the metadata
+	if parsed.QueryType != querylang.AUDIT_TYPE {
+		plan.Filter, plan.MetadataPlan, err = a.mdStore.ExplainWhere(parsed.Where.ToBson(), parsed.AsOf)
+		if err != nil {
+			return nil, err
+		}
+		plan.stage("plan", start)
+	}
+
+	start = time.Now()
+	switch parsed.QueryType {
+	case querylang.SELECT_TYPE, querylang.AUDIT_TYPE, querylang.STALE_TYPE:
+		var res QueryResult
+		res, err = a.evaluateQuery(parsed)
+		plan.stage("metadata", start)
+		switch t := res.(type) {
+		case common.SmapMessageList:
+			plan.Matched = len(t)
+		case common.DistinctResult:
+			plan.Matched = len(t)
+		case common.AuditLog:
+			plan.Matched = len(t)
+		case common.StaleStreams:
+			plan.Matched = len(t)
+		}
+	case querylang.DATA_TYPE:
+		dataParams := params.(*common.DataParams)
+		if err = a.prepareDataParams(dataParams); err != nil {
+			return nil, err
+		}
+		plan.stage("metadata", start)
+		plan.Matched = len(dataParams.UUIDs)
+		plan.Timeseries = timeseriesMethod(parsed.Data.Dtype, dataParams)
+		plan.Begin, plan.End = dataParams.Begin, dataParams.End
+
+		// the streams have been found, so only the timeseries store is timed
+		dataParams.Where, dataParams.AsOf = nil, time.Time{}
+		var res common.SmapMessageList
+		start = time.Now()
+		res, err = a.selectData(parsed.Data.Dtype, dataParams)
+		plan.stage("timeseries", start)
+		for _, msg := range res {
+			plan.Readings += len(msg.Readings)
+		}
+	case querylang.SET_TYPE, querylang.DELETE_TYPE:
+		var summary common.MutationSummary
+		summary, err = a.dryRun(params)
+		plan.stage("dry run", start)
+		plan.Mutation = &summary
+		plan.Matched = len(summary.Matched)
+		if dataParams, ok := params.(*common.DataParams); ok {
+			plan.Timeseries = "DeleteData"
+			plan.Begin, plan.End = dataParams.Begin, dataParams.End
+		}
+	}
+	return plan, err
+}
+
+// the TimeseriesStore method a data query uses
+func timeseriesMethod(dtype querylang.DataQueryType, params *common.DataParams) string {
+	switch {
+	case params.IsStatistical:
+		return "StatisticalData"
+	case params.IsWindow:
+		return "WindowData"
+	case dtype == querylang.BEFORE_TYPE:
+		return "Prev"
+	case dtype == querylang.AFTER_TYPE:
+		return "Next"
+	}
+	return "GetData"
+}
+
+// reports what a set or delete query would change without running it.
+// Streams whose tags already have the values being set, or which have none
+// of the tags being deleted, are matched but not modified
+func (a *Archiver) dryRun(params common.QueryParams) (common.MutationSummary, error) {
+	var (
+		summary = common.MutationSummary{DryRun: true}
+		err     error
+	)
+	switch params := params.(type) {
+	case *common.SetParams:
+		where := params.Where.ToBson()
+		if summary.Matched, err = a.mdStore.GetUUIDs(where); err != nil || len(params.Set) == 0 {
+			return summary, err
+		}
+		var differs []bson.M
+		for key, value := range params.Set.ToBson() {
+			differs = append(differs, bson.M{key: bson.M{"$ne": value}})
+		}
+		summary.Modified, err = a.mdStore.GetUUIDs(bson.M{"$and": []bson.M{where, {"$or": differs}}})
+	case *common.TagParams:
+		where := params.Where.ToBson()
+		if summary.Matched, err = a.mdStore.GetUUIDs(where); err != nil {
+			return summary, err
+		}
+		if len(params.Tags) == 0 {
+			summary.Removed = summary.Matched
+			break
+		}
+		var has []bson.M
+		for _, tag := range params.Tags {
+			has = append(has, bson.M{tag: bson.M{"$exists": true}})
+		}
+		summary.Modified, err = a.mdStore.GetUUIDs(bson.M{"$and": []bson.M{where, {"$or": has}}})
+	case *common.DataParams:
+		err = a.prepareDataParams(params)
+		summary.Matched = params.UUIDs
+	}
+	return summary, err
+}
@@ -0,0 +1,93 @@
+package archiver
+
+import (
+	"github.com/gtfierro/giles2/common"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMutationSummary(t *testing.T) {
+	a, _, md := newFakeArchiver()
+	for _, zone := range []string{"3", "3", "4"} {
+		uuid := common.NewUUID()
+		assert.NoError(t, a.AddData("test", &common.SmapMessage{Path: "/" + string(uuid), UUID: uuid, Metadata: common.Dict{"Zone": zone}}))
+	}
+	s0, _ := md.GetUUIDs(common.Dict{"Metadata.Zone": "3"}.ToBson())
+	md.docs[s0[0]]["Metadata.Floor"] = "2"
+
+	for _, test := range []struct {
+		query    string
+		expected common.MutationSummary
+	}{
+		{`explain set Metadata/Floor = "2" where Metadata/Zone = "3"`, common.MutationSummary{Matched: s0, Modified: s0[1:], DryRun: true}},
+		{`explain delete Metadata/Floor where Metadata/Zone = "3"`, common.MutationSummary{Matched: s0, Modified: s0[:1], DryRun: true}},
+		{`explain delete where Metadata/Zone = "3"`, common.MutationSummary{Matched: s0, Removed: s0, DryRun: true}},
+		{`set Metadata/Floor = "2" where Metadata/Zone = "3"`, common.MutationSummary{Matched: s0, Modified: s0[1:]}},
+		{`delete Metadata/Floor where Metadata/Zone = "3"`, common.MutationSummary{Matched: s0, Modified: s0}},
+		{`delete where Metadata/Zone = "3"`, common.MutationSummary{Matched: s0, Removed: s0}},
+		{`delete where Metadata/Zone = "3"`, common.MutationSummary{}},
+	} {
+		res, err := a.HandleQuery("test", test.query)
+		if plan, ok := res.(QueryPlan); ok {
+			res = *plan.Mutation
+		}
+		if assert.NoError(t, err, test.query) {
+			assert.Equal(t, test.expected, res, test.query)
+		}
+	}
+
+	// dry runs are not audited; queries matching nothing are
+	log, _ := a.HandleQuery("test", `select audit`)
+	assert.Len(t, log, 7)
+}
+
+func TestQueryPlan(t *testing.T) {
+	a, _, _ := newFakeArchiver()
+	uuid := common.NewUUID()
+	msg := &common.SmapMessage{
+		Path:     "/sensor",
+		UUID:     uuid,
+		Metadata: common.Dict{"Zone": "3"},
+		Readings: []common.Reading{&common.SmapNumberReading{Time: 1351043674000, Value: 1}, &common.SmapNumberReading{Time: 1351043675000, Value: 2}},
+	}
+	assert.NoError(t, a.AddData("test", msg))
+
+	for _, test := range []struct {
+		query      string
+		matched    int
+		timeseries string
+		readings   int
+		stages     []string
+	}{
+		{`explain select * where Metadata/Zone = "3"`, 1, "", 0, []string{"parse", "plan", "metadata"}},
+		{`explain select distinct Metadata/Zone`, 1, "", 0, []string{"parse", "plan", "metadata"}},
+		{`explain select data in (1351043674, 1351043676) where Metadata/Zone = "3"`, 1, "GetData", 2, []string{"parse", "plan", "metadata", "timeseries"}},
+		{`explain select data before now where Metadata/Zone = "4"`, 0, "Prev", 0, []string{"parse", "plan", "metadata", "timeseries"}},
+		{`explain delete where Metadata/Zone = "3"`, 1, "", 0, []string{"parse", "plan", "dry run"}},
+		{`explain select audit`, 1, "", 0, []string{"parse", "metadata"}},
+		{`explain select stale where Metadata/Zone = "3" older than 1h`, 0, "", 0, []string{"parse", "plan", "metadata"}},
+	} {
+		res, err := a.HandleQuery("test", test.query)
+		if !assert.NoError(t, err, test.query) {
+			continue
+		}
+		plan := res.(QueryPlan)
+		assert.Equal(t, test.matched, plan.Matched, test.query)
+		assert.Equal(t, test.timeseries, plan.Timeseries, test.query)
+		assert.Equal(t, test.readings, plan.Readings, test.query)
+		var stages []string
+		for _, stage := range plan.Stages {
+			stages = append(stages, stage.Name)
+		}
+		assert.Equal(t, test.stages, stages, test.query)
+		if plan.Filter != nil {
+			assert.Equal(t, "SCAN docs", plan.MetadataPlan, test.query)
+		}
+	}
+
+	// continuous query statements have no plan
+	for _, query := range []string{`explain list queries`, `explain drop query power15`} {
+		_, err := a.HandleQuery("test", query)
+		assert.Error(t, err, query)
+	}
+}
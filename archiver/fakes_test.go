@@ -0,0 +1,645 @@
+package archiver
+
+import (
+	"fmt"
+	"github.com/gtfierro/giles2/archiver/internal/querylang"
+	"github.com/gtfierro/giles2/common"
+	"gopkg.in/mgo.v2/bson"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// in-memory stores for testing the archiver without databases
+type fakeTSStore struct {
+	added   []*common.SmapMessage
+	failFor common.UUID
+}
+
+func (f *fakeTSStore) AddMessage(msg *common.SmapMessage) error {
+	if msg.UUID == f.failFor {
+		return fmt.Errorf("write failed")
+	}
+	f.added = append(f.added, msg)
+	return nil
+}
+func (f *fakeTSStore) Prev(uuids []common.UUID, ref uint64) ([]common.SmapNumbersResponse, error) {
+	var ret []common.SmapNumbersResponse
+	if ref == 0 {
+		return ret, nil
+	}
+	for _, resp := range f.readings(uuids, 0, ref-1) {
+		resp.Readings = resp.Readings[len(resp.Readings)-1:]
+		ret = append(ret, resp)
+	}
+	return ret, nil
+}
+func (f *fakeTSStore) Next(uuids []common.UUID, ref uint64) ([]common.SmapNumbersResponse, error) {
+	var ret []common.SmapNumbersResponse
+	for _, resp := range f.readings(uuids, ref+1, math.MaxUint64) {
+		resp.Readings = resp.Readings[:1]
+		ret = append(ret, resp)
+	}
+	return ret, nil
+}
+func (f *fakeTSStore) GetData(uuids []common.UUID, start, end uint64) ([]common.SmapNumbersResponse, error) {
+	return f.readings(uuids, start, end), nil
+}
+
+// numeric readings of the streams between start and end (in nanoseconds),
+// in the order they were added
+func (f *fakeTSStore) readings(uuids []common.UUID, start, end uint64) []common.SmapNumbersResponse {
+	var ret []common.SmapNumbersResponse
+	for _, uuid := range uuids {
+		resp := common.SmapNumbersResponse{UUID: uuid}
+		for _, msg := range f.added {
+			if msg.UUID != uuid {
+				continue
+			}
+			for _, rdg := range msg.Readings {
+				num, ok := rdg.(*common.SmapNumberReading)
+				if !ok {
+					continue
+				}
+				time, _ := common.ConvertTime(num.Time, common.GuessTimeUnit(num.Time), common.UOT_NS)
+				if time >= start && time <= end {
+					copied := *num
+					resp.Readings = append(resp.Readings, &copied)
+				}
+			}
+		}
+		if len(resp.Readings) > 0 {
+			ret = append(ret, resp)
+		}
+	}
+	return ret
+}
+func (f *fakeTSStore) StatisticalData([]common.UUID, int, uint64, uint64) ([]common.StatisticalNumbersResponse, error) {
+	return nil, nil
+}
+
+// windows of the readings in [start, end), as in btrdb
+func (f *fakeTSStore) WindowData(uuids []common.UUID, width, start, end uint64) ([]common.StatisticalNumbersResponse, error) {
+	var ret []common.StatisticalNumbersResponse
+	for _, resp := range f.readings(uuids, start, end-1) {
+		stats := common.StatisticalNumbersResponse{UUID: resp.UUID}
+		windows := make(map[uint64]*common.StatisticalNumberReading)
+		for _, rdg := range resp.Readings {
+			time, _ := common.ConvertTime(rdg.Time, common.GuessTimeUnit(rdg.Time), common.UOT_NS)
+			begin := start + (time-start)/width*width
+			window, found := windows[begin]
+			if !found {
+				window = &common.StatisticalNumberReading{Time: begin, UoT: common.UOT_NS, Min: rdg.Value, Max: rdg.Value}
+				windows[begin] = window
+				stats.Readings = append(stats.Readings, window)
+			}
+			window.Min = math.Min(window.Min, rdg.Value)
+			window.Max = math.Max(window.Max, rdg.Value)
+			window.Mean = (window.Mean*float64(window.Count) + rdg.Value) / float64(window.Count+1)
+			window.Count++
+		}
+		ret = append(ret, stats)
+	}
+	return ret, nil
+}
+
+// removes the readings in [start, end), as in btrdb
+func (f *fakeTSStore) DeleteData(uuids []common.UUID, start, end uint64) error {
+	for _, uuid := range uuids {
+		for _, msg := range f.added {
+			if msg.UUID != uuid {
+				continue
+			}
+			kept := msg.Readings[:0]
+			for _, rdg := range msg.Readings {
+				time, _ := common.ConvertTime(rdg.GetTime(), common.GuessTimeUnit(rdg.GetTime()), common.UOT_NS)
+				if time < start || time >= end {
+					kept = append(kept, rdg)
+				}
+			}
+			msg.Readings = kept
+		}
+	}
+	return nil
+}
+func (f *fakeTSStore) ValidTimestamp(time uint64, uot common.UnitOfTime) bool {
+	return time > 0
+}
+
+type fakeMDStore struct {
+	saved []*common.SmapMessage
+	// by source, then Path
+	collections map[string]map[string]*common.SmapMessage
+	// flattened document of each stream, the keys set explicitly on it and
+	// its source
+	docs     map[common.UUID]bson.M
+	explicit map[common.UUID]map[string]bool
+	sources  map[common.UUID]string
+	// how many times the streams under a Path were looked up
+	pathScans int
+	// versions of the documents, oldest first
+	history []fakeVersion
+	audit   common.AuditLog
+	queries map[string]common.ContinuousQuery
+	rules   map[string]common.AlertRule
+	hooks   map[string]common.Webhook
+	reports map[string]common.ReportRegistration
+	subs    map[string]common.DurableSubscription
+	// guards hooks, as webhooks save their sequence while they deliver
+	hooksLock sync.Mutex
+}
+
+func (f *fakeMDStore) GetUnitOfTime(common.UUID) (common.UnitOfTime, error) {
+	return common.UOT_MS, nil
+}
+func (f *fakeMDStore) GetStreamType(common.UUID) (common.StreamType, error) {
+	return common.NUMERIC_STREAM, nil
+}
+func (f *fakeMDStore) GetUnitOfMeasure(common.UUID) (string, error) { return "W", nil }
+
+// returns every saved document. The only where clause understood is a
+// regular expression on Path with an optional _source, which matches against
+// the stream documents
+func (f *fakeMDStore) GetTags(tags []string, where bson.M) (common.SmapMessageList, error) {
+	var ret common.SmapMessageList
+	if path, ok := where["Path"].(bson.M); ok {
+		re := regexp.MustCompile(path["$regex"].(string))
+		source, scoped := where["_source"]
+		f.pathScans++
+		for uuid, doc := range f.docs {
+			if re.MatchString(doc["Path"].(string)) && (!scoped || f.sources[uuid] == source) {
+				ret = append(ret, &common.SmapMessage{UUID: uuid, Path: doc["Path"].(string)})
+			}
+		}
+		return ret, nil
+	}
+	for _, msg := range f.saved {
+		if msg.HasMetadata() {
+			ret = append(ret, &common.SmapMessage{UUID: msg.UUID, Path: msg.Path, Metadata: msg.Metadata, Properties: msg.Properties})
+		}
+	}
+	return ret, nil
+}
+func (f *fakeMDStore) CountPaths(prefix string) ([]PathNode, error) {
+	var (
+		ret      []PathNode
+		children = make(map[string]int)
+		re       = regexp.MustCompile(querylang.PathPrefixPattern(prefix))
+	)
+	for uuid, doc := range f.docs {
+		path := doc["Path"].(string)
+		if !re.MatchString(path) {
+			continue
+		}
+		rest := strings.TrimPrefix(path[len(strings.TrimSuffix(prefix, "/")):], "/")
+		name := strings.SplitN(rest, "/", 2)[0]
+		i, found := children[name]
+		if !found {
+			i = len(ret)
+			children[name] = i
+			ret = append(ret, PathNode{Name: name})
+		}
+		ret[i].Streams++
+		if name == rest {
+			ret[i].UUID = uuid
+		}
+	}
+	return ret, nil
+}
+func (f *fakeMDStore) GetDistinct(tag string, where bson.M) (common.DistinctResult, error) {
+	var ret common.DistinctResult
+	seen := make(map[string]bool)
+	for _, doc := range f.docs {
+		if value, found := doc[tag]; found && matches(doc, where) && !seen[fmt.Sprint(value)] {
+			seen[fmt.Sprint(value)] = true
+			ret = append(ret, fmt.Sprint(value))
+		}
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+func (f *fakeMDStore) GetUUIDs(where bson.M) ([]common.UUID, error) {
+	var ret []common.UUID
+	for uuid, doc := range f.docs {
+		if matches(doc, where) {
+			ret = append(ret, uuid)
+		}
+	}
+	sort.Sort(uuids(ret))
+	return ret, nil
+}
+
+// a copy of a stream's document from a time on; doc is nil once removed
+type fakeVersion struct {
+	uuid common.UUID
+	from time.Time
+	doc  bson.M
+}
+
+func (f *fakeMDStore) version(uuid common.UUID) {
+	var doc bson.M
+	if f.docs[uuid] != nil {
+		doc = make(bson.M, len(f.docs[uuid]))
+		for k, v := range f.docs[uuid] {
+			doc[k] = v
+		}
+	}
+	f.history = append(f.history, fakeVersion{uuid: uuid, from: time.Now(), doc: doc})
+}
+
+// the documents as they were at the time, by stream
+func (f *fakeMDStore) docsAsOf(at time.Time) map[common.UUID]bson.M {
+	docs := make(map[common.UUID]bson.M)
+	for _, version := range f.history {
+		if !version.from.After(at) {
+			docs[version.uuid] = version.doc
+		}
+	}
+	return docs
+}
+func (f *fakeMDStore) GetTagsAsOf(tags []string, where bson.M, at time.Time) (common.SmapMessageList, error) {
+	var ret common.SmapMessageList
+	for uuid, doc := range f.docsAsOf(at) {
+		if doc == nil || !matches(doc, where) {
+			continue
+		}
+		msg := &common.SmapMessage{UUID: uuid, Metadata: common.Dict{}}
+		for k, v := range doc {
+			if strings.HasPrefix(k, "Metadata.") {
+				msg.Metadata[strings.TrimPrefix(k, "Metadata.")] = v
+			}
+		}
+		ret = append(ret, msg)
+	}
+	return ret, nil
+}
+func (f *fakeMDStore) GetDistinctAsOf(string, bson.M, time.Time) (common.DistinctResult, error) {
+	return nil, nil
+}
+func (f *fakeMDStore) GetUUIDsAsOf(where bson.M, at time.Time) ([]common.UUID, error) {
+	var ret []common.UUID
+	for uuid, doc := range f.docsAsOf(at) {
+		if doc != nil && matches(doc, where) {
+			ret = append(ret, uuid)
+		}
+	}
+	sort.Sort(uuids(ret))
+	return ret, nil
+}
+func (f *fakeMDStore) ExplainWhere(where bson.M, at time.Time) (bson.M, string, error) {
+	return where, "SCAN docs", nil
+}
+func (f *fakeMDStore) SaveTags(msg *common.SmapMessage) ([]string, error) {
+	f.saved = append(f.saved, msg)
+	if f.docs[msg.UUID] == nil {
+		f.docs[msg.UUID] = bson.M{}
+		f.explicit[msg.UUID] = make(map[string]bool)
+	}
+	var changed []string
+	for k, v := range msg.ToBson() {
+		if old, found := f.docs[msg.UUID][k]; !found || !reflect.DeepEqual(old, v) {
+			changed = append(changed, k)
+		}
+		f.docs[msg.UUID][k] = v
+		f.explicit[msg.UUID][k] = true
+	}
+	if len(changed) > 0 {
+		f.version(msg.UUID)
+	}
+	return changed, nil
+}
+func (f *fakeMDStore) SaveFormula(uuid common.UUID, formula *common.Formula) error {
+	if f.docs[uuid] == nil {
+		return fmt.Errorf("no stream %v", uuid)
+	}
+	f.docs[uuid]["Formula"] = formula
+	return nil
+}
+func (f *fakeMDStore) GetFormulas() (map[common.UUID]*common.Formula, error) {
+	formulas := make(map[common.UUID]*common.Formula)
+	for uuid, doc := range f.docs {
+		if formula, ok := doc["Formula"].(*common.Formula); ok {
+			formulas[uuid] = formula
+		}
+	}
+	return formulas, nil
+}
+func (f *fakeMDStore) SaveContinuousQuery(cq *common.ContinuousQuery) error {
+	if f.queries == nil {
+		f.queries = make(map[string]common.ContinuousQuery)
+	}
+	f.queries[cq.Name] = *cq
+	return nil
+}
+func (f *fakeMDStore) GetContinuousQueries() (common.ContinuousQueries, error) {
+	var ret common.ContinuousQueries
+	for _, cq := range f.queries {
+		ret = append(ret, cq)
+	}
+	return ret, nil
+}
+func (f *fakeMDStore) RemoveContinuousQuery(name string) error {
+	if _, found := f.queries[name]; !found {
+		return fmt.Errorf("not found")
+	}
+	delete(f.queries, name)
+	return nil
+}
+func (f *fakeMDStore) SaveAlertRule(rule *common.AlertRule) error {
+	if f.rules == nil {
+		f.rules = make(map[string]common.AlertRule)
+	}
+	f.rules[rule.Name] = *rule
+	return nil
+}
+func (f *fakeMDStore) GetAlertRules() ([]common.AlertRule, error) {
+	var ret []common.AlertRule
+	for _, rule := range f.rules {
+		ret = append(ret, rule)
+	}
+	return ret, nil
+}
+func (f *fakeMDStore) RemoveAlertRule(name string) error {
+	if _, found := f.rules[name]; !found {
+		return fmt.Errorf("not found")
+	}
+	delete(f.rules, name)
+	return nil
+}
+func (f *fakeMDStore) SaveWebhook(hook *common.Webhook) error {
+	f.hooksLock.Lock()
+	defer f.hooksLock.Unlock()
+	if f.hooks == nil {
+		f.hooks = make(map[string]common.Webhook)
+	}
+	f.hooks[hook.ID] = *hook
+	return nil
+}
+func (f *fakeMDStore) GetWebhooks() ([]common.Webhook, error) {
+	f.hooksLock.Lock()
+	defer f.hooksLock.Unlock()
+	var ret []common.Webhook
+	for _, hook := range f.hooks {
+		ret = append(ret, hook)
+	}
+	return ret, nil
+}
+func (f *fakeMDStore) RemoveWebhook(id string) error {
+	f.hooksLock.Lock()
+	defer f.hooksLock.Unlock()
+	if _, found := f.hooks[id]; !found {
+		return fmt.Errorf("not found")
+	}
+	delete(f.hooks, id)
+	return nil
+}
+func (f *fakeMDStore) SaveWebhookSequence(id string, sequence uint64) error {
+	f.hooksLock.Lock()
+	defer f.hooksLock.Unlock()
+	if hook, found := f.hooks[id]; found {
+		hook.Sequence = sequence
+		f.hooks[id] = hook
+	}
+	return nil
+}
+func (f *fakeMDStore) SaveReport(report *common.ReportRegistration) error {
+	if f.reports == nil {
+		f.reports = make(map[string]common.ReportRegistration)
+	}
+	f.reports[report.ID] = *report
+	return nil
+}
+func (f *fakeMDStore) GetReports() ([]common.ReportRegistration, error) {
+	var ret []common.ReportRegistration
+	for _, report := range f.reports {
+		ret = append(ret, report)
+	}
+	return ret, nil
+}
+func (f *fakeMDStore) RemoveReport(id string) error {
+	if _, found := f.reports[id]; !found {
+		return fmt.Errorf("not found")
+	}
+	delete(f.reports, id)
+	return nil
+}
+func (f *fakeMDStore) SaveSubscription(sub *common.DurableSubscription) error {
+	if f.subs == nil {
+		f.subs = make(map[string]common.DurableSubscription)
+	}
+	f.subs[sub.ID] = *sub
+	return nil
+}
+func (f *fakeMDStore) GetSubscriptions() ([]common.DurableSubscription, error) {
+	var ret []common.DurableSubscription
+	for _, sub := range f.subs {
+		ret = append(ret, sub)
+	}
+	return ret, nil
+}
+func (f *fakeMDStore) RemoveSubscription(id string) error {
+	if _, found := f.subs[id]; !found {
+		return fmt.Errorf("not found")
+	}
+	delete(f.subs, id)
+	return nil
+}
+
+// like an upsert, merges with the collection saved before
+func (f *fakeMDStore) SaveCollection(source string, msg *common.SmapMessage) (bool, error) {
+	if f.collections[source] == nil {
+		f.collections[source] = make(map[string]*common.SmapMessage)
+	}
+	saved, found := f.collections[source][msg.Path]
+	if !found {
+		saved = &common.SmapMessage{Path: msg.Path, Metadata: common.Dict{}, Properties: &common.SmapProperties{}}
+		f.collections[source][msg.Path] = saved
+	}
+	changed := !found
+	for k, v := range msg.Metadata {
+		changed = changed || saved.Metadata[k] != v
+		saved.Metadata[k] = v
+	}
+	if msg.Properties != nil && msg.Properties.UnitOfMeasure != "" {
+		changed = changed || saved.Properties.UnitOfMeasure != msg.Properties.UnitOfMeasure
+		saved.Properties.UnitOfMeasure = msg.Properties.UnitOfMeasure
+	}
+	if msg.Properties != nil && msg.Properties.Timezone != "" {
+		changed = changed || saved.Properties.Timezone != msg.Properties.Timezone
+		saved.Properties.Timezone = msg.Properties.Timezone
+	}
+	return changed, nil
+}
+func (f *fakeMDStore) GetCollections(source string, paths []string) (common.SmapMessageList, error) {
+	var ret common.SmapMessageList
+	for _, path := range paths {
+		if collection, found := f.collections[source][path]; found {
+			ret = append(ret, collection)
+		}
+	}
+	return ret, nil
+}
+func (f *fakeMDStore) SaveInherited(uuid common.UUID, source string, inherited *common.SmapMessage) ([]string, error) {
+	var changed []string
+	if f.docs[uuid] != nil {
+		f.sources[uuid] = source
+	}
+	for k, v := range inherited.ToBson() {
+		if doc := f.docs[uuid]; doc != nil && !f.explicit[uuid][k] {
+			if old, found := doc[k]; !found || !reflect.DeepEqual(old, v) {
+				changed = append(changed, k)
+			}
+			doc[k] = v
+		}
+	}
+	if len(changed) > 0 {
+		f.version(uuid)
+	}
+	return changed, nil
+}
+func (f *fakeMDStore) UpdateDocs(updates, where bson.M) (summary common.MutationSummary, err error) {
+	summary.Matched, _ = f.GetUUIDs(where)
+	for _, uuid := range summary.Matched {
+		changed := false
+		for k, v := range updates {
+			changed = changed || !reflect.DeepEqual(f.docs[uuid][k], v)
+			f.docs[uuid][k] = v
+			f.explicit[uuid][k] = true
+		}
+		if changed {
+			f.version(uuid)
+			summary.Modified = append(summary.Modified, uuid)
+		}
+	}
+	return
+}
+func (f *fakeMDStore) RemoveTags(tags []string, where bson.M) (summary common.MutationSummary, err error) {
+	summary.Matched, _ = f.GetUUIDs(where)
+	for _, uuid := range summary.Matched {
+		changed := false
+		for _, tag := range tags {
+			_, found := f.docs[uuid][tag]
+			changed = changed || found
+			delete(f.docs[uuid], tag)
+		}
+		if changed {
+			f.version(uuid)
+			summary.Modified = append(summary.Modified, uuid)
+		}
+	}
+	return
+}
+func (f *fakeMDStore) RemoveDocs(where bson.M) (summary common.MutationSummary, err error) {
+	summary.Matched, _ = f.GetUUIDs(where)
+	for _, uuid := range summary.Matched {
+		delete(f.docs, uuid)
+		f.version(uuid)
+	}
+	summary.Removed = summary.Matched
+	return
+}
+func (f *fakeMDStore) SaveAudit(entry *common.AuditEntry) error {
+	f.audit = append(f.audit, *entry)
+	return nil
+}
+func (f *fakeMDStore) GetAudit(bson.M) (common.AuditLog, error) { return f.audit, nil }
+
+// evaluates the parts of where clauses we use in tests against the flattened
+// documents of the fakeMDStore
+func matches(doc bson.M, where bson.M) bool {
+	for key, cond := range where {
+		switch key {
+		case "$and":
+			for _, clause := range clauses(cond) {
+				if !matches(doc, clause) {
+					return false
+				}
+			}
+		case "$or":
+			any := false
+			for _, clause := range clauses(cond) {
+				any = any || matches(doc, clause)
+			}
+			if !any {
+				return false
+			}
+		default:
+			value, found := doc[key]
+			// stored by mongo as strings
+			if uuid, ok := value.(common.UUID); ok {
+				value = string(uuid)
+			}
+			ops, isOps := asBson(cond)
+			if !isOps {
+				if !found || !reflect.DeepEqual(value, cond) {
+					return false
+				}
+				continue
+			}
+			for op, arg := range ops {
+				switch op {
+				case "$ne":
+					if found && reflect.DeepEqual(value, arg) {
+						return false
+					}
+				case "$exists":
+					if found != arg.(bool) {
+						return false
+					}
+				case "$regex":
+					if s, ok := value.(string); !ok || !regexp.MustCompile(arg.(string)).MatchString(s) {
+						return false
+					}
+				}
+			}
+		}
+	}
+	return true
+}
+
+func asBson(v interface{}) (bson.M, bool) {
+	switch t := v.(type) {
+	case bson.M:
+		return t, true
+	case common.Dict:
+		return t.ToBson(), true
+	}
+	return nil, false
+}
+
+func clauses(v interface{}) []bson.M {
+	var ret []bson.M
+	switch t := v.(type) {
+	case []bson.M:
+		ret = t
+	case []common.Dict:
+		for _, d := range t {
+			ret = append(ret, d.ToBson())
+		}
+	}
+	return ret
+}
+
+type uuids []common.UUID
+
+func (u uuids) Len() int           { return len(u) }
+func (u uuids) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
+func (u uuids) Less(i, j int) bool { return u[i] < u[j] }
+
+func newFakeArchiver() (*Archiver, *fakeTSStore, *fakeMDStore) {
+	ts := &fakeTSStore{}
+	md := &fakeMDStore{
+		collections: make(map[string]map[string]*common.SmapMessage),
+		docs:        make(map[common.UUID]bson.M),
+		explicit:    make(map[common.UUID]map[string]bool),
+		sources:     make(map[common.UUID]string),
+	}
+	a := &Archiver{tsStore: ts, mdStore: md, qp: querylang.NewQueryProcessor(), metrics: make(metricMap)}
+	a.metrics.addMetric("adds")
+	a.broker = NewBroker(a)
+	return a, ts, md
+}
@@ -0,0 +1,151 @@
+package archiver
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"unicode"
+)
+
+// formulaNode is a parsed arithmetic expression of a virtual stream
+type formulaNode interface {
+	eval(vars map[string]float64) float64
+}
+
+type numberNode float64
+
+func (n numberNode) eval(map[string]float64) float64 { return float64(n) }
+
+type varNode string
+
+func (n varNode) eval(vars map[string]float64) float64 { return vars[string(n)] }
+
+type negNode struct {
+	operand formulaNode
+}
+
+func (n negNode) eval(vars map[string]float64) float64 { return -n.operand.eval(vars) }
+
+type binaryNode struct {
+	op          rune
+	left, right formulaNode
+}
+
+func (n binaryNode) eval(vars map[string]float64) float64 {
+	left, right := n.left.eval(vars), n.right.eval(vars)
+	switch n.op {
+	case '+':
+		return left + right
+	case '-':
+		return left - right
+	case '*':
+		return left * right
+	}
+	// the reading is dropped (see virtualStream.value)
+	if right == 0 {
+		return math.NaN()
+	}
+	return left / right
+}
+
+// parses an expression of numbers and names joined by + - * / and
+// parentheses. Returns the names it uses
+func parseFormula(expression string) (formulaNode, []string, error) {
+	p := &formulaParser{input: []rune(expression), names: make(map[string]bool)}
+	node, err := p.expr()
+	if err == nil && p.peek() != 0 {
+		err = fmt.Errorf("Unexpected %q at %v in formula \"%v\"", p.peek(), p.pos, expression)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var names []string
+	for name := range p.names {
+		names = append(names, name)
+	}
+	return node, names, nil
+}
+
+type formulaParser struct {
+	input []rune
+	pos   int
+	names map[string]bool
+}
+
+// returns the next rune that is not a space, or 0 at the end
+func (p *formulaParser) peek() rune {
+	for p.pos < len(p.input) && unicode.IsSpace(p.input[p.pos]) {
+		p.pos++
+	}
+	if p.pos == len(p.input) {
+		return 0
+	}
+	return p.input[p.pos]
+}
+
+// expr := term {(+|-) term}
+func (p *formulaParser) expr() (formulaNode, error) {
+	left, err := p.term()
+	for err == nil && (p.peek() == '+' || p.peek() == '-') {
+		op := p.input[p.pos]
+		p.pos++
+		var right formulaNode
+		if right, err = p.term(); err == nil {
+			left = binaryNode{op, left, right}
+		}
+	}
+	return left, err
+}
+
+// term := factor {(*|/) factor}
+func (p *formulaParser) term() (formulaNode, error) {
+	left, err := p.factor()
+	for err == nil && (p.peek() == '*' || p.peek() == '/') {
+		op := p.input[p.pos]
+		p.pos++
+		var right formulaNode
+		if right, err = p.factor(); err == nil {
+			left = binaryNode{op, left, right}
+		}
+	}
+	return left, err
+}
+
+// factor := number | name | -factor | (expr)
+func (p *formulaParser) factor() (formulaNode, error) {
+	next := p.peek()
+	start := p.pos
+	switch {
+	case next == '-':
+		p.pos++
+		operand, err := p.factor()
+		return negNode{operand}, err
+	case next == '(':
+		p.pos++
+		node, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("Missing ) at %v in formula \"%v\"", p.pos, string(p.input))
+		}
+		p.pos++
+		return node, nil
+	case unicode.IsDigit(next) || next == '.':
+		for p.pos < len(p.input) && (unicode.IsDigit(p.input[p.pos]) || p.input[p.pos] == '.') {
+			p.pos++
+		}
+		num, err := strconv.ParseFloat(string(p.input[start:p.pos]), 64)
+		return numberNode(num), err
+	case unicode.IsLetter(next) || next == '_':
+		for p.pos < len(p.input) && (unicode.IsLetter(p.input[p.pos]) || unicode.IsDigit(p.input[p.pos]) || p.input[p.pos] == '_') {
+			p.pos++
+		}
+		name := string(p.input[start:p.pos])
+		p.names[name] = true
+		return varNode(name), nil
+	case next == 0:
+		return nil, fmt.Errorf("Unexpected end of formula \"%v\"", string(p.input))
+	}
+	return nil, fmt.Errorf("Unexpected %q at %v in formula \"%v\"", next, p.pos, string(p.input))
+}
@@ -0,0 +1,40 @@
+package archiver
+
+import (
+	"fmt"
+	"github.com/gtfierro/giles2/common"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestSelectAsOf(t *testing.T) {
+	a, _, _ := newFakeArchiver()
+	assert.NoError(t, a.AddData("test", &common.SmapMessage{Path: "/s0", UUID: "s0", Metadata: common.Dict{"Zone": "3"}, Readings: reading(1351043674000)}))
+	time.Sleep(10 * time.Millisecond)
+	before := fmt.Sprintf(" as of %dms", time.Now().UnixNano()/1e6)
+	time.Sleep(10 * time.Millisecond)
+	_, err := a.HandleQuery("test", `set Metadata/Zone = "4" where uuid = "s0"`)
+	assert.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	after := fmt.Sprintf(" as of %dms", time.Now().UnixNano()/1e6)
+	time.Sleep(10 * time.Millisecond)
+	_, err = a.HandleQuery("test", `delete where uuid = "s0"`)
+	assert.NoError(t, err)
+
+	for _, test := range []struct {
+		query  string
+		result common.SmapMessageList
+	}{
+		{`select uuid where Metadata/Zone = "3"` + before, common.SmapMessageList{{UUID: "s0", Metadata: common.Dict{"Zone": "3"}}}},
+		{`select uuid where Metadata/Zone = "4"` + before, nil},
+		{`select uuid where Metadata/Zone = "3"` + after, nil},
+		// removed streams keep their history
+		{`select Metadata/Zone where uuid = "s0"` + after, common.SmapMessageList{{UUID: "s0", Metadata: common.Dict{"Zone": "4"}}}},
+	} {
+		res, err := a.HandleQuery("test", test.query)
+		if assert.NoError(t, err, test.query) {
+			assert.Equal(t, test.result, res, test.query)
+		}
+	}
+}
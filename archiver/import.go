@@ -0,0 +1,155 @@
+package archiver
+
+import (
+	"fmt"
+	"github.com/gtfierro/giles2/common"
+)
+
+// how many readings an Importer buffers before writing them out
+const DefaultImportBatchSize = 5000
+
+// we stop recording individual row errors after this many so a badly
+// formatted file doesn't produce an enormous report
+const maxImportErrors = 1000
+
+// A single reading to backfill. Metadata is optional and is saved along with
+// the stream's readings
+type ImportRow struct {
+	UUID     common.UUID
+	Time     uint64
+	Value    interface{}
+	Metadata common.Dict
+}
+
+type ImportError struct {
+	// 1-based row (or line) of the input
+	Row   int    `json:"row"`
+	Error string `json:"error"`
+}
+
+// ImportSummary reports the outcome of an import
+type ImportSummary struct {
+	Rows     int           `json:"rows"`
+	Imported int           `json:"imported"`
+	Failed   int           `json:"failed"`
+	Errors   []ImportError `json:"errors,omitempty"`
+	// set if the import stopped early, e.g. because the input could not be read
+	Error string `json:"error,omitempty"`
+}
+
+type importBatch struct {
+	msg  *common.SmapMessage
+	rows []int
+}
+
+// An Importer validates and batches readings for historical backfill. Rows are
+// grouped by stream and written to the timeseries store once BatchSize
+// readings are buffered. Imported readings are not delivered to subscribers.
+// An Importer is not safe for concurrent use.
+type Importer struct {
+	a         *Archiver
+	caller    string
+	BatchSize int
+	pending   map[common.UUID]*importBatch
+	buffered  int
+	summary   ImportSummary
+}
+
+// NewImporter returns an Importer whose changes to metadata are recorded in the
+// audit log as made by caller, or by "import" if empty
+func (a *Archiver) NewImporter(caller string) *Importer {
+	if caller == "" {
+		caller = importCaller
+	}
+	return &Importer{
+		a:         a,
+		caller:    caller,
+		BatchSize: DefaultImportBatchSize,
+		pending:   make(map[common.UUID]*importBatch),
+	}
+}
+
+// Error records a row the caller could not parse
+func (imp *Importer) Error(row int, err error) {
+	imp.summary.Rows++
+	imp.fail(row, err)
+}
+
+func (imp *Importer) fail(row int, err error) {
+	imp.summary.Failed++
+	if len(imp.summary.Errors) < maxImportErrors {
+		imp.summary.Errors = append(imp.summary.Errors, ImportError{Row: row, Error: err.Error()})
+	}
+}
+
+// Add validates the row and buffers it, writing out the buffered readings
+// once there are enough of them
+func (imp *Importer) Add(row int, r ImportRow) {
+	imp.summary.Rows++
+	if r.UUID == "" {
+		imp.fail(row, fmt.Errorf("Missing uuid"))
+		return
+	}
+	uot := common.GuessTimeUnit(r.Time)
+	if !imp.a.tsStore.ValidTimestamp(r.Time, uot) {
+		imp.fail(row, fmt.Errorf("Invalid timestamp %v", r.Time))
+		return
+	}
+	var reading common.Reading
+	switch value := r.Value.(type) {
+	case float64:
+		reading = &common.SmapNumberReading{Time: r.Time, UoT: uot, Value: value}
+	case nil:
+		imp.fail(row, fmt.Errorf("Missing value"))
+		return
+	default:
+		reading = &common.SmapObjectReading{Time: r.Time, UoT: uot, Value: value}
+	}
+
+	batch, found := imp.pending[r.UUID]
+	if !found {
+		batch = &importBatch{msg: &common.SmapMessage{UUID: r.UUID}}
+		imp.pending[r.UUID] = batch
+	}
+	if len(r.Metadata) > 0 {
+		if batch.msg.Metadata == nil {
+			batch.msg.Metadata = make(common.Dict)
+		}
+		for k, v := range r.Metadata {
+			batch.msg.Metadata[k] = v
+		}
+	}
+	batch.msg.Readings = append(batch.msg.Readings, reading)
+	batch.rows = append(batch.rows, row)
+	imp.buffered++
+	if imp.buffered >= imp.BatchSize {
+		imp.Flush()
+	}
+}
+
+// Flush writes all buffered readings. Rows of a stream that cannot be
+// written are reported as errors
+func (imp *Importer) Flush() {
+	for uuid, batch := range imp.pending {
+		err := imp.a.prepareMessage(imp.caller, batch.msg)
+		if err == nil {
+			err = imp.a.tsStore.AddMessage(batch.msg)
+		}
+		if err != nil {
+			for _, row := range batch.rows {
+				imp.fail(row, err)
+			}
+		} else {
+			imp.summary.Imported += len(batch.rows)
+			imp.a.metrics["adds"].Mark(uint64(len(batch.rows)))
+		}
+		delete(imp.pending, uuid)
+	}
+	imp.buffered = 0
+}
+
+// Finish flushes any remaining readings and returns the summary of the import
+func (imp *Importer) Finish() ImportSummary {
+	imp.Flush()
+	return imp.summary
+}
@@ -0,0 +1,41 @@
+package archiver
+
+import (
+	"fmt"
+	"github.com/gtfierro/giles2/common"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestImporter(t *testing.T) {
+	a, ts, md := newFakeArchiver()
+	ts.failFor = "broken"
+	imp := a.NewImporter("")
+	imp.BatchSize = 2
+
+	imp.Add(1, ImportRow{UUID: "aaaa", Time: 1351043674000, Value: 1.0, Metadata: common.Dict{"Site": "A"}})
+	imp.Add(2, ImportRow{UUID: "aaaa", Time: 1351043675000, Value: "on"})
+	imp.Add(3, ImportRow{UUID: "", Time: 1351043676000, Value: 1.0})
+	imp.Add(4, ImportRow{UUID: "bbbb", Time: 0, Value: 1.0})
+	imp.Add(5, ImportRow{UUID: "bbbb", Time: 1351043676000})
+	imp.Add(6, ImportRow{UUID: "broken", Time: 1351043676000, Value: 2.0})
+	imp.Error(7, fmt.Errorf("bad row"))
+	summary := imp.Finish()
+
+	assert.Equal(t, 7, summary.Rows)
+	assert.Equal(t, 2, summary.Imported)
+	assert.Equal(t, 5, summary.Failed)
+	failed := make(map[int]bool)
+	for _, e := range summary.Errors {
+		failed[e.Row] = true
+	}
+	assert.Equal(t, map[int]bool{3: true, 4: true, 5: true, 6: true, 7: true}, failed)
+
+	// both readings for aaaa are written in a single batch with its metadata
+	if assert.Len(t, ts.added, 1) {
+		assert.Equal(t, common.UUID("aaaa"), ts.added[0].UUID)
+		assert.Len(t, ts.added[0].Readings, 2)
+		assert.True(t, ts.added[0].Readings[1].IsObject())
+	}
+	assert.Equal(t, "A", md.saved[0].Metadata["Site"])
+}
@@ -0,0 +1,109 @@
+package querylang
+
+import (
+	"container/list"
+	"github.com/gtfierro/giles2/common"
+	"sync"
+)
+
+// number of parsed queries a QueryProcessor keeps
+const queryCacheSize = 1024
+
+// queryCache is a least-recently-used cache of parsed queries keyed by their
+// query string
+type queryCache struct {
+	size    int
+	entries map[string]*list.Element
+	// most recently used at the front
+	order *list.List
+	sync.Mutex
+}
+
+type cachedQuery struct {
+	querystring string
+	parsed      *ParsedQuery
+}
+
+func newQueryCache(size int) *queryCache {
+	return &queryCache{
+		size:    size,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// returns a deep copy of the cached query so callers cannot change the cached
+// one
+func (c *queryCache) get(querystring string) (*ParsedQuery, bool) {
+	c.Lock()
+	defer c.Unlock()
+	elem, found := c.entries[querystring]
+	if !found {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return copyQuery(elem.Value.(*cachedQuery).parsed), true
+}
+
+func (c *queryCache) put(querystring string, parsed *ParsedQuery) {
+	c.Lock()
+	defer c.Unlock()
+	if elem, found := c.entries[querystring]; found {
+		c.order.MoveToFront(elem)
+		elem.Value.(*cachedQuery).parsed = parsed
+		return
+	}
+	c.entries[querystring] = c.order.PushFront(&cachedQuery{querystring, parsed})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedQuery).querystring)
+	}
+}
+
+// copies the query along with its clauses, target, keys and data query
+func copyQuery(parsed *ParsedQuery) *ParsedQuery {
+	c := *parsed
+	c.Keys = append([]string(nil), parsed.Keys...)
+	c.Target = append([]string(nil), parsed.Target...)
+	c.Where = copyDict(parsed.Where)
+	c.Set = copyDict(parsed.Set)
+	if parsed.Data != nil {
+		data := *parsed.Data
+		c.Data = &data
+	}
+	return &c
+}
+
+func copyDict(d common.Dict) common.Dict {
+	if d == nil {
+		return nil
+	}
+	c := make(common.Dict, len(d))
+	for k, v := range d {
+		c[k] = copyValue(v)
+	}
+	return c
+}
+
+func copyValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case common.Dict:
+		return copyDict(t)
+	case []common.Dict:
+		dicts := make([]common.Dict, len(t))
+		for i, d := range t {
+			dicts[i] = copyDict(d)
+		}
+		return dicts
+	case []interface{}:
+		values := make([]interface{}, len(t))
+		for i, value := range t {
+			values[i] = copyValue(value)
+		}
+		return values
+	case []string:
+		return append([]string(nil), t...)
+	}
+	return v
+}
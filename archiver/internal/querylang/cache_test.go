@@ -0,0 +1,49 @@
+package querylang
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQueryCache(t *testing.T) {
+	qp := NewQueryProcessor()
+	first := qp.Parse(`select * where Metadata/Zone = "3"`)
+	second := qp.Parse(`select * where Metadata/Zone = "3";`)
+	if first == second {
+		t.Error("cached queries should be copied")
+	}
+	if first.Hash != second.Hash || len(qp.cache.entries) != 1 {
+		t.Error("queries with and without ; should share a cache entry")
+	}
+	// changing a copy leaves the cached query alone
+	second.Where["Metadata.Zone"] = "4"
+	second.Keys[0] = "uuid"
+	if third := qp.Parse(`select * where Metadata/Zone = "3"`); third.Where["Metadata.Zone"] != "3" || third.Keys[0] != first.Keys[0] {
+		t.Error("cached query should not change with its copies, not ", third.Where, third.Keys)
+	}
+
+	// "now" is worked out again on every parse
+	before := qp.Parse(`select data before now where Metadata/Zone = "3"`)
+	time.Sleep(time.Millisecond)
+	after := qp.Parse(`select data before now where Metadata/Zone = "3"`)
+	if !after.Data.Start.After(before.Data.Start) {
+		t.Error("now should be later on the second parse, not ", after.Data.Start)
+	}
+	if len(qp.cache.entries) != 1 {
+		t.Error("queries with now should not be cached")
+	}
+
+	cache := newQueryCache(2)
+	cache.put("a", &ParsedQuery{Querystring: "a"})
+	cache.put("b", &ParsedQuery{Querystring: "b"})
+	cache.get("a")
+	cache.put("c", &ParsedQuery{Querystring: "c"})
+	if _, found := cache.get("b"); found {
+		t.Error("least recently used query should be evicted")
+	}
+	for _, querystring := range []string{"a", "c"} {
+		if pq, found := cache.get(querystring); !found || pq.Querystring != querystring {
+			t.Error(querystring, " should be cached")
+		}
+	}
+}
@@ -4,20 +4,26 @@ package querylang
 import (
 	"github.com/gtfierro/giles2/common"
 	"strings"
+	"time"
 )
 
 type QueryProcessor struct {
+	cache *queryCache
 }
 
-// TODO: add caching?
 func NewQueryProcessor() *QueryProcessor {
-	return &QueryProcessor{}
+	return &QueryProcessor{cache: newQueryCache(queryCacheSize)}
 }
 
+// Parse returns the parsed form of the query string. Queries are cached
+// unless they refer to "now", whose times must be worked out on every parse
 func (qp *QueryProcessor) Parse(querystring string) *ParsedQuery {
 	if !strings.HasSuffix(querystring, ";") {
 		querystring = querystring + ";"
 	}
+	if pq, found := qp.cache.get(querystring); found {
+		return pq
+	}
 	l := NewSQLex(querystring)
 	sqParse(l)
 	pq := ParsedQuery{
@@ -27,7 +33,11 @@ func (qp *QueryProcessor) Parse(querystring string) *ParsedQuery {
 		Where:     l.query.where,
 		Set:       l.query.set,
 		Distinct:  l.query.distinct,
+		AsOf:      l.query.asOf,
+		Explain:   l.query.explain,
 		Data:      l.query.data,
+		Name:      l.query.name,
+		OlderThan: l.query.olderThan,
 		Err:       l.error,
 		ErrPos:    l.lasttoken,
 		//TODO: have a more robust hash function
@@ -39,6 +49,9 @@ func (qp *QueryProcessor) Parse(querystring string) *ParsedQuery {
 		pq.Keys[i] = cleantagstring(key)
 		i += 1
 	}
+	if !l.query.relative {
+		qp.cache.put(querystring, &pq)
+	}
 	return &pq
 }
 
@@ -55,9 +68,19 @@ type ParsedQuery struct {
 	Set common.Dict
 	// are we querying distinct values?
 	Distinct bool
+	// if not zero, the where clause is evaluated against the metadata as it
+	// was at this time
+	AsOf time.Time
+	// report what the query would do rather than doing it
+	Explain bool
 	// a unique representation of this query used to compare two different query objects
 	Hash QueryHash
 	Data *DataQuery
+	// the name of the continuous query to create or drop
+	Name string
+	// select stale returns the streams quiet for longer than this, or if it
+	// is zero, for longer than expected
+	OlderThan time.Duration
 	// any error that arose during parsing
 	Err error
 	// token where the error in parsing took place
@@ -72,11 +95,13 @@ func (parsed *ParsedQuery) GetParams() common.QueryParams {
 			return &common.DistinctParams{
 				Tag:   parsed.Target[0],
 				Where: parsed.Where,
+				AsOf:  parsed.AsOf,
 			}
 		}
 		return &common.TagParams{
 			Tags:  parsed.Target,
 			Where: parsed.Where,
+			AsOf:  parsed.AsOf,
 		}
 	case DELETE_TYPE:
 		if parsed.Data == nil {
@@ -93,6 +118,15 @@ func (parsed *ParsedQuery) GetParams() common.QueryParams {
 				IsWindow:      false,
 			}
 		}
+	case AUDIT_TYPE:
+		return &common.AuditParams{
+			Where: parsed.Where,
+		}
+	case STALE_TYPE:
+		return &common.StaleParams{
+			Where:     parsed.Where,
+			OlderThan: parsed.OlderThan,
+		}
 	case SET_TYPE:
 		return &common.SetParams{
 			Set:   parsed.Set,
@@ -101,6 +135,7 @@ func (parsed *ParsedQuery) GetParams() common.QueryParams {
 	case DATA_TYPE:
 		return &common.DataParams{
 			Where:         parsed.Where,
+			AsOf:          parsed.AsOf,
 			StreamLimit:   int(parsed.Data.Limit.Streamlimit),
 			DataLimit:     int(parsed.Data.Limit.Limit),
 			Begin:         uint64(parsed.Data.Start.UnixNano()),
@@ -125,6 +160,11 @@ const (
 	SET_TYPE
 	DATA_TYPE
 	APPLY_TYPE
+	AUDIT_TYPE
+	CREATE_TYPE
+	DROP_TYPE
+	LIST_TYPE
+	STALE_TYPE
 )
 
 type QueryHash string
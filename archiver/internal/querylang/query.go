@@ -1,9 +1,13 @@
+// Code generated by goyacc -o query.go -p sq query.y. DO NOT EDIT.
+
 //line query.y:2
+
 package querylang
 
 import __yyfmt__ "fmt"
 
 //line query.y:3
+
 import (
 	"bufio"
 	"fmt"
@@ -27,6 +31,7 @@ type sqSymType struct {
 	timeconv common.UnitOfTime
 	list     List
 	time     _time.Time
+	timeref  TimeRef
 	timediff _time.Duration
 }
 
@@ -38,36 +43,48 @@ const APPLY = 57350
 const STATISTICAL = 57351
 const WINDOW = 57352
 const STATISTICS = 57353
-const WHERE = 57354
-const DATA = 57355
-const BEFORE = 57356
-const AFTER = 57357
-const LIMIT = 57358
-const STREAMLIMIT = 57359
-const NOW = 57360
-const LVALUE = 57361
-const QSTRING = 57362
-const EQ = 57363
-const NEQ = 57364
-const COMMA = 57365
-const ALL = 57366
-const LEFTPIPE = 57367
-const LIKE = 57368
-const AS = 57369
-const AND = 57370
-const OR = 57371
-const HAS = 57372
-const NOT = 57373
-const IN = 57374
-const TO = 57375
-const LPAREN = 57376
-const RPAREN = 57377
-const LBRACK = 57378
-const RBRACK = 57379
-const NUMBER = 57380
-const SEMICOLON = 57381
-const NEWLINE = 57382
-const TIMEUNIT = 57383
+const AUDIT = 57354
+const EXPLAIN = 57355
+const CREATE = 57356
+const DROP = 57357
+const LIST = 57358
+const QUERY = 57359
+const QUERIES = 57360
+const STALE = 57361
+const OLDER = 57362
+const THAN = 57363
+const WHERE = 57364
+const DATA = 57365
+const BEFORE = 57366
+const AFTER = 57367
+const LIMIT = 57368
+const STREAMLIMIT = 57369
+const NOW = 57370
+const LVALUE = 57371
+const QSTRING = 57372
+const EQ = 57373
+const NEQ = 57374
+const COMMA = 57375
+const ALL = 57376
+const LEFTPIPE = 57377
+const LIKE = 57378
+const UNDER = 57379
+const AS = 57380
+const OF = 57381
+const AND = 57382
+const OR = 57383
+const HAS = 57384
+const NOT = 57385
+const IN = 57386
+const TO = 57387
+const LPAREN = 57388
+const RPAREN = 57389
+const LBRACK = 57390
+const RBRACK = 57391
+const NUMBER = 57392
+const SEMICOLON = 57393
+const NEWLINE = 57394
+const TIMEUNIT = 57395
 
 var sqToknames = [...]string{
 	"$end",
@@ -81,6 +98,16 @@ var sqToknames = [...]string{
 	"STATISTICAL",
 	"WINDOW",
 	"STATISTICS",
+	"AUDIT",
+	"EXPLAIN",
+	"CREATE",
+	"DROP",
+	"LIST",
+	"QUERY",
+	"QUERIES",
+	"STALE",
+	"OLDER",
+	"THAN",
 	"WHERE",
 	"DATA",
 	"BEFORE",
@@ -96,7 +123,9 @@ var sqToknames = [...]string{
 	"ALL",
 	"LEFTPIPE",
 	"LIKE",
+	"UNDER",
 	"AS",
+	"OF",
 	"AND",
 	"OR",
 	"HAS",
@@ -112,13 +141,14 @@ var sqToknames = [...]string{
 	"NEWLINE",
 	"TIMEUNIT",
 }
+
 var sqStatenames = [...]string{}
 
 const sqEofCode = 1
 const sqErrCode = 2
 const sqInitialStackSize = 16
 
-//line query.y:415
+//line query.y:501
 
 const eof = 0
 
@@ -143,6 +173,14 @@ func (qt QueryType) String() string {
 		ret = "set"
 	case DATA_TYPE:
 		ret = "data"
+	case CREATE_TYPE:
+		ret = "create"
+	case DROP_TYPE:
+		ret = "drop"
+	case LIST_TYPE:
+		ret = "list"
+	case STALE_TYPE:
+		ret = "stale"
 	}
 	return ret
 }
@@ -158,8 +196,18 @@ type query struct {
 	where common.Dict
 	// are we querying distinct values?
 	distinct bool
+	// evaluate the where clause against the metadata at this time
+	asOf _time.Time
+	// report what the query would do instead of doing it
+	explain bool
+	// the query refers to "now", so parsing it again gives different times
+	relative bool
 	// list of tags to target for deletion, selection
 	Contents []string
+	// the continuous query to create or drop
+	name string
+	// select stale: how long streams must have been quiet
+	olderThan _time.Duration
 }
 
 func (q *query) Print() {
@@ -196,6 +244,16 @@ func NewSQLex(s string) *sqLex {
 			{Token: APPLY, Pattern: "apply"},
 			{Token: DELETE, Pattern: "delete"},
 			{Token: DISTINCT, Pattern: "distinct"},
+			{Token: AUDIT, Pattern: "audit\\b"},
+			{Token: EXPLAIN, Pattern: "explain\\b"},
+			{Token: CREATE, Pattern: "create\\b"},
+			{Token: DROP, Pattern: "drop\\b"},
+			{Token: LIST, Pattern: "list\\b"},
+			{Token: QUERIES, Pattern: "queries\\b"},
+			{Token: QUERY, Pattern: "query\\b"},
+			{Token: STALE, Pattern: "stale\\b"},
+			{Token: OLDER, Pattern: "older\\b"},
+			{Token: THAN, Pattern: "than\\b"},
 			{Token: STATISTICAL, Pattern: "statistical"},
 			{Token: STATISTICS, Pattern: "statistics"},
 			{Token: WINDOW, Pattern: "window"},
@@ -209,6 +267,7 @@ func NewSQLex(s string) *sqLex {
 			{Token: COMMA, Pattern: ","},
 			{Token: AND, Pattern: "and"},
 			{Token: AS, Pattern: "as"},
+			{Token: OF, Pattern: "of\\b"},
 			{Token: TO, Pattern: "to"},
 			{Token: DATA, Pattern: "data"},
 			{Token: OR, Pattern: "or"},
@@ -225,6 +284,7 @@ func NewSQLex(s string) *sqLex {
 			{Token: SEMICOLON, Pattern: ";"},
 			{Token: NEWLINE, Pattern: "\n"},
 			{Token: LIKE, Pattern: "(like)|~"},
+			{Token: UNDER, Pattern: "under\\b"},
 			{Token: NUMBER, Pattern: "([+-]?([0-9]*\\.)?[0-9]+)"},
 			{Token: LVALUE, Pattern: "[a-zA-Z\\~\\$\\_][a-zA-Z0-9\\/\\%_\\-]*"},
 			{Token: QSTRING, Pattern: "(\"[^\"\\\\]*?(\\.[^\"\\\\]*?)*?\")|('[^'\\\\]*?(\\.[^'\\\\]*?)*?')"},
@@ -261,134 +321,154 @@ func readline(fi *bufio.Reader) (string, bool) {
 // Parse has been moved to query_processor.go
 
 //line yacctab:1
-var sqExca = [...]int{
+var sqExca = [...]int8{
 	-1, 1,
 	1, -1,
 	-2, 0,
 }
 
-const sqNprod = 60
 const sqPrivate = 57344
 
-var sqTokenNames []string
-var sqStates []string
-
-const sqLast = 183
-
-var sqAct = [...]int{
-
-	109, 85, 53, 42, 82, 78, 14, 17, 14, 16,
-	55, 67, 41, 25, 54, 54, 55, 55, 21, 55,
-	66, 21, 62, 50, 48, 47, 46, 38, 64, 15,
-	49, 132, 83, 112, 52, 52, 14, 99, 63, 15,
-	43, 40, 111, 60, 45, 34, 46, 74, 23, 79,
-	43, 56, 57, 70, 45, 59, 46, 58, 77, 88,
-	104, 152, 148, 44, 91, 147, 130, 116, 103, 90,
-	89, 139, 134, 80, 97, 98, 100, 133, 31, 101,
-	30, 95, 96, 29, 135, 7, 128, 108, 127, 113,
-	18, 102, 27, 28, 76, 75, 17, 17, 17, 65,
-	68, 69, 117, 118, 119, 107, 120, 110, 79, 123,
-	26, 121, 146, 124, 142, 9, 141, 106, 61, 11,
-	13, 12, 105, 10, 131, 94, 72, 73, 35, 15,
-	122, 71, 136, 125, 8, 93, 92, 140, 11, 13,
-	12, 21, 10, 81, 32, 55, 15, 84, 15, 150,
-	151, 153, 154, 126, 155, 20, 156, 137, 138, 86,
-	87, 22, 24, 143, 129, 144, 145, 115, 114, 21,
-	149, 1, 33, 51, 36, 37, 2, 6, 4, 3,
-	5, 39, 19,
+const sqLast = 235
+
+var sqAct = [...]uint8{
+	147, 121, 29, 60, 81, 114, 106, 25, 62, 23,
+	26, 23, 13, 59, 82, 34, 37, 38, 40, 79,
+	28, 82, 43, 79, 77, 82, 30, 30, 51, 24,
+	54, 55, 64, 176, 91, 172, 16, 76, 113, 82,
+	112, 80, 61, 58, 27, 80, 63, 24, 64, 110,
+	109, 175, 94, 93, 23, 52, 39, 89, 90, 136,
+	61, 74, 92, 72, 63, 102, 64, 69, 67, 107,
+	83, 84, 97, 56, 115, 150, 149, 105, 87, 86,
+	85, 141, 193, 189, 118, 119, 124, 88, 188, 170,
+	154, 127, 140, 126, 125, 111, 180, 174, 173, 49,
+	48, 116, 47, 133, 134, 135, 137, 138, 167, 131,
+	132, 45, 46, 104, 103, 166, 139, 95, 96, 144,
+	41, 100, 101, 70, 30, 151, 98, 99, 187, 148,
+	35, 44, 26, 26, 26, 108, 155, 156, 157, 36,
+	36, 183, 146, 158, 182, 145, 142, 107, 163, 159,
+	161, 130, 129, 18, 128, 117, 160, 20, 22, 21,
+	14, 73, 50, 169, 171, 68, 53, 15, 71, 82,
+	162, 19, 177, 164, 20, 22, 21, 24, 181, 24,
+	120, 66, 17, 65, 122, 123, 165, 30, 19, 168,
+	191, 192, 194, 195, 24, 196, 153, 197, 178, 179,
+	20, 22, 21, 152, 42, 184, 30, 185, 186, 30,
+	75, 33, 190, 5, 19, 7, 6, 42, 32, 31,
+	143, 4, 3, 8, 9, 10, 5, 2, 7, 6,
+	1, 11, 78, 12, 57,
 }
-var sqPact = [...]int{
-
-	172, -1000, 110, 127, 129, 9, 157, -1000, -1000, 127,
-	78, 49, 46, 44, 121, -1000, 6, 107, 157, 157,
-	-12, 10, -14, -1000, -15, -1000, -4, -3, -3, 19,
-	17, 5, 127, -17, -1000, -10, -19, -28, -1000, 72,
-	20, -1000, 105, 127, 63, 20, 125, -1000, -1000, -3,
-	120, -6, 128, -1000, -1000, -1000, 143, 143, 35, 34,
-	127, -1000, -1000, 113, 112, 102, -1000, -1000, 20, 20,
-	-1000, 125, -1, 125, -1000, 127, 59, 33, 23, 99,
-	94, -3, -1000, 127, -1000, 80, 4, -5, 80, 155,
-	154, 32, 127, 127, 127, -1000, -1000, -1000, -1000, -1000,
-	-1000, -1000, 127, -1000, -1000, 125, -3, 143, -6, -1000,
-	114, 136, -1000, -1000, 56, 54, 151, -1000, -1000, -1000,
-	-1000, -1000, 31, 80, -1000, -1000, -7, 43, 38, 52,
-	143, -1000, -1000, -3, -3, 37, 80, 93, 91, -3,
-	-1000, -3, -3, 89, 30, 27, -3, 143, 143, 26,
-	80, 80, 143, -1000, -1000, 80, -1000,
+
+var sqPact = [...]int16{
+	209, -1000, -1000, 222, -1000, 148, 150, 165, 202, 201,
+	193, -1000, 102, 187, 5, 184, -1000, -1000, 150, 87,
+	56, 54, 53, 129, -1000, 4, 135, 187, 187, 22,
+	0, 154, 152, 17, 101, 16, 84, 101, 12, -1000,
+	197, 10, 189, -1000, -9, -5, -5, 30, 29, 28,
+	150, 6, -1000, -16, 2, 1, -1000, 77, 18, -1000,
+	90, 150, 70, 18, 139, 97, -1, -1000, -2, -1000,
+	-5, -11, -1000, -13, -1000, 24, -5, 122, 24, 24,
+	151, -1000, -1000, 158, 158, 47, 46, 150, -1000, -1000,
+	121, 119, 118, -1000, -1000, 18, 18, -1000, 139, 139,
+	9, 139, -1000, 150, 72, 45, 32, 113, 216, -1000,
+	-1000, -1000, -1000, -1000, -1000, 150, 112, -5, -1000, -1000,
+	-1000, 91, 26, 25, 91, 180, 173, 43, 150, 150,
+	150, -1000, -1000, -1000, -1000, -1000, -1000, -1000, -1000, 150,
+	-1000, -1000, 139, 191, 24, -5, 158, -1000, 144, 159,
+	-1000, -1000, 71, 64, 166, -1000, -1000, -1000, -1000, -1000,
+	187, -1000, 42, 91, -1000, -15, 52, 51, 7, -18,
+	158, -1000, -1000, -5, -5, 50, -1000, 91, 111, 108,
+	-5, -1000, -5, -5, 95, 41, 36, -5, 158, 158,
+	35, 91, 91, 158, -1000, -1000, 91, -1000,
 }
-var sqPgo = [...]int{
 
-	0, 181, 12, 155, 9, 180, 85, 5, 63, 177,
-	23, 173, 4, 1, 0, 2, 3, 171,
+var sqPgo = [...]uint8{
+	0, 234, 13, 2, 7, 233, 36, 6, 8, 12,
+	232, 130, 24, 5, 120, 1, 0, 4, 3, 230,
+	227, 221,
 }
-var sqR1 = [...]int{
 
-	0, 17, 17, 17, 17, 17, 17, 17, 17, 6,
+var sqR1 = [...]int8{
+	0, 19, 19, 19, 21, 21, 21, 20, 20, 20,
+	20, 20, 20, 20, 20, 20, 20, 20, 20, 6,
 	6, 8, 7, 7, 4, 4, 4, 4, 4, 4,
 	5, 5, 5, 5, 9, 9, 9, 9, 9, 9,
-	9, 10, 10, 11, 11, 11, 11, 12, 12, 13,
-	13, 13, 13, 14, 14, 3, 2, 2, 2, 2,
-	2, 2, 2, 2, 15, 16, 1, 1, 1, 1,
+	9, 11, 11, 12, 12, 12, 12, 10, 10, 10,
+	13, 13, 14, 14, 15, 15, 15, 15, 16, 16,
+	3, 2, 2, 2, 2, 2, 2, 2, 2, 2,
+	17, 18, 1, 1, 1, 1,
 }
-var sqR2 = [...]int{
 
-	0, 4, 3, 4, 4, 3, 4, 4, 3, 1,
+var sqR2 = [...]int8{
+	0, 1, 2, 1, 8, 4, 3, 5, 4, 5,
+	4, 3, 5, 4, 4, 3, 4, 4, 3, 1,
 	3, 3, 1, 3, 3, 3, 3, 5, 5, 5,
 	1, 1, 2, 1, 9, 7, 13, 13, 14, 5,
-	5, 1, 2, 2, 1, 1, 1, 2, 3, 0,
-	2, 2, 4, 0, 2, 2, 3, 3, 3, 3,
-	2, 3, 4, 3, 1, 1, 3, 3, 2, 1,
+	5, 0, 3, 1, 2, 1, 2, 2, 1, 1,
+	2, 3, 0, 3, 0, 2, 2, 4, 0, 2,
+	2, 3, 3, 3, 3, 3, 2, 3, 4, 3,
+	1, 1, 3, 3, 2, 1,
 }
-var sqChk = [...]int{
-
-	-1000, -17, 4, 7, 6, -5, -9, -6, 24, 5,
-	13, 9, 11, 10, -16, 19, -4, -16, -6, -9,
-	-3, 12, -3, 39, -3, -16, 32, 14, 15, 34,
-	34, 34, 23, -3, 39, 21, -3, -3, 39, -1,
-	31, -2, -16, 30, -8, 34, 36, 39, 39, 34,
-	-10, -11, 38, -15, 18, 20, -10, -10, 38, 38,
-	38, -6, 39, -15, 38, -8, 39, 39, 28, 29,
-	-2, 26, 21, 22, -16, 32, 31, -2, -7, -15,
-	-10, 23, -12, 38, 19, -13, 16, 17, -13, 35,
-	35, -16, 23, 23, 23, -2, -2, -15, -15, 38,
-	-15, -16, 32, 35, 37, 23, 23, -10, -16, -14,
-	27, 38, 38, -14, 13, 13, 35, -4, -4, -4,
-	-16, -7, -10, -13, -12, 19, 17, 32, 32, 13,
-	35, -14, 38, 34, 34, 32, -13, -10, -10, 34,
-	-14, 23, 23, -10, -10, -10, 23, 35, 35, -10,
-	-13, -13, 35, -14, -14, -13, -14,
+
+var sqChk = [...]int16{
+	-1000, -19, -20, 13, -21, 4, 7, 6, 14, 15,
+	16, -20, -5, -9, 12, 19, -6, 34, 5, 23,
+	9, 11, 10, -18, 29, -4, -18, -6, -9, -3,
+	22, 17, 17, 18, -3, -11, 38, -3, -3, 51,
+	-3, -14, 20, -18, 44, 24, 25, 46, 46, 46,
+	33, -3, 51, 31, -3, -3, 51, -1, 43, -2,
+	-18, 42, -8, 46, 48, 29, 29, 51, -11, 51,
+	39, -11, 51, -14, 51, 21, 46, -12, -10, 28,
+	50, -17, 30, -12, -12, 50, 50, 50, -6, 51,
+	-17, 50, -8, 51, 51, 40, 41, -2, 36, 37,
+	31, 32, -18, 44, 43, -2, -7, -17, 38, 51,
+	51, -12, 51, 51, -13, 50, -12, 33, -13, -13,
+	29, -15, 26, 27, -15, 47, 47, -18, 33, 33,
+	33, -2, -2, -17, -17, -17, 50, -17, -18, 44,
+	47, 49, 33, 4, -18, 33, -12, -16, 38, 50,
+	50, -16, 23, 23, 47, -4, -4, -4, -18, -7,
+	-9, -13, -12, -15, 29, 27, 44, 44, 23, -3,
+	47, -16, 50, 46, 46, 44, 51, -15, -12, -12,
+	46, -16, 33, 33, -12, -12, -12, 33, 47, 47,
+	-12, -15, -15, 47, -16, -16, -15, -16,
 }
-var sqDef = [...]int{
-
-	0, -2, 0, 0, 0, 0, 0, 20, 21, 23,
-	0, 0, 0, 0, 9, 55, 0, 0, 0, 0,
-	0, 0, 0, 2, 0, 22, 0, 0, 0, 0,
-	0, 0, 0, 0, 5, 0, 0, 0, 8, 45,
-	0, 59, 0, 0, 0, 0, 0, 1, 3, 0,
-	0, 31, 34, 35, 36, 54, 39, 39, 0, 0,
-	0, 10, 4, 14, 15, 16, 6, 7, 0, 0,
-	58, 0, 0, 0, 50, 0, 0, 0, 0, 12,
-	0, 0, 32, 0, 33, 43, 0, 0, 43, 0,
-	0, 0, 0, 0, 0, 56, 57, 46, 47, 48,
-	49, 51, 0, 53, 11, 0, 0, 39, 37, 29,
-	0, 40, 41, 30, 0, 0, 0, 17, 18, 19,
-	52, 13, 0, 43, 38, 44, 0, 0, 0, 0,
-	39, 25, 42, 0, 0, 0, 43, 0, 0, 0,
-	24, 0, 0, 0, 0, 0, 0, 39, 39, 0,
-	43, 43, 39, 26, 27, 43, 28,
+
+var sqDef = [...]int8{
+	0, -2, 1, 0, 3, 0, 0, 0, 0, 0,
+	0, 2, 41, 0, 0, 52, 30, 31, 33, 0,
+	0, 0, 0, 19, 71, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 41, 0, 0, 41, 0, 11,
+	52, 0, 0, 32, 0, 0, 0, 0, 0, 0,
+	0, 0, 15, 0, 0, 0, 18, 60, 0, 75,
+	0, 0, 0, 0, 0, 0, 0, 6, 0, 8,
+	0, 0, 10, 0, 13, 0, 0, 0, 43, 45,
+	48, 49, 70, 54, 54, 0, 0, 0, 20, 14,
+	24, 25, 26, 16, 17, 0, 0, 74, 0, 0,
+	0, 0, 66, 0, 0, 0, 0, 22, 0, 5,
+	7, 42, 9, 12, 53, 0, 0, 0, 44, 46,
+	47, 58, 0, 0, 58, 0, 0, 0, 0, 0,
+	0, 72, 73, 61, 62, 63, 64, 65, 67, 0,
+	69, 21, 0, 0, 50, 0, 54, 39, 0, 55,
+	56, 40, 0, 0, 0, 27, 28, 29, 68, 23,
+	0, 51, 0, 58, 59, 0, 0, 0, 0, 0,
+	54, 35, 57, 0, 0, 0, 4, 58, 0, 0,
+	0, 34, 0, 0, 0, 0, 0, 0, 54, 54,
+	0, 58, 58, 54, 36, 37, 58, 38,
 }
-var sqTok1 = [...]int{
 
+var sqTok1 = [...]int8{
 	1,
 }
-var sqTok2 = [...]int{
 
+var sqTok2 = [...]int8{
 	2, 3, 4, 5, 6, 7, 8, 9, 10, 11,
 	12, 13, 14, 15, 16, 17, 18, 19, 20, 21,
 	22, 23, 24, 25, 26, 27, 28, 29, 30, 31,
 	32, 33, 34, 35, 36, 37, 38, 39, 40, 41,
+	42, 43, 44, 45, 46, 47, 48, 49, 50, 51,
+	52, 53,
 }
-var sqTok3 = [...]int{
+
+var sqTok3 = [...]int8{
 	0,
 }
 
@@ -470,9 +550,9 @@ func sqErrorMessage(state, lookAhead int) string {
 	expected := make([]int, 0, 4)
 
 	// Look for shiftable tokens.
-	base := sqPact[state]
+	base := int(sqPact[state])
 	for tok := TOKSTART; tok-1 < len(sqToknames); tok++ {
-		if n := base + tok; n >= 0 && n < sqLast && sqChk[sqAct[n]] == tok {
+		if n := base + tok; n >= 0 && n < sqLast && int(sqChk[int(sqAct[n])]) == tok {
 			if len(expected) == cap(expected) {
 				return res
 			}
@@ -482,13 +562,13 @@ func sqErrorMessage(state, lookAhead int) string {
 
 	if sqDef[state] == -2 {
 		i := 0
-		for sqExca[i] != -1 || sqExca[i+1] != state {
+		for sqExca[i] != -1 || int(sqExca[i+1]) != state {
 			i += 2
 		}
 
 		// Look for tokens that we accept or reduce.
 		for i += 2; sqExca[i] >= 0; i += 2 {
-			tok := sqExca[i]
+			tok := int(sqExca[i])
 			if tok < TOKSTART || sqExca[i+1] == 0 {
 				continue
 			}
@@ -519,30 +599,30 @@ func sqlex1(lex sqLexer, lval *sqSymType) (char, token int) {
 	token = 0
 	char = lex.Lex(lval)
 	if char <= 0 {
-		token = sqTok1[0]
+		token = int(sqTok1[0])
 		goto out
 	}
 	if char < len(sqTok1) {
-		token = sqTok1[char]
+		token = int(sqTok1[char])
 		goto out
 	}
 	if char >= sqPrivate {
 		if char < sqPrivate+len(sqTok2) {
-			token = sqTok2[char-sqPrivate]
+			token = int(sqTok2[char-sqPrivate])
 			goto out
 		}
 	}
 	for i := 0; i < len(sqTok3); i += 2 {
-		token = sqTok3[i+0]
+		token = int(sqTok3[i+0])
 		if token == char {
-			token = sqTok3[i+1]
+			token = int(sqTok3[i+1])
 			goto out
 		}
 	}
 
 out:
 	if token == 0 {
-		token = sqTok2[1] /* unknown char */
+		token = int(sqTok2[1]) /* unknown char */
 	}
 	if sqDebug >= 3 {
 		__yyfmt__.Printf("lex %s(%d)\n", sqTokname(token), uint(char))
@@ -597,7 +677,7 @@ sqstack:
 	sqS[sqp].yys = sqstate
 
 sqnewstate:
-	sqn = sqPact[sqstate]
+	sqn = int(sqPact[sqstate])
 	if sqn <= sqFlag {
 		goto sqdefault /* simple state */
 	}
@@ -608,8 +688,8 @@ sqnewstate:
 	if sqn < 0 || sqn >= sqLast {
 		goto sqdefault
 	}
-	sqn = sqAct[sqn]
-	if sqChk[sqn] == sqtoken { /* valid shift */
+	sqn = int(sqAct[sqn])
+	if int(sqChk[sqn]) == sqtoken { /* valid shift */
 		sqrcvr.char = -1
 		sqtoken = -1
 		sqVAL = sqrcvr.lval
@@ -622,7 +702,7 @@ sqnewstate:
 
 sqdefault:
 	/* default state action */
-	sqn = sqDef[sqstate]
+	sqn = int(sqDef[sqstate])
 	if sqn == -2 {
 		if sqrcvr.char < 0 {
 			sqrcvr.char, sqtoken = sqlex1(sqlex, &sqrcvr.lval)
@@ -631,18 +711,18 @@ sqdefault:
 		/* look through exception table */
 		xi := 0
 		for {
-			if sqExca[xi+0] == -1 && sqExca[xi+1] == sqstate {
+			if sqExca[xi+0] == -1 && int(sqExca[xi+1]) == sqstate {
 				break
 			}
 			xi += 2
 		}
 		for xi += 2; ; xi += 2 {
-			sqn = sqExca[xi+0]
+			sqn = int(sqExca[xi+0])
 			if sqn < 0 || sqn == sqtoken {
 				break
 			}
 		}
-		sqn = sqExca[xi+1]
+		sqn = int(sqExca[xi+1])
 		if sqn < 0 {
 			goto ret0
 		}
@@ -664,10 +744,10 @@ sqdefault:
 
 			/* find a state where "error" is a legal shift action */
 			for sqp >= 0 {
-				sqn = sqPact[sqS[sqp].yys] + sqErrCode
+				sqn = int(sqPact[sqS[sqp].yys]) + sqErrCode
 				if sqn >= 0 && sqn < sqLast {
-					sqstate = sqAct[sqn] /* simulate a shift of "error" */
-					if sqChk[sqstate] == sqErrCode {
+					sqstate = int(sqAct[sqn]) /* simulate a shift of "error" */
+					if int(sqChk[sqstate]) == sqErrCode {
 						goto sqstack
 					}
 				}
@@ -703,7 +783,7 @@ sqdefault:
 	sqpt := sqp
 	_ = sqpt // guard against "declared and not used"
 
-	sqp -= sqR2[sqn]
+	sqp -= int(sqR2[sqn])
 	// sqp is now the index of $0. Perform the default action. Iff the
 	// reduced production is ε, $1 is possibly out of range.
 	if sqp+1 >= len(sqS) {
@@ -714,248 +794,333 @@ sqdefault:
 	sqVAL = sqS[sqp+1]
 
 	/* consult goto table to find next state */
-	sqn = sqR1[sqn]
-	sqg := sqPgo[sqn]
+	sqn = int(sqR1[sqn])
+	sqg := int(sqPgo[sqn])
 	sqj := sqg + sqS[sqp].yys + 1
 
 	if sqj >= sqLast {
-		sqstate = sqAct[sqg]
+		sqstate = int(sqAct[sqg])
 	} else {
-		sqstate = sqAct[sqj]
-		if sqChk[sqstate] != -sqn {
-			sqstate = sqAct[sqg]
+		sqstate = int(sqAct[sqj])
+		if int(sqChk[sqstate]) != -sqn {
+			sqstate = int(sqAct[sqg])
 		}
 	}
 	// dummy call; replaced with literal code
 	switch sqnt {
 
-	case 1:
+	case 2:
+		sqDollar = sqS[sqpt-2 : sqpt+1]
+//line query.y:64
+		{
+			sqlex.(*sqLex).query.explain = true
+		}
+	case 4:
+		sqDollar = sqS[sqpt-8 : sqpt+1]
+//line query.y:72
+		{
+			sqlex.(*sqLex).query.name = sqDollar[3].str
+			sqlex.(*sqLex).query.data = sqDollar[6].data
+			sqlex.(*sqLex).query.where = sqDollar[7].dict
+			sqlex.(*sqLex).query.qtype = CREATE_TYPE
+		}
+	case 5:
 		sqDollar = sqS[sqpt-4 : sqpt+1]
-		//line query.y:59
+//line query.y:79
+		{
+			sqlex.(*sqLex).query.name = sqDollar[3].str
+			sqlex.(*sqLex).query.qtype = DROP_TYPE
+		}
+	case 6:
+		sqDollar = sqS[sqpt-3 : sqpt+1]
+//line query.y:84
+		{
+			sqlex.(*sqLex).query.qtype = LIST_TYPE
+		}
+	case 7:
+		sqDollar = sqS[sqpt-5 : sqpt+1]
+//line query.y:90
 		{
 			sqlex.(*sqLex).query.Contents = sqDollar[2].list
 			sqlex.(*sqLex).query.where = sqDollar[3].dict
+			sqlex.(*sqLex).query.asOf = sqDollar[4].time
 			sqlex.(*sqLex).query.qtype = SELECT_TYPE
 		}
-	case 2:
-		sqDollar = sqS[sqpt-3 : sqpt+1]
-		//line query.y:65
+	case 8:
+		sqDollar = sqS[sqpt-4 : sqpt+1]
+//line query.y:97
 		{
 			sqlex.(*sqLex).query.Contents = sqDollar[2].list
+			sqlex.(*sqLex).query.asOf = sqDollar[3].time
 			sqlex.(*sqLex).query.qtype = SELECT_TYPE
 		}
-	case 3:
-		sqDollar = sqS[sqpt-4 : sqpt+1]
-		//line query.y:70
+	case 9:
+		sqDollar = sqS[sqpt-5 : sqpt+1]
+//line query.y:103
 		{
 			sqlex.(*sqLex).query.where = sqDollar[3].dict
 			sqlex.(*sqLex).query.data = sqDollar[2].data
+			sqlex.(*sqLex).query.asOf = sqDollar[4].time
 			sqlex.(*sqLex).query.qtype = DATA_TYPE
 		}
-	case 4:
+	case 10:
+		sqDollar = sqS[sqpt-4 : sqpt+1]
+//line query.y:110
+		{
+			sqlex.(*sqLex).query.where = sqDollar[3].dict
+			sqlex.(*sqLex).query.qtype = AUDIT_TYPE
+		}
+	case 11:
+		sqDollar = sqS[sqpt-3 : sqpt+1]
+//line query.y:115
+		{
+			sqlex.(*sqLex).query.qtype = AUDIT_TYPE
+		}
+	case 12:
+		sqDollar = sqS[sqpt-5 : sqpt+1]
+//line query.y:119
+		{
+			sqlex.(*sqLex).query.where = sqDollar[3].dict
+			sqlex.(*sqLex).query.olderThan = sqDollar[4].timediff
+			sqlex.(*sqLex).query.qtype = STALE_TYPE
+		}
+	case 13:
 		sqDollar = sqS[sqpt-4 : sqpt+1]
-		//line query.y:76
+//line query.y:125
+		{
+			sqlex.(*sqLex).query.olderThan = sqDollar[3].timediff
+			sqlex.(*sqLex).query.qtype = STALE_TYPE
+		}
+	case 14:
+		sqDollar = sqS[sqpt-4 : sqpt+1]
+//line query.y:130
 		{
 			sqlex.(*sqLex).query.where = sqDollar[3].dict
 			sqlex.(*sqLex).query.set = sqDollar[2].dict
 			sqlex.(*sqLex).query.qtype = SET_TYPE
 		}
-	case 5:
+	case 15:
 		sqDollar = sqS[sqpt-3 : sqpt+1]
-		//line query.y:82
+//line query.y:136
 		{
 			sqlex.(*sqLex).query.set = sqDollar[2].dict
 			sqlex.(*sqLex).query.qtype = SET_TYPE
 		}
-	case 6:
+	case 16:
 		sqDollar = sqS[sqpt-4 : sqpt+1]
-		//line query.y:87
+//line query.y:141
 		{
 			sqlex.(*sqLex).query.Contents = sqDollar[2].list
 			sqlex.(*sqLex).query.where = sqDollar[3].dict
 			sqlex.(*sqLex).query.qtype = DELETE_TYPE
 		}
-	case 7:
+	case 17:
 		sqDollar = sqS[sqpt-4 : sqpt+1]
-		//line query.y:93
+//line query.y:147
 		{
 			sqlex.(*sqLex).query.data = sqDollar[2].data
 			sqlex.(*sqLex).query.where = sqDollar[3].dict
 			sqlex.(*sqLex).query.qtype = DELETE_TYPE
 		}
-	case 8:
+	case 18:
 		sqDollar = sqS[sqpt-3 : sqpt+1]
-		//line query.y:99
+//line query.y:153
 		{
 			sqlex.(*sqLex).query.Contents = []string{}
 			sqlex.(*sqLex).query.where = sqDollar[2].dict
 			sqlex.(*sqLex).query.qtype = DELETE_TYPE
 		}
-	case 9:
+	case 19:
 		sqDollar = sqS[sqpt-1 : sqpt+1]
-		//line query.y:107
+//line query.y:161
 		{
 			sqVAL.list = List{sqDollar[1].str}
 		}
-	case 10:
+	case 20:
 		sqDollar = sqS[sqpt-3 : sqpt+1]
-		//line query.y:111
+//line query.y:165
 		{
 			sqVAL.list = append(List{sqDollar[1].str}, sqDollar[3].list...)
 		}
-	case 11:
+	case 21:
 		sqDollar = sqS[sqpt-3 : sqpt+1]
-		//line query.y:117
+//line query.y:171
 		{
 			sqVAL.list = sqDollar[2].list
 		}
-	case 12:
+	case 22:
 		sqDollar = sqS[sqpt-1 : sqpt+1]
-		//line query.y:122
+//line query.y:176
 		{
 			sqVAL.list = List{sqDollar[1].str}
 		}
-	case 13:
+	case 23:
 		sqDollar = sqS[sqpt-3 : sqpt+1]
-		//line query.y:126
+//line query.y:180
 		{
 			sqVAL.list = append(List{sqDollar[1].str}, sqDollar[3].list...)
 		}
-	case 14:
+	case 24:
 		sqDollar = sqS[sqpt-3 : sqpt+1]
-		//line query.y:132
+//line query.y:186
 		{
 			sqVAL.dict = common.Dict{sqDollar[1].str: sqDollar[3].str}
 		}
-	case 15:
+	case 25:
 		sqDollar = sqS[sqpt-3 : sqpt+1]
-		//line query.y:136
+//line query.y:190
 		{
 			sqVAL.dict = common.Dict{sqDollar[1].str: sqDollar[3].str}
 		}
-	case 16:
+	case 26:
 		sqDollar = sqS[sqpt-3 : sqpt+1]
-		//line query.y:140
+//line query.y:194
 		{
 			sqVAL.dict = common.Dict{sqDollar[1].str: sqDollar[3].list}
 		}
-	case 17:
+	case 27:
 		sqDollar = sqS[sqpt-5 : sqpt+1]
-		//line query.y:144
+//line query.y:198
 		{
 			sqDollar[5].dict[sqDollar[1].str] = sqDollar[3].str
 			sqVAL.dict = sqDollar[5].dict
 		}
-	case 18:
+	case 28:
 		sqDollar = sqS[sqpt-5 : sqpt+1]
-		//line query.y:149
+//line query.y:203
 		{
 			sqDollar[5].dict[sqDollar[1].str] = sqDollar[3].str
 			sqVAL.dict = sqDollar[5].dict
 		}
-	case 19:
+	case 29:
 		sqDollar = sqS[sqpt-5 : sqpt+1]
-		//line query.y:154
+//line query.y:208
 		{
 			sqDollar[5].dict[sqDollar[1].str] = sqDollar[3].list
 			sqVAL.dict = sqDollar[5].dict
 		}
-	case 20:
+	case 30:
 		sqDollar = sqS[sqpt-1 : sqpt+1]
-		//line query.y:161
+//line query.y:215
 		{
 			sqlex.(*sqLex).query.Contents = sqDollar[1].list
 			sqVAL.list = sqDollar[1].list
 		}
-	case 21:
+	case 31:
 		sqDollar = sqS[sqpt-1 : sqpt+1]
-		//line query.y:166
+//line query.y:220
 		{
 			sqVAL.list = List{}
 		}
-	case 22:
+	case 32:
 		sqDollar = sqS[sqpt-2 : sqpt+1]
-		//line query.y:170
+//line query.y:224
 		{
 			sqlex.(*sqLex).query.distinct = true
 			sqVAL.list = List{sqDollar[2].str}
 		}
-	case 23:
+	case 33:
 		sqDollar = sqS[sqpt-1 : sqpt+1]
-		//line query.y:175
+//line query.y:229
 		{
 			sqlex.(*sqLex).query.distinct = true
 			sqVAL.list = List{}
 		}
-	case 24:
+	case 34:
 		sqDollar = sqS[sqpt-9 : sqpt+1]
-		//line query.y:182
+//line query.y:236
 		{
-			sqVAL.data = &DataQuery{Dtype: IN_TYPE, Start: sqDollar[4].time, End: sqDollar[6].time, Limit: sqDollar[8].limit, Timeconv: sqDollar[9].timeconv, IsStatistical: false, IsWindow: false}
+			sqVAL.data = &DataQuery{Dtype: IN_TYPE, Start: sqDollar[4].timeref.Time, End: sqDollar[6].timeref.Time, StartRef: sqDollar[4].timeref, EndRef: sqDollar[6].timeref, Limit: sqDollar[8].limit, Timeconv: sqDollar[9].timeconv, IsStatistical: false, IsWindow: false}
 		}
-	case 25:
+	case 35:
 		sqDollar = sqS[sqpt-7 : sqpt+1]
-		//line query.y:186
+//line query.y:240
 		{
-			sqVAL.data = &DataQuery{Dtype: IN_TYPE, Start: sqDollar[3].time, End: sqDollar[5].time, Limit: sqDollar[6].limit, Timeconv: sqDollar[7].timeconv, IsStatistical: false, IsWindow: false}
+			sqVAL.data = &DataQuery{Dtype: IN_TYPE, Start: sqDollar[3].timeref.Time, End: sqDollar[5].timeref.Time, StartRef: sqDollar[3].timeref, EndRef: sqDollar[5].timeref, Limit: sqDollar[6].limit, Timeconv: sqDollar[7].timeconv, IsStatistical: false, IsWindow: false}
 		}
-	case 26:
+	case 36:
 		sqDollar = sqS[sqpt-13 : sqpt+1]
-		//line query.y:190
+//line query.y:244
 		{
 			num, err := strconv.ParseInt(sqDollar[3].str, 10, 64)
 			if err != nil {
 				sqlex.(*sqLex).Error(fmt.Sprintf("Could not parse integer \"%v\" (%v)", sqDollar[1].str, err.Error()))
 			}
-			sqVAL.data = &DataQuery{Dtype: IN_TYPE, Start: sqDollar[8].time, End: sqDollar[10].time, Limit: sqDollar[12].limit, Timeconv: sqDollar[13].timeconv, IsStatistical: true, IsWindow: false, PointWidth: uint64(num)}
+			sqVAL.data = &DataQuery{Dtype: IN_TYPE, Start: sqDollar[8].timeref.Time, End: sqDollar[10].timeref.Time, StartRef: sqDollar[8].timeref, EndRef: sqDollar[10].timeref, Limit: sqDollar[12].limit, Timeconv: sqDollar[13].timeconv, IsStatistical: true, IsWindow: false, PointWidth: uint64(num)}
 		}
-	case 27:
+	case 37:
 		sqDollar = sqS[sqpt-13 : sqpt+1]
-		//line query.y:198
+//line query.y:252
 		{
 			num, err := strconv.ParseInt(sqDollar[3].str, 10, 64)
 			if err != nil {
 				sqlex.(*sqLex).Error(fmt.Sprintf("Could not parse integer \"%v\" (%v)", sqDollar[1].str, err.Error()))
 			}
-			sqVAL.data = &DataQuery{Dtype: IN_TYPE, Start: sqDollar[8].time, End: sqDollar[10].time, Limit: sqDollar[12].limit, Timeconv: sqDollar[13].timeconv, IsStatistical: true, IsWindow: false, PointWidth: uint64(num)}
+			sqVAL.data = &DataQuery{Dtype: IN_TYPE, Start: sqDollar[8].timeref.Time, End: sqDollar[10].timeref.Time, StartRef: sqDollar[8].timeref, EndRef: sqDollar[10].timeref, Limit: sqDollar[12].limit, Timeconv: sqDollar[13].timeconv, IsStatistical: true, IsWindow: false, PointWidth: uint64(num)}
 		}
-	case 28:
+	case 38:
 		sqDollar = sqS[sqpt-14 : sqpt+1]
-		//line query.y:206
+//line query.y:260
 		{
 			dur, err := common.ParseReltime(sqDollar[3].str, sqDollar[4].str)
 			if err != nil {
 				sqlex.(*sqLex).Error(fmt.Sprintf("Error parsing relative time \"%v %v\" (%v)", sqDollar[3].str, sqDollar[4].str, err.Error()))
 			}
-			sqVAL.data = &DataQuery{Dtype: IN_TYPE, Start: sqDollar[9].time, End: sqDollar[11].time, Limit: sqDollar[13].limit, Timeconv: sqDollar[14].timeconv, IsStatistical: false, IsWindow: true, Width: uint64(dur.Nanoseconds())}
+			sqVAL.data = &DataQuery{Dtype: IN_TYPE, Start: sqDollar[9].timeref.Time, End: sqDollar[11].timeref.Time, StartRef: sqDollar[9].timeref, EndRef: sqDollar[11].timeref, Limit: sqDollar[13].limit, Timeconv: sqDollar[14].timeconv, IsStatistical: false, IsWindow: true, Width: uint64(dur.Nanoseconds())}
 		}
-	case 29:
+	case 39:
 		sqDollar = sqS[sqpt-5 : sqpt+1]
-		//line query.y:214
+//line query.y:268
 		{
-			sqVAL.data = &DataQuery{Dtype: BEFORE_TYPE, Start: sqDollar[3].time, Limit: sqDollar[4].limit, Timeconv: sqDollar[5].timeconv, IsStatistical: false, IsWindow: false}
+			sqVAL.data = &DataQuery{Dtype: BEFORE_TYPE, Start: sqDollar[3].timeref.Time, StartRef: sqDollar[3].timeref, Limit: sqDollar[4].limit, Timeconv: sqDollar[5].timeconv, IsStatistical: false, IsWindow: false}
 		}
-	case 30:
+	case 40:
 		sqDollar = sqS[sqpt-5 : sqpt+1]
-		//line query.y:218
+//line query.y:272
 		{
-			sqVAL.data = &DataQuery{Dtype: AFTER_TYPE, Start: sqDollar[3].time, Limit: sqDollar[4].limit, Timeconv: sqDollar[5].timeconv, IsStatistical: false, IsWindow: false}
+			sqVAL.data = &DataQuery{Dtype: AFTER_TYPE, Start: sqDollar[3].timeref.Time, StartRef: sqDollar[3].timeref, Limit: sqDollar[4].limit, Timeconv: sqDollar[5].timeconv, IsStatistical: false, IsWindow: false}
 		}
-	case 31:
+	case 41:
+		sqDollar = sqS[sqpt-0 : sqpt+1]
+//line query.y:279
+		{
+			sqVAL.time = _time.Time{}
+		}
+	case 42:
+		sqDollar = sqS[sqpt-3 : sqpt+1]
+//line query.y:283
+		{
+			sqVAL.time = sqDollar[3].timeref.Time
+		}
+	case 43:
 		sqDollar = sqS[sqpt-1 : sqpt+1]
-		//line query.y:224
+//line query.y:289
 		{
-			sqVAL.time = sqDollar[1].time
+			sqVAL.timeref = TimeRef{Time: sqDollar[1].time}
 		}
-	case 32:
+	case 44:
 		sqDollar = sqS[sqpt-2 : sqpt+1]
-		//line query.y:228
+//line query.y:293
 		{
-			sqVAL.time = sqDollar[1].time.Add(sqDollar[2].timediff)
+			sqVAL.timeref = TimeRef{Time: sqDollar[1].time.Add(sqDollar[2].timediff)}
 		}
-	case 33:
+	case 45:
+		sqDollar = sqS[sqpt-1 : sqpt+1]
+//line query.y:297
+		{
+			sqlex.(*sqLex).query.relative = true
+			sqVAL.timeref = TimeRef{Time: _time.Now(), Relative: true}
+		}
+	case 46:
 		sqDollar = sqS[sqpt-2 : sqpt+1]
-		//line query.y:234
+//line query.y:302
+		{
+			sqlex.(*sqLex).query.relative = true
+			sqVAL.timeref = TimeRef{Time: _time.Now().Add(sqDollar[2].timediff), Relative: true, Offset: sqDollar[2].timediff}
+		}
+	case 47:
+		sqDollar = sqS[sqpt-2 : sqpt+1]
+//line query.y:309
 		{
 			foundtime, err := common.ParseAbsTime(sqDollar[1].str, sqDollar[2].str)
 			if err != nil {
@@ -963,9 +1128,9 @@ sqdefault:
 			}
 			sqVAL.time = foundtime
 		}
-	case 34:
+	case 48:
 		sqDollar = sqS[sqpt-1 : sqpt+1]
-		//line query.y:242
+//line query.y:317
 		{
 			num, err := strconv.ParseInt(sqDollar[1].str, 10, 64)
 			if err != nil {
@@ -973,9 +1138,9 @@ sqdefault:
 			}
 			sqVAL.time = _time.Unix(num, 0)
 		}
-	case 35:
+	case 49:
 		sqDollar = sqS[sqpt-1 : sqpt+1]
-		//line query.y:250
+//line query.y:325
 		{
 			found := false
 			for _, format := range supported_formats {
@@ -991,15 +1156,9 @@ sqdefault:
 				sqlex.(*sqLex).Error(fmt.Sprintf("No time format matching \"%v\" found", sqDollar[1].str))
 			}
 		}
-	case 36:
-		sqDollar = sqS[sqpt-1 : sqpt+1]
-		//line query.y:266
-		{
-			sqVAL.time = _time.Now()
-		}
-	case 37:
+	case 50:
 		sqDollar = sqS[sqpt-2 : sqpt+1]
-		//line query.y:272
+//line query.y:343
 		{
 			var err error
 			sqVAL.timediff, err = common.ParseReltime(sqDollar[1].str, sqDollar[2].str)
@@ -1007,9 +1166,9 @@ sqdefault:
 				sqlex.(*sqLex).Error(fmt.Sprintf("Error parsing relative time \"%v %v\" (%v)", sqDollar[1].str, sqDollar[2].str, err.Error()))
 			}
 		}
-	case 38:
+	case 51:
 		sqDollar = sqS[sqpt-3 : sqpt+1]
-		//line query.y:280
+//line query.y:351
 		{
 			newDuration, err := common.ParseReltime(sqDollar[1].str, sqDollar[2].str)
 			if err != nil {
@@ -1017,15 +1176,27 @@ sqdefault:
 			}
 			sqVAL.timediff = common.AddDurations(newDuration, sqDollar[3].timediff)
 		}
-	case 39:
+	case 52:
+		sqDollar = sqS[sqpt-0 : sqpt+1]
+//line query.y:363
+		{
+			sqVAL.timediff = 0
+		}
+	case 53:
+		sqDollar = sqS[sqpt-3 : sqpt+1]
+//line query.y:367
+		{
+			sqVAL.timediff = sqDollar[3].timediff
+		}
+	case 54:
 		sqDollar = sqS[sqpt-0 : sqpt+1]
-		//line query.y:290
+//line query.y:372
 		{
 			sqVAL.limit = Limit{Limit: -1, Streamlimit: -1}
 		}
-	case 40:
+	case 55:
 		sqDollar = sqS[sqpt-2 : sqpt+1]
-		//line query.y:294
+//line query.y:376
 		{
 			num, err := strconv.ParseInt(sqDollar[2].str, 10, 64)
 			if err != nil {
@@ -1033,9 +1204,9 @@ sqdefault:
 			}
 			sqVAL.limit = Limit{Limit: num, Streamlimit: -1}
 		}
-	case 41:
+	case 56:
 		sqDollar = sqS[sqpt-2 : sqpt+1]
-		//line query.y:302
+//line query.y:384
 		{
 			num, err := strconv.ParseInt(sqDollar[2].str, 10, 64)
 			if err != nil {
@@ -1043,9 +1214,9 @@ sqdefault:
 			}
 			sqVAL.limit = Limit{Limit: -1, Streamlimit: num}
 		}
-	case 42:
+	case 57:
 		sqDollar = sqS[sqpt-4 : sqpt+1]
-		//line query.y:310
+//line query.y:392
 		{
 			limit_num, err := strconv.ParseInt(sqDollar[2].str, 10, 64)
 			if err != nil {
@@ -1057,15 +1228,15 @@ sqdefault:
 			}
 			sqVAL.limit = Limit{Limit: limit_num, Streamlimit: slimit_num}
 		}
-	case 43:
+	case 58:
 		sqDollar = sqS[sqpt-0 : sqpt+1]
-		//line query.y:324
+//line query.y:406
 		{
 			sqVAL.timeconv = common.UOT_MS
 		}
-	case 44:
+	case 59:
 		sqDollar = sqS[sqpt-2 : sqpt+1]
-		//line query.y:328
+//line query.y:410
 		{
 			uot, err := common.ParseUOT(sqDollar[2].str)
 			if err != nil {
@@ -1073,89 +1244,95 @@ sqdefault:
 			}
 			sqVAL.timeconv = uot
 		}
-	case 45:
+	case 60:
 		sqDollar = sqS[sqpt-2 : sqpt+1]
-		//line query.y:340
+//line query.y:422
 		{
 			sqVAL.dict = sqDollar[2].dict
 		}
-	case 46:
+	case 61:
 		sqDollar = sqS[sqpt-3 : sqpt+1]
-		//line query.y:347
+//line query.y:429
 		{
 			sqVAL.dict = common.Dict{fixMongoKey(sqDollar[1].str): common.Dict{"$regex": sqDollar[3].str}}
 		}
-	case 47:
+	case 62:
 		sqDollar = sqS[sqpt-3 : sqpt+1]
-		//line query.y:351
+//line query.y:433
+		{
+			sqVAL.dict = common.Dict{fixMongoKey(sqDollar[1].str): common.Dict{"$regex": PathPrefixPattern(sqDollar[3].str)}}
+		}
+	case 63:
+		sqDollar = sqS[sqpt-3 : sqpt+1]
+//line query.y:437
 		{
 			sqVAL.dict = common.Dict{fixMongoKey(sqDollar[1].str): sqDollar[3].str}
 		}
-	case 48:
+	case 64:
 		sqDollar = sqS[sqpt-3 : sqpt+1]
-		//line query.y:355
+//line query.y:441
 		{
 			sqVAL.dict = common.Dict{fixMongoKey(sqDollar[1].str): sqDollar[3].str}
 		}
-	case 49:
+	case 65:
 		sqDollar = sqS[sqpt-3 : sqpt+1]
-		//line query.y:359
+//line query.y:445
 		{
 			sqVAL.dict = common.Dict{fixMongoKey(sqDollar[1].str): common.Dict{"$neq": sqDollar[3].str}}
 		}
-	case 50:
+	case 66:
 		sqDollar = sqS[sqpt-2 : sqpt+1]
-		//line query.y:363
+//line query.y:449
 		{
 			sqVAL.dict = common.Dict{fixMongoKey(sqDollar[2].str): common.Dict{"$exists": true}}
 		}
-	case 51:
+	case 67:
 		sqDollar = sqS[sqpt-3 : sqpt+1]
-		//line query.y:367
+//line query.y:453
 		{
 			sqVAL.dict = common.Dict{fixMongoKey(sqDollar[3].str): common.Dict{"$in": sqDollar[1].list}}
 		}
-	case 52:
+	case 68:
 		sqDollar = sqS[sqpt-4 : sqpt+1]
-		//line query.y:371
+//line query.y:457
 		{
 			sqVAL.dict = common.Dict{fixMongoKey(sqDollar[3].str): common.Dict{"$not": common.Dict{"$in": sqDollar[1].list}}}
 		}
-	case 53:
+	case 69:
 		sqDollar = sqS[sqpt-3 : sqpt+1]
-		//line query.y:375
+//line query.y:461
 		{
 			sqVAL.dict = sqDollar[2].dict
 		}
-	case 54:
+	case 70:
 		sqDollar = sqS[sqpt-1 : sqpt+1]
-		//line query.y:381
+//line query.y:467
 		{
 			sqVAL.str = sqDollar[1].str[1 : len(sqDollar[1].str)-1]
 		}
-	case 55:
+	case 71:
 		sqDollar = sqS[sqpt-1 : sqpt+1]
-		//line query.y:387
+//line query.y:473
 		{
 
 			sqlex.(*sqLex)._keys[sqDollar[1].str] = struct{}{}
 			sqVAL.str = cleantagstring(sqDollar[1].str)
 		}
-	case 56:
+	case 72:
 		sqDollar = sqS[sqpt-3 : sqpt+1]
-		//line query.y:395
+//line query.y:481
 		{
 			sqVAL.dict = common.Dict{"$and": []common.Dict{sqDollar[1].dict, sqDollar[3].dict}}
 		}
-	case 57:
+	case 73:
 		sqDollar = sqS[sqpt-3 : sqpt+1]
-		//line query.y:399
+//line query.y:485
 		{
 			sqVAL.dict = common.Dict{"$or": []common.Dict{sqDollar[1].dict, sqDollar[3].dict}}
 		}
-	case 58:
+	case 74:
 		sqDollar = sqS[sqpt-2 : sqpt+1]
-		//line query.y:403
+//line query.y:489
 		{
 			tmp := make(common.Dict)
 			for k, v := range sqDollar[2].dict {
@@ -1163,9 +1340,9 @@ sqdefault:
 			}
 			sqVAL.dict = tmp
 		}
-	case 59:
+	case 75:
 		sqDollar = sqS[sqpt-1 : sqpt+1]
-		//line query.y:411
+//line query.y:497
 		{
 			sqVAL.dict = sqDollar[1].dict
 		}
@@ -25,15 +25,18 @@ Notes here
     timeconv common.UnitOfTime
 	list List
 	time _time.Time
+	timeref TimeRef
     timediff _time.Duration
 }
 
-%token <str> SELECT DISTINCT DELETE SET APPLY STATISTICAL WINDOW STATISTICS
+%token <str> SELECT DISTINCT DELETE SET APPLY STATISTICAL WINDOW STATISTICS AUDIT EXPLAIN
+%token <str> CREATE DROP LIST QUERY QUERIES
+%token <str> STALE OLDER THAN
 %token <str> WHERE
 %token <str> DATA BEFORE AFTER LIMIT STREAMLIMIT NOW
 %token <str> LVALUE QSTRING
 %token <str> EQ NEQ COMMA ALL LEFTPIPE
-%token <str> LIKE AS
+%token <str> LIKE UNDER AS OF
 %token <str> AND OR HAS NOT IN TO
 %token <str> LPAREN RPAREN LBRACK RBRACK
 %token NUMBER
@@ -44,8 +47,9 @@ Notes here
 %type <dict> whereList whereTerm whereClause setList
 %type <list> selector tagList valueList valueListBrack
 %type <data> dataClause
-%type <time> timeref abstime
-%type <timediff> reltime
+%type <time> abstime asOf
+%type <timeref> timeref
+%type <timediff> reltime olderThan
 %type <limit> limit
 %type <timeconv> timeconv
 %type <str> NUMBER qstring lvalue TIMEUNIT
@@ -55,23 +59,73 @@ Notes here
 
 %%
 
-query		: SELECT selector whereClause SEMICOLON
+query		: statement
+			| EXPLAIN statement
+			{
+				sqlex.(*sqLex).query.explain = true
+			}
+			| continuousQuery
+			;
+
+/* continuous queries are window queries the archiver keeps running */
+continuousQuery : CREATE QUERY LVALUE AS SELECT dataClause whereClause SEMICOLON
+			{
+				sqlex.(*sqLex).query.name = $3
+				sqlex.(*sqLex).query.data = $6
+				sqlex.(*sqLex).query.where = $7
+				sqlex.(*sqLex).query.qtype = CREATE_TYPE
+			}
+			| DROP QUERY LVALUE SEMICOLON
+			{
+				sqlex.(*sqLex).query.name = $3
+				sqlex.(*sqLex).query.qtype = DROP_TYPE
+			}
+			| LIST QUERIES SEMICOLON
+			{
+				sqlex.(*sqLex).query.qtype = LIST_TYPE
+			}
+			;
+
+statement	: SELECT selector whereClause asOf SEMICOLON
 			{
 				sqlex.(*sqLex).query.Contents = $2
 				sqlex.(*sqLex).query.where = $3
+				sqlex.(*sqLex).query.asOf = $4
 				sqlex.(*sqLex).query.qtype = SELECT_TYPE
 			}
-			| SELECT selector SEMICOLON
+			| SELECT selector asOf SEMICOLON
 			{
 				sqlex.(*sqLex).query.Contents = $2
+				sqlex.(*sqLex).query.asOf = $3
 				sqlex.(*sqLex).query.qtype = SELECT_TYPE
 			}
-			| SELECT dataClause whereClause SEMICOLON
+			| SELECT dataClause whereClause asOf SEMICOLON
 			{
 				sqlex.(*sqLex).query.where = $3
 				sqlex.(*sqLex).query.data = $2
+				sqlex.(*sqLex).query.asOf = $4
 				sqlex.(*sqLex).query.qtype = DATA_TYPE
 			}
+			| SELECT AUDIT whereClause SEMICOLON
+			{
+				sqlex.(*sqLex).query.where = $3
+				sqlex.(*sqLex).query.qtype = AUDIT_TYPE
+			}
+			| SELECT AUDIT SEMICOLON
+			{
+				sqlex.(*sqLex).query.qtype = AUDIT_TYPE
+			}
+			| SELECT STALE whereClause olderThan SEMICOLON
+			{
+				sqlex.(*sqLex).query.where = $3
+				sqlex.(*sqLex).query.olderThan = $4
+				sqlex.(*sqLex).query.qtype = STALE_TYPE
+			}
+			| SELECT STALE olderThan SEMICOLON
+			{
+				sqlex.(*sqLex).query.olderThan = $3
+				sqlex.(*sqLex).query.qtype = STALE_TYPE
+			}
             | SET setList whereClause SEMICOLON
             {
 				sqlex.(*sqLex).query.where = $3
@@ -180,11 +234,11 @@ selector	: tagList
 
 dataClause : DATA IN LPAREN timeref COMMA timeref RPAREN limit timeconv
 			{
-				$$ = &DataQuery{Dtype: IN_TYPE, Start: $4, End: $6, Limit: $8, Timeconv: $9, IsStatistical: false, IsWindow: false}
+				$$ = &DataQuery{Dtype: IN_TYPE, Start: $4.Time, End: $6.Time, StartRef: $4, EndRef: $6, Limit: $8, Timeconv: $9, IsStatistical: false, IsWindow: false}
 			}
 		   | DATA IN timeref COMMA timeref limit timeconv
 			{
-				$$ = &DataQuery{Dtype: IN_TYPE, Start: $3, End: $5, Limit: $6, Timeconv: $7, IsStatistical: false, IsWindow: false}
+				$$ = &DataQuery{Dtype: IN_TYPE, Start: $3.Time, End: $5.Time, StartRef: $3, EndRef: $5, Limit: $6, Timeconv: $7, IsStatistical: false, IsWindow: false}
 			}
 		   | STATISTICAL LPAREN NUMBER RPAREN DATA IN LPAREN timeref COMMA timeref RPAREN limit timeconv
 			{
@@ -192,7 +246,7 @@ dataClause : DATA IN LPAREN timeref COMMA timeref RPAREN limit timeconv
                 if err != nil {
 				    sqlex.(*sqLex).Error(fmt.Sprintf("Could not parse integer \"%v\" (%v)", $1, err.Error()))
                 }
-				$$ = &DataQuery{Dtype: IN_TYPE, Start: $8, End: $10, Limit: $12, Timeconv: $13, IsStatistical: true, IsWindow: false, PointWidth: uint64(num)}
+				$$ = &DataQuery{Dtype: IN_TYPE, Start: $8.Time, End: $10.Time, StartRef: $8, EndRef: $10, Limit: $12, Timeconv: $13, IsStatistical: true, IsWindow: false, PointWidth: uint64(num)}
 			}
 		   | STATISTICS LPAREN NUMBER RPAREN DATA IN LPAREN timeref COMMA timeref RPAREN limit timeconv
 			{
@@ -200,7 +254,7 @@ dataClause : DATA IN LPAREN timeref COMMA timeref RPAREN limit timeconv
                 if err != nil {
 				    sqlex.(*sqLex).Error(fmt.Sprintf("Could not parse integer \"%v\" (%v)", $1, err.Error()))
                 }
-				$$ = &DataQuery{Dtype: IN_TYPE, Start: $8, End: $10, Limit: $12, Timeconv: $13, IsStatistical: true, IsWindow: false, PointWidth: uint64(num)}
+				$$ = &DataQuery{Dtype: IN_TYPE, Start: $8.Time, End: $10.Time, StartRef: $8, EndRef: $10, Limit: $12, Timeconv: $13, IsStatistical: true, IsWindow: false, PointWidth: uint64(num)}
 			}
 		   | WINDOW LPAREN NUMBER lvalue RPAREN DATA IN LPAREN timeref COMMA timeref RPAREN limit timeconv
 			{
@@ -208,25 +262,46 @@ dataClause : DATA IN LPAREN timeref COMMA timeref RPAREN limit timeconv
                 if err != nil {
 				    sqlex.(*sqLex).Error(fmt.Sprintf("Error parsing relative time \"%v %v\" (%v)", $3, $4, err.Error()))
                 }
-				$$ = &DataQuery{Dtype: IN_TYPE, Start: $9, End: $11, Limit: $13, Timeconv: $14, IsStatistical: false, IsWindow: true, Width: uint64(dur.Nanoseconds())}
+				$$ = &DataQuery{Dtype: IN_TYPE, Start: $9.Time, End: $11.Time, StartRef: $9, EndRef: $11, Limit: $13, Timeconv: $14, IsStatistical: false, IsWindow: true, Width: uint64(dur.Nanoseconds())}
 			}
 		   | DATA BEFORE timeref limit timeconv
 			{
-				$$ = &DataQuery{Dtype: BEFORE_TYPE, Start: $3, Limit: $4, Timeconv: $5, IsStatistical: false, IsWindow: false}
+				$$ = &DataQuery{Dtype: BEFORE_TYPE, Start: $3.Time, StartRef: $3, Limit: $4, Timeconv: $5, IsStatistical: false, IsWindow: false}
 			}
 		   | DATA AFTER timeref limit timeconv
 			{
-				$$ = &DataQuery{Dtype: AFTER_TYPE, Start: $3, Limit: $4, Timeconv: $5, IsStatistical: false, IsWindow: false}
+				$$ = &DataQuery{Dtype: AFTER_TYPE, Start: $3.Time, StartRef: $3, Limit: $4, Timeconv: $5, IsStatistical: false, IsWindow: false}
 			}
 		   ;
 
+/* evaluate the where clause against metadata as it was at the given time */
+asOf		: /* empty */
+			{
+				$$ = _time.Time{}
+			}
+			| AS OF timeref
+			{
+				$$ = $3.Time
+			}
+			;
+
 timeref		: abstime
 			{
-				$$ = $1
+				$$ = TimeRef{Time: $1}
 			}
 			| abstime reltime
 			{
-                $$ = $1.Add($2)
+                $$ = TimeRef{Time: $1.Add($2)}
+			}
+			| NOW
+			{
+                sqlex.(*sqLex).query.relative = true
+				$$ = TimeRef{Time: _time.Now(), Relative: true}
+			}
+			| NOW reltime
+			{
+                sqlex.(*sqLex).query.relative = true
+				$$ = TimeRef{Time: _time.Now().Add($2), Relative: true, Offset: $2}
 			}
 			;
 
@@ -261,10 +336,6 @@ abstime		: NUMBER LVALUE
                 if !found {
 				    sqlex.(*sqLex).Error(fmt.Sprintf("No time format matching \"%v\" found", $1))
                 }
-            }
-			| NOW
-            {
-                $$ = _time.Now()
             }
 			;
 
@@ -286,6 +357,17 @@ reltime		: NUMBER lvalue
             }
 			;
 
+/* streams quiet for longer than this are stale; if empty, those quiet for
+   longer than expected are */
+olderThan	: /* empty */
+			{
+				$$ = 0
+			}
+			| OLDER THAN reltime
+			{
+				$$ = $3
+			}
+			;
 limit		: /* empty */
 			{
 				$$ = Limit{Limit: -1, Streamlimit: -1}
@@ -347,6 +429,10 @@ whereTerm : lvalue LIKE qstring
 			{
 				$$ = common.Dict{fixMongoKey($1): common.Dict{"$regex": $3}}
 			}
+		  | lvalue UNDER qstring
+			{
+				$$ = common.Dict{fixMongoKey($1): common.Dict{"$regex": PathPrefixPattern($3)}}
+			}
 		  | lvalue EQ qstring
 			{
 				$$ = common.Dict{fixMongoKey($1): $3}
@@ -435,6 +521,14 @@ func (qt QueryType) String() string {
 		ret = "set"
 	case DATA_TYPE:
 		ret = "data"
+	case CREATE_TYPE:
+		ret = "create"
+	case DROP_TYPE:
+		ret = "drop"
+	case LIST_TYPE:
+		ret = "list"
+	case STALE_TYPE:
+		ret = "stale"
 	}
 	return ret
 }
@@ -450,8 +544,18 @@ type query struct {
 	where	  common.Dict
 	// are we querying distinct values?
 	distinct  bool
+	// evaluate the where clause against the metadata at this time
+	asOf      _time.Time
+	// report what the query would do instead of doing it
+	explain   bool
+	// the query refers to "now", so parsing it again gives different times
+	relative  bool
 	// list of tags to target for deletion, selection
 	Contents  []string
+	// the continuous query to create or drop
+	name      string
+	// select stale: how long streams must have been quiet
+	olderThan _time.Duration
 }
 
 func (q *query) Print() {
@@ -488,6 +592,16 @@ func NewSQLex(s string) *sqLex {
             {Token: APPLY, Pattern: "apply"},
 			{Token: DELETE, Pattern: "delete"},
 			{Token: DISTINCT, Pattern: "distinct"},
+			{Token: AUDIT, Pattern: "audit\\b"},
+			{Token: EXPLAIN, Pattern: "explain\\b"},
+			{Token: CREATE, Pattern: "create\\b"},
+			{Token: DROP, Pattern: "drop\\b"},
+			{Token: LIST, Pattern: "list\\b"},
+			{Token: QUERIES, Pattern: "queries\\b"},
+			{Token: QUERY, Pattern: "query\\b"},
+			{Token: STALE, Pattern: "stale\\b"},
+			{Token: OLDER, Pattern: "older\\b"},
+			{Token: THAN, Pattern: "than\\b"},
 			{Token: STATISTICAL, Pattern: "statistical"},
 			{Token: STATISTICS, Pattern: "statistics"},
 			{Token: WINDOW, Pattern: "window"},
@@ -501,6 +615,7 @@ func NewSQLex(s string) *sqLex {
 			{Token: COMMA, Pattern: ","},
 			{Token: AND, Pattern: "and"},
 			{Token: AS, Pattern: "as"},
+			{Token: OF, Pattern: "of\\b"},
 			{Token: TO, Pattern: "to"},
 			{Token: DATA, Pattern: "data"},
 			{Token: OR, Pattern: "or"},
@@ -517,6 +632,7 @@ func NewSQLex(s string) *sqLex {
 			{Token: SEMICOLON, Pattern: ";"},
 			{Token: NEWLINE, Pattern: "\n"},
 			{Token: LIKE, Pattern: "(like)|~"},
+			{Token: UNDER, Pattern: "under\\b"},
 			{Token: NUMBER, Pattern: "([+-]?([0-9]*\\.)?[0-9]+)"},
 			{Token: LVALUE, Pattern: "[a-zA-Z\\~\\$\\_][a-zA-Z0-9\\/\\%_\\-]*"},
 			{Token: QSTRING, Pattern: "(\"[^\"\\\\]*?(\\.[^\"\\\\]*?)*?\")|('[^'\\\\]*?(\\.[^'\\\\]*?)*?')"},
@@ -6,9 +6,12 @@ import (
 )
 
 type DataQuery struct {
-	Dtype         DataQueryType
-	Start         time.Time
-	End           time.Time
+	Dtype DataQueryType
+	Start time.Time
+	End   time.Time
+	// the times as written in the query; see Resolve
+	StartRef      TimeRef
+	EndRef        TimeRef
 	Limit         Limit
 	Timeconv      common.UnitOfTime
 	IsStatistical bool
@@ -17,6 +20,35 @@ type DataQuery struct {
 	PointWidth    uint64
 }
 
+// Resolve works out the Start and End of the query again for the given
+// time, so that "now" need not be the time the query was parsed
+func (dq *DataQuery) Resolve(now time.Time) {
+	dq.Start = dq.StartRef.At(now)
+	dq.End = dq.EndRef.At(now)
+}
+
+// true if the start of the range moves with "now", so readings age out of it
+func (dq *DataQuery) IsRolling() bool {
+	return dq.Dtype == IN_TYPE && dq.StartRef.Relative
+}
+
+// TimeRef is a time in a query. Times relative to "now" keep their offset
+// from it, so they can be worked out again as time passes
+type TimeRef struct {
+	// the time when the query was parsed
+	Time     time.Time
+	Relative bool
+	Offset   time.Duration
+}
+
+// returns the time, taking now as the current time if it is relative
+func (t TimeRef) At(now time.Time) time.Time {
+	if t.Relative {
+		return now.Add(t.Offset)
+	}
+	return t.Time
+}
+
 type Limit struct {
 	Limit       int64
 	Streamlimit int64
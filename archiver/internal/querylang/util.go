@@ -1,6 +1,7 @@
 package querylang
 
 import (
+	"regexp"
 	"strings"
 )
 
@@ -10,3 +11,11 @@ func cleantagstring(inp string) string {
 	tmp = strings.Replace(tmp, "/", ".", -1)
 	return tmp
 }
+
+// PathPrefixPattern returns a regular expression matching the path prefix and
+// everything beneath it, but not its siblings: "/a/b" matches "/a/b" and
+// "/a/b/c" but not "/a/bc". Anchored at the start so that Mongo can use the
+// index on Path
+func PathPrefixPattern(prefix string) string {
+	return "^" + regexp.QuoteMeta(strings.TrimSuffix(prefix, "/")) + "(/|$)"
+}
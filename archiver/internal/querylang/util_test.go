@@ -1,6 +1,11 @@
 package querylang
 
-import "testing"
+import (
+	"github.com/gtfierro/giles2/common"
+	"regexp"
+	"testing"
+	"time"
+)
 
 func TestCleanTagString(t *testing.T) {
 	var x, y, z string
@@ -11,3 +16,136 @@ func TestCleanTagString(t *testing.T) {
 		t.Error(y, " should = ", z)
 	}
 }
+
+func TestPathUnder(t *testing.T) {
+	pq := NewQueryProcessor().Parse(`select * where Path under "/building1/floor2/"`)
+	if pq.Err != nil {
+		t.Fatal(pq.Err)
+	}
+	pattern := pq.Where["Path"].(common.Dict)["$regex"]
+	if pattern != `^/building1/floor2(/|$)` {
+		t.Error(pattern, " should = ", `^/building1/floor2(/|$)`)
+	}
+	re := regexp.MustCompile(pattern.(string))
+	for path, matches := range map[string]bool{
+		"/building1/floor2":    true,
+		"/building1/floor2/s0": true,
+		"/building1/floor20":   false,
+		"/building1":           false,
+	} {
+		if re.MatchString(path) != matches {
+			t.Error(path, " matching ", pattern, " should = ", matches)
+		}
+	}
+
+	// keys that begin with "under" are still keys
+	pq = NewQueryProcessor().Parse(`select * where understudy = "x"`)
+	if pq.Err != nil {
+		t.Fatal(pq.Err)
+	}
+	if pq.Where["understudy"] != "x" {
+		t.Error(pq.Where, " should match understudy")
+	}
+}
+
+func TestAsOf(t *testing.T) {
+	qp := NewQueryProcessor()
+	march, _ := time.Parse("1/2/2006", "3/1/2016")
+	for _, querystring := range []string{
+		`select uuid where Metadata/Zone = "3" as of "3/1/2016"`,
+		`select * as of "3/1/2016"`,
+		`select data in ("1/1/2016", "4/1/2016") as s where Metadata/Zone = "3" as of "3/1/2016"`,
+	} {
+		pq := qp.Parse(querystring)
+		if pq.Err != nil {
+			t.Error(querystring, pq.Err)
+		} else if !pq.AsOf.Equal(march) {
+			t.Error(querystring, " as of ", pq.AsOf, " should = ", march)
+		}
+	}
+	if pq := qp.Parse(`select uuid where Metadata/Zone = "3"`); !pq.AsOf.IsZero() {
+		t.Error("queries without as of should have no time, not ", pq.AsOf)
+	}
+	// keys that begin with "of" are still keys
+	if pq := qp.Parse(`select office_temp where uuid = "x"`); pq.Err != nil || len(pq.Target) != 1 || pq.Target[0] != "office_temp" {
+		t.Error("office_temp should be selected, not ", pq.Target, pq.Err)
+	}
+}
+
+func TestRelativeTimes(t *testing.T) {
+	qp := NewQueryProcessor()
+	pq := qp.Parse(`select data in (now -1h, now) where Metadata/Zone = "3"`)
+	if pq.Err != nil {
+		t.Fatal(pq.Err)
+	}
+	if !pq.Data.StartRef.Relative || pq.Data.StartRef.Offset != -time.Hour || !pq.Data.EndRef.Relative {
+		t.Error("now -1h should be relative to now, not ", pq.Data.StartRef)
+	}
+	if !pq.Data.IsRolling() {
+		t.Error("ranges starting relative to now should roll")
+	}
+	later := time.Now().Add(time.Minute)
+	pq.Data.Resolve(later)
+	if !pq.Data.Start.Equal(later.Add(-time.Hour)) || !pq.Data.End.Equal(later) {
+		t.Error("resolved range should be ", later.Add(-time.Hour), later, " not ", pq.Data.Start, pq.Data.End)
+	}
+
+	pq = qp.Parse(`select data in ("1/1/2016", now) where Metadata/Zone = "3"`)
+	if pq.Data.StartRef.Relative || pq.Data.IsRolling() {
+		t.Error("ranges starting at a fixed time should not roll")
+	}
+	pq.Data.Resolve(later)
+	if march, _ := time.Parse("1/2/2006", "1/1/2016"); !pq.Data.Start.Equal(march) {
+		t.Error("fixed times should not change when resolved, not ", pq.Data.Start)
+	}
+}
+
+func TestContinuousQueries(t *testing.T) {
+	qp := NewQueryProcessor()
+	pq := qp.Parse(`create query power15 as select window(15min) data in (now -1d, now) where Metadata/Type = "Power"`)
+	if pq.Err != nil {
+		t.Fatal(pq.Err)
+	}
+	if pq.QueryType != CREATE_TYPE || pq.Name != "power15" || !pq.Data.IsWindow || pq.Data.Width != uint64(15*time.Minute) {
+		t.Error("should create power15 with 15 minute windows, not ", pq.QueryType, pq.Name, pq.Data)
+	}
+	if pq.Where["Metadata.Type"] != "Power" {
+		t.Error("where clause should be kept, not ", pq.Where)
+	}
+	if pq = qp.Parse(`drop query power15`); pq.Err != nil || pq.QueryType != DROP_TYPE || pq.Name != "power15" {
+		t.Error("should drop power15, not ", pq.QueryType, pq.Name, pq.Err)
+	}
+	if pq = qp.Parse(`list queries`); pq.Err != nil || pq.QueryType != LIST_TYPE {
+		t.Error("should list queries, not ", pq.QueryType, pq.Err)
+	}
+	if pq = qp.Parse(`explain drop query power15`); pq.Err == nil {
+		t.Error("continuous queries cannot be explained")
+	}
+}
+
+func TestStaleQueries(t *testing.T) {
+	qp := NewQueryProcessor()
+	pq := qp.Parse(`select stale where Metadata/Type = "Temperature" older than 1h`)
+	if pq.Err != nil {
+		t.Fatal(pq.Err)
+	}
+	if pq.QueryType != STALE_TYPE || pq.OlderThan != time.Hour || pq.Where["Metadata.Type"] != "Temperature" {
+		t.Error("should select streams of type Temperature quiet for an hour, not ", pq.QueryType, pq.OlderThan, pq.Where)
+	}
+	if pq = qp.Parse(`select stale where Metadata/Type = "Temperature"`); pq.Err != nil || pq.QueryType != STALE_TYPE || pq.OlderThan != 0 {
+		t.Error("should select stale streams, not ", pq.QueryType, pq.OlderThan, pq.Err)
+	}
+	if pq = qp.Parse(`select stale older than 2d`); pq.Err != nil || pq.Where != nil || pq.OlderThan != 48*time.Hour {
+		t.Error("should select all streams quiet for two days, not ", pq.Where, pq.OlderThan, pq.Err)
+	}
+}
+
+// keys may begin with keywords
+func TestKeywordPrefixes(t *testing.T) {
+	qp := NewQueryProcessor()
+	for _, key := range []string{"auditor", "explained", "created", "dropped", "listed", "queries_run", "query_time", "stale_count", "older_value", "thank"} {
+		if pq := qp.Parse(`select ` + key + ` where uuid = "x"`); pq.Err != nil || len(pq.Target) != 1 || pq.Target[0] != key {
+			t.Error(key, " should be selected, not ", pq.Target, pq.Err)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package archiver
+
+import (
+	"github.com/gtfierro/giles2/common"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The broker journals the messages carrying readings in the order they are
+// committed, stamped with their commit time: nanoseconds since the epoch,
+// made strictly increasing. Transports that can resume a client (Server-Sent
+// Events) use the commit time of the last message they delivered as the
+// position of the client, and are given the messages committed after it when
+// the client comes back. Unlike selecting by reading timestamps, this also
+// catches up readings that arrived late or were backfilled. The journal keeps
+// the messages of the last journalRetention, and at most journalSize of them.
+// Copies of a message forwarded to a subscriber, e.g. with the readings past
+// the end of its range left out, are journaled as aliases of the message, so
+// they have its commit time.
+
+// how long messages are kept in the journal
+var journalRetention = 10 * time.Minute
+
+const journalSize = 10000
+
+type journalEntry struct {
+	committed uint64
+	msg       *common.SmapMessage
+	// copies of msg with the same commit time
+	aliases []*common.SmapMessage
+}
+
+type journal struct {
+	// oldest first
+	entries []journalEntry
+	// commit time of the messages in entries
+	index map[*common.SmapMessage]uint64
+	// commit time of the newest message, and of the newest one dropped
+	last    uint64
+	dropped uint64
+	sync.Mutex
+}
+
+func newJournal() *journal {
+	return &journal{index: make(map[*common.SmapMessage]uint64)}
+}
+
+// journals the message as committed at now, and returns its commit time
+func (j *journal) record(msg *common.SmapMessage, now time.Time) uint64 {
+	j.Lock()
+	defer j.Unlock()
+	committed := uint64(now.UnixNano())
+	if committed <= j.last {
+		committed = j.last + 1
+	}
+	j.last = committed
+	j.entries = append(j.entries, journalEntry{committed: committed, msg: msg})
+	j.index[msg] = committed
+
+	oldest := uint64(now.Add(-journalRetention).UnixNano())
+	drop := 0
+	for drop < len(j.entries) && (len(j.entries)-drop > journalSize || j.entries[drop].committed < oldest) {
+		j.dropped = j.entries[drop].committed
+		delete(j.index, j.entries[drop].msg)
+		for _, alias := range j.entries[drop].aliases {
+			delete(j.index, alias)
+		}
+		drop++
+	}
+	if drop > 0 {
+		j.entries = append(j.entries[:0], j.entries[drop:]...)
+	}
+	return committed
+}
+
+// gives the copy of the message the commit time of the message, as long as
+// the message is in the journal
+func (j *journal) alias(copy, msg *common.SmapMessage) {
+	j.Lock()
+	defer j.Unlock()
+	committed, found := j.index[msg]
+	if !found {
+		return
+	}
+	i := sort.Search(len(j.entries), func(i int) bool { return j.entries[i].committed >= committed })
+	if i < len(j.entries) && j.entries[i].msg == msg {
+		j.entries[i].aliases = append(j.entries[i].aliases, copy)
+		j.index[copy] = committed
+	}
+}
+
+// returns the commit time of the message; found is false if it is not in
+// the journal
+func (j *journal) committed(msg *common.SmapMessage) (committed uint64, found bool) {
+	j.Lock()
+	defer j.Unlock()
+	committed, found = j.index[msg]
+	return
+}
+
+// returns the commit time of the newest message
+func (j *journal) newest() uint64 {
+	j.Lock()
+	defer j.Unlock()
+	return j.last
+}
+
+// returns the messages of the streams committed after [since]. complete is
+// false if messages committed after [since] have already been dropped
+func (j *journal) since(since uint64, streams map[common.UUID]bool) (msgs common.SmapMessageList, complete bool) {
+	j.Lock()
+	defer j.Unlock()
+	for _, entry := range j.entries {
+		if entry.committed > since && streams[entry.msg.UUID] {
+			msgs = append(msgs, entry.msg)
+		}
+	}
+	return msgs, since >= j.dropped
+}
@@ -0,0 +1,106 @@
+package archiver
+
+import (
+	"github.com/gtfierro/giles2/common"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestSubscriptionEvents(t *testing.T) {
+	a, _, _ := newFakeArchiver()
+	reading := func(uuid common.UUID, ms uint64) *common.SmapMessage {
+		return &common.SmapMessage{Path: "/" + string(uuid), UUID: uuid, Metadata: common.Dict{"Zone": "3"}, Readings: []common.Reading{&common.SmapNumberReading{Time: ms, Value: 1}}}
+	}
+	assert.NoError(t, a.AddData("test", reading("aaaa", 1351043674000)))
+
+	query := `select data before now where Metadata/Zone = "3"`
+	subscribe := func(events bool) *Subscriber {
+		sub := NewSubscriber(make(chan bool), 10, func(err error) { t.Error(err) })
+		if events {
+			sub.ReceiveEvents()
+		}
+		go a.HandleNewSubscriber(sub, query)
+		<-sub.C
+		return sub
+	}
+	plain, evented := subscribe(false), subscribe(true)
+	next := func(sub *Subscriber) QueryResult {
+		select {
+		case val := <-sub.C:
+			return val
+		case <-time.After(time.Second):
+			t.Fatal("nothing delivered")
+		}
+		return nil
+	}
+
+	// only subscribers that receive events are told about the new stream
+	late := reading("bbbb", 1351043000000)
+	assert.NoError(t, a.AddData("test", late))
+	assert.Equal(t, SubscriptionDiff{Query: query + ";", Added: []common.UUID{"bbbb"}}, next(evented))
+	assert.Equal(t, late, next(evented))
+	assert.Equal(t, late, next(plain))
+	assert.Empty(t, plain.C)
+
+	// readings committed after a message are found whatever their timestamps
+	first := reading("aaaa", 1351043680000)
+	assert.NoError(t, a.AddData("test", first))
+	assert.NoError(t, a.AddData("test", reading("cccc", 1351043681000)))
+	backfilled := reading("bbbb", 1351043001000)
+	assert.NoError(t, a.AddData("test", backfilled))
+	committed, found := a.Committed(first)
+	assert.True(t, found)
+	missed, err := a.SelectCommittedSince(query, committed)
+	assert.NoError(t, err)
+	assert.Equal(t, common.SmapMessageList{journaled(t, a, "cccc"), backfilled}, missed)
+}
+
+// the journaled message of the stream
+func journaled(t *testing.T, a *Archiver, uuid common.UUID) *common.SmapMessage {
+	a.broker.journal.Lock()
+	defer a.broker.journal.Unlock()
+	for _, entry := range a.broker.journal.entries {
+		if entry.msg.UUID == uuid {
+			return entry.msg
+		}
+	}
+	t.Fatalf("%v not journaled", uuid)
+	return nil
+}
+
+func TestJournal(t *testing.T) {
+	j := newJournal()
+	now := time.Now()
+	msgs := []*common.SmapMessage{{UUID: "aaaa"}, {UUID: "bbbb"}, {UUID: "aaaa"}}
+	// commit times are increasing even if the clock is not
+	first := j.record(msgs[0], now)
+	second := j.record(msgs[1], now)
+	assert.True(t, second > first)
+	assert.Equal(t, second, j.newest())
+	_, found := j.committed(&common.SmapMessage{})
+	assert.False(t, found, "unknown messages have no commit time")
+
+	// copies of a message have its commit time
+	trimmed := &common.SmapMessage{UUID: "aaaa"}
+	j.alias(trimmed, msgs[0])
+	committed, found := j.committed(trimmed)
+	assert.True(t, found)
+	assert.Equal(t, first, committed)
+
+	missed, complete := j.since(first, map[common.UUID]bool{"aaaa": true, "bbbb": true})
+	assert.True(t, complete)
+	assert.Equal(t, common.SmapMessageList{msgs[1]}, missed)
+
+	// messages older than journalRetention are dropped
+	third := j.record(msgs[2], now.Add(journalRetention+time.Second))
+	missed, complete = j.since(first, map[common.UUID]bool{"aaaa": true})
+	assert.False(t, complete)
+	assert.Equal(t, common.SmapMessageList{msgs[2]}, missed)
+	committed, found = j.committed(msgs[2])
+	assert.True(t, found)
+	assert.Equal(t, third, committed)
+	_, found = j.committed(msgs[0])
+	assert.False(t, found, "nor do dropped messages")
+	assert.Len(t, j.index, 1)
+}
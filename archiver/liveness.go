@@ -0,0 +1,334 @@
+package archiver
+
+import (
+	"github.com/gtfierro/giles2/common"
+	"gopkg.in/mgo.v2/bson"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The broker keeps the time the last reading of each stream arrived and
+// learns how often the stream reports from the gaps between them. A stream
+// with the metadata
+//    Metadata/ReportingInterval = "5min"
+// is expected to report that often instead. A stream is stale once it has
+// been quiet for staleFactor of its expected intervals, and live again when
+// its next reading arrives; the subscribers of the stream are sent a
+// LivenessChange on each transition. "select stale where ..." lists the
+// matching streams that are stale, and "select stale where ... older than 1h"
+// those that have been quiet for longer than an hour.
+
+// how often streams are checked for going quiet
+var livenessInterval = 10 * time.Second
+
+// a stream is stale once it has been quiet for this many expected intervals
+const staleFactor = 3
+
+// the weight of the latest gap between readings in the learned interval
+const learningRate = 0.125
+
+// liveness states
+const (
+	STREAM_LIVE  = "live"
+	STREAM_STALE = "stale"
+)
+
+// Delivered to the subscribers of a stream when it goes stale or comes back
+type LivenessChange struct {
+	UUID     common.UUID
+	State    string
+	LastSeen time.Time
+	// the expected interval between readings
+	Interval time.Duration
+}
+
+func (change LivenessChange) IsResult() {}
+
+type streamLiveness struct {
+	lastSeen time.Time
+	// moving average of the gaps between readings
+	learned time.Duration
+	stale   bool
+	// from Metadata/ReportingInterval, overrides the learned interval
+	reporting time.Duration
+}
+
+// the interval the stream is expected to report at; zero if not known
+func (s *streamLiveness) expected() time.Duration {
+	if s.reporting > 0 {
+		return s.reporting
+	}
+	return s.learned
+}
+
+// livenessTracker holds the liveness of the streams that have sent readings
+// since the archiver started, or that have a reporting interval
+type livenessTracker struct {
+	streams map[common.UUID]*streamLiveness
+	// when the tracker started; streams without readings since count from here
+	started time.Time
+	sync.Mutex
+}
+
+func newLivenessTracker() *livenessTracker {
+	return &livenessTracker{
+		streams: make(map[common.UUID]*streamLiveness),
+		started: time.Now(),
+	}
+}
+
+// records that a reading of the stream arrived at now. Returns the change if
+// the stream was stale
+func (l *livenessTracker) observe(uuid common.UUID, now time.Time) *LivenessChange {
+	l.Lock()
+	defer l.Unlock()
+	s, found := l.streams[uuid]
+	if !found {
+		l.streams[uuid] = &streamLiveness{lastSeen: now}
+		return nil
+	}
+	// streams with a reporting interval may be tracked before their first reading
+	if !s.lastSeen.IsZero() {
+		gap := now.Sub(s.lastSeen)
+		if s.learned == 0 {
+			s.learned = gap
+		} else if gap > 0 {
+			s.learned += time.Duration(learningRate * float64(gap-s.learned))
+		}
+	}
+	s.lastSeen = now
+	if !s.stale {
+		return nil
+	}
+	s.stale = false
+	return &LivenessChange{UUID: uuid, State: STREAM_LIVE, LastSeen: now, Interval: s.expected()}
+}
+
+// returns when the last reading of the stream arrived (or, once trackLiveness
+// has seen it, was stored), or when the tracker started if there is none
+func (l *livenessTracker) lastSeen(uuid common.UUID) time.Time {
+	l.Lock()
+	defer l.Unlock()
+	if s, found := l.streams[uuid]; found && !s.lastSeen.IsZero() {
+		return s.lastSeen
+	}
+	return l.started
+}
+
+// runs checkLiveness every livenessInterval
+func (a *Archiver) startLiveness() {
+	go func() {
+		for now := range time.Tick(livenessInterval) {
+			a.broker.checkLiveness(now)
+		}
+	}()
+}
+
+// marks the streams that have been quiet for too long as stale and tells
+// their subscribers
+func (b *Broker) checkLiveness(now time.Time) {
+	intervals, err := b.a.reportingIntervals()
+	if err != nil {
+		log.Errorf("Could not get reporting intervals (%v)", err)
+	}
+	var withInterval []common.UUID
+	for uuid := range intervals {
+		withInterval = append(withInterval, uuid)
+	}
+	b.trackLiveness(withInterval, now)
+
+	var changes []LivenessChange
+	b.liveness.Lock()
+	for uuid, s := range b.liveness.streams {
+		s.reporting = intervals[uuid]
+		last := s.lastSeen
+		if last.IsZero() {
+			last = b.liveness.started
+		}
+		if expected := s.expected(); !s.stale && expected > 0 && now.Sub(last) > staleFactor*expected {
+			s.stale = true
+			changes = append(changes, LivenessChange{UUID: uuid, State: STREAM_STALE, LastSeen: s.lastSeen, Interval: expected})
+		}
+	}
+	b.liveness.Unlock()
+	b.publishLiveness(changes)
+}
+
+// starts tracking the streams that are not yet tracked. Those that have not
+// sent readings since the archiver started were last seen when their last
+// reading was stored
+func (b *Broker) trackLiveness(uuids []common.UUID, now time.Time) {
+	var unseen []common.UUID
+	b.liveness.Lock()
+	for _, uuid := range uuids {
+		if _, found := b.liveness.streams[uuid]; !found {
+			unseen = append(unseen, uuid)
+		}
+	}
+	b.liveness.Unlock()
+	if len(unseen) == 0 {
+		return
+	}
+	stored, err := b.a.lastReadings(unseen, now)
+	if err != nil {
+		log.Errorf("Could not get last readings (%v)", err)
+		return
+	}
+	b.liveness.Lock()
+	for _, uuid := range unseen {
+		if _, found := b.liveness.streams[uuid]; !found {
+			b.liveness.streams[uuid] = &streamLiveness{lastSeen: stored[uuid]}
+		}
+	}
+	b.liveness.Unlock()
+}
+
+// sends the liveness changes to the subscribers of their streams that
+// receive events
+func (b *Broker) publishLiveness(changes []LivenessChange) {
+	for _, change := range changes {
+		var subscribers []*Subscriber
+		b.subscribersLock.RLock()
+		if list, found := b.subscribers[change.UUID]; found {
+			for _, sub := range *list {
+				if sub.events {
+					subscribers = append(subscribers, sub)
+				}
+			}
+		}
+		b.subscribersLock.RUnlock()
+		for _, sub := range subscribers {
+			if err := sub.QueueToSend(change); err != nil {
+				log.Warningf("Could not deliver liveness change to subscriber (%v)", err)
+			}
+		}
+	}
+}
+
+// returns the reporting intervals of the streams with a valid
+// Metadata/ReportingInterval
+func (a *Archiver) reportingIntervals() (map[common.UUID]time.Duration, error) {
+	intervals := make(map[common.UUID]time.Duration)
+	values, err := a.mdStore.GetDistinct("Metadata.ReportingInterval", bson.M{"Metadata.ReportingInterval": bson.M{"$exists": true}})
+	if err != nil {
+		return intervals, err
+	}
+	for _, value := range values {
+		interval, err := common.ParseDuration(value)
+		if err != nil || interval <= 0 {
+			log.Warningf("Ignoring invalid ReportingInterval %v (%v)", value, err)
+			continue
+		}
+		uuids, err := a.mdStore.GetUUIDs(bson.M{"Metadata.ReportingInterval": value})
+		if err != nil {
+			return intervals, err
+		}
+		for _, uuid := range uuids {
+			intervals[uuid] = interval
+		}
+	}
+	return intervals, nil
+}
+
+// returns the times of the last stored readings of the streams before now.
+// Streams without readings are left out
+func (a *Archiver) lastReadings(uuids []common.UUID, now time.Time) (map[common.UUID]time.Time, error) {
+	last := make(map[common.UUID]time.Time)
+	if len(uuids) == 0 {
+		return last, nil
+	}
+	prev, err := a.tsStore.Prev(uuids, uint64(now.UnixNano()))
+	if err != nil {
+		return last, err
+	}
+	for _, resp := range prev {
+		if len(resp.Readings) == 0 {
+			continue
+		}
+		t := resp.Readings[len(resp.Readings)-1].Time
+		ns, err := common.ConvertTime(t, common.GuessTimeUnit(t), common.UOT_NS)
+		if err != nil {
+			return last, err
+		}
+		last[resp.UUID] = time.Unix(0, int64(ns))
+	}
+	return last, nil
+}
+
+// SelectStale returns the streams matching the where clause that have been
+// quiet for longer than params.OlderThan or, if it is zero, that are stale
+func (a *Archiver) SelectStale(params *common.StaleParams) (common.StaleStreams, error) {
+	where := params.Where
+	if where == nil {
+		where = common.Dict{}
+	}
+	matched, err := a.broker.uuids.getUUIDs(a.mdStore, where)
+	if err != nil {
+		return nil, err
+	}
+	// virtual streams have no readings of their own
+	stored, _ := a.virtuals.split(matched)
+	intervals, err := a.reportingIntervals()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		now    = time.Now()
+		stale  = common.StaleStreams{}
+		unseen []common.UUID
+	)
+	l := a.broker.liveness
+	l.Lock()
+	for _, uuid := range stored {
+		s, found := l.streams[uuid]
+		if !found || s.lastSeen.IsZero() {
+			unseen = append(unseen, uuid)
+			continue
+		}
+		interval := s.expected()
+		if reporting, found := intervals[uuid]; found {
+			interval = reporting
+		}
+		if isStale(params.OlderThan, now, s.lastSeen, interval) {
+			stale = append(stale, common.StaleStream{UUID: uuid, LastSeen: s.lastSeen, Interval: interval})
+		}
+	}
+	l.Unlock()
+	// streams that have not sent readings since the archiver started
+	last, err := a.lastReadings(unseen, now)
+	if err != nil {
+		return nil, err
+	}
+	for _, uuid := range unseen {
+		quiet := last[uuid]
+		if quiet.IsZero() {
+			quiet = l.started
+		}
+		if isStale(params.OlderThan, now, quiet, intervals[uuid]) {
+			stale = append(stale, common.StaleStream{UUID: uuid, LastSeen: last[uuid], Interval: intervals[uuid]})
+		}
+	}
+	sort.Sort(quietestFirst(stale))
+	return stale, nil
+}
+
+// a stream last seen at the given time is stale if it has been quiet for
+// longer than olderThan or, if that is zero, for staleFactor of its interval
+func isStale(olderThan time.Duration, now, last time.Time, interval time.Duration) bool {
+	if olderThan > 0 {
+		return now.Sub(last) > olderThan
+	}
+	return interval > 0 && now.Sub(last) > staleFactor*interval
+}
+
+type quietestFirst common.StaleStreams
+
+func (qf quietestFirst) Len() int      { return len(qf) }
+func (qf quietestFirst) Swap(i, j int) { qf[i], qf[j] = qf[j], qf[i] }
+func (qf quietestFirst) Less(i, j int) bool {
+	if qf[i].LastSeen.Equal(qf[j].LastSeen) {
+		return qf[i].UUID < qf[j].UUID
+	}
+	return qf[i].LastSeen.Before(qf[j].LastSeen)
+}
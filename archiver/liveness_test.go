@@ -0,0 +1,74 @@
+package archiver
+
+import (
+	"github.com/gtfierro/giles2/common"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestLiveness(t *testing.T) {
+	a, ts, _ := newFakeArchiver()
+	var (
+		steady     = common.NewUUID()
+		configured = common.NewUUID()
+		other      = common.NewUUID()
+		archived   = common.NewUUID()
+		now        = time.Now()
+		// the last reading of archived was stored before the archiver started
+		stored = uint64(now.Add(-2*time.Hour).UnixNano() / 1e6)
+	)
+	for uuid, md := range map[common.UUID]common.Dict{
+		steady:     {"Type": "Temperature"},
+		configured: {"Type": "Temperature", "ReportingInterval": "1min"},
+		other:      {"Type": "Humidity"},
+		archived:   {"Type": "Humidity"},
+	} {
+		assert.NoError(t, a.AddData("test", &common.SmapMessage{Path: "/" + string(uuid), UUID: uuid, Metadata: md}))
+	}
+	ts.AddMessage(&common.SmapMessage{UUID: archived, Readings: []common.Reading{&common.SmapNumberReading{Time: stored, Value: 1}}})
+
+	// steady reports every 10 minutes, but has been quiet for 31
+	a.broker.liveness.observe(steady, now.Add(-41*time.Minute))
+	a.broker.liveness.observe(steady, now.Add(-31*time.Minute))
+	a.broker.liveness.observe(configured, now.Add(-2*time.Minute))
+	a.broker.liveness.observe(other, now.Add(-90*time.Minute))
+
+	sub := NewSubscriber(make(chan bool), 10, func(error) {})
+	sub.ReceiveEvents()
+	a.broker.addSubscriberToStream(steady, sub)
+	a.broker.checkLiveness(now)
+	if assert.Len(t, sub.C, 1) {
+		change := (<-sub.C).(LivenessChange)
+		assert.Equal(t, LivenessChange{UUID: steady, State: STREAM_STALE, LastSeen: now.Add(-31 * time.Minute), Interval: 10 * time.Minute}, change)
+	}
+
+	uuids := func(query string) (ret []common.UUID) {
+		res, err := a.HandleQuery("test", query)
+		assert.NoError(t, err, query)
+		for _, stream := range res.(common.StaleStreams) {
+			ret = append(ret, stream.UUID)
+		}
+		return
+	}
+	assert.Equal(t, []common.UUID{steady}, uuids(`select stale where Metadata/Type = "Temperature"`))
+	assert.Equal(t, []common.UUID{steady, configured}, uuids(`select stale where Metadata/Type = "Temperature" older than 1min`))
+	// quietest first; streams without readings since the archiver started
+	// were last seen when their last reading was stored
+	assert.Equal(t, []common.UUID{archived, other}, uuids(`select stale older than 1h`))
+	res, _ := a.HandleQuery("test", `select stale where Metadata/Type = "Humidity" older than 1h`)
+	if stale := res.(common.StaleStreams); assert.Len(t, stale, 2) {
+		assert.Equal(t, time.Unix(0, int64(stored*1e6)), stale[0].LastSeen)
+	}
+
+	// streams go stale once, and are live again with their next reading
+	a.broker.checkLiveness(now.Add(4 * time.Minute))
+	assert.Empty(t, sub.C)
+	assert.NoError(t, a.AddData("test", &common.SmapMessage{UUID: steady, Readings: []common.Reading{&common.SmapNumberReading{Time: uint64(time.Now().UnixNano() / 1e6), Value: 20}}}))
+	if assert.Len(t, sub.C, 2) {
+		change := (<-sub.C).(LivenessChange)
+		assert.Equal(t, STREAM_LIVE, change.State)
+		assert.IsType(t, &common.SmapMessage{}, <-sub.C)
+	}
+	assert.Empty(t, uuids(`select stale where Metadata/Type = "Temperature" older than 10min`))
+}
@@ -3,6 +3,7 @@ package archiver
 import (
 	"github.com/gtfierro/giles2/common"
 	"gopkg.in/mgo.v2/bson"
+	"time"
 )
 
 type MetadataStore interface {
@@ -14,11 +15,78 @@ type MetadataStore interface {
 	GetDistinct(tag string, where bson.M) (common.DistinctResult, error)
 	GetUUIDs(where bson.M) ([]common.UUID, error)
 
-	SaveTags(msg *common.SmapMessage) error
+	// Every change to a stream's document is kept as a version valid until
+	// the next change. These evaluate the where clause against the versions
+	// that were current at the given time
+	GetTagsAsOf(tags []string, where bson.M, at time.Time) (common.SmapMessageList, error)
+	GetDistinctAsOf(tag string, where bson.M, at time.Time) (common.DistinctResult, error)
+	GetUUIDsAsOf(where bson.M, at time.Time) ([]common.UUID, error)
 
-	UpdateDocs(updates, where bson.M) error
+	// ExplainWhere returns the filter the where clause is translated to and
+	// a description of how the store evaluates it (e.g. the index it uses).
+	// If at is not zero, it is explained as of that time
+	ExplainWhere(where bson.M, at time.Time) (filter bson.M, plan string, err error)
 
-	//TODO: add feedback on how many docs changed/removed/etc. This requires a specialized struct
-	RemoveTags(tags []string, where bson.M) error
-	RemoveDocs(where bson.M) error
+	// SaveTags records the keys it saves as set explicitly on the stream.
+	// Returns the (dotted) keys of the stream's document that changed
+	SaveTags(msg *common.SmapMessage) ([]string, error)
+
+	// groups the streams at or beneath the Path prefix by the segment of
+	// their Path that follows it, returning a PathNode with the Name,
+	// number of Streams and (if it is a stream itself) UUID of each. The
+	// stream at prefix itself, if any, has an empty Name
+	CountPaths(prefix string) ([]PathNode, error)
+
+	// Collections are the paths of sMAP objects that are not streams. They
+	// are kept apart from streams, one per Path of each source. Saving
+	// returns true if the collection changed
+	SaveCollection(source string, msg *common.SmapMessage) (bool, error)
+	GetCollections(source string, paths []string) (common.SmapMessageList, error)
+	// saves the tags a stream inherits from the collections of source,
+	// except for keys set explicitly on the stream, and records source as
+	// the source of the stream (queried as "_source"). Returns the keys of
+	// the stream's document that changed
+	SaveInherited(uuid common.UUID, source string, inherited *common.SmapMessage) ([]string, error)
+
+	// virtual streams are stream documents with a formula
+	SaveFormula(uuid common.UUID, formula *common.Formula) error
+	GetFormulas() (map[common.UUID]*common.Formula, error)
+
+	// continuous queries, by name. Saving replaces the one of the same name
+	SaveContinuousQuery(cq *common.ContinuousQuery) error
+	GetContinuousQueries() (common.ContinuousQueries, error)
+	RemoveContinuousQuery(name string) error
+
+	// alert rules, by name. Saving replaces the one of the same name
+	SaveAlertRule(rule *common.AlertRule) error
+	GetAlertRules() ([]common.AlertRule, error)
+	RemoveAlertRule(name string) error
+
+	// webhook registrations, by ID. Saving replaces the one of the same ID
+	SaveWebhook(hook *common.Webhook) error
+	GetWebhooks() ([]common.Webhook, error)
+	RemoveWebhook(id string) error
+	// records the Sequence of the webhook, if it is still registered
+	SaveWebhookSequence(id string, sequence uint64) error
+
+	// report registrations of sMAP drivers, by ID. Saving replaces the one
+	// of the same ID
+	SaveReport(report *common.ReportRegistration) error
+	GetReports() ([]common.ReportRegistration, error)
+	RemoveReport(id string) error
+
+	// durable subscriptions, by ID. Saving replaces the one of the same ID
+	SaveSubscription(sub *common.DurableSubscription) error
+	GetSubscriptions() ([]common.DurableSubscription, error)
+	RemoveSubscription(id string) error
+
+	// these report the streams they matched and changed. The keys set by
+	// UpdateDocs are recorded as set explicitly on the streams
+	UpdateDocs(updates, where bson.M) (common.MutationSummary, error)
+	RemoveTags(tags []string, where bson.M) (common.MutationSummary, error)
+	RemoveDocs(where bson.M) (common.MutationSummary, error)
+
+	// the audit log is append-only
+	SaveAudit(entry *common.AuditEntry) error
+	GetAudit(where bson.M) (common.AuditLog, error)
 }
@@ -3,22 +3,37 @@ package archiver
 // mongo provider for metadata store
 import (
 	"fmt"
+	"github.com/gtfierro/giles2/archiver/internal/querylang"
 	"github.com/gtfierro/giles2/common"
 	"github.com/karlseguin/ccache"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 	"net"
+	"reflect"
+	"strings"
 	"sync/atomic"
 	"time"
 )
 
 // default select clause to ignore internal variables
-var ignoreDefault = bson.M{"_id": 0, "_api": 0}
+var ignoreDefault = bson.M{"_id": 0, "_api": 0, "_explicit": 0, "_source": 0, "_valid_from": 0, "_valid_to": 0}
 
 type mongoStore struct {
-	session  *mgo.Session
-	db       *mgo.Database
-	metadata *mgo.Collection
+	session     *mgo.Session
+	db          *mgo.Database
+	metadata    *mgo.Collection
+	collections *mgo.Collection
+	// versions of metadata documents, valid from _valid_from until
+	// _valid_to (unset for the current version)
+	history  *mgo.Collection
+	audit    *mgo.Collection
+	queries  *mgo.Collection
+	alerts   *mgo.Collection
+	webhooks *mgo.Collection
+	// durable subscriptions
+	subscriptions *mgo.Collection
+	// report registrations
+	reports *mgo.Collection
 
 	pool *mongoConnectionPool
 
@@ -52,9 +67,18 @@ func newMongoStore(c *mongoConfig) *mongoStore {
 	// fetch/create collections and db reference
 	m.db = m.session.DB("archiver")
 	m.metadata = m.db.C("metadata")
+	m.collections = m.db.C("collections")
+	m.history = m.db.C("history")
+	m.audit = m.db.C("audit")
+	m.queries = m.db.C("queries")
+	m.alerts = m.db.C("alerts")
+	m.webhooks = m.db.C("webhooks")
+	m.subscriptions = m.db.C("subscriptions")
+	m.reports = m.db.C("reports")
 
 	// add indexes. This will fail Fatal
 	m.addIndexes()
+	m.seedHistory()
 
 	m.pool = newMongoConnectionPool(m.session, m.metadata, 20)
 
@@ -108,6 +132,93 @@ func (m *mongoStore) addIndexes() {
 	if err != nil {
 		log.Fatalf("Could not create index on metadata.properties.streamtype (%v)", err)
 	}
+
+	// collections used to be unique by Path alone
+	m.collections.DropIndex("Path")
+	index.Key = []string{"Source", "Path"}
+	index.Unique = true
+	err = m.collections.EnsureIndex(index)
+	if err != nil {
+		log.Fatalf("Could not create index on collections.Source, collections.Path (%v)", err)
+	}
+
+	index.Key = []string{"uuid", "_valid_to"}
+	index.Unique = false
+	err = m.history.EnsureIndex(index)
+	if err != nil {
+		log.Fatalf("Could not create index on history.uuid (%v)", err)
+	}
+
+	index.Key = []string{"_valid_from"}
+	err = m.history.EnsureIndex(index)
+	if err != nil {
+		log.Fatalf("Could not create index on history._valid_from (%v)", err)
+	}
+
+	index.Key = []string{"uuid"}
+	err = m.audit.EnsureIndex(index)
+	if err != nil {
+		log.Fatalf("Could not create index on audit.uuid (%v)", err)
+	}
+
+	index.Key = []string{"Time"}
+	err = m.audit.EnsureIndex(index)
+	if err != nil {
+		log.Fatalf("Could not create index on audit.Time (%v)", err)
+	}
+
+	index.Key = []string{"Name"}
+	index.Unique = true
+	err = m.queries.EnsureIndex(index)
+	if err != nil {
+		log.Fatalf("Could not create index on queries.Name (%v)", err)
+	}
+
+	err = m.alerts.EnsureIndex(index)
+	if err != nil {
+		log.Fatalf("Could not create index on alerts.Name (%v)", err)
+	}
+
+	index.Key = []string{"ID"}
+	err = m.webhooks.EnsureIndex(index)
+	if err != nil {
+		log.Fatalf("Could not create index on webhooks.ID (%v)", err)
+	}
+
+	err = m.subscriptions.EnsureIndex(index)
+	if err != nil {
+		log.Fatalf("Could not create index on subscriptions.ID (%v)", err)
+	}
+
+	err = m.reports.EnsureIndex(index)
+	if err != nil {
+		log.Fatalf("Could not create index on reports.ID (%v)", err)
+	}
+}
+
+// streams written before we kept history get a single version, valid since
+// the epoch
+func (m *mongoStore) seedHistory() {
+	if count, err := m.history.Count(); err != nil || count > 0 {
+		return
+	}
+	var (
+		iter  = m.metadata.Find(nil).Select(ignoreDefault).Iter()
+		doc   = bson.M{}
+		count int
+	)
+	for iter.Next(&doc) {
+		doc["_valid_from"] = time.Unix(0, 0)
+		if err := m.history.Insert(doc); err != nil {
+			log.Errorf("Could not save initial version of %v (%v)", doc["uuid"], err)
+		}
+		doc = bson.M{}
+		count++
+	}
+	if err := iter.Close(); err != nil {
+		log.Errorf("Could not read metadata for history (%v)", err)
+	}
+	log.Noticef("Saved initial versions of %v streams", count)
 }
 
 func (m *mongoStore) GetUnitOfTime(uuid common.UUID) (common.UnitOfTime, error) {
@@ -206,21 +317,22 @@ func (m *mongoStore) GetUnitOfMeasure(uuid common.UUID) (string, error) {
 
 // Retrieves all tags in the provided list that match the provided where clause.
 func (m *mongoStore) GetTags(tags []string, where bson.M) (common.SmapMessageList, error) {
+	return m.getTags(m.metadata, tags, fixWhere(where))
+}
+
+func (m *mongoStore) GetTagsAsOf(tags []string, where bson.M, at time.Time) (common.SmapMessageList, error) {
+	return m.getTags(m.history, tags, asOf(where, at))
+}
+
+func (m *mongoStore) getTags(collection *mgo.Collection, tags []string, whereClause bson.M) (common.SmapMessageList, error) {
 	var (
-		staged      *mgo.Query
-		selectTags  bson.M
-		whereClause bson.M
-		x           []bson.M
+		staged     *mgo.Query
+		selectTags bson.M
+		x          []bson.M
 	)
-	if len(where) != 0 {
-		whereClause = make(bson.M)
-		for wk, wv := range where {
-			whereClause[common.FixMongoKey(wk)] = wv
-		}
-	}
-	staged = m.metadata.Find(whereClause)
+	staged = collection.Find(whereClause)
 	if len(tags) == 0 { // select all
-		selectTags = bson.M{"_id": 0, "_api": 0}
+		selectTags = ignoreDefault
 	} else {
 		selectTags = bson.M{"_id": 0}
 		for _, tag := range tags {
@@ -254,6 +366,39 @@ func (m *mongoStore) GetDistinct(tag string, where bson.M) (common.DistinctResul
 	return result, err
 }
 
+func (m *mongoStore) CountPaths(prefix string) ([]PathNode, error) {
+	var (
+		groups []struct {
+			Name    string      `bson:"_id"`
+			Streams int         `bson:"streams"`
+			UUID    common.UUID `bson:"uuid"`
+		}
+		// the rest of the Path after prefix and its slash
+		rest = bson.M{"$substr": []interface{}{"$Path", len(strings.TrimSuffix(prefix, "/")) + 1, -1}}
+	)
+	err := m.metadata.Pipe([]bson.M{
+		{"$match": bson.M{"Path": bson.M{"$regex": querylang.PathPrefixPattern(prefix)}, "uuid": bson.M{"$exists": true}}},
+		{"$project": bson.M{"uuid": 1, "rest": rest}},
+		{"$project": bson.M{"uuid": 1, "rest": 1, "name": bson.M{"$arrayElemAt": []interface{}{bson.M{"$split": []interface{}{"$rest", "/"}}, 0}}}},
+		{"$group": bson.M{
+			"_id":     "$name",
+			"streams": bson.M{"$sum": 1},
+			"uuid":    bson.M{"$max": bson.M{"$cond": []interface{}{bson.M{"$eq": []string{"$rest", "$name"}}, "$uuid", nil}}},
+		}},
+	}).All(&groups)
+	nodes := make([]PathNode, len(groups))
+	for i, group := range groups {
+		nodes[i] = PathNode{Name: group.Name, Streams: group.Streams, UUID: group.UUID}
+	}
+	return nodes, err
+}
+
+func (m *mongoStore) GetDistinctAsOf(tag string, where bson.M, at time.Time) (common.DistinctResult, error) {
+	var result common.DistinctResult
+	err := m.history.Find(asOf(where, at)).Distinct(common.FixMongoKey(tag), &result)
+	return result, err
+}
+
 func (m *mongoStore) GetUUIDs(where bson.M) ([]common.UUID, error) {
 	var results []common.UUID
 	var x []bson.M
@@ -273,16 +418,162 @@ func (m *mongoStore) GetUUIDs(where bson.M) ([]common.UUID, error) {
 	return results, err
 }
 
-func (m *mongoStore) SaveTags(msg *common.SmapMessage) error {
+func (m *mongoStore) GetUUIDsAsOf(where bson.M, at time.Time) ([]common.UUID, error) {
+	var x []bson.M
+	err := m.history.Find(asOf(where, at)).Select(bson.M{"_id": 0, "uuid": 1}).All(&x)
+	results := make([]common.UUID, len(x))
+	for i, doc := range x {
+		results[i] = common.UUID(doc["uuid"].(string))
+	}
+	return results, err
+}
+
+func (m *mongoStore) ExplainWhere(where bson.M, at time.Time) (filter bson.M, plan string, err error) {
+	var (
+		collection = m.metadata
+		res        bson.M
+	)
+	filter = fixWhere(where)
+	if !at.IsZero() {
+		collection = m.history
+		filter = asOf(where, at)
+	}
+	if err = collection.Find(filter).Explain(&res); err != nil {
+		return
+	}
+	return filter, describePlan(res), nil
+}
+
+// describes the winning plan of a mongo explain as its stages from last to
+// first, e.g. "FETCH <- IXSCAN Path_1"
+func describePlan(explained bson.M) string {
+	// before MongoDB 3.0, explain only names the cursor
+	if cursor, found := explained["cursor"]; found {
+		return fmt.Sprintf("%v", cursor)
+	}
+	planner, _ := explained["queryPlanner"].(bson.M)
+	stage, _ := planner["winningPlan"].(bson.M)
+	var stages []string
+	for stage != nil {
+		desc := fmt.Sprintf("%v", stage["stage"])
+		if index, found := stage["indexName"]; found {
+			desc += fmt.Sprintf(" %v", index)
+		}
+		stages = append(stages, desc)
+		stage, _ = stage["inputStage"].(bson.M)
+	}
+	return strings.Join(stages, " <- ")
+}
+
+// fixes the keys of a where clause for use with mongo
+func fixWhere(where bson.M) bson.M {
+	if len(where) == 0 {
+		return nil
+	}
+	whereClause := make(bson.M)
+	for wk, wv := range where {
+		whereClause[common.FixMongoKey(wk)] = wv
+	}
+	return whereClause
+}
+
+// the where clause restricted to versions that were current at the given time
+func asOf(where bson.M, at time.Time) bson.M {
+	current := bson.M{
+		"_valid_from": bson.M{"$lte": at},
+		"$or":         []bson.M{{"_valid_to": nil}, {"_valid_to": bson.M{"$gt": at}}},
+	}
+	if len(where) == 0 {
+		return current
+	}
+	return bson.M{"$and": []bson.M{fixWhere(where), current}}
+}
+
+// saves a new version of each of the streams whose document changed since
+// its last version, and ends the current version of those that were removed.
+// Returns the streams that changed
+func (m *mongoStore) saveVersions(uuids []common.UUID) (changed []common.UUID, err error) {
+	if len(uuids) == 0 {
+		return
+	}
+	var (
+		now      = time.Now()
+		current  []bson.M
+		previous []bson.M
+	)
+	if err = m.metadata.Find(bson.M{"uuid": bson.M{"$in": uuids}}).Select(ignoreDefault).All(&current); err != nil {
+		return
+	}
+	if err = m.history.Find(bson.M{"uuid": bson.M{"$in": uuids}, "_valid_to": nil}).Select(ignoreDefault).All(&previous); err != nil {
+		return
+	}
+	ended := make(map[interface{}]bson.M, len(previous))
+	for _, version := range previous {
+		ended[version["uuid"]] = version
+	}
+	for _, doc := range current {
+		uuid := doc["uuid"]
+		if version, found := ended[uuid]; found {
+			delete(ended, uuid)
+			if reflect.DeepEqual(version, doc) {
+				continue
+			}
+			if err = m.endVersion(uuid, now); err != nil {
+				return
+			}
+		}
+		doc["_valid_from"] = now
+		if err = m.history.Insert(doc); err != nil {
+			return
+		}
+		changed = append(changed, common.UUID(uuid.(string)))
+	}
+	for uuid := range ended {
+		if err = m.endVersion(uuid, now); err != nil {
+			return
+		}
+		changed = append(changed, common.UUID(uuid.(string)))
+	}
+	return
+}
+
+func (m *mongoStore) endVersion(uuid interface{}, at time.Time) error {
+	_, err := m.history.UpdateAll(bson.M{"uuid": uuid, "_valid_to": nil}, bson.M{"$set": bson.M{"_valid_to": at}})
+	return err
+}
+
+func (m *mongoStore) SaveTags(msg *common.SmapMessage) ([]string, error) {
 	if msg == nil {
-		return fmt.Errorf("Message is null")
+		return nil, fmt.Errorf("Message is null")
 	}
 	// if the message has no metadata and is already in cache, then skip writing
 	if !msg.HasMetadata() && m.uuidCache.Get(string(msg.UUID)) != nil {
-		return nil
+		return nil, nil
+	}
+	// save to the metadata database, remembering which keys the stream sets
+	// itself so they are not replaced by inherited ones
+	doc := msg.ToBson()
+	update := bson.M{"$set": doc}
+	if explicit := tagKeys(doc); len(explicit) > 0 {
+		update["$addToSet"] = bson.M{"_explicit": bson.M{"$each": explicit}}
+	}
+	// versions are only saved if the upsert changed the document
+	var before bson.M
+	info, err := m.metadata.Find(bson.M{"uuid": msg.UUID}).Select(ignoreDefault).Apply(mgo.Change{Update: update, Upsert: true}, &before)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	if info.UpsertedId != nil {
+		keys = docKeys(doc)
+	} else {
+		keys = changedKeys(before, doc)
+	}
+	if len(keys) > 0 {
+		if _, err = m.saveVersions([]common.UUID{msg.UUID}); err != nil {
+			return nil, err
+		}
 	}
-	// save to the metadata database
-	_, err := m.metadata.Upsert(bson.M{"uuid": msg.UUID}, bson.M{"$set": msg.ToBson()})
 	// and save to the uuid cache
 	m.uuidCache.Set(string(msg.UUID), struct{}{}, m.cacheExpiry)
 	if msg.Properties != nil && msg.Properties.UnitOfTime != 0 {
@@ -291,32 +582,288 @@ func (m *mongoStore) SaveTags(msg *common.SmapMessage) error {
 	if msg.Properties != nil && msg.Properties.UnitOfMeasure != "" {
 		m.uomCache.Set(string(msg.UUID), msg.Properties.UnitOfMeasure, m.cacheExpiry)
 	}
+	return keys, nil
+}
+
+func (m *mongoStore) SaveCollection(source string, msg *common.SmapMessage) (bool, error) {
+	doc := msg.ToBson()
+	delete(doc, "uuid")
+	saved, err := m.GetCollections(source, []string{msg.Path})
+	if err != nil {
+		return false, err
+	}
+	if len(saved) > 0 && containsAll(saved[0].ToBson(), doc) {
+		return false, nil
+	}
+	doc["Source"] = source
+	_, err = m.collections.Upsert(bson.M{"Source": source, "Path": msg.Path}, bson.M{"$set": doc})
+	return err == nil, err
+}
+
+func (m *mongoStore) GetCollections(source string, paths []string) (common.SmapMessageList, error) {
+	var x []bson.M
+	err := m.collections.Find(bson.M{"Source": source, "Path": bson.M{"$in": paths}}).Select(bson.M{"_id": 0, "Source": 0}).All(&x)
+	return common.SmapMessageListFromBson(x), err
+}
+
+// returns the (dotted) keys of doc whose values differ from those of the
+// stored document, comparing them as they would be read back from mongo
+func changedKeys(stored, doc bson.M) (keys []string) {
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		return docKeys(doc)
+	}
+	var values bson.M
+	if err = bson.Unmarshal(raw, &values); err != nil {
+		return docKeys(doc)
+	}
+	for key, value := range values {
+		parts := strings.Split(key, ".")
+		cur := stored
+		for _, part := range parts[:len(parts)-1] {
+			if cur, _ = cur[part].(bson.M); cur == nil {
+				break
+			}
+		}
+		if cur == nil {
+			keys = append(keys, key)
+		} else if stored, found := cur[parts[len(parts)-1]]; !found || !reflect.DeepEqual(stored, value) {
+			keys = append(keys, key)
+		}
+	}
+	return
+}
+
+func docKeys(doc bson.M) (keys []string) {
+	for key := range doc {
+		keys = append(keys, key)
+	}
+	return
+}
+
+// true if saved has every key of doc with the same value
+func containsAll(saved, doc bson.M) bool {
+	for k, v := range doc {
+		if !reflect.DeepEqual(saved[k], v) {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *mongoStore) SaveInherited(uuid common.UUID, source string, inherited *common.SmapMessage) ([]string, error) {
+	var before bson.M
+	if err := m.metadata.Find(bson.M{"uuid": uuid}).Select(bson.M{"_id": 0}).One(&before); err == mgo.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	updates := inherited.ToBson()
+	delete(updates, "uuid")
+	delete(updates, "Path")
+	if explicit, ok := before["_explicit"].([]interface{}); ok {
+		for _, key := range explicit {
+			delete(updates, key.(string))
+		}
+	}
+	keys := changedKeys(before, updates)
+	if len(keys) == 0 && before["_source"] == source {
+		return nil, nil
+	}
+	updates["_source"] = source
+	// inherited properties may differ from what we have cached
+	m.uotCache.Delete(string(uuid))
+	m.uomCache.Delete(string(uuid))
+	m.stCache.Delete(string(uuid))
+	if err := m.metadata.Update(bson.M{"uuid": uuid}, bson.M{"$set": updates}); err != nil {
+		return nil, err
+	}
+	if _, err := m.saveVersions([]common.UUID{uuid}); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (m *mongoStore) SaveFormula(uuid common.UUID, formula *common.Formula) error {
+	if err := m.metadata.Update(bson.M{"uuid": uuid}, bson.M{"$set": bson.M{"Formula": formula}}); err != nil {
+		return err
+	}
+	_, err := m.saveVersions([]common.UUID{uuid})
 	return err
 }
 
-func (m *mongoStore) UpdateDocs(updates, where bson.M) error {
-	//TODO: loop through matched UUIDs
-	info, updateErr := m.metadata.UpdateAll(where, bson.M{"$set": updates})
+func (m *mongoStore) GetFormulas() (map[common.UUID]*common.Formula, error) {
+	var (
+		iter     = m.metadata.Find(bson.M{"Formula": bson.M{"$exists": true}}).Select(bson.M{"uuid": 1, "Formula": 1}).Iter()
+		raw      bson.Raw
+		formulas = make(map[common.UUID]*common.Formula)
+	)
+	for iter.Next(&raw) {
+		var doc struct {
+			UUID    common.UUID     `bson:"uuid"`
+			Formula *common.Formula `bson:"Formula"`
+		}
+		// one bad formula should not keep the other virtual streams from
+		// loading
+		if err := raw.Unmarshal(&doc); err != nil || doc.Formula == nil {
+			log.Errorf("Skipping invalid formula of %v (%v)", doc.UUID, err)
+			continue
+		}
+		formulas[doc.UUID] = doc.Formula
+	}
+	return formulas, iter.Close()
+}
+
+// the keys of a document other than its uuid and Path
+func tagKeys(doc bson.M) []string {
+	keys := make([]string, 0, len(doc))
+	for key := range doc {
+		if key != "uuid" && key != "Path" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func (m *mongoStore) UpdateDocs(updates, where bson.M) (summary common.MutationSummary, err error) {
+	// the where clause may no longer match once updated
+	if summary.Matched, err = m.GetUUIDs(where); err != nil || len(summary.Matched) == 0 {
+		return
+	}
+	info, err := m.metadata.UpdateAll(bson.M{"uuid": bson.M{"$in": summary.Matched}}, bson.M{
+		"$set": updates,
+		// so that collections do not replace them
+		"$addToSet": bson.M{"_explicit": bson.M{"$each": tagKeys(updates)}},
+	})
+	if err != nil {
+		return
+	}
 	log.Infof("Updated %v records", info.Updated)
-	return updateErr
+	summary.Modified, err = m.saveVersions(summary.Matched)
+	return
 }
 
-func (m *mongoStore) RemoveTags(tags []string, where bson.M) error {
-	//TODO: loop through matched UUIDs
+func (m *mongoStore) RemoveTags(tags []string, where bson.M) (summary common.MutationSummary, err error) {
 	updates := bson.M{}
 	for _, tag := range tags {
 		updates[tag] = 1
 	}
-	info, updateErr := m.metadata.UpdateAll(where, bson.M{"$unset": updates})
+	if summary.Matched, err = m.GetUUIDs(where); err != nil || len(summary.Matched) == 0 {
+		return
+	}
+	info, err := m.metadata.UpdateAll(bson.M{"uuid": bson.M{"$in": summary.Matched}}, bson.M{"$unset": updates})
+	if err != nil {
+		return
+	}
 	log.Infof("Updated %v records", info.Updated)
-	return updateErr
+	summary.Modified, err = m.saveVersions(summary.Matched)
+	return
 }
 
-func (m *mongoStore) RemoveDocs(where bson.M) error {
-	//TODO: loop through matched UUIDs
-	ci, removeErr := m.metadata.RemoveAll(where)
+func (m *mongoStore) RemoveDocs(where bson.M) (summary common.MutationSummary, err error) {
+	if summary.Matched, err = m.GetUUIDs(where); err != nil || len(summary.Matched) == 0 {
+		return
+	}
+	ci, err := m.metadata.RemoveAll(bson.M{"uuid": bson.M{"$in": summary.Matched}})
+	if err != nil {
+		return
+	}
 	log.Infof("Removed %v records", ci.Removed)
-	return removeErr
+	summary.Removed, err = m.saveVersions(summary.Matched)
+	return
+}
+
+func (m *mongoStore) SaveContinuousQuery(cq *common.ContinuousQuery) error {
+	_, err := m.queries.Upsert(bson.M{"Name": cq.Name}, cq)
+	return err
+}
+
+func (m *mongoStore) GetContinuousQueries() (common.ContinuousQueries, error) {
+	var queries common.ContinuousQueries
+	err := m.queries.Find(nil).Select(bson.M{"_id": 0}).Sort("Name").All(&queries)
+	return queries, err
+}
+
+func (m *mongoStore) RemoveContinuousQuery(name string) error {
+	return m.queries.Remove(bson.M{"Name": name})
+}
+
+func (m *mongoStore) SaveAlertRule(rule *common.AlertRule) error {
+	_, err := m.alerts.Upsert(bson.M{"Name": rule.Name}, rule)
+	return err
+}
+
+func (m *mongoStore) GetAlertRules() ([]common.AlertRule, error) {
+	var rules []common.AlertRule
+	err := m.alerts.Find(nil).Select(bson.M{"_id": 0}).Sort("Name").All(&rules)
+	return rules, err
+}
+
+func (m *mongoStore) RemoveAlertRule(name string) error {
+	return m.alerts.Remove(bson.M{"Name": name})
+}
+
+func (m *mongoStore) SaveWebhook(hook *common.Webhook) error {
+	_, err := m.webhooks.Upsert(bson.M{"ID": hook.ID}, hook)
+	return err
+}
+
+func (m *mongoStore) GetWebhooks() ([]common.Webhook, error) {
+	var hooks []common.Webhook
+	err := m.webhooks.Find(nil).Select(bson.M{"_id": 0}).Sort("ID").All(&hooks)
+	return hooks, err
+}
+
+func (m *mongoStore) RemoveWebhook(id string) error {
+	return m.webhooks.Remove(bson.M{"ID": id})
+}
+
+func (m *mongoStore) SaveWebhookSequence(id string, sequence uint64) error {
+	err := m.webhooks.Update(bson.M{"ID": id}, bson.M{"$set": bson.M{"Sequence": sequence}})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+func (m *mongoStore) SaveReport(report *common.ReportRegistration) error {
+	_, err := m.reports.Upsert(bson.M{"ID": report.ID}, report)
+	return err
+}
+
+func (m *mongoStore) GetReports() ([]common.ReportRegistration, error) {
+	var reports []common.ReportRegistration
+	err := m.reports.Find(nil).Select(bson.M{"_id": 0}).Sort("ID").All(&reports)
+	return reports, err
+}
+
+func (m *mongoStore) RemoveReport(id string) error {
+	return m.reports.Remove(bson.M{"ID": id})
+}
+
+func (m *mongoStore) SaveSubscription(sub *common.DurableSubscription) error {
+	_, err := m.subscriptions.Upsert(bson.M{"ID": sub.ID}, sub)
+	return err
+}
+
+func (m *mongoStore) GetSubscriptions() ([]common.DurableSubscription, error) {
+	var subs []common.DurableSubscription
+	err := m.subscriptions.Find(nil).Select(bson.M{"_id": 0}).Sort("ID").All(&subs)
+	return subs, err
+}
+
+func (m *mongoStore) RemoveSubscription(id string) error {
+	return m.subscriptions.Remove(bson.M{"ID": id})
+}
+
+func (m *mongoStore) SaveAudit(entry *common.AuditEntry) error {
+	return m.audit.Insert(entry)
+}
+
+func (m *mongoStore) GetAudit(where bson.M) (common.AuditLog, error) {
+	var entries common.AuditLog
+	err := m.audit.Find(fixWhere(where)).Select(bson.M{"_id": 0}).Sort("Time").All(&entries)
+	return entries, err
 }
 
 type mongoSession struct {
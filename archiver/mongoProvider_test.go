@@ -1,3 +1,8 @@
+// +build mongo
+
+// These need a MongoDB listening on localhost; run them with
+//    go test -tags mongo
+
 package archiver
 
 import (
@@ -8,6 +13,7 @@ import (
 	"os"
 	"reflect"
 	"testing"
+	"time"
 )
 
 var ms *mongoStore
@@ -18,12 +24,7 @@ func TestMain(m *testing.M) {
 	if err != nil {
 		log.Fatalf("%v", err)
 	}
-	config := &mongoConfig{
-		address:     addr,
-		enforceKeys: false,
-	}
-	ms = newMongoStore(config)
-	pm = newMongoPermissionsManager(config)
+	ms = newMongoStore(&mongoConfig{address: addr})
 	aConfig := LoadConfig("../giles.cfg")
 	testArchiver = NewArchiver(aConfig)
 	flag.Parse()
@@ -314,3 +315,43 @@ func TestGetUUIDs(t *testing.T) {
 
 	}
 }
+
+func TestGetTagsAsOf(t *testing.T) {
+	zone := string(common.NewUUID())
+	msg := &common.SmapMessage{Path: "/sensor9", UUID: common.NewUUID(), Metadata: common.Dict{"Zone": zone + "3"}}
+	ms.SaveTags(msg)
+	before := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	ms.UpdateDocs(bson.M{"Metadata.Zone": zone + "4"}, bson.M{"uuid": msg.UUID})
+	time.Sleep(10 * time.Millisecond)
+	after := time.Now()
+
+	for _, test := range []struct {
+		zone   string
+		at     time.Time
+		result []common.UUID
+	}{
+		{zone + "3", before, []common.UUID{msg.UUID}},
+		{zone + "4", before, []common.UUID{}},
+		{zone + "3", after, []common.UUID{}},
+		{zone + "4", after, []common.UUID{msg.UUID}},
+	} {
+		res, err := ms.GetUUIDsAsOf(bson.M{"Metadata.Zone": test.zone}, test.at)
+		if err != nil {
+			t.Errorf("Err during GetUUIDsAsOf (%v) \n%v", err, test)
+		}
+		if !reflect.DeepEqual(test.result, res) {
+			t.Errorf("Result should be \n%v\n but was \n%v\n", test.result, res)
+		}
+	}
+
+	ms.RemoveDocs(bson.M{"uuid": msg.UUID})
+	res, err := ms.GetTagsAsOf([]string{"Metadata.Zone"}, bson.M{"uuid": msg.UUID}, after)
+	if err != nil {
+		t.Errorf("Err during GetTagsAsOf (%v)", err)
+	}
+	expected := common.SmapMessageList{{Metadata: common.Dict{"Zone": zone + "4"}}}
+	if !reflect.DeepEqual(expected, res) {
+		t.Errorf("Removed streams should keep their history. Result should be \n%v\n but was \n%v\n", expected.ToBson(), res.ToBson())
+	}
+}
@@ -0,0 +1,34 @@
+package archiver
+
+import (
+	"github.com/gtfierro/giles2/common"
+)
+
+// The HTTP plugin keeps reports installed on the sMAP drivers registered with
+// it. The registrations are kept in the metadata store so that the plugin can
+// take them up again when the archiver restarts
+
+// SaveReport saves the registration, replacing the one of the same ID. It is
+// recorded in the audit log as made by caller
+func (a *Archiver) SaveReport(caller string, report common.ReportRegistration) error {
+	if err := a.mdStore.SaveReport(&report); err != nil {
+		return err
+	}
+	a.audit(caller, "register report "+report.ID+" on "+report.Source, nil)
+	return nil
+}
+
+// Reports returns the saved registrations
+func (a *Archiver) Reports() ([]common.ReportRegistration, error) {
+	return a.mdStore.GetReports()
+}
+
+// RemoveReport forgets the registration. The removal is recorded in the audit
+// log as made by caller
+func (a *Archiver) RemoveReport(caller, id string) error {
+	if err := a.mdStore.RemoveReport(id); err != nil {
+		return err
+	}
+	a.audit(caller, "remove report "+id, nil)
+	return nil
+}
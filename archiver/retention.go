@@ -0,0 +1,302 @@
+package archiver
+
+import (
+	"fmt"
+	"github.com/gtfierro/giles2/common"
+	"github.com/satori/go.uuid"
+	"gopkg.in/mgo.v2/bson"
+	"sort"
+	"time"
+)
+
+// Retention policies (the [Retention "<name>"] sections of the configuration)
+// age out the readings of the streams matching their where clause. Before raw
+// readings are deleted they are rolled up into windows, and the Min, Mean, Max
+// and Count of each window are written to four companion streams: timeseries
+// stores only hold numbers, so each StatisticalNumberReading is split across
+// them. Companions carry
+//    Metadata/RollupOf = "<uuid of the raw stream>"
+//    Metadata/RollupPolicy = "<policy name>"
+//    Metadata/RollupStatistic = "min", "mean", "max" or "count"
+// and the unit of measure of the raw stream, but not its other metadata. They
+// are written beneath /_derived (e.g. /_derived/building1/meter/<policy>/mean
+// for /building1/meter), so they do not inherit the collections above the raw
+// stream and where clauses written for raw streams do not match them. Read
+// them with e.g.
+//    select data in (now -1y, now) where Metadata/RollupOf = "<uuid>" and Metadata/RollupStatistic = "mean"
+
+// the root of the paths of the streams derived from others by retention
+// rollups and continuous queries
+const derivedRoot = "/_derived"
+
+// narrows the where clause to the streams that are not derived from others,
+// so that retention policies and continuous queries leave alone the streams
+// they and each other write
+func notDerived(where common.Dict) common.Dict {
+	return common.Dict{"$and": []common.Dict{
+		where,
+		{"Metadata.RollupOf": common.Dict{"$exists": false}},
+		{"Metadata.DerivedFrom": common.Dict{"$exists": false}},
+	}}
+}
+
+// companion streams get a UUIDv3 of the raw uuid, policy and statistic under
+// this namespace, so each run writes to the same companions
+var ROLLUP_NAMESPACE_UUID = uuid.FromStringOrNil("5d8c1f3a-3b2e-11e7-a919-92ebcb67fe33")
+
+// the streams each window is split into
+var windowStatistics = []string{"min", "mean", "max", "count"}
+
+// What enforcing a retention policy did or, in a dry run, would do. Times are
+// in nanoseconds
+type RetentionReport struct {
+	Policy string
+	DryRun bool
+	// raw readings before this are rolled up and deleted
+	RawBefore uint64
+	// rollups before this are deleted; 0 if they are kept forever
+	RollupBefore uint64 `json:",omitempty"`
+	Streams      []RetentionStream
+}
+
+// The raw readings of a stream between Begin and End, rolled up into Windows
+// windows before they are deleted
+type RetentionStream struct {
+	UUID    common.UUID
+	Begin   uint64
+	End     uint64
+	Windows int
+}
+
+type retentionPolicy struct {
+	name string
+	// matches the raw streams, leaving out derived streams
+	where      common.Dict
+	raw        time.Duration
+	rollup     time.Duration
+	keepRollup time.Duration
+}
+
+// checks and parses a [Retention] section of the configuration
+func (a *Archiver) newRetentionPolicy(name string, c *Retention) (*retentionPolicy, error) {
+	var err error
+	p := &retentionPolicy{name: name}
+	if c.Where == "" {
+		return nil, fmt.Errorf("Retention policy %v needs a where clause", name)
+	}
+	parsed := a.qp.Parse("select uuid where " + c.Where)
+	if parsed.Err != nil {
+		return nil, fmt.Errorf("Error (%v) in where clause \"%v\" of retention policy %v (error at %v)", parsed.Err, c.Where, name, parsed.ErrPos)
+	}
+	p.where = notDerived(parsed.Where)
+	if p.raw, err = common.ParseDuration(c.Raw); err != nil || p.raw <= 0 {
+		return nil, fmt.Errorf("Retention policy %v needs a positive Raw duration (%v)", name, err)
+	}
+	if c.Rollup != "" {
+		if p.rollup, err = common.ParseDuration(c.Rollup); err != nil || p.rollup <= 0 {
+			return nil, fmt.Errorf("Invalid Rollup %v of retention policy %v (%v)", c.Rollup, name, err)
+		}
+	}
+	if c.KeepRollup != "" {
+		if p.rollup == 0 {
+			return nil, fmt.Errorf("Retention policy %v has a KeepRollup but no Rollup", name)
+		}
+		if p.keepRollup, err = common.ParseDuration(c.KeepRollup); err != nil || p.keepRollup <= 0 {
+			return nil, fmt.Errorf("Invalid KeepRollup %v of retention policy %v (%v)", c.KeepRollup, name, err)
+		}
+	}
+	return p, nil
+}
+
+// sets the retention policies from the configuration, ordered by name
+func (a *Archiver) loadRetention(policies map[string]*Retention) error {
+	var names []string
+	for name := range policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p, err := a.newRetentionPolicy(name, policies[name])
+		if err != nil {
+			return err
+		}
+		a.retention = append(a.retention, p)
+	}
+	return nil
+}
+
+// enforces the retention policies every interval
+func (a *Archiver) startRetention(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			if _, err := a.EnforceRetention(retentionCaller, false); err != nil {
+				log.Errorf("Could not enforce retention policies (%v)", err)
+			}
+		}
+	}()
+}
+
+// EnforceRetention rolls up and deletes the readings that have aged out of
+// each retention policy, recording the deletions in the audit log as made by
+// caller. A dry run reports what would be done without changing anything
+func (a *Archiver) EnforceRetention(caller string, dryRun bool) ([]RetentionReport, error) {
+	a.retentionLock.Lock()
+	defer a.retentionLock.Unlock()
+	var reports []RetentionReport
+	now := time.Now()
+	for _, p := range a.retention {
+		report, err := a.enforcePolicy(caller, p, now, dryRun)
+		if err != nil {
+			return reports, fmt.Errorf("Error enforcing retention policy %v (%v)", p.name, err)
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+func (a *Archiver) enforcePolicy(caller string, p *retentionPolicy, now time.Time, dryRun bool) (report RetentionReport, err error) {
+	report = RetentionReport{Policy: p.name, DryRun: dryRun, RawBefore: uint64(now.Add(-p.raw).UnixNano())}
+	// only whole windows are rolled up
+	width := uint64(p.rollup)
+	if width > 0 {
+		report.RawBefore -= report.RawBefore % width
+	}
+	matched, err := a.broker.uuids.getUUIDs(a.mdStore, p.where)
+	if err != nil {
+		return
+	}
+	// virtual streams have no readings of their own
+	stored, _ := a.virtuals.split(matched)
+	var deleted []common.UUID
+	for _, raw := range stored {
+		var stream *RetentionStream
+		if stream, err = a.expireStream(caller, p, raw, report.RawBefore, dryRun); err != nil {
+			return
+		}
+		if stream != nil {
+			report.Streams = append(report.Streams, *stream)
+			deleted = append(deleted, raw)
+		}
+	}
+	if p.keepRollup > 0 {
+		report.RollupBefore = uint64(now.Add(-p.keepRollup).UnixNano())
+		var companions []common.UUID
+		if companions, err = a.mdStore.GetUUIDs(bson.M{"Metadata.RollupPolicy": p.name}); err != nil {
+			return
+		}
+		if !dryRun && len(companions) > 0 {
+			if err = a.tsStore.DeleteData(companions, 0, report.RollupBefore); err != nil {
+				return
+			}
+		}
+	}
+	if !dryRun && len(deleted) > 0 {
+		a.audit(caller, "retention "+p.name, deleted)
+	}
+	return
+}
+
+// rolls up and deletes the readings of the raw stream before the given time.
+// Returns nil if it has none
+func (a *Archiver) expireStream(caller string, p *retentionPolicy, raw common.UUID, before uint64, dryRun bool) (*RetentionStream, error) {
+	first, err := a.tsStore.Next([]common.UUID{raw}, 0)
+	if err != nil || len(first) == 0 || len(first[0].Readings) == 0 {
+		return nil, err
+	}
+	begin, err := common.ConvertTime(first[0].Readings[0].Time, common.GuessTimeUnit(first[0].Readings[0].Time), common.UOT_NS)
+	if err != nil || begin >= before {
+		return nil, err
+	}
+	stream := &RetentionStream{UUID: raw, Begin: begin, End: before}
+	if width := uint64(p.rollup); width > 0 {
+		stream.Begin -= stream.Begin % width
+		windows, err := a.tsStore.WindowData([]common.UUID{raw}, width, stream.Begin, stream.End)
+		if err != nil {
+			return nil, err
+		}
+		var rollups []*common.StatisticalNumberReading
+		for _, resp := range windows {
+			for _, window := range resp.Readings {
+				if window.Count > 0 {
+					rollups = append(rollups, window)
+				}
+			}
+		}
+		stream.Windows = len(rollups)
+		if !dryRun {
+			err = a.saveStatistics(caller, raw, rollups, func(path, stat string) *common.SmapMessage {
+				return &common.SmapMessage{
+					UUID: derivedUUID(ROLLUP_NAMESPACE_UUID, raw, p.name, stat),
+					Path: derivedRoot + path + "/" + p.name + "/" + stat,
+					Metadata: common.Dict{
+						"RollupOf":        string(raw),
+						"RollupPolicy":    p.name,
+						"RollupStatistic": stat,
+						"RollupWidth":     p.rollup.String(),
+					},
+				}
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if !dryRun {
+		if err = a.tsStore.DeleteData([]common.UUID{raw}, stream.Begin, stream.End); err != nil {
+			return nil, err
+		}
+	}
+	return stream, nil
+}
+
+// writes the Min, Mean, Max and Count of the windows of the source stream to
+// a stream each. derive is given the path of the source and the statistic,
+// and returns the uuid, path and metadata of the stream to write it to
+func (a *Archiver) saveStatistics(caller string, source common.UUID, windows []*common.StatisticalNumberReading, derive func(path, stat string) *common.SmapMessage) error {
+	if len(windows) == 0 {
+		return nil
+	}
+	path := "/" + string(source)
+	if paths, err := a.mdStore.GetDistinct("Path", bson.M{"uuid": string(source)}); err != nil {
+		return err
+	} else if len(paths) > 0 {
+		path = paths[0]
+	}
+	uom, err := a.mdStore.GetUnitOfMeasure(source)
+	if err != nil {
+		return err
+	}
+	for _, stat := range windowStatistics {
+		msg := derive(path, stat)
+		msg.Properties = &common.SmapProperties{UnitOfTime: common.UOT_NS, UnitOfMeasure: uom, StreamType: common.NUMERIC_STREAM}
+		if stat == "count" {
+			msg.Properties.UnitOfMeasure = "count"
+		}
+		for _, window := range windows {
+			time, err := common.ConvertTime(window.Time, common.GuessTimeUnit(window.Time), common.UOT_NS)
+			if err != nil {
+				return err
+			}
+			value := float64(window.Count)
+			switch stat {
+			case "min":
+				value = window.Min
+			case "mean":
+				value = window.Mean
+			case "max":
+				value = window.Max
+			}
+			msg.Readings = append(msg.Readings, &common.SmapNumberReading{Time: time, UoT: common.UOT_NS, Value: value})
+		}
+		if err := a.AddData(caller, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the uuid of the stream a statistic of the source is written to, a UUIDv3
+// under the given namespace
+func derivedUUID(namespace uuid.UUID, source common.UUID, name, stat string) common.UUID {
+	return common.UUID(uuid.NewV3(namespace, string(source)+"/"+name+"/"+stat).String())
+}
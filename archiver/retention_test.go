@@ -0,0 +1,90 @@
+package archiver
+
+import (
+	"github.com/gtfierro/giles2/common"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRetention(t *testing.T) {
+	a, _, _ := newFakeArchiver()
+	assert.Error(t, a.loadRetention(map[string]*Retention{"bad": {Where: `Metadata/Type = "Sensor"`, Raw: "1d", KeepRollup: "1y"}}))
+	assert.NoError(t, a.loadRetention(map[string]*Retention{
+		"sensors": {Where: `Metadata/Type = "Sensor"`, Raw: "90d", Rollup: "1d", KeepRollup: "1y"},
+		"scratch": {Where: `Metadata/Type = "Scratch"`, Raw: "30d"},
+	}))
+
+	var (
+		sensor, scratch = common.NewUUID(), common.NewUUID()
+		now             = time.Now()
+		day             = uint64(24 * time.Hour)
+		ms              = func(t time.Time) uint64 { return uint64(t.UnixNano() / 1e6) }
+		// the start of the day 100 days ago, in milliseconds
+		old = (uint64(now.Add(-100*24*time.Hour).UnixNano()) / day * day) / 1e6
+	)
+	reading := func(time uint64, value float64) common.Reading {
+		return &common.SmapNumberReading{Time: time, Value: value}
+	}
+	assert.NoError(t, a.AddData("test", &common.SmapMessage{Path: "/sensor", UUID: sensor, Metadata: common.Dict{"Type": "Sensor"}, Readings: []common.Reading{
+		reading(old+3600e3, 1),
+		reading(old+7200e3, 3),
+		reading(old+25*3600e3, 5),
+		reading(ms(now.Add(-24*time.Hour)), 7),
+	}}))
+	assert.NoError(t, a.AddData("test", &common.SmapMessage{Path: "/scratch", UUID: scratch, Metadata: common.Dict{"Type": "Scratch"}, Readings: []common.Reading{
+		reading(ms(now.Add(-40*24*time.Hour)), 1),
+		reading(ms(now.Add(-10*24*time.Hour)), 2),
+	}}))
+
+	values := func(query string) (ret []float64) {
+		res, err := a.HandleQuery("test", query)
+		assert.NoError(t, err, query)
+		for _, msg := range res.(common.SmapMessageList) {
+			for _, rdg := range msg.Readings {
+				ret = append(ret, rdg.GetValue().(float64))
+			}
+		}
+		return
+	}
+
+	reports, err := a.EnforceRetention("test", true)
+	assert.NoError(t, err)
+	if assert.Len(t, reports, 2) {
+		assert.Equal(t, "scratch", reports[0].Policy)
+		assert.Len(t, reports[0].Streams, 1)
+		assert.Zero(t, reports[0].RollupBefore)
+		assert.Equal(t, "sensors", reports[1].Policy)
+		assert.True(t, reports[1].DryRun)
+		if assert.Len(t, reports[1].Streams, 1) {
+			assert.Equal(t, sensor, reports[1].Streams[0].UUID)
+			assert.Equal(t, old*1e6, reports[1].Streams[0].Begin)
+			assert.Equal(t, 2, reports[1].Streams[0].Windows)
+		}
+	}
+	assert.Equal(t, []float64{1, 3, 5, 7}, values(`select data in (now -200d, now) where uuid = "`+string(sensor)+`"`))
+
+	_, err = a.EnforceRetention("test", false)
+	assert.NoError(t, err)
+	assert.Equal(t, []float64{7}, values(`select data in (now -200d, now) where uuid = "`+string(sensor)+`"`))
+	assert.Equal(t, []float64{2}, values(`select data in (now -200d, now) where uuid = "`+string(scratch)+`"`))
+	for stat, expected := range map[string][]float64{"min": {1, 5}, "mean": {2, 5}, "max": {3, 5}, "count": {2, 1}} {
+		assert.Equal(t, expected, values(`select data in (now -200d, now) where Metadata/RollupOf = "`+string(sensor)+`" and Metadata/RollupStatistic = "`+stat+`"`), stat)
+	}
+	// rollups are kept apart from the raw streams
+	paths, err := a.HandleQuery("test", `select distinct Path where Metadata/RollupOf = "`+string(sensor)+`"`)
+	assert.NoError(t, err)
+	assert.Contains(t, paths, "/_derived/sensor/sensors/mean")
+	// rollups are not picked up by the where clause of their policy
+	reports, err = a.EnforceRetention("test", false)
+	assert.NoError(t, err)
+	for _, report := range reports {
+		assert.Empty(t, report.Streams, report.Policy)
+	}
+
+	// rollups age out too
+	a.retention[1].keepRollup = 95 * 24 * time.Hour
+	_, err = a.EnforceRetention("test", false)
+	assert.NoError(t, err)
+	assert.Empty(t, values(`select data in (now -200d, now) where Metadata/RollupOf = "`+string(sensor)+`"`))
+}
@@ -0,0 +1,224 @@
+package archiver
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/gtfierro/giles2/common"
+	"io"
+	"math"
+)
+
+// Archives are newline-delimited JSON so they do not depend on the metadata
+// or timeseries store in use. The first line identifies the format
+//    {"GilesArchive": 1}
+// and every following line is an sMAP message. For each stream there is one
+// message with its Path, Metadata, Properties and Actuator, followed by
+// messages carrying its readings in chunks. Timestamps are in the unit of time
+// of the stream.
+const SnapshotVersion = 1
+
+// how much time (in nanoseconds) of a stream's readings we fetch from the
+// timeseries store at once while exporting
+const snapshotWindow = uint64(24 * 60 * 60 * 1e9)
+
+type snapshotHeader struct {
+	GilesArchive int
+}
+
+// SnapshotFilter restricts what is exported. An empty Where matches every
+// stream. Begin and End bound the readings and may be in any unit of time; an
+// End of 0 means now
+type SnapshotFilter struct {
+	Where string
+	Begin uint64
+	End   uint64
+}
+
+type SnapshotSummary struct {
+	Streams  int
+	Readings int
+}
+
+// converts bounds on readings in any unit of time to nanoseconds. An end of 0
+// means now
+func snapshotBounds(from, to uint64) (begin, end uint64, err error) {
+	end = to
+	if end == 0 {
+		end = common.GetNow(common.UOT_NS)
+	}
+	if begin, err = common.ConvertTime(from, common.GuessTimeUnit(from), common.UOT_NS); err != nil {
+		return
+	}
+	if end, err = common.ConvertTime(end, common.GuessTimeUnit(end), common.UOT_NS); err != nil {
+		return
+	}
+	if end < begin {
+		begin, end = end, begin
+	}
+	return
+}
+
+// where clause of the filter as parsed by the query language
+func (a *Archiver) snapshotWhere(filter SnapshotFilter) (common.Dict, error) {
+	if filter.Where == "" {
+		return common.Dict{}, nil
+	}
+	querystring := "select * where " + filter.Where
+	parsed := a.qp.Parse(querystring)
+	if parsed.Err != nil {
+		return nil, fmt.Errorf("Error (%v) in where clause \"%v\" (error at %v)", parsed.Err, filter.Where, parsed.ErrPos)
+	}
+	return parsed.Where, nil
+}
+
+// Export writes the documents of all streams matching the filter, and their
+// readings within its time range, to w in the archive format
+func (a *Archiver) Export(w io.Writer, filter SnapshotFilter) (summary SnapshotSummary, err error) {
+	where, err := a.snapshotWhere(filter)
+	if err != nil {
+		return
+	}
+	begin, end, err := snapshotBounds(filter.Begin, filter.End)
+	if err != nil {
+		return
+	}
+	docs, err := a.mdStore.GetTags(nil, where.ToBson())
+	if err != nil {
+		return
+	}
+
+	buffered := bufio.NewWriter(w)
+	encoder := json.NewEncoder(buffered)
+	if err = encoder.Encode(snapshotHeader{SnapshotVersion}); err != nil {
+		return
+	}
+	for _, doc := range docs {
+		if doc.UUID == "" {
+			continue
+		}
+		if err = encoder.Encode(doc); err != nil {
+			return
+		}
+		summary.Streams++
+		uot, err := a.mdStore.GetUnitOfTime(doc.UUID)
+		if err != nil {
+			return summary, err
+		}
+		if uot == 0 {
+			uot = common.UOT_MS
+		}
+		// walk the stream in windows so we never hold all of its readings,
+		// skipping ahead to the next reading after each window
+		start := begin
+		for start <= end {
+			if start, err = a.nextReadingTime(doc.UUID, start); err != nil || start > end {
+				break
+			}
+			stop := start + snapshotWindow - 1
+			if stop > end || stop < start {
+				stop = end
+			}
+			responses, err := a.tsStore.GetData([]common.UUID{doc.UUID}, start, stop)
+			if err != nil {
+				return summary, err
+			}
+			for _, resp := range responses {
+				if len(resp.Readings) == 0 {
+					continue
+				}
+				msg := &common.SmapMessage{UUID: doc.UUID, Readings: make([]common.Reading, len(resp.Readings))}
+				for i, rdg := range resp.Readings {
+					rdg.ConvertTime(uot)
+					msg.Readings[i] = rdg
+				}
+				if err = encoder.Encode(msg); err != nil {
+					return summary, err
+				}
+				summary.Readings += len(msg.Readings)
+			}
+			if stop == end {
+				break
+			}
+			start = stop + 1
+		}
+		if err != nil {
+			return summary, err
+		}
+	}
+	err = buffered.Flush()
+	return
+}
+
+// returns the time in nanoseconds of the first reading of the stream at or
+// after [from], or math.MaxUint64 if there is none
+func (a *Archiver) nextReadingTime(uuid common.UUID, from uint64) (uint64, error) {
+	ref := from
+	if ref > 0 {
+		ref--
+	}
+	responses, err := a.tsStore.Next([]common.UUID{uuid}, ref)
+	if err != nil {
+		return 0, err
+	}
+	for _, resp := range responses {
+		if len(resp.Readings) > 0 {
+			time := resp.Readings[0].GetTime()
+			return common.ConvertTime(time, common.GuessTimeUnit(time), common.UOT_NS)
+		}
+	}
+	return math.MaxUint64, nil
+}
+
+// Restore recreates the streams in an archive written by Export. Documents are
+// saved to the metadata store and the readings between from and to (in any
+// unit of time; a to of 0 means now) are written to the timeseries store.
+// Restored readings are not delivered to subscribers.
+func (a *Archiver) Restore(r io.Reader, from, to uint64) (summary SnapshotSummary, err error) {
+	begin, end, err := snapshotBounds(from, to)
+	if err != nil {
+		return
+	}
+	decoder := json.NewDecoder(bufio.NewReader(r))
+	var header snapshotHeader
+	if err = decoder.Decode(&header); err != nil {
+		return summary, fmt.Errorf("Could not read archive header (%v)", err)
+	}
+	if header.GilesArchive != SnapshotVersion {
+		return summary, fmt.Errorf("Unsupported archive version %v", header.GilesArchive)
+	}
+
+	for {
+		var msg common.SmapMessage
+		if err = decoder.Decode(&msg); err == io.EOF {
+			return summary, nil
+		} else if err != nil {
+			return summary, err
+		}
+		if msg.UUID == "" {
+			continue
+		}
+		if msg.HasMetadata() || msg.Path != "" {
+			summary.Streams++
+		}
+		// keep only the readings in range
+		readings := msg.Readings[:0]
+		for _, rdg := range msg.Readings {
+			time, err := common.ConvertTime(rdg.GetTime(), common.GuessTimeUnit(rdg.GetTime()), common.UOT_NS)
+			if err == nil && time >= begin && time <= end {
+				readings = append(readings, rdg)
+			}
+		}
+		msg.Readings = readings
+		if err = a.prepareMessage(restoreCaller, &msg); err != nil {
+			return summary, err
+		}
+		if len(msg.Readings) == 0 {
+			continue
+		}
+		if err = a.tsStore.AddMessage(&msg); err != nil {
+			return summary, err
+		}
+		summary.Readings += len(msg.Readings)
+	}
+}
@@ -0,0 +1,51 @@
+package archiver
+
+import (
+	"bytes"
+	"github.com/gtfierro/giles2/common"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	src, _, srcMD := newFakeArchiver()
+	// a day and a half of readings, so export needs more than one window
+	msg := &common.SmapMessage{
+		UUID:     "aaaa",
+		Path:     "/sensor0",
+		Metadata: common.Dict{"Site": "A"},
+		Readings: []common.Reading{
+			&common.SmapNumberReading{Time: 1351043674000, Value: 1},
+			&common.SmapNumberReading{Time: 1351087000000, Value: 2},
+			&common.SmapNumberReading{Time: 1351173400000, Value: 3},
+		},
+	}
+	assert.Nil(t, src.AddData("test", msg))
+	assert.Len(t, srcMD.saved, 1)
+
+	var archive bytes.Buffer
+	summary, err := src.Export(&archive, SnapshotFilter{Begin: 1351043674000, End: 1351173400000})
+	assert.Nil(t, err)
+	assert.Equal(t, SnapshotSummary{Streams: 1, Readings: 3}, summary)
+	assert.True(t, strings.HasPrefix(archive.String(), `{"GilesArchive":1}`))
+
+	// restore only the first two readings
+	dst, dstTS, dstMD := newFakeArchiver()
+	summary, err = dst.Restore(&archive, 1351043674000, 1351087000000)
+	assert.Nil(t, err)
+	assert.Equal(t, SnapshotSummary{Streams: 1, Readings: 2}, summary)
+	assert.Equal(t, "A", dstMD.saved[0].Metadata["Site"])
+	assert.Equal(t, "/sensor0", dstMD.saved[0].Path)
+	restored := dstTS.readings([]common.UUID{"aaaa"}, 0, common.GetNow(common.UOT_NS))
+	if assert.Len(t, restored, 1) && assert.Len(t, restored[0].Readings, 2) {
+		assert.Equal(t, uint64(1351043674000), restored[0].Readings[0].Time)
+		assert.Equal(t, float64(2), restored[0].Readings[1].Value)
+	}
+}
+
+func TestRestoreBadHeader(t *testing.T) {
+	a, _, _ := newFakeArchiver()
+	_, err := a.Restore(strings.NewReader(`{"GilesArchive": 2}`), 0, 0)
+	assert.NotNil(t, err)
+}
@@ -3,6 +3,8 @@ package archiver
 import (
 	"fmt"
 	"github.com/gtfierro/giles2/archiver/internal/querylang"
+	"github.com/gtfierro/giles2/common"
+	"time"
 )
 
 type Subscriber struct {
@@ -10,6 +12,19 @@ type Subscriber struct {
 	closed       <-chan bool
 	errorHandler func(error)
 	query        *querylang.ParsedQuery
+	// set if the query's time range rolls forward with now
+	window *rollingWindow
+	// set for durable subscriptions, whose cursors follow the readings
+	// delivered to them (see Delivered)
+	durable *durableSubscription
+	// set once the initial results have been delivered
+	initialDelivered bool
+	// if not zero, the readings after this time (in nanoseconds) are sent
+	// after the initial results, to catch up a resumed subscription
+	since uint64
+	// set if the subscriber is sent the events of its subscription as well
+	// as the results of its query
+	events bool
 }
 
 // The [closed] argument is a channel provided by the protocol adapter
@@ -23,6 +38,16 @@ func NewSubscriber(closed <-chan bool, bufferSize int, handleError func(error))
 	}
 }
 
+// ReceiveEvents has the subscriber sent the events of its subscription: a
+// SubscriptionDiff when the matching streams change, a WindowExpiry as
+// readings leave a range relative to now and a LivenessChange as streams go
+// stale or live again. Transports call it before HandleNewSubscriber if their
+// clients understand these; other subscribers only get the results of their
+// query
+func (s *Subscriber) ReceiveEvents() {
+	s.events = true
+}
+
 // Attempts to send a message on the subscribers channel. If this
 // fails (e.g. queue is full), then the message is dropped
 func (s *Subscriber) QueueToSend(v QueryResult) error {
@@ -39,6 +64,62 @@ func (s *Subscriber) BlockSend(v QueryResult) {
 	s.C <- v
 }
 
+// returns msg with only the readings that are not after the end of the
+// subscriber's range (e.g. "now -30min" in "select data in (now -1h, now
+// -30min)") at the given time, or nil if none are left. Readings are left out
+// of a copy of msg, which the broker journals as an alias of msg. Ranges that
+// end at now are not cut, so readings from clocks a little ahead still arrive
+func (s *Subscriber) inRange(msg *common.SmapMessage, now time.Time) *common.SmapMessage {
+	if s.query == nil {
+		return msg
+	}
+	data := s.query.Data
+	if data == nil || data.Dtype != querylang.IN_TYPE || len(msg.Readings) == 0 || (data.EndRef.Relative && data.EndRef.Offset >= 0) {
+		return msg
+	}
+	end := uint64(data.EndRef.At(now).UnixNano())
+	var readings []common.Reading
+	for _, rdg := range msg.Readings {
+		time, err := common.ConvertTime(rdg.GetTime(), common.GuessTimeUnit(rdg.GetTime()), common.UOT_NS)
+		if err == nil && time <= end {
+			readings = append(readings, rdg)
+		}
+	}
+	if len(readings) == len(msg.Readings) {
+		return msg
+	} else if len(readings) == 0 {
+		return nil
+	}
+	inRange := *msg
+	inRange.Readings = readings
+	return &inRange
+}
+
+// Delivered tells the archiver that the transport has delivered the result
+// to the client. The cursors of a durable subscription move past the readings
+// of the results delivered, so results that are lost are sent again when the
+// subscription is resumed. Transports call it from a single goroutine, in
+// the order results were delivered
+func (s *Subscriber) Delivered(v QueryResult) {
+	if s.durable == nil {
+		return
+	}
+	switch t := v.(type) {
+	case common.SmapMessageList:
+		// the first list is the initial results, e.g. the latest reading of
+		// each stream, which do not cover the readings before them
+		if !s.initialDelivered {
+			s.initialDelivered = true
+			return
+		}
+		for _, msg := range t {
+			s.durable.advance(msg)
+		}
+	case *common.SmapMessage:
+		s.durable.advance(t)
+	}
+}
+
 // sends error to the client
 func (s *Subscriber) SendError(e error) {
 	s.errorHandler(e)
@@ -14,6 +14,16 @@ func NewExponentialTimer(max int64) *ExponentialTimer {
 }
 
 func (et *ExponentialTimer) Wait(showTime bool) {
+	wait := et.Next()
+	if showTime {
+		log.Debugf("Waiting %v for new connection", wait)
+	}
+	time.Sleep(wait)
+}
+
+// Next returns how long to wait now and doubles the following wait, for
+// callers that must stop waiting early
+func (et *ExponentialTimer) Next() time.Duration {
 	oldTime := et.currentTime
 	if et.currentTime < et.maximumTime {
 		tmp := oldTime << 1
@@ -22,10 +32,7 @@ func (et *ExponentialTimer) Wait(showTime bool) {
 		}
 		et.currentTime = tmp
 	}
-	if showTime {
-		log.Debugf("Waiting %v seconds for new connection", oldTime)
-	}
-	time.Sleep(time.Duration(oldTime) * time.Second)
+	return time.Duration(oldTime) * time.Second
 }
 
 func (et *ExponentialTimer) Reset() {
@@ -0,0 +1,126 @@
+package archiver
+
+import (
+	"encoding/json"
+	"github.com/gtfierro/giles2/common"
+	"gopkg.in/mgo.v2/bson"
+	"strings"
+	"sync"
+)
+
+// number of where clauses whose UUIDs are cached
+const uuidCacheSize = 1024
+
+// uuidCache holds the UUIDs matching recently evaluated where clauses so that
+// repeated queries do not go to the metadata store. An entry is dropped when
+// a key in its where clause may have changed
+type uuidCache struct {
+	entries map[string]uuidCacheEntry
+	// incremented whenever entries are dropped, so that a lookup racing with
+	// a change does not cache what it read before the change
+	generation uint64
+	sync.RWMutex
+}
+
+type uuidCacheEntry struct {
+	keys  []string
+	uuids []common.UUID
+}
+
+func newUUIDCache() *uuidCache {
+	return &uuidCache{entries: make(map[string]uuidCacheEntry)}
+}
+
+// returns the UUIDs matching the where clause, from the cache if possible
+func (c *uuidCache) getUUIDs(store MetadataStore, where common.Dict) ([]common.UUID, error) {
+	bytes, err := json.Marshal(where)
+	if err != nil {
+		return store.GetUUIDs(where.ToBson())
+	}
+	key := string(bytes)
+	c.RLock()
+	entry, found := c.entries[key]
+	generation := c.generation
+	c.RUnlock()
+	if found {
+		return append([]common.UUID{}, entry.uuids...), nil
+	}
+
+	uuids, err := store.GetUUIDs(where.ToBson())
+	if err != nil {
+		return uuids, err
+	}
+	c.Lock()
+	if c.generation == generation {
+		if len(c.entries) >= uuidCacheSize {
+			for old := range c.entries {
+				delete(c.entries, old)
+				break
+			}
+		}
+		c.entries[key] = uuidCacheEntry{keys: whereKeys(where.ToBson()), uuids: uuids}
+	}
+	c.Unlock()
+	return append([]common.UUID{}, uuids...), nil
+}
+
+// drops the entries whose where clauses use any of the given keys or keys
+// beneath them
+func (c *uuidCache) invalidate(keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.generation++
+	for clause, entry := range c.entries {
+		if keysOverlap(keys, entry.keys) {
+			delete(c.entries, clause)
+		}
+	}
+}
+
+// drops every entry
+func (c *uuidCache) clear() {
+	c.Lock()
+	c.generation++
+	c.entries = make(map[string]uuidCacheEntry)
+	c.Unlock()
+}
+
+// returns the document keys a where clause tests
+func whereKeys(where bson.M) (keys []string) {
+	for key, value := range where {
+		if !strings.HasPrefix(key, "$") {
+			keys = append(keys, key)
+			continue
+		}
+		// $and, $or
+		if clauses, ok := value.([]common.Dict); ok {
+			for _, clause := range clauses {
+				keys = append(keys, whereKeys(clause.ToBson())...)
+			}
+		}
+	}
+	return
+}
+
+// true if a changed key is one of the keys or contains one of them
+func keysOverlap(changed, keys []string) bool {
+	for _, c := range changed {
+		for _, key := range keys {
+			if key == c || strings.HasPrefix(key, c+".") || strings.HasPrefix(key, c+"|") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// returns the document keys set by a message
+func messageKeys(msg *common.SmapMessage) (keys []string) {
+	for key := range msg.ToBson() {
+		keys = append(keys, key)
+	}
+	return
+}
@@ -0,0 +1,85 @@
+package archiver
+
+import (
+	"github.com/gtfierro/giles2/archiver/internal/querylang"
+	"github.com/gtfierro/giles2/common"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+)
+
+// counts the where clauses evaluated by the metadata store
+type countingMDStore struct {
+	*fakeMDStore
+	lookups int
+}
+
+func (c *countingMDStore) GetUUIDs(where bson.M) ([]common.UUID, error) {
+	c.lookups++
+	return c.fakeMDStore.GetUUIDs(where)
+}
+
+func TestUUIDCache(t *testing.T) {
+	a, _, md := newFakeArchiver()
+	store := &countingMDStore{fakeMDStore: md}
+	a.mdStore = store
+	s0, s1 := common.NewUUID(), common.NewUUID()
+	assert.NoError(t, a.AddData("test", &common.SmapMessage{Path: "/s0", UUID: s0, Metadata: common.Dict{"Zone": "3"}}))
+	assert.NoError(t, a.AddData("test", &common.SmapMessage{Path: "/s1", UUID: s1, Metadata: common.Dict{"Zone": "4"}}))
+
+	query := `select data before now where Metadata/Zone = "3"`
+	selectZone3 := func() []common.UUID {
+		parsed := a.qp.Parse(query)
+		params := parsed.GetParams().(*common.DataParams)
+		assert.NoError(t, a.prepareDataParams(params))
+		return params.UUIDs
+	}
+	lookups := store.lookups
+	assert.Equal(t, []common.UUID{s0}, selectZone3())
+	assert.Equal(t, []common.UUID{s0}, selectZone3())
+	assert.Equal(t, lookups+1, store.lookups, "repeated where clauses should be cached")
+
+	// messages that do not change Zone leave the cache alone
+	assert.NoError(t, a.AddData("test", &common.SmapMessage{Path: "/s1", UUID: s1, Metadata: common.Dict{"Floor": "2"}}))
+	selectZone3()
+	assert.Equal(t, lookups+1, store.lookups)
+
+	assert.NoError(t, a.AddData("test", &common.SmapMessage{Path: "/s1", UUID: s1, Metadata: common.Dict{"Zone": "3"}}))
+	matched := selectZone3()
+	assert.Len(t, matched, 2)
+	assert.Contains(t, matched, s1)
+	assert.Equal(t, lookups+2, store.lookups)
+
+	// repeating the stream's metadata, as every sMAP message does, changes
+	// nothing, even for clauses on uuid or Path
+	query = `select data before now where Path = "/s0"`
+	selectZone3()
+	assert.NoError(t, a.AddData("test", &common.SmapMessage{Path: "/s0", UUID: s0, Metadata: common.Dict{"Zone": "3"},
+		Readings: []common.Reading{&common.SmapNumberReading{Time: 1351043674000, Value: 1}}}))
+	assert.Equal(t, []common.UUID{s0}, selectZone3())
+	assert.Equal(t, lookups+3, store.lookups)
+	// but a new Timezone does
+	query = `select data before now where Properties/Timezone = "America/Los_Angeles"`
+	assert.Empty(t, selectZone3())
+	assert.NoError(t, a.AddData("test", &common.SmapMessage{Path: "/s0", UUID: s0, Properties: &common.SmapProperties{Timezone: "America/Los_Angeles"}}))
+	assert.Equal(t, []common.UUID{s0}, selectZone3())
+	query = `select data before now where Metadata/Zone = "3"`
+
+	_, err := a.HandleQuery("test", `set Metadata/Zone = "4" where uuid = "`+string(s0)+`"`)
+	assert.NoError(t, err)
+	assert.Equal(t, []common.UUID{s1}, selectZone3())
+
+	_, err = a.HandleQuery("test", `delete Metadata/Zone where uuid = "`+string(s1)+`"`)
+	assert.NoError(t, err)
+	assert.Empty(t, selectZone3())
+}
+
+func TestWhereKeys(t *testing.T) {
+	parsed := querylang.NewQueryProcessor().Parse(`select * where Metadata/Zone = "3" and Path like "/a" or has Metadata/Location/Building`)
+	assert.NoError(t, parsed.Err)
+	keys := whereKeys(parsed.Where.ToBson())
+	assert.Len(t, keys, 3)
+	assert.True(t, keysOverlap([]string{"Metadata.Location"}, keys))
+	assert.True(t, keysOverlap([]string{"Path"}, keys))
+	assert.False(t, keysOverlap([]string{"Metadata.Floor", "Metadata.Zon"}, keys))
+}
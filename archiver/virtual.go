@@ -0,0 +1,463 @@
+package archiver
+
+import (
+	"fmt"
+	"github.com/gtfierro/giles2/common"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// the aggregates a virtual stream can compute over the streams matching its
+// where clause
+var aggregates = map[string]func(values []float64) float64{
+	"sum": func(values []float64) (sum float64) {
+		for _, value := range values {
+			sum += value
+		}
+		return
+	},
+	"mean": func(values []float64) float64 {
+		var sum float64
+		for _, value := range values {
+			sum += value
+		}
+		return sum / float64(len(values))
+	},
+	"min": func(values []float64) float64 {
+		min := math.Inf(1)
+		for _, value := range values {
+			min = math.Min(min, value)
+		}
+		return min
+	},
+	"max": func(values []float64) float64 {
+		max := math.Inf(-1)
+		for _, value := range values {
+			max = math.Max(max, value)
+		}
+		return max
+	},
+}
+
+// virtualStream is a stream whose readings are computed from its inputs
+// rather than stored. Each input holds its last value until its next reading,
+// so a reading is computed whenever any input has one
+type virtualStream struct {
+	uuid    common.UUID
+	formula *common.Formula
+	// set for expressions
+	expr formulaNode
+	// set for aggregates
+	where common.Dict
+	// last value of each input, for computing readings as they arrive. Nil
+	// until the first reading of an input arrives
+	latest     map[common.UUID]float64
+	latestLock sync.Mutex
+}
+
+// computes the value of the stream from the values of its inputs. Returns
+// false if the inputs do not have enough values or the value is not finite
+// (e.g. when dividing by zero)
+func (vs *virtualStream) value(values map[common.UUID]float64, inputs []common.UUID) (float64, bool) {
+	if vs.expr != nil {
+		vars := make(map[string]float64, len(vs.formula.Inputs))
+		for name, uuid := range vs.formula.Inputs {
+			value, found := values[uuid]
+			if !found {
+				return 0, false
+			}
+			vars[name] = value
+		}
+		value := vs.expr.eval(vars)
+		return value, !math.IsNaN(value) && !math.IsInf(value, 0)
+	}
+	var present []float64
+	for _, uuid := range inputs {
+		if value, found := values[uuid]; found {
+			present = append(present, value)
+		}
+	}
+	if len(present) == 0 {
+		return 0, false
+	}
+	value := aggregates[vs.formula.Aggregate](present)
+	return value, !math.IsNaN(value) && !math.IsInf(value, 0)
+}
+
+// computes the readings of the stream from the readings of its inputs. Only
+// readings at or after from (in nanoseconds) are returned
+func (vs *virtualStream) evaluate(responses []common.SmapNumbersResponse, inputs []common.UUID, from uint64) []*common.SmapNumberReading {
+	var events inputEvents
+	for _, resp := range responses {
+		for _, rdg := range resp.Readings {
+			time, err := common.ConvertTime(rdg.Time, common.GuessTimeUnit(rdg.Time), common.UOT_NS)
+			if err == nil {
+				events = append(events, inputEvent{time, resp.UUID, rdg.Value})
+			}
+		}
+	}
+	sort.Stable(events)
+
+	var (
+		values   = make(map[common.UUID]float64)
+		readings []*common.SmapNumberReading
+	)
+	for i, ev := range events {
+		values[ev.uuid] = ev.value
+		// readings at the same time are applied together
+		if i+1 < len(events) && events[i+1].time == ev.time {
+			continue
+		}
+		if ev.time < from {
+			continue
+		}
+		if value, ok := vs.value(values, inputs); ok {
+			readings = append(readings, &common.SmapNumberReading{Time: ev.time, UoT: common.UOT_NS, Value: value})
+		}
+	}
+	return readings
+}
+
+// a reading of an input of a virtual stream, at a time in nanoseconds
+type inputEvent struct {
+	time  uint64
+	uuid  common.UUID
+	value float64
+}
+
+type inputEvents []inputEvent
+
+func (ie inputEvents) Len() int           { return len(ie) }
+func (ie inputEvents) Swap(i, j int)      { ie[i], ie[j] = ie[j], ie[i] }
+func (ie inputEvents) Less(i, j int) bool { return ie[i].time < ie[j].time }
+
+// virtualStreams are the virtual streams known to the archiver
+type virtualStreams struct {
+	streams map[common.UUID]*virtualStream
+	// input uuid -> the expressions that use it
+	byInput map[common.UUID][]*virtualStream
+	// aggregates, whose inputs are the streams matching their where clause
+	// when a reading arrives
+	aggregates []*virtualStream
+	sync.RWMutex
+}
+
+func (v *virtualStreams) register(vs *virtualStream) {
+	v.Lock()
+	if v.streams == nil {
+		v.streams = make(map[common.UUID]*virtualStream)
+		v.byInput = make(map[common.UUID][]*virtualStream)
+	}
+	v.unindex(vs.uuid)
+	v.streams[vs.uuid] = vs
+	if vs.expr != nil {
+		for _, input := range vs.formula.Inputs {
+			// an input may have more than one name
+			if streams := v.byInput[input]; len(streams) == 0 || streams[len(streams)-1] != vs {
+				v.byInput[input] = append(streams, vs)
+			}
+		}
+	} else {
+		v.aggregates = append(v.aggregates, vs)
+	}
+	v.Unlock()
+}
+
+func (v *virtualStreams) remove(uuids []common.UUID) {
+	v.Lock()
+	for _, uuid := range uuids {
+		v.unindex(uuid)
+		delete(v.streams, uuid)
+	}
+	v.Unlock()
+}
+
+// removes the registered stream of the uuid from byInput and aggregates
+func (v *virtualStreams) unindex(uuid common.UUID) {
+	old, found := v.streams[uuid]
+	if !found {
+		return
+	}
+	if old.expr == nil {
+		v.aggregates = withoutVirtual(v.aggregates, old)
+		return
+	}
+	for _, input := range old.formula.Inputs {
+		if v.byInput[input] = withoutVirtual(v.byInput[input], old); len(v.byInput[input]) == 0 {
+			delete(v.byInput, input)
+		}
+	}
+}
+
+func withoutVirtual(streams []*virtualStream, vs *virtualStream) []*virtualStream {
+	kept := streams[:0]
+	for _, s := range streams {
+		if s != vs {
+			kept = append(kept, s)
+		}
+	}
+	return kept
+}
+
+// returns the virtual streams that may use the stream of the uuid: the
+// expressions with it as an input and every aggregate
+func (v *virtualStreams) using(uuid common.UUID) []*virtualStream {
+	v.RLock()
+	defer v.RUnlock()
+	streams := make([]*virtualStream, 0, len(v.byInput[uuid])+len(v.aggregates))
+	streams = append(streams, v.byInput[uuid]...)
+	return append(streams, v.aggregates...)
+}
+
+func (v *virtualStreams) get(uuid common.UUID) *virtualStream {
+	v.RLock()
+	defer v.RUnlock()
+	return v.streams[uuid]
+}
+
+// separates the stored streams from the virtual ones
+func (v *virtualStreams) split(uuids []common.UUID) (stored []common.UUID, virtual []*virtualStream) {
+	v.RLock()
+	defer v.RUnlock()
+	for _, uuid := range uuids {
+		if vs, found := v.streams[uuid]; found {
+			virtual = append(virtual, vs)
+		} else {
+			stored = append(stored, uuid)
+		}
+	}
+	return
+}
+
+// DefineVirtual saves msg as the metadata of a virtual stream computed by
+// the formula. Its readings are computed when queried and, for subscribers,
+// as the readings of its inputs arrive. The definition is recorded in the
+// audit log as made by caller
+func (a *Archiver) DefineVirtual(caller string, msg *common.SmapMessage, formula *common.Formula) error {
+	if msg.UUID == "" {
+		return fmt.Errorf("Virtual stream needs a uuid")
+	}
+	if len(msg.Readings) > 0 {
+		return fmt.Errorf("Virtual stream %v cannot have readings", msg.UUID)
+	}
+	vs, err := a.newVirtualStream(msg.UUID, formula)
+	if err != nil {
+		return err
+	}
+	changed, err := a.mdStore.SaveTags(msg)
+	if err != nil {
+		return err
+	}
+	if err = a.mdStore.SaveFormula(msg.UUID, formula); err != nil {
+		return err
+	}
+	a.virtuals.register(vs)
+	a.broker.uuids.invalidate(append(changed, "Formula"))
+	a.audit(caller, "define "+msg.Path, []common.UUID{msg.UUID})
+	return nil
+}
+
+// checks and parses the formula of a virtual stream
+func (a *Archiver) newVirtualStream(uuid common.UUID, formula *common.Formula) (*virtualStream, error) {
+	vs := &virtualStream{uuid: uuid, formula: formula}
+	switch {
+	case formula == nil || (formula.Expression == "") == (formula.Aggregate == ""):
+		return nil, fmt.Errorf("Virtual stream %v needs either an expression or an aggregate", uuid)
+	case formula.Expression != "":
+		expr, names, err := parseFormula(formula.Expression)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			input, found := formula.Inputs[name]
+			if !found {
+				return nil, fmt.Errorf("Formula \"%v\" has no input named %v", formula.Expression, name)
+			}
+			if input == uuid || a.virtuals.get(input) != nil {
+				return nil, fmt.Errorf("Input %v of %v is a virtual stream", name, uuid)
+			}
+		}
+		vs.expr = expr
+	default:
+		if _, found := aggregates[formula.Aggregate]; !found {
+			return nil, fmt.Errorf("Unknown aggregate %v (expected sum, mean, min or max)", formula.Aggregate)
+		}
+		if formula.Where == "" {
+			return nil, fmt.Errorf("Aggregate %v needs a where clause", formula.Aggregate)
+		}
+		parsed := a.qp.Parse("select uuid where " + formula.Where)
+		if parsed.Err != nil {
+			return nil, fmt.Errorf("Error (%v) in where clause \"%v\" (error at %v)", parsed.Err, formula.Where, parsed.ErrPos)
+		}
+		vs.where = parsed.Where
+	}
+	return vs, nil
+}
+
+// registers the virtual streams saved in the metadata store
+func (a *Archiver) loadVirtuals() {
+	formulas, err := a.mdStore.GetFormulas()
+	if err != nil {
+		log.Errorf("Could not load virtual streams (%v)", err)
+		return
+	}
+	for uuid, formula := range formulas {
+		if vs, err := a.newVirtualStream(uuid, formula); err != nil {
+			log.Errorf("Could not load virtual stream %v (%v)", uuid, err)
+		} else {
+			a.virtuals.register(vs)
+		}
+	}
+}
+
+// the streams a virtual stream is computed from. Virtual streams matching the
+// where clause of an aggregate are left out
+func (a *Archiver) virtualInputs(vs *virtualStream) ([]common.UUID, error) {
+	if vs.expr != nil {
+		var inputs []common.UUID
+		for _, uuid := range vs.formula.Inputs {
+			inputs = append(inputs, uuid)
+		}
+		return inputs, nil
+	}
+	matched, err := a.broker.uuids.getUUIDs(a.mdStore, vs.where)
+	if err != nil {
+		return nil, err
+	}
+	inputs, _ := a.virtuals.split(matched)
+	return inputs, nil
+}
+
+// returns the inputs of a virtual stream with their last readings before ref
+// and, if read is not nil, the readings it returns for them
+func (a *Archiver) readInputs(vs *virtualStream, ref uint64, read func([]common.UUID) ([]common.SmapNumbersResponse, error)) (inputs []common.UUID, readings []common.SmapNumbersResponse, err error) {
+	if inputs, err = a.virtualInputs(vs); err != nil {
+		return
+	}
+	if readings, err = a.tsStore.Prev(inputs, ref); err != nil || read == nil {
+		return
+	}
+	more, err := read(inputs)
+	return inputs, append(readings, more...), err
+}
+
+// These read readings like the TimeseriesStore methods they are named for,
+// computing those of virtual streams from their inputs
+
+func (a *Archiver) getData(uuids []common.UUID, begin, end uint64) ([]common.SmapNumbersResponse, error) {
+	stored, virtual := a.virtuals.split(uuids)
+	readings, err := a.tsStore.GetData(stored, begin, end)
+	if err != nil {
+		return readings, err
+	}
+	for _, vs := range virtual {
+		inputs, inputReadings, err := a.readInputs(vs, begin, func(inputs []common.UUID) ([]common.SmapNumbersResponse, error) {
+			return a.tsStore.GetData(inputs, begin, end)
+		})
+		if err != nil {
+			return readings, err
+		}
+		readings = append(readings, common.SmapNumbersResponse{UUID: vs.uuid, Readings: vs.evaluate(inputReadings, inputs, begin)})
+	}
+	return readings, nil
+}
+
+func (a *Archiver) prev(uuids []common.UUID, ref uint64) ([]common.SmapNumbersResponse, error) {
+	stored, virtual := a.virtuals.split(uuids)
+	readings, err := a.tsStore.Prev(stored, ref)
+	if err != nil {
+		return readings, err
+	}
+	for _, vs := range virtual {
+		inputs, inputReadings, err := a.readInputs(vs, ref, nil)
+		if err != nil {
+			return readings, err
+		}
+		if computed := vs.evaluate(inputReadings, inputs, 0); len(computed) > 0 {
+			readings = append(readings, common.SmapNumbersResponse{UUID: vs.uuid, Readings: computed[len(computed)-1:]})
+		}
+	}
+	return readings, nil
+}
+
+func (a *Archiver) next(uuids []common.UUID, ref uint64) ([]common.SmapNumbersResponse, error) {
+	stored, virtual := a.virtuals.split(uuids)
+	readings, err := a.tsStore.Next(stored, ref)
+	if err != nil {
+		return readings, err
+	}
+	for _, vs := range virtual {
+		inputs, inputReadings, err := a.readInputs(vs, ref, func(inputs []common.UUID) ([]common.SmapNumbersResponse, error) {
+			return a.tsStore.Next(inputs, ref)
+		})
+		if err != nil {
+			return readings, err
+		}
+		if computed := vs.evaluate(inputReadings, inputs, ref+1); len(computed) > 0 {
+			readings = append(readings, common.SmapNumbersResponse{UUID: vs.uuid, Readings: computed[:1]})
+		}
+	}
+	return readings, nil
+}
+
+// computes the readings of the virtual streams that use the stream of the
+// message and forwards them to their subscribers
+func (a *Archiver) updateVirtuals(msg *common.SmapMessage) {
+	if len(msg.Readings) == 0 {
+		return
+	}
+	for _, vs := range a.virtuals.using(msg.UUID) {
+		inputs, err := a.virtualInputs(vs)
+		if err != nil {
+			log.Errorf("Could not find the inputs of virtual stream %v (%v)", vs.uuid, err)
+			continue
+		}
+		if !containsUUID(inputs, msg.UUID) {
+			continue
+		}
+		if computed := a.updateVirtual(vs, inputs, msg); len(computed.Readings) > 0 {
+			a.broker.ForwardMessage(computed)
+		}
+	}
+}
+
+func (a *Archiver) updateVirtual(vs *virtualStream, inputs []common.UUID, msg *common.SmapMessage) *common.SmapMessage {
+	vs.latestLock.Lock()
+	defer vs.latestLock.Unlock()
+	computed := &common.SmapMessage{UUID: vs.uuid}
+	if vs.latest == nil {
+		// start from the last values stored for the inputs
+		vs.latest = make(map[common.UUID]float64)
+		held, err := a.tsStore.Prev(inputs, uint64(time.Now().UnixNano()))
+		if err != nil {
+			log.Errorf("Could not read the inputs of virtual stream %v (%v)", vs.uuid, err)
+		}
+		for _, resp := range held {
+			if len(resp.Readings) > 0 && resp.UUID != msg.UUID {
+				vs.latest[resp.UUID] = resp.Readings[len(resp.Readings)-1].Value
+			}
+		}
+	}
+	for _, rdg := range msg.Readings {
+		num, ok := rdg.GetValue().(float64)
+		if !ok {
+			continue
+		}
+		vs.latest[msg.UUID] = num
+		if value, ok := vs.value(vs.latest, inputs); ok {
+			computed.Readings = append(computed.Readings, &common.SmapNumberReading{Time: rdg.GetTime(), UoT: common.GuessTimeUnit(rdg.GetTime()), Value: value})
+		}
+	}
+	return computed
+}
+
+func containsUUID(uuids []common.UUID, uuid common.UUID) bool {
+	for _, u := range uuids {
+		if u == uuid {
+			return true
+		}
+	}
+	return false
+}
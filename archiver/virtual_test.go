@@ -0,0 +1,140 @@
+package archiver
+
+import (
+	"github.com/gtfierro/giles2/common"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestFormula(t *testing.T) {
+	for expression, expected := range map[string]float64{
+		"voltage * current":     240,
+		"-(voltage + 2) / 2":    -61,
+		"voltage - current * 2": 116,
+		"1.5 * (current)":       3,
+	} {
+		node, _, err := parseFormula(expression)
+		if assert.NoError(t, err, expression) {
+			assert.Equal(t, expected, node.eval(map[string]float64{"voltage": 120, "current": 2}), expression)
+		}
+	}
+	_, names, _ := parseFormula("a * b + a")
+	assert.Len(t, names, 2)
+	for _, bad := range []string{"a +", "a $ b", "(a * b", "a b"} {
+		_, _, err := parseFormula(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestVirtualStreams(t *testing.T) {
+	a, _, _ := newFakeArchiver()
+	var (
+		voltage, current, c1, c2 = common.NewUUID(), common.NewUUID(), common.NewUUID(), common.NewUUID()
+		power, total             = common.NewUUID(), common.NewUUID()
+	)
+	reading := func(time uint64, value float64) []common.Reading {
+		return []common.Reading{&common.SmapNumberReading{Time: time, Value: value}}
+	}
+	for _, msg := range []*common.SmapMessage{
+		{Path: "/voltage", UUID: voltage, Readings: reading(1351043674000, 120)},
+		{Path: "/current", UUID: current, Readings: reading(1351043675000, 2)},
+		{Path: "/voltage", UUID: voltage, Readings: reading(1351043676000, 110)},
+		{Path: "/current", UUID: current, Readings: reading(1351043676000, 3)},
+		{Path: "/c1", UUID: c1, Metadata: common.Dict{"Circuit": "A"}, Readings: reading(1351043674000, 1)},
+		{Path: "/c2", UUID: c2, Metadata: common.Dict{"Circuit": "A"}, Readings: reading(1351043675000, 2)},
+	} {
+		assert.NoError(t, a.AddData("test", msg))
+	}
+
+	assert.Error(t, a.DefineVirtual("test", &common.SmapMessage{UUID: power}, &common.Formula{Expression: "voltage * amps", Inputs: map[string]common.UUID{"voltage": voltage}}))
+	assert.Error(t, a.DefineVirtual("test", &common.SmapMessage{UUID: total}, &common.Formula{Aggregate: "median", Where: `Metadata/Circuit = "A"`}))
+	assert.NoError(t, a.DefineVirtual("test", &common.SmapMessage{Path: "/power", UUID: power}, &common.Formula{
+		Expression: "voltage * current",
+		Inputs:     map[string]common.UUID{"voltage": voltage, "current": current},
+	}))
+	// formulas cannot be set by a query, as they would not be registered
+	_, err := a.HandleQuery("test", `set Formula = "voltage * current" where uuid = "`+string(power)+`"`)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "DefineVirtual")
+	}
+	// the aggregate matches its own where clause, but is not one of its inputs
+	assert.NoError(t, a.DefineVirtual("test", &common.SmapMessage{Path: "/total", UUID: total, Metadata: common.Dict{"Circuit": "A"}}, &common.Formula{
+		Aggregate: "sum",
+		Where:     `Metadata/Circuit = "A"`,
+	}))
+
+	values := func(query string) (ret [][2]float64) {
+		res, err := a.HandleQuery("test", query)
+		assert.NoError(t, err, query)
+		for _, msg := range res.(common.SmapMessageList) {
+			for _, rdg := range msg.Readings {
+				rdg.ConvertTime(common.UOT_MS)
+				ret = append(ret, [2]float64{float64(rdg.GetTime()), rdg.GetValue().(float64)})
+			}
+		}
+		return
+	}
+	assert.Equal(t, [][2]float64{{1351043675000, 240}, {1351043676000, 330}}, values(`select data in (1351043674, 1351043680) where Path = "/power"`))
+	assert.Equal(t, [][2]float64{{1351043676000, 330}}, values(`select data before 1351043680 where Path = "/power"`))
+	assert.Equal(t, [][2]float64{{1351043676000, 330}}, values(`select data after 1351043675 where Path = "/power"`))
+	assert.Equal(t, [][2]float64{{1351043674000, 1}, {1351043675000, 3}}, values(`select data in (1351043674, 1351043680) where Path = "/total"`))
+
+	// readings of the inputs are computed as they arrive
+	closed := make(chan bool)
+	sub := NewSubscriber(closed, 10, func(err error) { t.Error(err) })
+	go a.HandleNewSubscriber(sub, `select data before 1351043680 where Path = "/power"`)
+	<-sub.C
+	assert.NoError(t, a.AddData("test", &common.SmapMessage{UUID: current, Readings: reading(1351043677000, 4)}))
+	computed := (<-sub.C).(*common.SmapMessage)
+	assert.Equal(t, power, computed.UUID)
+	if assert.Len(t, computed.Readings, 1) {
+		assert.Equal(t, 440.0, computed.Readings[0].GetValue())
+	}
+	closed <- true
+
+	_, err = a.HandleQuery("test", `delete where Path = "/power"`)
+	assert.NoError(t, err)
+	assert.Nil(t, a.virtuals.get(power))
+	// only the aggregate may still use voltage
+	assert.Equal(t, []*virtualStream{a.virtuals.get(total)}, a.virtuals.using(voltage))
+}
+
+func TestVirtualDivideByZero(t *testing.T) {
+	a, _, _ := newFakeArchiver()
+	energy, hours, rate := common.NewUUID(), common.NewUUID(), common.NewUUID()
+	reading := func(time uint64, value float64) []common.Reading {
+		return []common.Reading{&common.SmapNumberReading{Time: time, Value: value}}
+	}
+	for _, msg := range []*common.SmapMessage{
+		{Path: "/energy", UUID: energy, Readings: reading(1351043674000, 10)},
+		{Path: "/hours", UUID: hours, Readings: reading(1351043674000, 2)},
+		{Path: "/hours", UUID: hours, Readings: reading(1351043675000, 0)},
+	} {
+		assert.NoError(t, a.AddData("test", msg))
+	}
+	assert.NoError(t, a.DefineVirtual("test", &common.SmapMessage{Path: "/rate", UUID: rate}, &common.Formula{
+		Expression: "energy / hours",
+		Inputs:     map[string]common.UUID{"energy": energy, "hours": hours},
+	}))
+
+	// readings dividing by zero are dropped
+	res, err := a.HandleQuery("test", `select data in (1351043674, 1351043680) where Path = "/rate"`)
+	if assert.NoError(t, err) && assert.Len(t, res, 1) {
+		readings := res.(common.SmapMessageList)[0].Readings
+		if assert.Len(t, readings, 1) {
+			assert.Equal(t, 5.0, readings[0].GetValue())
+		}
+	}
+
+	closed := make(chan bool)
+	sub := NewSubscriber(closed, 10, func(err error) { t.Error(err) })
+	go a.HandleNewSubscriber(sub, `select data before 1351043680 where Path = "/rate"`)
+	<-sub.C
+	assert.NoError(t, a.AddData("test", &common.SmapMessage{UUID: energy, Readings: reading(1351043676000, 20)}))
+	assert.NoError(t, a.AddData("test", &common.SmapMessage{UUID: hours, Readings: reading(1351043677000, 4)}))
+	computed := (<-sub.C).(*common.SmapMessage)
+	if assert.Len(t, computed.Readings, 1) {
+		assert.Equal(t, 5.0, computed.Readings[0].GetValue())
+	}
+	closed <- true
+}
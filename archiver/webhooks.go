@@ -0,0 +1,376 @@
+package archiver
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gtfierro/giles2/common"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Webhooks (see common.Webhook) subscribe to a query on behalf of consumers
+// that cannot hold a connection open, such as serverless functions. The
+// broker delivers to a webhook like to any other subscriber, and the results
+// are POSTed to the Target in batches of up to webhookBatchSize, at most
+// webhookFlushInterval after the first result of the batch arrived. Each POST
+// carries a JSON WebhookBatch and the header
+//    X-Giles-Signature: sha256=<hex HMAC-SHA256 of the body keyed by the secret>
+// A batch that is not acknowledged with a 2xx is sent again, waiting longer
+// after each failure, and dropped after webhookAttempts tries. Registrations
+// are kept in the metadata store and resumed when the archiver starts. The
+// Sequence of the batches is kept with them and saved before each batch is
+// sent, so it keeps counting up across restarts and registrations of the
+// same ID.
+
+// how long the first result of a batch waits for others to join it
+var webhookFlushInterval = time.Second
+
+const (
+	webhookBatchSize = 100
+	// results queued for a webhook while a batch is being delivered; more
+	// are dropped
+	webhookBufferSize = 1000
+	webhookAttempts   = 8
+	// longest wait (in seconds) between attempts
+	webhookMaxBackoff = 300
+)
+
+// the Type of the results in a batch
+const (
+	WEBHOOK_INITIAL  = "initial"
+	WEBHOOK_DATA     = "data"
+	WEBHOOK_DIFF     = "diff"
+	WEBHOOK_EXPIRE   = "expire"
+	WEBHOOK_LIVENESS = "liveness"
+)
+
+// WebhookBatch is the body of the POSTs to a webhook
+type WebhookBatch struct {
+	Webhook string
+	// counts the batches of the webhook, so receivers can drop repeats of a
+	// batch whose acknowledgement was lost. It is never reused, but batches
+	// that were dropped leave gaps
+	Sequence uint64
+	Results  []WebhookResult
+}
+
+type WebhookResult struct {
+	Type string
+	Data QueryResult
+}
+
+// WebhookStatus is what we report about a webhook; it leaves out the secret
+type WebhookStatus struct {
+	ID      string
+	Query   string
+	Target  string
+	Created time.Time
+	// batches acknowledged by the target and dropped after failing
+	Delivered    uint64
+	Dropped      uint64
+	LastDelivery time.Time `json:",omitempty"`
+	LastError    string    `json:",omitempty"`
+}
+
+type webhook struct {
+	common.Webhook
+	sub    *Subscriber
+	closed chan bool
+	stop   chan struct{}
+	client *http.Client
+	status WebhookStatus
+	// saves the Sequence of the webhook
+	store MetadataStore
+	// set once the webhook is stopped, after which it numbers no more batches
+	retired bool
+	sync.Mutex
+}
+
+// the webhooks of the archiver by ID
+type webhooks struct {
+	hooks map[string]*webhook
+	sync.Mutex
+}
+
+// SignWebhook returns the X-Giles-Signature header of a webhook POST with the
+// given body
+func SignWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// checks a webhook registration
+func (a *Archiver) checkWebhook(hook common.Webhook) error {
+	if err := a.checkSubscriptionQuery(hook.Query); err != nil {
+		return err
+	}
+	if target, err := url.Parse(hook.Target); err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return fmt.Errorf("Webhook target \"%v\" is not an http(s) URL", hook.Target)
+	}
+	if hook.Secret == "" {
+		return fmt.Errorf("Webhook needs a secret to sign its deliveries")
+	}
+	return nil
+}
+
+// resumes the webhooks saved in the metadata store
+func (a *Archiver) loadWebhooks() {
+	saved, err := a.mdStore.GetWebhooks()
+	if err != nil {
+		log.Errorf("Could not load webhooks (%v)", err)
+		return
+	}
+	for _, hook := range saved {
+		if err := a.checkWebhook(hook); err != nil {
+			log.Errorf("Could not load webhook %v (%v)", hook.ID, err)
+			continue
+		}
+		a.startWebhook(hook)
+	}
+}
+
+// RegisterWebhook saves the webhook and starts delivering to it. It is given
+// an ID unless it has one, replacing the webhook of the same ID. The
+// registration is recorded in the audit log as made by caller
+func (a *Archiver) RegisterWebhook(caller string, hook common.Webhook) (WebhookStatus, error) {
+	if err := a.checkWebhook(hook); err != nil {
+		return WebhookStatus{}, err
+	}
+	if hook.ID == "" {
+		hook.ID = string(common.NewUUID())
+	}
+	hook.Created = time.Now()
+	// a webhook registered again carries on numbering its batches from where
+	// the one it replaces stopped
+	hook.Sequence = 0
+	old := a.stopWebhook(hook.ID)
+	if old != nil {
+		hook.Sequence = old.Sequence
+	}
+	if err := a.mdStore.SaveWebhook(&hook); err != nil {
+		if old != nil {
+			a.startWebhook(*old)
+		}
+		return WebhookStatus{}, err
+	}
+	w := a.startWebhook(hook)
+	a.audit(caller, "register webhook "+hook.ID, nil)
+	return w.getStatus(), nil
+}
+
+// RemoveWebhook stops delivering to the webhook and forgets it. The removal
+// is recorded in the audit log as made by caller
+func (a *Archiver) RemoveWebhook(caller, id string) error {
+	a.webhooks.Lock()
+	_, found := a.webhooks.hooks[id]
+	a.webhooks.Unlock()
+	if !found {
+		return fmt.Errorf("No webhook %v", id)
+	}
+	if err := a.mdStore.RemoveWebhook(id); err != nil {
+		return err
+	}
+	a.stopWebhook(id)
+	a.audit(caller, "remove webhook "+id, nil)
+	return nil
+}
+
+// Webhooks returns the status of the webhooks ordered by ID
+func (a *Archiver) Webhooks() []WebhookStatus {
+	a.webhooks.Lock()
+	defer a.webhooks.Unlock()
+	ret := make([]WebhookStatus, 0, len(a.webhooks.hooks))
+	for _, w := range a.webhooks.hooks {
+		ret = append(ret, w.getStatus())
+	}
+	sort.Sort(webhooksByID(ret))
+	return ret
+}
+
+type webhooksByID []WebhookStatus
+
+func (wi webhooksByID) Len() int           { return len(wi) }
+func (wi webhooksByID) Swap(i, j int)      { wi[i], wi[j] = wi[j], wi[i] }
+func (wi webhooksByID) Less(i, j int) bool { return wi[i].ID < wi[j].ID }
+
+// subscribes the webhook to its query and starts delivering its results
+func (a *Archiver) startWebhook(hook common.Webhook) *webhook {
+	w := &webhook{
+		Webhook: hook,
+		closed:  make(chan bool, 1),
+		stop:    make(chan struct{}),
+		client:  &http.Client{Timeout: 10 * time.Second},
+		status:  WebhookStatus{ID: hook.ID, Query: hook.Query, Target: hook.Target, Created: hook.Created},
+		store:   a.mdStore,
+	}
+	w.sub = NewSubscriber(w.closed, webhookBufferSize, w.handleError)
+	w.sub.ReceiveEvents()
+	a.webhooks.Lock()
+	if a.webhooks.hooks == nil {
+		a.webhooks.hooks = make(map[string]*webhook)
+	}
+	a.webhooks.hooks[hook.ID] = w
+	a.webhooks.Unlock()
+	go func() {
+		// returns once the webhook is stopped
+		if err := a.HandleNewSubscriber(w.sub, w.Query); err != nil {
+			log.Errorf("Could not subscribe webhook %v (%v)", w.ID, err)
+		}
+	}()
+	go w.deliver()
+	return w
+}
+
+// stops delivering to the webhook, if there is one with the ID, and returns
+// it as it was when stopped: its Sequence is the last one it will use
+func (a *Archiver) stopWebhook(id string) *common.Webhook {
+	a.webhooks.Lock()
+	w, found := a.webhooks.hooks[id]
+	delete(a.webhooks.hooks, id)
+	a.webhooks.Unlock()
+	if !found {
+		return nil
+	}
+	w.Lock()
+	w.retired = true
+	hook := w.Webhook
+	w.Unlock()
+	close(w.stop)
+	w.closed <- true
+	return &hook
+}
+
+func (w *webhook) getStatus() WebhookStatus {
+	w.Lock()
+	defer w.Unlock()
+	return w.status
+}
+
+func (w *webhook) handleError(err error) {
+	if err == nil {
+		return
+	}
+	w.Lock()
+	w.status.LastError = err.Error()
+	w.Unlock()
+}
+
+// batches the results of the subscription and sends them to the target
+func (w *webhook) deliver() {
+	var (
+		batch   []WebhookResult
+		flush   <-chan time.Time
+		initial = true
+	)
+	for {
+		select {
+		case <-w.stop:
+			return
+		case val := <-w.sub.C:
+			result := WebhookResult{Type: WEBHOOK_DATA, Data: val}
+			switch val.(type) {
+			case SubscriptionDiff:
+				result.Type = WEBHOOK_DIFF
+			case WindowExpiry:
+				result.Type = WEBHOOK_EXPIRE
+			case LivenessChange:
+				result.Type = WEBHOOK_LIVENESS
+			case *common.SmapMessage:
+				// readings
+			default:
+				if initial {
+					result.Type = WEBHOOK_INITIAL
+					initial = false
+				}
+			}
+			batch = append(batch, result)
+			if len(batch) == 1 {
+				flush = time.After(webhookFlushInterval)
+			}
+			if len(batch) < webhookBatchSize {
+				continue
+			}
+		case <-flush:
+		}
+		w.send(batch)
+		batch, flush = nil, nil
+	}
+}
+
+// POSTs the batch to the target until it is acknowledged, the attempts run
+// out or the webhook is stopped
+func (w *webhook) send(results []WebhookResult) {
+	// the sequence is saved under the lock, so a webhook replacing this one
+	// starts after it
+	w.Lock()
+	if w.retired {
+		w.Unlock()
+		return
+	}
+	w.Sequence++
+	sequence := w.Sequence
+	if err := w.store.SaveWebhookSequence(w.ID, sequence); err != nil {
+		log.Errorf("Could not save the sequence of webhook %v (%v)", w.ID, err)
+	}
+	w.Unlock()
+	body, err := json.Marshal(WebhookBatch{Webhook: w.ID, Sequence: sequence, Results: results})
+	if err != nil {
+		log.Errorf("Could not encode batch for webhook %v (%v)", w.ID, err)
+		return
+	}
+	timer := NewExponentialTimer(webhookMaxBackoff)
+	for attempt := 1; ; attempt++ {
+		err = w.post(body)
+		w.Lock()
+		if err == nil {
+			w.status.Delivered++
+			w.status.LastDelivery = time.Now()
+			w.status.LastError = ""
+		} else {
+			w.status.LastError = err.Error()
+			if attempt == webhookAttempts {
+				w.status.Dropped++
+			}
+		}
+		w.Unlock()
+		if err == nil {
+			return
+		}
+		if attempt == webhookAttempts {
+			log.Errorf("Dropping batch %v of webhook %v after %v attempts (%v)", sequence, w.ID, attempt, err)
+			return
+		}
+		log.Warningf("Could not deliver batch %v to webhook %v (%v)", sequence, w.ID, err)
+		select {
+		case <-w.stop:
+			return
+		case <-time.After(timer.Next()):
+		}
+	}
+}
+
+func (w *webhook) post(body []byte) error {
+	req, err := http.NewRequest("POST", w.Target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Giles-Signature", SignWebhook(w.Secret, body))
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("POST %v returned %v", w.Target, resp.Status)
+	}
+	return nil
+}
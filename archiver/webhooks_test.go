@@ -0,0 +1,163 @@
+package archiver
+
+import (
+	"encoding/json"
+	"github.com/gtfierro/giles2/common"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhooks(t *testing.T) {
+	webhookFlushInterval = 10 * time.Millisecond
+	type batch struct {
+		Webhook  string
+		Sequence uint64
+		Results  []struct {
+			Type string
+			Data json.RawMessage
+		}
+	}
+	var (
+		batches = make(chan batch, 10)
+		posts   int
+		lock    sync.Mutex
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		assert.Equal(t, SignWebhook("secret", body), req.Header.Get("X-Giles-Signature"))
+		lock.Lock()
+		posts++
+		// the first delivery fails and is tried again
+		failed := posts == 1
+		lock.Unlock()
+		if failed {
+			rw.WriteHeader(503)
+			return
+		}
+		var b batch
+		assert.NoError(t, json.Unmarshal(body, &b))
+		batches <- b
+	}))
+	defer srv.Close()
+	next := func() batch {
+		select {
+		case b := <-batches:
+			return b
+		case <-time.After(5 * time.Second):
+			t.Fatal("no batch delivered")
+		}
+		return batch{}
+	}
+
+	a, ts, md := newFakeArchiver()
+	room := common.NewUUID()
+	assert.NoError(t, a.AddData("test", &common.SmapMessage{Path: "/room", UUID: room, Metadata: common.Dict{"Type": "Temperature"}}))
+
+	query := `select data before now where Metadata/Type = "Temperature"`
+	for _, bad := range []common.Webhook{
+		{Query: `delete where Metadata/Type = "Temperature"`, Target: srv.URL, Secret: "secret"},
+		{Query: query, Target: "ftp://example.com", Secret: "secret"},
+		{Query: query, Target: srv.URL},
+	} {
+		_, err := a.RegisterWebhook("test", bad)
+		assert.Error(t, err, bad.Query+" "+bad.Target)
+	}
+	status, err := a.RegisterWebhook("test", common.Webhook{Query: query, Target: srv.URL, Secret: "secret"})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, status.ID)
+
+	b := next()
+	assert.Equal(t, status.ID, b.Webhook)
+	assert.Equal(t, uint64(1), b.Sequence)
+	if assert.Len(t, b.Results, 1) {
+		assert.Equal(t, WEBHOOK_INITIAL, b.Results[0].Type)
+	}
+
+	// readings arriving together are delivered together
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, a.AddData("test", &common.SmapMessage{UUID: room, Readings: []common.Reading{&common.SmapNumberReading{Time: uint64(1e12 + i), Value: float64(i)}}}))
+	}
+	b = next()
+	assert.Equal(t, uint64(2), b.Sequence)
+	if assert.Len(t, b.Results, 3) {
+		assert.Equal(t, WEBHOOK_DATA, b.Results[2].Type)
+	}
+	// the batch is counted once the receiver has answered
+	for i := 0; i < 100 && a.Webhooks()[0].Delivered < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if listed := a.Webhooks(); assert.Len(t, listed, 1) {
+		assert.Equal(t, uint64(2), listed[0].Delivered)
+		assert.Empty(t, listed[0].LastError)
+	}
+
+	// registrations are kept in the metadata store and resumed on restart,
+	// numbering their batches on from where they were
+	saved, _ := md.GetWebhooks()
+	if assert.Len(t, saved, 1) {
+		assert.Equal(t, "secret", saved[0].Secret)
+		assert.Equal(t, uint64(2), saved[0].Sequence)
+	}
+	restarted := &Archiver{tsStore: ts, mdStore: md, qp: a.qp, metrics: a.metrics}
+	restarted.broker = NewBroker(restarted)
+	restarted.loadWebhooks()
+	if resumed := restarted.Webhooks(); assert.Len(t, resumed, 1) {
+		assert.Equal(t, status.ID, resumed[0].ID)
+	}
+	b = next()
+	assert.Equal(t, uint64(3), b.Sequence)
+
+	// registering again replaces the webhook, which numbers no more batches
+	restarted.webhooks.Lock()
+	replaced := restarted.webhooks.hooks[status.ID]
+	restarted.webhooks.Unlock()
+	_, err = restarted.RegisterWebhook("test", common.Webhook{ID: status.ID, Query: query, Target: srv.URL, Secret: "secret"})
+	assert.NoError(t, err)
+	b = next()
+	assert.Equal(t, uint64(4), b.Sequence)
+	replaced.send([]WebhookResult{{Type: WEBHOOK_DATA}})
+	replaced.Lock()
+	assert.Equal(t, uint64(3), replaced.Sequence)
+	replaced.Unlock()
+	restarted.stopWebhook(status.ID)
+
+	assert.NoError(t, a.RemoveWebhook("test", status.ID))
+	assert.Error(t, a.RemoveWebhook("test", status.ID))
+	assert.Empty(t, a.Webhooks())
+	saved, _ = md.GetWebhooks()
+	assert.Empty(t, saved)
+}
+
+func TestWebhookStopsWhileWaiting(t *testing.T) {
+	posted := make(chan bool, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(503)
+		posted <- true
+	}))
+	defer srv.Close()
+	_, _, md := newFakeArchiver()
+	w := &webhook{
+		Webhook: common.Webhook{ID: "hook", Target: srv.URL, Secret: "secret"},
+		stop:    make(chan struct{}),
+		client:  &http.Client{Timeout: time.Second},
+		store:   md,
+	}
+	sent := make(chan bool)
+	go func() {
+		w.send([]WebhookResult{{Type: WEBHOOK_DATA}})
+		sent <- true
+	}()
+	<-posted
+	// the first wait between attempts is a second
+	close(w.stop)
+	select {
+	case <-sent:
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("stopping the webhook should end its wait to try again")
+	}
+}
@@ -0,0 +1,104 @@
+package archiver
+
+import (
+	"github.com/gtfierro/giles2/common"
+	"sort"
+	"sync"
+	"time"
+)
+
+// how often rolling windows are checked for readings that have aged out
+var windowInterval = time.Second
+
+// Delivered to the subscribers of a query whose time range starts relative to
+// now (e.g. "select data in (now -1h, now)") as readings age out of the
+// range. Readings of the listed streams before Before (in nanoseconds) should
+// be dropped
+type WindowExpiry struct {
+	Query   string
+	Before  uint64
+	UUIDs   []common.UUID
+	Expired int
+}
+
+func (expiry WindowExpiry) IsResult() {}
+
+// rollingWindow tracks the readings delivered to one subscriber of a rolling
+// query so that it can tell the subscriber when they leave the range
+type rollingWindow struct {
+	query string
+	// offset of the start of the range from now
+	start time.Duration
+	// uuid -> times of the delivered readings in nanoseconds
+	readings map[common.UUID][]uint64
+	sync.Mutex
+}
+
+func newRollingWindow(query string, start time.Duration) *rollingWindow {
+	return &rollingWindow{
+		query:    query,
+		start:    start,
+		readings: make(map[common.UUID][]uint64),
+	}
+}
+
+// records the readings delivered in the given result
+func (w *rollingWindow) add(result QueryResult) {
+	var msgs common.SmapMessageList
+	switch t := result.(type) {
+	case common.SmapMessageList:
+		msgs = t
+	case *common.SmapMessage:
+		msgs = common.SmapMessageList{t}
+	default:
+		return
+	}
+	w.Lock()
+	defer w.Unlock()
+	for _, msg := range msgs {
+		for _, rdg := range msg.Readings {
+			time, err := common.ConvertTime(rdg.GetTime(), common.GuessTimeUnit(rdg.GetTime()), common.UOT_NS)
+			if err == nil {
+				w.readings[msg.UUID] = append(w.readings[msg.UUID], time)
+			}
+		}
+	}
+}
+
+// forgets the readings that are out of the range at the given time. Returns
+// nil if there were none
+func (w *rollingWindow) expire(now time.Time) *WindowExpiry {
+	before := uint64(now.Add(w.start).UnixNano())
+	expiry := &WindowExpiry{Query: w.query, Before: before}
+	w.Lock()
+	for uuid, times := range w.readings {
+		kept := times[:0]
+		for _, time := range times {
+			if time >= before {
+				kept = append(kept, time)
+			}
+		}
+		if len(kept) == len(times) {
+			continue
+		}
+		expiry.UUIDs = append(expiry.UUIDs, uuid)
+		expiry.Expired += len(times) - len(kept)
+		if len(kept) == 0 {
+			delete(w.readings, uuid)
+		} else {
+			w.readings[uuid] = kept
+		}
+	}
+	w.Unlock()
+	if len(expiry.UUIDs) == 0 {
+		return nil
+	}
+	sort.Sort(uuidList(expiry.UUIDs))
+	return expiry
+}
+
+type uuidList []common.UUID
+
+func (ul uuidList) Len() int           { return len(ul) }
+func (ul uuidList) Swap(i, j int)      { ul[i], ul[j] = ul[j], ul[i] }
+func (ul uuidList) Less(i, j int) bool { return ul[i] < ul[j] }
@@ -0,0 +1,106 @@
+package archiver
+
+import (
+	"github.com/gtfierro/giles2/common"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRollingSubscription(t *testing.T) {
+	defer func(interval time.Duration) { windowInterval = interval }(windowInterval)
+	windowInterval = 10 * time.Millisecond
+	a, _, _ := newFakeArchiver()
+	uuid := common.NewUUID()
+	ms := func(t time.Time) uint64 { return uint64(t.UnixNano() / 1e6) }
+	assert.NoError(t, a.AddData("test", &common.SmapMessage{
+		Path:     "/s0",
+		UUID:     uuid,
+		Metadata: common.Dict{"Zone": "3"},
+		Readings: []common.Reading{
+			&common.SmapNumberReading{Time: ms(time.Now().Add(-time.Hour + 200*time.Millisecond)), Value: 1},
+			&common.SmapNumberReading{Time: ms(time.Now().Add(-10 * time.Minute)), Value: 2},
+		},
+	}))
+
+	query := `select data in (now -1h, now) where Metadata/Zone = "3"`
+	subscribe := func() (*Subscriber, chan bool) {
+		closed := make(chan bool)
+		sub := NewSubscriber(closed, 10, func(err error) { t.Error(err) })
+		sub.ReceiveEvents()
+		go a.HandleNewSubscriber(sub, query)
+		return sub, closed
+	}
+	readings := func(res QueryResult) (count int) {
+		for _, msg := range res.(common.SmapMessageList) {
+			count += len(msg.Readings)
+		}
+		return
+	}
+
+	first, closeFirst := subscribe()
+	assert.Equal(t, 2, readings(<-first.C))
+	select {
+	case res := <-first.C:
+		assert.Equal(t, WindowExpiry{Query: query + ";", Before: res.(WindowExpiry).Before, UUIDs: []common.UUID{uuid}, Expired: 1}, res)
+	case <-time.After(2 * time.Second):
+		t.Fatal("the oldest reading should have expired")
+	}
+
+	assert.NoError(t, a.AddData("test", &common.SmapMessage{UUID: uuid, Readings: []common.Reading{&common.SmapNumberReading{Time: ms(time.Now()), Value: 3}}}))
+	assert.IsType(t, &common.SmapMessage{}, <-first.C)
+
+	// later subscribers see the range as of when they subscribe
+	second, closeSecond := subscribe()
+	assert.Equal(t, 2, readings(<-second.C))
+	closeFirst <- true
+	closeSecond <- true
+}
+
+func TestSubscriptionEndsBeforeNow(t *testing.T) {
+	a, _, _ := newFakeArchiver()
+	uuid := common.NewUUID()
+	ms := func(t time.Time) uint64 { return uint64(t.UnixNano() / 1e6) }
+	assert.NoError(t, a.AddData("test", &common.SmapMessage{Path: "/s0", UUID: uuid, Metadata: common.Dict{"Zone": "3"}}))
+
+	closed := make(chan bool)
+	sub := NewSubscriber(closed, 10, func(err error) { t.Error(err) })
+	go a.HandleNewSubscriber(sub, `select data in (now -1h, now -30min) where Metadata/Zone = "3"`)
+	<-sub.C
+
+	// live readings are after the end of the range
+	assert.NoError(t, a.AddData("test", &common.SmapMessage{UUID: uuid, Readings: []common.Reading{
+		&common.SmapNumberReading{Time: ms(time.Now()), Value: 1},
+	}}))
+	straddling := &common.SmapMessage{UUID: uuid, Readings: []common.Reading{
+		&common.SmapNumberReading{Time: ms(time.Now().Add(-40 * time.Minute)), Value: 2},
+		&common.SmapNumberReading{Time: ms(time.Now().Add(-20 * time.Minute)), Value: 3},
+	}}
+	assert.NoError(t, a.AddData("test", straddling))
+	// committed after the message, but not sent to the subscriber yet
+	assert.NoError(t, a.AddData("test", &common.SmapMessage{UUID: common.NewUUID(), Readings: []common.Reading{
+		&common.SmapNumberReading{Time: ms(time.Now()), Value: 4},
+	}}))
+	select {
+	case res := <-sub.C:
+		msg := res.(*common.SmapMessage)
+		if assert.Len(t, msg.Readings, 1) {
+			assert.Equal(t, float64(2), msg.Readings[0].GetValue())
+		}
+		// the id of the Server-Sent Event carrying the copy is the commit
+		// time of the message, not that of the newest message
+		committed, found := a.Committed(msg)
+		assert.True(t, found)
+		original, _ := a.Committed(straddling)
+		assert.Equal(t, original, committed)
+		assert.True(t, committed < a.LastCommitted())
+	case <-time.After(2 * time.Second):
+		t.Fatal("the reading in the range should be forwarded")
+	}
+	select {
+	case res := <-sub.C:
+		t.Error("only readings in the range should be forwarded, not ", res)
+	default:
+	}
+	closed <- true
+}
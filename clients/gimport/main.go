@@ -0,0 +1,131 @@
+// gimport streams CSV or newline-delimited JSON files of historical readings
+// to the import endpoint of a Giles HTTP interface and prints the rows that
+// could not be imported
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/codegangsta/cli"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var contentTypes = map[string]string{
+	"csv":    "text/csv",
+	"ndjson": "application/x-ndjson",
+}
+
+type importError struct {
+	Row   int    `json:"row"`
+	Error string `json:"error"`
+}
+
+type importSummary struct {
+	Rows     int           `json:"rows"`
+	Imported int           `json:"imported"`
+	Failed   int           `json:"failed"`
+	Errors   []importError `json:"errors"`
+	Error    string        `json:"error"`
+}
+
+// guesses the format from the file extension if it wasn't given
+func getFormat(c *cli.Context, filename string) (string, error) {
+	format := c.String("format")
+	if format == "" {
+		switch strings.ToLower(filepath.Ext(filename)) {
+		case ".csv":
+			format = "csv"
+		case ".ndjson", ".jsonl":
+			format = "ndjson"
+		default:
+			return "", fmt.Errorf("Cannot guess format of %v. Use --format csv or --format ndjson", filename)
+		}
+	}
+	if _, found := contentTypes[format]; !found {
+		return "", fmt.Errorf("Unknown format %v", format)
+	}
+	return format, nil
+}
+
+func doImport(c *cli.Context) error {
+	if len(c.Args()) == 0 {
+		return cli.NewExitError("Need at least one file to import", 1)
+	}
+	failed := false
+	for _, filename := range c.Args() {
+		summary, err := importFile(c, filename)
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		fmt.Printf("%v: %d rows, %d imported, %d failed\n", filename, summary.Rows, summary.Imported, summary.Failed)
+		for _, e := range summary.Errors {
+			fmt.Printf("  row %d: %v\n", e.Row, e.Error)
+		}
+		if len(summary.Errors) < summary.Failed {
+			fmt.Printf("  ... and %d more\n", summary.Failed-len(summary.Errors))
+		}
+		if summary.Error != "" {
+			fmt.Printf("  import stopped early: %v\n", summary.Error)
+		}
+		failed = failed || summary.Failed > 0 || summary.Error != ""
+	}
+	if failed {
+		return cli.NewExitError("Some rows were not imported", 2)
+	}
+	return nil
+}
+
+func importFile(c *cli.Context, filename string) (summary importSummary, err error) {
+	format, err := getFormat(c, filename)
+	if err != nil {
+		return
+	}
+	var input io.ReadCloser
+	if filename == "-" {
+		input = os.Stdin
+	} else if input, err = os.Open(filename); err != nil {
+		return
+	}
+	defer input.Close()
+
+	// the file is streamed rather than read into memory
+	resp, err := http.Post(strings.TrimRight(c.String("url"), "/")+"/import", contentTypes[format], input)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "application/json; charset=utf-8" {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		err = fmt.Errorf("Import of %v failed (%v): %s", filename, resp.Status, msg)
+		return
+	}
+	err = json.NewDecoder(resp.Body).Decode(&summary)
+	return
+}
+
+func main() {
+	app := cli.NewApp()
+	app.Name = "gimport"
+	app.Usage = "Backfill historical readings into Giles"
+	app.ArgsUsage = "file [file...] (- reads standard input)"
+	app.Version = "0.0.1"
+	app.Action = doImport
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "url,u",
+			Value: "http://localhost:8079",
+			Usage: "Base URL of the Giles HTTP interface",
+		},
+		cli.StringFlag{
+			Name:  "format,f",
+			Value: "",
+			Usage: "csv or ndjson. Guessed from the file extension if not given",
+		},
+	}
+	app.Run(os.Args)
+}
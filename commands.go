@@ -0,0 +1,87 @@
+package main
+
+import (
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"github.com/gtfierro/giles2/archiver"
+	"io"
+	"os"
+	"strings"
+)
+
+// Subcommands run against the configured stores instead of starting the
+// archiver:
+//    giles -c giles.cfg export -where "Metadata/Site = 'A'" -begin 1451606400000 -o site-a.json.gz
+//    giles -c giles.cfg import -i site-a.json.gz
+// Archives ending in .gz are compressed. "-" reads stdin or writes stdout.
+func runCommand(config *archiver.Config, args []string) error {
+	switch args[0] {
+	case "export":
+		return runExport(config, args[1:])
+	case "import":
+		return runImport(config, args[1:])
+	}
+	return fmt.Errorf("Unknown command %q (expected export or import)", args[0])
+}
+
+func snapshotFlags(name string, filter *archiver.SnapshotFilter) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Uint64Var(&filter.Begin, "begin", 0, "Earliest reading to include (timestamp in any unit)")
+	flags.Uint64Var(&filter.End, "end", 0, "Latest reading to include (timestamp in any unit; defaults to now)")
+	return flags
+}
+
+func runExport(config *archiver.Config, args []string) (err error) {
+	var filter archiver.SnapshotFilter
+	flags := snapshotFlags("export", &filter)
+	flags.StringVar(&filter.Where, "where", "", "Only export streams matching this where clause")
+	output := flags.String("o", "-", "Archive file to write")
+	flags.Parse(args)
+
+	var w io.WriteCloser = os.Stdout
+	if *output != "-" {
+		if w, err = os.Create(*output); err != nil {
+			return err
+		}
+	}
+	defer w.Close()
+	if strings.HasSuffix(*output, ".gz") {
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		w = gz
+	}
+
+	a := archiver.NewArchiver(config)
+	summary, err := a.Export(w, filter)
+	if err != nil {
+		return err
+	}
+	log.Noticef("Exported %d streams with %d readings", summary.Streams, summary.Readings)
+	return nil
+}
+
+func runImport(config *archiver.Config, args []string) (err error) {
+	var filter archiver.SnapshotFilter
+	flags := snapshotFlags("import", &filter)
+	input := flags.String("i", "-", "Archive file to read")
+	flags.Parse(args)
+
+	var r io.ReadCloser = os.Stdin
+	if *input != "-" {
+		if r, err = os.Open(*input); err != nil {
+			return err
+		}
+	}
+	defer r.Close()
+	if strings.HasSuffix(*input, ".gz") {
+		if r, err = gzip.NewReader(r); err != nil {
+			return err
+		}
+	}
+
+	a := archiver.NewArchiver(config)
+	summary, err := a.Restore(r, filter.Begin, filter.End)
+	log.Noticef("Imported %d streams with %d readings", summary.Streams, summary.Readings)
+	return err
+}
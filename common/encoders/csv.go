@@ -0,0 +1,199 @@
+package encoders
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/gtfierro/giles2/common"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// one row per timestamp, one column per stream
+	CSV_LAYOUT_WIDE = "wide"
+	// one uuid,time,value row per reading
+	CSV_LAYOUT_LONG = "long"
+)
+
+// CSVEncoder writes data query results in the wide or long layout, and tag
+// query results as one row per stream with a column for each Metadata and
+// Properties key. The layout is chosen with the media type parameter, e.g.
+// "text/csv; layout=long"
+type CSVEncoder struct {
+	Layout string
+}
+
+func NewCSVEncoder(params map[string]string) Encoder {
+	if params["layout"] == CSV_LAYOUT_LONG {
+		return CSVEncoder{Layout: CSV_LAYOUT_LONG}
+	}
+	return CSVEncoder{Layout: CSV_LAYOUT_WIDE}
+}
+
+func (enc CSVEncoder) ContentType() string {
+	return CSV_CONTENT_TYPE + "; charset=utf-8"
+}
+
+func (enc CSVEncoder) Encode(w io.Writer, res interface{}) error {
+	var rows [][]string
+	switch t := res.(type) {
+	case common.SmapMessageList:
+		if !hasReadings(t) {
+			rows = tagRows(t)
+		} else if enc.Layout == CSV_LAYOUT_LONG {
+			rows = longRows(t)
+		} else {
+			rows = wideRows(t)
+		}
+	case common.DistinctResult:
+		rows = append(rows, []string{"value"})
+		for _, val := range t {
+			rows = append(rows, []string{val})
+		}
+	default:
+		return fmt.Errorf("Cannot encode %T as CSV", res)
+	}
+	writer := csv.NewWriter(w)
+	if err := writer.WriteAll(rows); err != nil {
+		return err
+	}
+	return writer.Error()
+}
+
+func hasReadings(list common.SmapMessageList) bool {
+	for _, msg := range list {
+		if len(msg.Readings) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// time,<uuid>,<uuid>,... with a blank cell where a stream has no reading at
+// that time
+func wideRows(list common.SmapMessageList) [][]string {
+	var (
+		header = []string{"time"}
+		times  []uint64
+		// time -> column -> value
+		cells = make(map[uint64][]string)
+	)
+	for col, msg := range list {
+		header = append(header, string(msg.UUID))
+		for _, rdg := range msg.Readings {
+			row, found := cells[rdg.GetTime()]
+			if !found {
+				row = make([]string, len(list))
+				cells[rdg.GetTime()] = row
+				times = append(times, rdg.GetTime())
+			}
+			row[col] = formatValue(rdg.GetValue())
+		}
+	}
+	sort.Sort(uint64Slice(times))
+	rows := [][]string{header}
+	for _, time := range times {
+		rows = append(rows, append([]string{strconv.FormatUint(time, 10)}, cells[time]...))
+	}
+	return rows
+}
+
+func longRows(list common.SmapMessageList) [][]string {
+	rows := [][]string{{"uuid", "time", "value"}}
+	for _, msg := range list {
+		for _, rdg := range msg.Readings {
+			rows = append(rows, []string{string(msg.UUID), strconv.FormatUint(rdg.GetTime(), 10), formatValue(rdg.GetValue())})
+		}
+	}
+	return rows
+}
+
+// uuid,Path followed by the union of all Metadata and Properties keys, e.g.
+// Metadata/Location/City
+func tagRows(list common.SmapMessageList) [][]string {
+	var (
+		flattened = make([]map[string]string, len(list))
+		columns   = make(map[string]bool)
+		header    []string
+	)
+	for i, msg := range list {
+		flattened[i] = make(map[string]string)
+		flattenDict(flattened[i], "Metadata/", msg.Metadata)
+		if msg.Properties != nil && !msg.Properties.IsEmpty() {
+			if msg.Properties.UnitOfTime != 0 {
+				flattened[i]["Properties/UnitofTime"] = msg.Properties.UnitOfTime.String()
+			}
+			if msg.Properties.UnitOfMeasure != "" {
+				flattened[i]["Properties/UnitofMeasure"] = msg.Properties.UnitOfMeasure
+			}
+			if msg.Properties.StreamType != 0 {
+				flattened[i]["Properties/StreamType"] = msg.Properties.StreamType.String()
+			}
+			if msg.Properties.Timezone != "" {
+				flattened[i]["Properties/Timezone"] = msg.Properties.Timezone
+			}
+			if msg.Properties.ReadingType != "" {
+				flattened[i]["Properties/ReadingType"] = msg.Properties.ReadingType
+			}
+		}
+		for key := range flattened[i] {
+			if !columns[key] {
+				columns[key] = true
+				header = append(header, key)
+			}
+		}
+	}
+	sort.Strings(header)
+	rows := [][]string{append([]string{"uuid", "Path"}, header...)}
+	for i, msg := range list {
+		row := []string{string(msg.UUID), msg.Path}
+		for _, key := range header {
+			row = append(row, flattened[i][key])
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// Metadata keys are stored with '|' in place of '/'. Nested documents are
+// flattened the same way
+func flattenDict(into map[string]string, prefix string, d map[string]interface{}) {
+	for k, v := range d {
+		key := prefix + strings.Replace(k, "|", "/", -1)
+		switch nested := v.(type) {
+		case map[string]interface{}:
+			flattenDict(into, key+"/", nested)
+		case common.Dict:
+			flattenDict(into, key+"/", nested)
+		default:
+			into[key] = formatValue(v)
+		}
+	}
+}
+
+// numbers are written without exponents, strings as-is and anything else as
+// JSON
+func formatValue(val interface{}) string {
+	switch t := val.(type) {
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	case string:
+		return t
+	case nil:
+		return ""
+	}
+	encoded, err := json.Marshal(val)
+	if err != nil {
+		return fmt.Sprintf("%v", val)
+	}
+	return string(encoded)
+}
+
+type uint64Slice []uint64
+
+func (s uint64Slice) Len() int           { return len(s) }
+func (s uint64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s uint64Slice) Less(i, j int) bool { return s[i] < s[j] }
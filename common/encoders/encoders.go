@@ -0,0 +1,135 @@
+// Package encoders converts query results to the output formats clients ask
+// for (JSON, CSV, line protocol, ...). Encoders are registered by media type
+// so interfaces can pick one from an HTTP Accept header or its equivalent,
+// and other packages can register their own formats with Register.
+package encoders
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	JSON_CONTENT_TYPE          = "application/json"
+	CSV_CONTENT_TYPE           = "text/csv"
+	LINEPROTOCOL_CONTENT_TYPE  = "application/x-influxdb-line-protocol"
+	DEFAULT_ENCODER_MEDIA_TYPE = JSON_CONTENT_TYPE
+)
+
+// An Encoder writes a query result (SmapMessageList, DistinctResult, ...) to a
+// writer. Encoders that cannot represent a result return an error without
+// writing anything.
+type Encoder interface {
+	// value for the Content-Type header of encoded results
+	ContentType() string
+	Encode(w io.Writer, res interface{}) error
+}
+
+// A Constructor returns an Encoder configured by the parameters of the
+// requested media type, e.g. layout=long in "text/csv; layout=long"
+type Constructor func(params map[string]string) Encoder
+
+var (
+	registry     = make(map[string]Constructor)
+	registryLock sync.RWMutex
+)
+
+func init() {
+	Register(JSON_CONTENT_TYPE, func(map[string]string) Encoder { return JSONEncoder{} })
+	Register(CSV_CONTENT_TYPE, NewCSVEncoder)
+	Register(LINEPROTOCOL_CONTENT_TYPE, func(map[string]string) Encoder { return LineProtocolEncoder{} })
+}
+
+// Register makes an encoder available for the given media type, replacing any
+// encoder already registered for it
+func Register(mediatype string, c Constructor) {
+	registryLock.Lock()
+	registry[strings.ToLower(mediatype)] = c
+	registryLock.Unlock()
+}
+
+// Get returns the encoder for a single media type such as
+// "text/csv; layout=long"
+func Get(mediatype string) (Encoder, error) {
+	name, params, err := mime.ParseMediaType(mediatype)
+	if err != nil {
+		return nil, err
+	}
+	registryLock.RLock()
+	c, found := registry[name]
+	registryLock.RUnlock()
+	if !found {
+		return nil, fmt.Errorf("No encoder for %v", name)
+	}
+	return c(params), nil
+}
+
+// Negotiate picks the encoder for the highest quality media type in an Accept
+// header that we have an encoder for. Clients that do not send a header, or
+// accept nothing we know, get JSON
+func Negotiate(accept string) Encoder {
+	for _, mediatype := range parseAccept(accept) {
+		if enc, err := Get(mediatype); err == nil {
+			return enc
+		}
+	}
+	enc, _ := Get(DEFAULT_ENCODER_MEDIA_TYPE)
+	return enc
+}
+
+type acceptRange struct {
+	mediatype string
+	quality   float64
+}
+
+type byQuality []acceptRange
+
+func (b byQuality) Len() int           { return len(b) }
+func (b byQuality) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byQuality) Less(i, j int) bool { return b[i].quality > b[j].quality }
+
+// returns the media types in the header, best first, with the q parameter
+// removed
+func parseAccept(accept string) []string {
+	var ranges []acceptRange
+	for _, part := range strings.Split(accept, ",") {
+		name, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		quality := 1.0
+		if q, found := params["q"]; found {
+			if quality, err = strconv.ParseFloat(q, 64); err != nil {
+				continue
+			}
+			delete(params, "q")
+		}
+		if quality <= 0 {
+			continue
+		}
+		ranges = append(ranges, acceptRange{mime.FormatMediaType(name, params), quality})
+	}
+	sort.Stable(byQuality(ranges))
+	ret := make([]string, len(ranges))
+	for i, r := range ranges {
+		ret[i] = r.mediatype
+	}
+	return ret
+}
+
+// JSONEncoder produces the same output the archiver has always returned
+type JSONEncoder struct{}
+
+func (enc JSONEncoder) ContentType() string {
+	return JSON_CONTENT_TYPE + "; charset=utf-8"
+}
+
+func (enc JSONEncoder) Encode(w io.Writer, res interface{}) error {
+	return json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,108 @@
+package encoders
+
+import (
+	"bytes"
+	"github.com/gtfierro/giles2/common"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+var dataResult = common.SmapMessageList{
+	{
+		UUID: "aaaa",
+		Readings: []common.Reading{
+			&common.SmapNumberReading{Time: 1351043674000, Value: 1},
+			&common.SmapNumberReading{Time: 1351043675000, Value: 2.5},
+		},
+	},
+	{
+		UUID: "bbbb",
+		Readings: []common.Reading{
+			&common.SmapObjectReading{Time: 1351043675000, Value: "on"},
+		},
+	},
+}
+
+func TestNegotiate(t *testing.T) {
+	for _, test := range []struct {
+		accept   string
+		expected Encoder
+	}{
+		{"", JSONEncoder{}},
+		{"*/*", JSONEncoder{}},
+		{"text/html, application/xhtml+xml", JSONEncoder{}},
+		{"text/csv", CSVEncoder{Layout: CSV_LAYOUT_WIDE}},
+		{"text/csv; layout=long", CSVEncoder{Layout: CSV_LAYOUT_LONG}},
+		{"application/json;q=0.5, text/csv", CSVEncoder{Layout: CSV_LAYOUT_WIDE}},
+		{"text/csv;q=0, application/x-influxdb-line-protocol", LineProtocolEncoder{}},
+	} {
+		assert.Equal(t, test.expected, Negotiate(test.accept), test.accept)
+	}
+}
+
+func TestCSVEncoder(t *testing.T) {
+	for _, test := range []struct {
+		title    string
+		layout   string
+		res      interface{}
+		expected string
+	}{
+		{
+			"Wide",
+			CSV_LAYOUT_WIDE,
+			dataResult,
+			"time,aaaa,bbbb\n1351043674000,1,\n1351043675000,2.5,on\n",
+		},
+		{
+			"Long",
+			CSV_LAYOUT_LONG,
+			dataResult,
+			"uuid,time,value\naaaa,1351043674000,1\naaaa,1351043675000,2.5\nbbbb,1351043675000,on\n",
+		},
+		{
+			"Tags",
+			CSV_LAYOUT_WIDE,
+			common.SmapMessageList{
+				{UUID: "aaaa", Path: "/a", Metadata: common.Dict{"Site": "A", "Location|City": "Berkeley"}},
+				{UUID: "bbbb", Path: "/b", Metadata: common.Dict{"Site": "B"}, Properties: &common.SmapProperties{UnitOfMeasure: "W"}},
+			},
+			"uuid,Path,Metadata/Location/City,Metadata/Site,Properties/UnitofMeasure\naaaa,/a,Berkeley,A,\nbbbb,/b,,B,W\n",
+		},
+		{
+			"Distinct",
+			CSV_LAYOUT_WIDE,
+			common.DistinctResult{"A", "B"},
+			"value\nA\nB\n",
+		},
+	} {
+		var buf bytes.Buffer
+		err := CSVEncoder{Layout: test.layout}.Encode(&buf, test.res)
+		assert.Nil(t, err, test.title)
+		assert.Equal(t, test.expected, buf.String(), test.title)
+	}
+}
+
+func TestLineProtocolEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	err := LineProtocolEncoder{}.Encode(&buf, dataResult)
+	assert.Nil(t, err)
+	assert.Equal(t, "giles,uuid=aaaa value=1 1351043674000000000\n"+
+		"giles,uuid=aaaa value=2.5 1351043675000000000\n"+
+		"giles,uuid=bbbb value=\"on\" 1351043675000000000\n", buf.String())
+
+	// readings converted by a query know their unit, which cannot always be
+	// guessed from the timestamp
+	buf.Reset()
+	converted := &common.SmapNumberReading{Time: 1351043674000, Value: 1}
+	assert.Nil(t, converted.ConvertTime(common.UOT_S))
+	assert.Equal(t, common.UOT_S, converted.UoT)
+	early := &common.SmapNumberReading{Time: 5000, UoT: common.UOT_MS, Value: 2}
+	err = LineProtocolEncoder{}.Encode(&buf, common.SmapMessageList{{UUID: "aaaa", Readings: []common.Reading{converted, early}}})
+	assert.Nil(t, err)
+	assert.Equal(t, "giles,uuid=aaaa value=1 1351043674000000000\ngiles,uuid=aaaa value=2 5000000000\n", buf.String())
+
+	buf.Reset()
+	err = LineProtocolEncoder{}.Encode(&buf, common.SmapMessageList{{UUID: "aaaa", Metadata: common.Dict{"Site": "A"}}})
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, buf.Len())
+}
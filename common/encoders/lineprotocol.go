@@ -0,0 +1,82 @@
+package encoders
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/gtfierro/giles2/common"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// measurement used when a stream has no Path
+const DEFAULT_MEASUREMENT = "giles"
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	tagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+	stringEscaper      = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+)
+
+// LineProtocolEncoder writes data query results in InfluxDB line protocol,
+//  <Path>,uuid=<uuid> value=<value> <timestamp in ns>
+// Numeric readings become float fields and object readings string fields.
+// Only results containing readings can be encoded
+type LineProtocolEncoder struct{}
+
+func (enc LineProtocolEncoder) ContentType() string {
+	return LINEPROTOCOL_CONTENT_TYPE + "; charset=utf-8"
+}
+
+func (enc LineProtocolEncoder) Encode(w io.Writer, res interface{}) error {
+	list, ok := res.(common.SmapMessageList)
+	if !ok || (len(list) > 0 && !hasReadings(list)) {
+		return fmt.Errorf("Line protocol can only encode the results of data queries")
+	}
+	var buf bytes.Buffer
+	for _, msg := range list {
+		measurement := DEFAULT_MEASUREMENT
+		if msg.Path != "" {
+			measurement = msg.Path
+		}
+		prefix := measurementEscaper.Replace(measurement) + ",uuid=" + tagEscaper.Replace(string(msg.UUID)) + " value="
+		for _, rdg := range msg.Readings {
+			time, err := common.ConvertTime(rdg.GetTime(), timeUnit(rdg), common.UOT_NS)
+			if err != nil {
+				return err
+			}
+			buf.WriteString(prefix)
+			buf.WriteString(formatField(rdg.GetValue()))
+			buf.WriteByte(' ')
+			buf.WriteString(strconv.FormatUint(time, 10))
+			buf.WriteByte('\n')
+		}
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// returns the unit of time of the reading, which query results are converted
+// to. Only readings that do not know it have it guessed from the timestamp
+func timeUnit(rdg common.Reading) common.UnitOfTime {
+	var uot common.UnitOfTime
+	switch t := rdg.(type) {
+	case *common.SmapNumberReading:
+		uot = t.UoT
+	case *common.SmapObjectReading:
+		uot = t.UoT
+	case *common.StatisticalNumberReading:
+		uot = t.UoT
+	}
+	if uot == 0 {
+		uot = common.GuessTimeUnit(rdg.GetTime())
+	}
+	return uot
+}
+
+func formatField(val interface{}) string {
+	if f, ok := val.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return `"` + stringEscaper.Replace(formatValue(val)) + `"`
+}
@@ -11,6 +11,10 @@ type SmapProperties struct {
 	UnitOfTime    UnitOfTime
 	UnitOfMeasure string
 	StreamType    StreamType
+	// tz database name of the source, e.g. America/Los_Angeles
+	Timezone string
+	// sMAP drivers describe numeric streams as "long" or "double"
+	ReadingType string
 }
 
 func (sp SmapProperties) MarshalJSON() ([]byte, error) {
@@ -40,6 +44,20 @@ func (sp SmapProperties) MarshalJSON() ([]byte, error) {
 		}
 		m["UnitofMeasure"] = sp.UnitOfMeasure
 	}
+	if len(sp.Timezone) != 0 {
+		empty = false
+		if len(m) == 0 {
+			m = make(map[string]string)
+		}
+		m["Timezone"] = sp.Timezone
+	}
+	if len(sp.ReadingType) != 0 {
+		empty = false
+		if len(m) == 0 {
+			m = make(map[string]string)
+		}
+		m["ReadingType"] = sp.ReadingType
+	}
 	if !empty {
 		return json.Marshal(m)
 	} else {
@@ -50,7 +68,9 @@ func (sp SmapProperties) MarshalJSON() ([]byte, error) {
 func (sp SmapProperties) IsEmpty() bool {
 	return sp.UnitOfTime == 0 &&
 		sp.UnitOfMeasure == "" &&
-		sp.StreamType == 0
+		sp.StreamType == 0 &&
+		sp.Timezone == "" &&
+		sp.ReadingType == ""
 }
 
 type SmapMessage struct {
@@ -60,6 +80,9 @@ type SmapMessage struct {
 	Actuator   Dict            `json:",omitempty" msgpack:",omitempty"`
 	Metadata   Dict            `json:",omitempty" msgpack:",omitempty"`
 	Readings   []Reading       `json:",omitempty" msgpack:",omitempty"`
+	// names of the children of a sMAP collection. Only used while
+	// collapsing a TieredSmapMessage; collections are not stored
+	Contents []string `json:"-" msgpack:"-"`
 }
 
 // will insert a key string e.g. "Metadata.KeyName" and value e.g. "Value"
@@ -115,10 +138,23 @@ func (msg *SmapMessage) ToBson() (ret bson.M) {
 			ret["Actuator."+fixKey(k)] = v
 		}
 	}
+	// unset properties are left out so they do not overwrite saved ones
 	if msg.Properties != nil && !msg.Properties.IsEmpty() {
-		ret["Properties.UnitofTime"] = msg.Properties.UnitOfTime
-		ret["Properties.UnitofMeasure"] = msg.Properties.UnitOfMeasure
-		ret["Properties.StreamType"] = msg.Properties.StreamType
+		if msg.Properties.UnitOfTime != 0 {
+			ret["Properties.UnitofTime"] = msg.Properties.UnitOfTime
+		}
+		if msg.Properties.UnitOfMeasure != "" {
+			ret["Properties.UnitofMeasure"] = msg.Properties.UnitOfMeasure
+		}
+		if msg.Properties.StreamType != 0 {
+			ret["Properties.StreamType"] = msg.Properties.StreamType
+		}
+		if msg.Properties.Timezone != "" {
+			ret["Properties.Timezone"] = msg.Properties.Timezone
+		}
+		if msg.Properties.ReadingType != "" {
+			ret["Properties.ReadingType"] = msg.Properties.ReadingType
+		}
 	}
 	return ret
 }
@@ -145,8 +181,13 @@ func (sm *SmapMessage) UnmarshalJSON(b []byte) (err error) {
 	if len(incoming.Metadata) > 0 {
 		sm.Metadata = DictFromBson(flatten(incoming.Metadata))
 	}
+	sm.Contents = incoming.Contents
 	if !incoming.Properties.IsEmpty() {
 		sm.Properties = &incoming.Properties
+		// only numeric streams have a ReadingType
+		if sm.Properties.StreamType == 0 && sm.Properties.ReadingType != "" {
+			sm.Properties.StreamType = NUMERIC_STREAM
+		}
 	}
 	if len(incoming.Actuator) > 0 {
 		sm.Actuator = DictFromBson(flatten(incoming.Actuator))
@@ -175,7 +216,7 @@ func (sm *SmapMessage) UnmarshalJSON(b []byte) (err error) {
 
 		// the unit of time for these readings
 		var uot UnitOfTime
-		if sm.Properties == nil || sm.Properties.IsEmpty() {
+		if sm.Properties == nil || sm.Properties.UnitOfTime == 0 {
 			// if we don't have info, then calculate from time
 			uot = GuessTimeUnit(time)
 		} else {
@@ -229,6 +270,12 @@ func SmapMessageFromBson(m bson.M) *SmapMessage {
 					ret.Properties.StreamType = NUMERIC_STREAM
 				}
 			}
+			if tz, fnd := props["Timezone"]; fnd {
+				ret.Properties.Timezone, _ = tz.(string)
+			}
+			if rt, fnd := props["ReadingType"]; fnd {
+				ret.Properties.ReadingType, _ = rt.(string)
+			}
 		}
 	}
 
@@ -242,8 +289,10 @@ func (msg *SmapMessage) HasMetadata() bool {
 		(msg.Properties != nil && !msg.Properties.IsEmpty())
 }
 
+// sMAP drivers give collections UUIDs too, so anything with Contents is a
+// collection rather than a timeseries
 func (msg *SmapMessage) IsTimeseries() bool {
-	return msg.UUID != ""
+	return msg.UUID != "" && len(msg.Contents) == 0
 }
 
 func (msg SmapMessage) IsResult() {}
@@ -274,62 +323,24 @@ type TieredSmapMessage map[string]*SmapMessage
 // this collection of SmapMessages. Inheritance starts from the root path "/"
 // can progresses towards the leaves.
 // First, get a list of all of the potential timeseries (any path that contains a UUID)
-// Then, for each of the prefixes for the path of that timeserie (util.getPrefixes), grab
+// Then, for each of the prefixes for the path of that timeserie (util.GetPrefixes), grab
 // the paths from the TieredSmapMessage that match the prefixes. Sort these in "decreasing" order
 // and apply to the metadata.
 // Finally, delete all non-timeseries paths
 func (tsm *TieredSmapMessage) CollapseToTimeseries() {
-	var (
-		prefixMsg *SmapMessage
-		found     bool
-	)
 	for path, msg := range *tsm {
 		if !msg.IsTimeseries() {
 			continue
 		}
-		prefixes := getPrefixes(path)
+		prefixes := GetPrefixes(path)
 		sort.Sort(sort.Reverse(sort.StringSlice(prefixes)))
 		for _, prefix := range prefixes {
 			// if we don't find the prefix OR it exists but doesn't have metadata, we skip
-			prefixMsg, found = (*tsm)[prefix]
-			if !found || prefixMsg == nil || (prefixMsg != nil && !prefixMsg.HasMetadata()) {
+			prefixMsg, found := (*tsm)[prefix]
+			if !found || prefixMsg == nil || !prefixMsg.HasMetadata() {
 				continue
 			}
-			// otherwise, we apply keys from paths higher up if our timeseries doesn't already have the key
-			// (this is reverse inheritance)
-			if prefixMsg.Metadata != nil && len(prefixMsg.Metadata) > 0 {
-				for k, v := range prefixMsg.Metadata {
-					if _, hasKey := msg.Metadata[k]; !hasKey {
-						if msg.Metadata == nil {
-							msg.Metadata = make(Dict)
-						}
-						msg.Metadata[k] = v
-					}
-				}
-			}
-			if prefixMsg.Properties != nil && !prefixMsg.Properties.IsEmpty() {
-				if msg.Properties.UnitOfTime != 0 {
-					msg.Properties.UnitOfTime = prefixMsg.Properties.UnitOfTime
-				}
-				if msg.Properties.UnitOfMeasure != "" {
-					msg.Properties.UnitOfMeasure = prefixMsg.Properties.UnitOfMeasure
-				}
-				if msg.Properties.StreamType != 0 {
-					msg.Properties.StreamType = prefixMsg.Properties.StreamType
-				}
-			}
-
-			if prefixMsg.Actuator != nil && len(prefixMsg.Actuator) > 0 {
-				for k, v := range prefixMsg.Actuator {
-					if _, hasKey := msg.Actuator[k]; !hasKey {
-						if msg.Actuator == nil {
-							msg.Actuator = make(Dict)
-						}
-						msg.Actuator[k] = v
-					}
-				}
-			}
-			(*tsm)[path] = msg
+			msg.inheritFrom(prefixMsg)
 		}
 	}
 	// when done, delete all non timeseries paths
@@ -340,6 +351,70 @@ func (tsm *TieredSmapMessage) CollapseToTimeseries() {
 	}
 }
 
+// Inherit returns what a stream at [path] inherits from the collections above
+// it: each key comes from the deepest collection that defines it. Collections
+// that are not above [path] are ignored. Returns nil if nothing is inherited
+func Inherit(path string, collections SmapMessageList) *SmapMessage {
+	byPath := make(map[string]*SmapMessage, len(collections))
+	for _, collection := range collections {
+		byPath[collection.Path] = collection
+	}
+	prefixes := GetPrefixes(path)
+	sort.Sort(sort.Reverse(sort.StringSlice(prefixes)))
+	inherited := &SmapMessage{Path: path}
+	for _, prefix := range prefixes {
+		if collection, found := byPath[prefix]; found && collection.HasMetadata() {
+			inherited.inheritFrom(collection)
+		}
+	}
+	if !inherited.HasMetadata() {
+		return nil
+	}
+	return inherited
+}
+
+// copies the Metadata, Actuator and Properties keys of [parent] that this
+// message does not define itself (this is reverse inheritance)
+func (msg *SmapMessage) inheritFrom(parent *SmapMessage) {
+	for k, v := range parent.Metadata {
+		if _, hasKey := msg.Metadata[k]; !hasKey {
+			if msg.Metadata == nil {
+				msg.Metadata = make(Dict)
+			}
+			msg.Metadata[k] = v
+		}
+	}
+	for k, v := range parent.Actuator {
+		if _, hasKey := msg.Actuator[k]; !hasKey {
+			if msg.Actuator == nil {
+				msg.Actuator = make(Dict)
+			}
+			msg.Actuator[k] = v
+		}
+	}
+	if parent.Properties == nil || parent.Properties.IsEmpty() {
+		return
+	}
+	if msg.Properties == nil {
+		msg.Properties = &SmapProperties{}
+	}
+	if msg.Properties.UnitOfTime == 0 {
+		msg.Properties.UnitOfTime = parent.Properties.UnitOfTime
+	}
+	if msg.Properties.UnitOfMeasure == "" {
+		msg.Properties.UnitOfMeasure = parent.Properties.UnitOfMeasure
+	}
+	if msg.Properties.StreamType == 0 {
+		msg.Properties.StreamType = parent.Properties.StreamType
+	}
+	if msg.Properties.Timezone == "" {
+		msg.Properties.Timezone = parent.Properties.Timezone
+	}
+	if msg.Properties.ReadingType == "" {
+		msg.Properties.ReadingType = parent.Properties.ReadingType
+	}
+}
+
 type incomingSmapMessage struct {
 	// Readings for this message
 	Readings [][]json.RawMessage
@@ -117,6 +117,68 @@ func TestSmapMessageFromBson(t *testing.T) {
 	}
 }
 
+func TestTieredSmapMessageCollections(t *testing.T) {
+	// as delivered by a sMAP driver: collections have uuids and Contents
+	var tsm TieredSmapMessage
+	err := json.Unmarshal([]byte(`{
+	"/": {"Contents": ["building"], "uuid": "2f4f0e5c-1d7d-11e2-ad69-a7c2fa8dba61"},
+	"/building": {"Contents": ["sensor0"], "uuid": "3a1e4b2c-1d7d-11e2-ad69-a7c2fa8dba61", "Metadata": {"Site": "Soda"}},
+	"/building/sensor0": {
+		"uuid": "d24325e6-1d7d-11e2-ad69-a7c2fa8dba61",
+		"Properties": {"Timezone": "America/Los_Angeles", "UnitofMeasure": "Watt", "UnitofTime": "ms", "ReadingType": "double"},
+		"Readings": [[1351043674000, 0.5]]
+	}}`), &tsm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, msg := range tsm {
+		msg.Path = path
+	}
+	tsm.CollapseToTimeseries()
+
+	if len(tsm) != 1 {
+		t.Fatalf("Expected only the timeseries to remain but got %v", tsm)
+	}
+	msg := tsm["/building/sensor0"]
+	if msg.Metadata["Site"] != "Soda" {
+		t.Errorf("Metadata was not inherited from the collection: %v", msg.Metadata)
+	}
+	if msg.Properties.Timezone != "America/Los_Angeles" || msg.Properties.ReadingType != "double" {
+		t.Errorf("Timezone and ReadingType were not kept: %+v", msg.Properties)
+	}
+	if msg.Properties.StreamType != NUMERIC_STREAM {
+		t.Errorf("A ReadingType implies a numeric stream, not %v", msg.Properties.StreamType)
+	}
+	bson := msg.ToBson()
+	if bson["Properties.Timezone"] != "America/Los_Angeles" {
+		t.Errorf("Timezone was not saved: %v", bson)
+	}
+}
+
+func TestCollapseToTimeseriesProperties(t *testing.T) {
+	tsm := TieredSmapMessage{
+		"/":     {Path: "/", Properties: &SmapProperties{UnitOfTime: UOT_S, UnitOfMeasure: "W"}},
+		"/a":    {Path: "/a", UUID: "a"},
+		"/b":    {Path: "/b", UUID: "b", Properties: &SmapProperties{UnitOfTime: UOT_MS}},
+		"/c/d":  {Path: "/c/d", UUID: "d"},
+		"/c":    {Path: "/c", Properties: &SmapProperties{UnitOfMeasure: "kW"}},
+		"/none": {Path: "/none"},
+	}
+	tsm.CollapseToTimeseries()
+	if len(tsm) != 3 {
+		t.Fatalf("Expected 3 timeseries but got %v", tsm)
+	}
+	if p := tsm["/a"].Properties; p == nil || p.UnitOfTime != UOT_S || p.UnitOfMeasure != "W" {
+		t.Errorf("/a should inherit the root properties but has %+v", p)
+	}
+	if p := tsm["/b"].Properties; p.UnitOfTime != UOT_MS || p.UnitOfMeasure != "W" {
+		t.Errorf("/b should keep its UnitofTime and inherit UnitofMeasure but has %+v", p)
+	}
+	if p := tsm["/c/d"].Properties; p.UnitOfTime != UOT_S || p.UnitOfMeasure != "kW" {
+		t.Errorf("/c/d should take UnitofMeasure from /c but has %+v", p)
+	}
+}
+
 func BenchmarkSmapMessageFromBson(b *testing.B) {
 	in := bson.M{"uuid": string(NewUUID()), "Path": "/sensor8", "Metadata": bson.M{"System": "HVAC", "Point|Name": "Hey"}}
 	b.ReportAllocs()
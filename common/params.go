@@ -2,6 +2,7 @@ package common
 
 import (
 	"fmt"
+	"time"
 )
 
 type QueryParams interface {
@@ -11,6 +12,8 @@ type QueryParams interface {
 type TagParams struct {
 	Tags  []string
 	Where Dict
+	// if set, select from the metadata as it was at this time
+	AsOf time.Time
 }
 
 func (params TagParams) Dump() string {
@@ -25,6 +28,8 @@ func (params TagParams) Dump() string {
 type DistinctParams struct {
 	Tag   string
 	Where Dict
+	// if set, select from the metadata as it was at this time
+	AsOf time.Time
 }
 
 func (params DistinctParams) Dump() string {
@@ -33,6 +38,23 @@ func (params DistinctParams) Dump() string {
 	return ret
 }
 
+type AuditParams struct {
+	Where Dict
+}
+
+func (params AuditParams) Dump() string {
+	return fmt.Sprintf("SELECT AUDIT\nWHERE:\n%+v", params.Where)
+}
+
+type StaleParams struct {
+	Where     Dict
+	OlderThan time.Duration
+}
+
+func (params StaleParams) Dump() string {
+	return fmt.Sprintf("SELECT STALE\nWHERE:\n%+v\nOLDER THAN %v", params.Where, params.OlderThan)
+}
+
 type SetParams struct {
 	Set   Dict
 	Where Dict
@@ -53,6 +75,9 @@ type DataParams struct {
 	Where Dict
 	// UUIDs from which to fetch data. Superceded by Where
 	UUIDs []UUID
+	// if set, the Where clause is evaluated against the metadata as it
+	// was at this time
+	AsOf time.Time
 	// restrict the number of streams returned
 	StreamLimit int
 	// restrict the number of data points per stream returned.
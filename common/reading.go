@@ -51,7 +51,9 @@ func (s *SmapNumberReading) ConvertTime(to_uot UnitOfTime) (err error) {
 	guess := GuessTimeUnit(s.Time)
 	if to_uot != guess {
 		s.Time, err = convertTime(s.Time, guess, to_uot)
-		s.UoT = guess
+	}
+	if err == nil {
+		s.UoT = to_uot
 	}
 	return
 }
@@ -90,7 +92,9 @@ func (s *SmapObjectReading) ConvertTime(to_uot UnitOfTime) (err error) {
 	guess := GuessTimeUnit(s.Time)
 	if to_uot != guess {
 		s.Time, err = convertTime(s.Time, guess, to_uot)
-		s.UoT = guess
+	}
+	if err == nil {
+		s.UoT = to_uot
 	}
 	return
 }
@@ -140,7 +144,9 @@ func (s *StatisticalNumberReading) ConvertTime(to_uot UnitOfTime) (err error) {
 	guess := GuessTimeUnit(s.Time)
 	if to_uot != guess {
 		s.Time, err = convertTime(s.Time, guess, to_uot)
-		s.UoT = guess
+	}
+	if err == nil {
+		s.UoT = to_uot
 	}
 	return
 }
@@ -164,12 +164,24 @@ func ParseReltime(num, units string) (time.Duration, error) {
 		d *= time.Nanosecond
 	case "d", "day", "days":
 		d *= 24 * time.Hour
+	case "y", "yr", "year", "years":
+		d *= 365 * 24 * time.Hour
 	default:
-		err = fmt.Errorf("Invalid unit %v. Must be h,m,s,us,ms,ns,d", units)
+		err = fmt.Errorf("Invalid unit %v. Must be h,m,s,us,ms,ns,d,y", units)
 	}
 	return d, err
 }
 
+// parses a duration written as a number and unit, e.g. "90d" or "15 min"
+func ParseDuration(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	split := strings.IndexFunc(s, func(r rune) bool { return r < '0' || r > '9' })
+	if split <= 0 {
+		return 0, fmt.Errorf("Invalid duration %v. Must be a number and a unit, e.g. 90d", s)
+	}
+	return ParseReltime(s[:split], strings.TrimSpace(s[split:]))
+}
+
 // Takes 2 durations and returns the result of them added together
 func AddDurations(d1, d2 time.Duration) time.Duration {
 	d1nano := d1.Nanoseconds()
@@ -7,6 +7,7 @@ import (
 	"github.com/satori/go.uuid"
 	"gopkg.in/mgo.v2/bson"
 	"strings"
+	"time"
 )
 
 // internal unique identifier
@@ -22,6 +23,150 @@ type DistinctResult []string
 func (dr DistinctResult) IsResult() {
 }
 
+// AuditEntry records a change made to the archive
+type AuditEntry struct {
+	Time time.Time `bson:"Time"`
+	// who made the change: the plugin it came through, followed by the ID
+	// of the API key, or the VK or address used if known, e.g. "http/<key ID>"
+	Caller string `bson:"Caller"`
+	// the query that made the change, or "add <Path>" for metadata changed
+	// by adding data
+	Query string `bson:"Query"`
+	// the streams that were changed
+	UUIDs []UUID `bson:"uuid"`
+}
+
+// MutationSummary is the result of a set or delete query
+type MutationSummary struct {
+	// streams matched by the where clause
+	Matched []UUID
+	// streams whose metadata changed
+	Modified []UUID
+	// streams whose metadata was removed entirely
+	Removed []UUID
+	// set if the query was explained rather than run; Modified and Removed
+	// are what it would have changed
+	DryRun bool `json:",omitempty"`
+}
+
+func (ms MutationSummary) IsResult() {}
+
+// Formula defines a virtual stream, whose readings are computed from those of
+// other streams rather than stored. It is either an arithmetic Expression over
+// the named Inputs (e.g. "voltage * current") or an Aggregate ("sum", "mean",
+// "min" or "max") of the streams matching the Where clause
+type Formula struct {
+	Expression string          `bson:"Expression,omitempty" json:",omitempty"`
+	Inputs     map[string]UUID `bson:"Inputs,omitempty" json:",omitempty"`
+	Aggregate  string          `bson:"Aggregate,omitempty" json:",omitempty"`
+	// in the query language, e.g. Metadata/Circuit = "A"
+	Where string `bson:"Where,omitempty" json:",omitempty"`
+}
+
+// ContinuousQuery is a window query the archiver keeps running as time
+// passes, writing the windows of each matching stream to new streams
+type ContinuousQuery struct {
+	Name string `bson:"Name"`
+	// the create query statement that defined it
+	Query   string    `bson:"Query"`
+	Created time.Time `bson:"Created"`
+	// the windows before this time (in nanoseconds) have been written
+	Through uint64 `bson:"Through"`
+}
+
+// ContinuousQueries is the result of list queries, and of creating or
+// dropping one
+type ContinuousQueries []ContinuousQuery
+
+func (cq ContinuousQueries) IsResult() {}
+
+// AlertRule raises an alert for each stream matching Where whose readings
+// meet the Condition ("value > 30"; the operators are > >= < <= = !=) for at
+// least For (e.g. "5min"). A rule with the Condition "no data" raises an alert
+// for each matching stream without readings for For. Alerts are sent to each
+// of the Sinks as they fire and resolve
+type AlertRule struct {
+	Name string `bson:"Name"`
+	// in the query language, e.g. Metadata/Type = "Temperature"
+	Where     string      `bson:"Where"`
+	Condition string      `bson:"Condition"`
+	For       string      `bson:"For,omitempty" json:",omitempty"`
+	Sinks     []AlertSink `bson:"Sinks"`
+}
+
+// AlertSink is where alerts are sent: Type is "log", "webhook" (Target is the
+// URL alerts are POSTed to as JSON) or "bosswave" (Target is the signal of the
+// archiver interface alerts are published on)
+type AlertSink struct {
+	Type   string `bson:"Type"`
+	Target string `bson:"Target,omitempty" json:",omitempty"`
+}
+
+// Webhook delivers the results of a subscription to Query by POSTing them to
+// Target, signed with Secret
+type Webhook struct {
+	ID      string    `bson:"ID"`
+	Query   string    `bson:"Query"`
+	Target  string    `bson:"Target"`
+	Secret  string    `bson:"Secret"`
+	Created time.Time `bson:"Created"`
+	// of the last batch sent, kept so that the numbering carries on when
+	// the archiver restarts or the webhook is registered again
+	Sequence uint64 `bson:"Sequence" json:"-"`
+}
+
+// ReportRegistration is a sMAP driver at Source that the archiver keeps a
+// report installed on, delivering the streams under Resource to each of
+// DeliveryLocation
+type ReportRegistration struct {
+	ID               string   `bson:"ID"`
+	Source           string   `bson:"Source"`
+	Resource         string   `bson:"Resource"`
+	DeliveryLocation []string `bson:"DeliveryLocation"`
+	// bounds (in seconds) on how often the driver delivers
+	MinPeriod int64     `bson:"MinPeriod,omitempty"`
+	MaxPeriod int64     `bson:"MaxPeriod,omitempty"`
+	Created   time.Time `bson:"Created"`
+}
+
+// DurableSubscription is a subscription kept in the metadata store so that it
+// survives restarts of the archiver. Transport names the plugin delivering it
+// and Target where that plugin delivers to, e.g. the VK of a BOSSWAVE client
+type DurableSubscription struct {
+	ID        string `bson:"ID"`
+	Transport string `bson:"Transport"`
+	Target    string `bson:"Target"`
+	Query     string `bson:"Query"`
+	// chosen by the client to tell its subscriptions apart
+	Nonce uint32 `bson:"Nonce"`
+	// the readings of each stream (by uuid) up to this time (in
+	// nanoseconds) have been delivered; for streams that are not listed,
+	// those up to Cursor
+	Cursors map[string]uint64 `bson:"Cursors,omitempty" json:",omitempty"`
+	Cursor  uint64            `bson:"Cursor"`
+	Created time.Time         `bson:"Created"`
+}
+
+// StaleStream is a stream that has gone quiet
+type StaleStream struct {
+	UUID UUID
+	// when its last reading arrived; zero if it has none
+	LastSeen time.Time
+	// how often it is expected to report, from Metadata/ReportingInterval or
+	// learned from its readings; zero if not known
+	Interval time.Duration `json:",omitempty"`
+}
+
+// StaleStreams is the result of a select stale query, quietest first
+type StaleStreams []StaleStream
+
+func (ss StaleStreams) IsResult() {}
+
+// AuditLog is the result of a select audit query
+type AuditLog []AuditEntry
+
+func (al AuditLog) IsResult() {}
+
 // a flat map for storing key-value pairs
 type Dict map[string]interface{}
 
@@ -4,6 +4,7 @@ import (
 	"gopkg.in/mgo.v2/bson"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func BenchmarkDictFromBson1(b *testing.B) {
@@ -60,3 +61,29 @@ func TestConvertTime(t *testing.T) {
 		}
 	}
 }
+
+func TestParseDuration(t *testing.T) {
+	for _, test := range []struct {
+		input  string
+		result time.Duration
+	}{
+		{"90d", 90 * 24 * time.Hour},
+		{"15min", 15 * time.Minute},
+		{"5 y", 5 * 365 * 24 * time.Hour},
+		{" 1h", time.Hour},
+		{"250ms", 250 * time.Millisecond},
+	} {
+		res, err := ParseDuration(test.input)
+		if err != nil {
+			t.Error(err)
+		}
+		if res != test.result {
+			t.Errorf("Parsing %q should be %v but was %v", test.input, test.result, res)
+		}
+	}
+	for _, bad := range []string{"", "d", "90", "-1d", "90 fortnights"} {
+		if _, err := ParseDuration(bad); err == nil {
+			t.Errorf("Parsing %q should fail", bad)
+		}
+	}
+}
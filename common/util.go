@@ -65,7 +65,7 @@ func compareStringSliceAsSet(s1, s2 []string) bool {
 // Given a forward-slash delimited path, returns a slice of prefixes, e.g.:
 // input: /a/b/c/d
 // output: ['/', '/a','/a/b','/a/b/c']
-func getPrefixes(s string) []string {
+func GetPrefixes(s string) []string {
 	ret := []string{"/"}
 	root := ""
 	s = "/" + s
@@ -87,21 +87,21 @@ func TestGetPrefixes(t *testing.T) {
 	var x string
 	var y, z []string
 	x = "/a/b/c"
-	y = getPrefixes(x)
+	y = GetPrefixes(x)
 	z = []string{"/", "/a", "/a/b"}
 	if !isStringSliceEqual(y, z) {
 		t.Error("Got ", y, " should be ", z)
 	}
 
 	x = "/a/b/c/"
-	y = getPrefixes(x)
+	y = GetPrefixes(x)
 	z = []string{"/", "/a", "/a/b"}
 	if !isStringSliceEqual(y, z) {
 		t.Error("Got ", y, " should be ", z)
 	}
 
 	x = "a/b/c/"
-	y = getPrefixes(x)
+	y = GetPrefixes(x)
 	z = []string{"/", "/a", "/a/b"}
 	if !isStringSliceEqual(y, z) {
 		t.Error("Got ", y, " should be ", z)
@@ -2,9 +2,12 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"github.com/gtfierro/giles2/archiver"
 	"github.com/gtfierro/giles2/plugins/bosswave"
 	"github.com/gtfierro/giles2/plugins/http"
+	"github.com/gtfierro/giles2/plugins/influx"
+	"github.com/gtfierro/giles2/plugins/mqtt"
 	"github.com/gtfierro/giles2/plugins/msgpack"
 	"github.com/gtfierro/giles2/plugins/tcpjson"
 	"github.com/gtfierro/giles2/plugins/websocket"
@@ -56,8 +59,22 @@ func main() {
 	//	panic("STOP")
 	//})
 
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [-c giles.cfg] [export|import [flags]]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 	config := archiver.LoadConfig(*configfile)
+
+	// subcommands (e.g. export) may write to stdout, so they run before we
+	// print anything
+	if flag.NArg() > 0 {
+		if err := runCommand(config, flag.Args()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	archiver.PrintConfig(config)
 
 	/** Configure CPU profiling */
@@ -85,6 +102,7 @@ func main() {
 	}
 
 	a := archiver.NewArchiver(config)
+	a.Start()
 
 	if config.HTTP.Enabled {
 		go http.Handle(a, *config.HTTP.Port)
@@ -102,9 +120,21 @@ func main() {
 		go msgpack.HandleUDP4(a, *config.MsgPackUDP.Port)
 	}
 
+	if config.MsgPackTCP.Enabled {
+		go msgpack.HandleTCP(a, *config.MsgPackTCP.Port)
+	}
+
 	if config.TCPJSON.Enabled {
 		go tcpjson.Handle(a, *config.TCPJSON.AddPort, *config.TCPJSON.QueryPort, *config.TCPJSON.SubscribePort)
 	}
 
+	if config.Influx.Enabled {
+		go influx.Handle(a, *config.Influx.HTTPPort, *config.Influx.UDPPort)
+	}
+
+	if config.MQTT.Enabled {
+		go mqtt.Handle(a, &config.MQTT)
+	}
+
 	<-done
 }
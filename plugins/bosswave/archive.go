@@ -297,7 +297,7 @@ func (bwh *BOSSWaveHandler) ParseArchiveRequest(request *ArchiveRequest) (*URIAr
 			}
 			ret.Metadata[k] = val
 		}
-		if err = bwh.a.AddData(ret); err != nil {
+		if err = bwh.a.AddData(giles.Caller("bosswave", request.FromVK), ret); err != nil {
 			log.Error(errors.Wrap(err, "Could not add data"))
 		}
 	}
@@ -358,7 +358,7 @@ type URIArchiver struct {
 }
 
 func (uri *URIArchiver) Listen(a *giles.Archiver) {
-	util.NewWorkerPool(uri.metadataChan, func(msg *bw.SimpleMessage) { a.AddData(uri.GetMetadata(msg)) }, 1000).Start()
+	util.NewWorkerPool(uri.metadataChan, func(msg *bw.SimpleMessage) { a.AddData(giles.Caller("bosswave", msg.From), uri.GetMetadata(msg)) }, 1000).Start()
 	for msg := range uri.subscription {
 		for _, po := range msg.POs {
 			if !po.IsType(uri.PO, uri.PO) {
@@ -372,7 +372,7 @@ func (uri *URIArchiver) Listen(a *giles.Archiver) {
 			if err != nil {
 				log.Error(errors.Wrap(err, "Could not unmarshal msgpack object"))
 			}
-			err = a.AddData(uri.GetSmapMessage(thing))
+			err = a.AddData(giles.Caller("bosswave", msg.From), uri.GetSmapMessage(thing))
 			if err != nil {
 				log.Error(errors.Wrap(err, "Could not add data"))
 			}
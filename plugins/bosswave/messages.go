@@ -18,6 +18,7 @@ const (
 	GilesStatisticsPIDString            = "2.0.8.6"
 	GilesQueryListResultPIDString       = "2.0.8.7"
 	GilesQueryErrorPIDString            = "2.0.8.9"
+	GilesAlertPIDString                 = "2.0.8.10"
 )
 
 var (
@@ -30,11 +31,14 @@ var (
 	GilesQueryMetadataResultPID   = bw.FromDotForm(GilesQueryMetadataResultPIDString)
 	GilesQueryTimeseriesResultPID = bw.FromDotForm(GilesQueryTimeseriesResultPIDString)
 	GilesArchiveRequestPID        = bw.FromDotForm(GilesArchiveRequestPIDString)
+	GilesAlertPID                 = bw.FromDotForm(GilesAlertPIDString)
 )
 
 type KeyValueQuery struct {
 	Query string
 	Nonce uint32
+	// subscriptions that are durable are kept across restarts of the archiver
+	Durable bool
 }
 
 func (msg KeyValueQuery) ToMsgPackBW() (po bw.PayloadObject) {
@@ -53,6 +57,23 @@ func (msg QueryError) ToMsgPackBW() (po bw.PayloadObject) {
 	return
 }
 
+// An alert as it fires or resolves. Times are in nanoseconds; Value is only
+// meaningful if HasValue is true
+type Alert struct {
+	Rule     string
+	UUID     string
+	State    string
+	Since    int64
+	Changed  int64
+	Value    float64
+	HasValue bool
+}
+
+func (msg Alert) ToMsgPackBW() (po bw.PayloadObject) {
+	po, _ = bw.CreateMsgPackPayloadObject(GilesAlertPID, msg)
+	return
+}
+
 type QueryListResult struct {
 	Nonce uint32
 	Data  []string
@@ -67,6 +67,11 @@ func NewHandler(a *giles.Archiver, config *giles.BOSSWAVE) *BOSSWaveHandler {
 
 	bwh.iface.SubscribeSlot("subscribe", bwh.listenCQBS)
 
+	// alert rules with a bosswave sink publish on the signal named by its target
+	a.RegisterAlertSink("bosswave", bwh.publishAlert)
+	// durable subscriptions publish on the signals of the VK that made them
+	a.RegisterSubscriptionTransport("bosswave", bwh.startDurableSubscriber)
+
 	v, e := views.CreateView(bwh.bw, views.Expression{
 		NamespaceList: config.ListenNS,
 		N:             &views.EqualsNode{Key: views.String("giles")},
@@ -137,7 +142,7 @@ func (bwh *BOSSWaveHandler) listenQueries(msg *bw.SimpleMessage) {
 	signalURI = fmt.Sprintf("%s,queries", fromVK[:len(fromVK)-1])
 
 	log.Infof("Got query %+v", query)
-	res, err := bwh.a.HandleQuery(query.Query)
+	res, err := bwh.a.HandleQuery(giles.Caller("bosswave", fromVK), query.Query)
 	if err != nil {
 		msg := QueryError{
 			Query: query.Query,
@@ -171,6 +176,20 @@ func (bwh *BOSSWaveHandler) listenQueries(msg *bw.SimpleMessage) {
 	}
 }
 
+func (bwh *BOSSWaveHandler) publishAlert(signal string, alert giles.Alert) error {
+	msg := Alert{
+		Rule:    alert.Rule,
+		UUID:    string(alert.UUID),
+		State:   alert.State,
+		Since:   alert.Since.UnixNano(),
+		Changed: alert.Changed.UnixNano(),
+	}
+	if alert.Value != nil {
+		msg.Value, msg.HasValue = *alert.Value, true
+	}
+	return bwh.iface.PublishSignal(signal, msg.ToMsgPackBW())
+}
+
 func (bwh *BOSSWaveHandler) listenCQBS(msg *bw.SimpleMessage) {
 	var (
 		// the publisher of the message. We incorporate this into the signal URI
@@ -190,15 +209,29 @@ func (bwh *BOSSWaveHandler) listenCQBS(msg *bw.SimpleMessage) {
 		log.Error(errors.Wrap(err, "Could not unmarshal received query"))
 	}
 
+	if query.Durable {
+		if _, err := bwh.a.SubscribeDurable(giles.Caller("bosswave", fromVK), "bosswave", fromVK, query.Query, query.Nonce); err != nil {
+			log.Error(errors.Wrap(err, "Could not make durable subscription"))
+		}
+		return
+	}
 	subscription := bwh.StartSubscriber(fromVK, query)
 	go bwh.a.HandleNewSubscriber(subscription, query.Query)
 }
 
 func (bwh *BOSSWaveHandler) StartSubscriber(vk string, query KeyValueQuery) *giles.Subscriber {
+	return bwh.startSubscriber(vk, query, make(chan bool))
+}
+
+func (bwh *BOSSWaveHandler) startDurableSubscriber(sub common.DurableSubscription, closed <-chan bool) *giles.Subscriber {
+	return bwh.startSubscriber(sub.Target, KeyValueQuery{Query: sub.Query, Nonce: sub.Nonce, Durable: true}, closed)
+}
+
+func (bwh *BOSSWaveHandler) startSubscriber(vk string, query KeyValueQuery, closed <-chan bool) *giles.Subscriber {
 	bws := &BWSubscriber{
 		bw:      bwh.bw,
 		nonce:   query.Nonce,
-		closeC:  make(chan bool),
+		closeC:  closed,
 		baseURI: fmt.Sprintf("%s,", vk[:len(vk)-1]),
 	}
 	bws.allURI = bws.baseURI + "all"
@@ -216,6 +249,10 @@ func (bwh *BOSSWaveHandler) StartSubscriber(vk string, query KeyValueQuery) *gil
 				log.Debugf("smap messages list %+v", t)
 				pos := POsFromSmapMessageList(query.Nonce, t)
 				reply = append(reply, pos...)
+			case *common.SmapMessage:
+				log.Debugf("smap message %+v", t)
+				pos := POsFromSmapMessageList(query.Nonce, common.SmapMessageList{t})
+				reply = append(reply, pos...)
 			case common.DistinctResult:
 				log.Debugf("distinct list %+v", t)
 				reply = append(reply, POFromDistinctResult(query.Nonce, t))
@@ -224,7 +261,10 @@ func (bwh *BOSSWaveHandler) StartSubscriber(vk string, query KeyValueQuery) *gil
 			}
 			if err := bwh.iface.PublishSignal(bws.allURI, reply...); err != nil {
 				log.Error(errors.Wrap(err, "Could not publish reply"))
+				continue
 			}
+			// durable subscriptions move on only once the result is published
+			bws.subscription.Delivered(val)
 		}
 	}(bws)
 
@@ -234,7 +274,7 @@ func (bwh *BOSSWaveHandler) StartSubscriber(vk string, query KeyValueQuery) *gil
 type BWSubscriber struct {
 	bw            *bw.BW2Client
 	subscription  *giles.Subscriber
-	closeC        chan bool
+	closeC        <-chan bool
 	baseURI       string
 	allURI        string
 	timeseriesURI string
@@ -0,0 +1,57 @@
+package http
+
+import (
+	"encoding/json"
+	giles "github.com/gtfierro/giles2/archiver"
+	"github.com/gtfierro/giles2/common"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+)
+
+// Alert rules are managed with
+//    curl -XPOST http://localhost:8079/api/alerts/rules/<key> -d '{"Name": "hot",
+//      "Where": "Metadata/Type = \"Temperature\"", "Condition": "value > 30", "For": "5min",
+//      "Sinks": [{"Type": "webhook", "Target": "http://example.com/alerts"}]}'
+//    curl http://localhost:8079/api/alerts/rules
+//    curl -XDELETE http://localhost:8079/api/alerts/rules/hot
+// and the pending and firing alerts are listed with
+//    curl http://localhost:8079/api/alerts
+
+func (h *HTTPHandler) handleListAlerts(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(rw).Encode(h.a.ActiveAlerts())
+}
+
+func (h *HTTPHandler) handleListAlertRules(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(rw).Encode(h.a.AlertRules())
+}
+
+func (h *HTTPHandler) handleSaveAlertRule(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	var rule common.AlertRule
+	defer req.Body.Close()
+	if err := json.NewDecoder(req.Body).Decode(&rule); err != nil {
+		log.Errorf("Error decoding alert rule: %v", err)
+		rw.WriteHeader(400)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	if err := h.a.SaveAlertRule(giles.KeyCaller("http", ps.ByName("key")), rule); err != nil {
+		log.Errorf("Error saving alert rule: %v", err)
+		rw.WriteHeader(400)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	rw.WriteHeader(200)
+}
+
+func (h *HTTPHandler) handleRemoveAlertRule(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	if err := h.a.RemoveAlertRule(giles.Caller("http", ""), ps.ByName("name")); err != nil {
+		rw.WriteHeader(404)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	rw.WriteHeader(204)
+}
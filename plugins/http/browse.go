@@ -0,0 +1,34 @@
+package http
+
+import (
+	"encoding/json"
+	giles "github.com/gtfierro/giles2/archiver"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+)
+
+// what browsing needs of the archiver
+type pathBrowser interface {
+	Browse(prefix string) (*giles.PathNode, error)
+}
+
+// GET /api/browse/<path> returns the node at <path> in the stream hierarchy
+// with its immediate children and the number of streams beneath each, e.g.
+//    curl http://localhost:8079/api/browse/building1
+//    {"Path":"/building1","Streams":3,"Children":[{"Name":"floor2","Path":"/building1/floor2","Streams":3}]}
+func (h *HTTPHandler) handleBrowse(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	serveBrowse(rw, h.a, ps.ByName("path"))
+}
+
+func serveBrowse(rw http.ResponseWriter, a pathBrowser, path string) {
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	node, err := a.Browse(path)
+	if err != nil {
+		log.Errorf("Error browsing %v: %v", path, err)
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	json.NewEncoder(rw).Encode(node)
+}
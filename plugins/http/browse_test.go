@@ -0,0 +1,44 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	giles "github.com/gtfierro/giles2/archiver"
+	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
+	"testing"
+)
+
+// browses a fixed tree, remembering what was asked for
+type fakeBrowser struct {
+	asked []string
+}
+
+func (fb *fakeBrowser) Browse(prefix string) (*giles.PathNode, error) {
+	fb.asked = append(fb.asked, prefix)
+	if prefix == "/broken" {
+		return nil, fmt.Errorf("no metadata store")
+	}
+	return &giles.PathNode{Path: "/building1", Streams: 3, Children: []giles.PathNode{
+		{Name: "floor2", Path: "/building1/floor2", Streams: 3},
+	}}, nil
+}
+
+func TestServeBrowse(t *testing.T) {
+	browser := &fakeBrowser{}
+	rw := httptest.NewRecorder()
+	serveBrowse(rw, browser, "/building1")
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "application/json; charset=utf-8", rw.Header().Get("Content-Type"))
+	var node giles.PathNode
+	if assert.NoError(t, json.NewDecoder(rw.Body).Decode(&node)) {
+		assert.Equal(t, 3, node.Streams)
+		assert.Equal(t, []giles.PathNode{{Name: "floor2", Path: "/building1/floor2", Streams: 3}}, node.Children)
+	}
+
+	rw = httptest.NewRecorder()
+	serveBrowse(rw, browser, "/broken")
+	assert.Equal(t, 500, rw.Code)
+	assert.Equal(t, "no metadata store", rw.Body.String())
+	assert.Equal(t, []string{"/building1", "/broken"}, browser.asked)
+}
@@ -19,15 +19,28 @@
 //          "uuid" : "d24325e6-1d7d-11e2-ad69-a7c2fa8dba61"
 //      }
 //    }
+// Objects delivered by sMAP drivers also contain collections, which list their
+// children in Contents and may have their own uuid:
+//    {
+//      "/" : { "Contents" : ["sensor0"], "uuid" : "2f4f0e5c-1d7d-11e2-ad69-a7c2fa8dba61" },
+//      "/sensor0" : { ... }
+//    }
+// Their Metadata and Properties are inherited by the streams beneath them;
+// collections themselves are not stored as streams.
 package http
 
 import (
+	"bytes"
 	"encoding/json"
 	giles "github.com/gtfierro/giles2/archiver"
 	"github.com/gtfierro/giles2/common"
+	"github.com/gtfierro/giles2/common/encoders"
+	"github.com/gtfierro/giles2/plugins/msgpack"
 	"github.com/julienschmidt/httprouter"
 	"github.com/op/go-logging"
 	"io"
+	"io/ioutil"
+	"mime"
 	"net"
 	"net/http"
 	"os"
@@ -50,23 +63,53 @@ func init() {
 type HTTPHandler struct {
 	a       *giles.Archiver
 	handler http.Handler
+	reports *reportRegistry
 }
 
 func NewHTTPHandler(a *giles.Archiver) *HTTPHandler {
+	return newHTTPHandler(a, a)
+}
+
+func newHTTPHandler(a *giles.Archiver, reports reportStore) *HTTPHandler {
 	r := httprouter.New()
-	h := &HTTPHandler{a, r}
+	h := &HTTPHandler{a, r, newReportRegistry(reports)}
 	r.POST("/add/:key", h.handleAdd)
+	r.POST("/import/:key", h.handleImport)
+	r.POST("/import", h.handleImport)
 	r.POST("/api/query/:key", h.handleSingleQuery)
 	r.POST("/api/query", h.handleSingleQuery)
+	r.GET("/api/browse/*path", h.handleBrowse)
+	r.POST("/api/virtual/:key", h.handleVirtual)
+	r.POST("/api/virtual", h.handleVirtual)
+	r.GET("/api/retention", h.handleRetention)
+	r.POST("/api/retention/:key", h.handleRetention)
+	r.POST("/api/retention", h.handleRetention)
+	r.GET("/api/alerts", h.handleListAlerts)
+	r.GET("/api/alerts/rules", h.handleListAlertRules)
+	r.POST("/api/alerts/rules/:key", h.handleSaveAlertRule)
+	r.POST("/api/alerts/rules", h.handleSaveAlertRule)
+	r.DELETE("/api/alerts/rules/:name", h.handleRemoveAlertRule)
+	r.GET("/api/webhooks", h.handleListWebhooks)
+	r.POST("/api/webhooks/:key", h.handleRegisterWebhook)
+	r.POST("/api/webhooks", h.handleRegisterWebhook)
+	r.DELETE("/api/webhooks/:id", h.handleRemoveWebhook)
+	r.GET("/api/subscriptions", h.handleListSubscriptions)
+	r.DELETE("/api/subscriptions/:id", h.handleUnsubscribe)
 	r.POST("/republish", h.handleRepublisher)
 	r.POST("/republish/:key", h.handleRepublisher)
 	r.POST("/subscribe", h.handleSubscriber)
 	r.POST("/subscribe/:key", h.handleSubscriber)
+	r.GET("/api/subscribe/sse", h.handleSSESubscriber)
+	r.GET("/api/subscribe/sse/:key", h.handleSSESubscriber)
+	r.POST("/reports/:key", h.handleRegisterReport)
+	r.GET("/reports", h.handleListReports)
+	r.DELETE("/reports/:key/:uuid", h.handleDeleteReport)
 	return h
 }
 
 func Handle(a *giles.Archiver, port int) {
 	h := NewHTTPHandler(a)
+	h.reports.load()
 	address, err := net.ResolveTCPAddr("tcp4", "0.0.0.0:"+strconv.Itoa(port))
 	if err != nil {
 		log.Fatalf("Error resolving address %v: %v", "0.0.0.0:"+strconv.Itoa(port), err)
@@ -80,6 +123,10 @@ func Handle(a *giles.Archiver, port int) {
 	srv.ListenAndServe()
 }
 
+// /add/:key is also where sMAP drivers deliver reports (see reports.go). We
+// respond 200 only once every stream has been added, so a driver keeps and
+// redelivers a report that failed part way; readings that were already
+// written are written again with the same timestamps.
 func (h *HTTPHandler) handleAdd(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 	var (
 		messages common.TieredSmapMessage
@@ -87,25 +134,80 @@ func (h *HTTPHandler) handleAdd(rw http.ResponseWriter, req *http.Request, ps ht
 	)
 	defer req.Body.Close()
 
-	if messages, err = handleJSON(req.Body); err != nil {
-		log.Errorf("Error handling JSON: %v", err)
+	if isMsgPack(req.Header.Get("Content-Type")) {
+		messages, err = handleMsgPack(req.Body)
+	} else {
+		messages, err = handleJSON(req.Body)
+	}
+	if err != nil {
+		log.Errorf("Error decoding readings: %v", err)
 		rw.WriteHeader(400)
 		rw.Write([]byte(err.Error()))
 		return
 	}
 
-	messages.CollapseToTimeseries()
-	for _, msg := range messages {
-		if addErr := h.a.AddData(msg); addErr != nil {
-			rw.WriteHeader(500)
-			rw.Write([]byte(addErr.Error()))
-			return
-		}
+	if _, addErr := h.a.AddTiered(giles.KeyCaller("http", ps.ByName("key")), messages); addErr != nil {
+		rw.WriteHeader(500)
+		rw.Write([]byte(addErr.Error()))
+		return
 	}
 
 	rw.WriteHeader(200)
 }
 
+// POST /api/virtual/<key> defines a virtual stream: a sMAP stream object
+// without readings and with a Formula, e.g.
+//    {"uuid": "...", "Path": "/building1/power",
+//     "Formula": {"Expression": "voltage * current", "Inputs": {"voltage": "<uuid>", "current": "<uuid>"}}}
+// or
+//    {"uuid": "...", "Path": "/circuitA/total",
+//     "Formula": {"Aggregate": "sum", "Where": "Metadata/Circuit = \"A\""}}
+func (h *HTTPHandler) handleVirtual(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	var (
+		msg     common.SmapMessage
+		virtual struct {
+			Formula *common.Formula
+		}
+	)
+	defer req.Body.Close()
+	body, err := ioutil.ReadAll(req.Body)
+	if err == nil {
+		err = json.Unmarshal(body, &msg)
+	}
+	if err == nil {
+		err = json.Unmarshal(body, &virtual)
+	}
+	if err != nil {
+		log.Errorf("Error decoding virtual stream: %v", err)
+		rw.WriteHeader(400)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	if err = h.a.DefineVirtual(giles.KeyCaller("http", ps.ByName("key")), &msg, virtual.Formula); err != nil {
+		log.Errorf("Error defining virtual stream: %v", err)
+		rw.WriteHeader(400)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	rw.WriteHeader(200)
+}
+
+// GET /api/retention reports what enforcing the retention policies would do
+// now without changing anything; POST /api/retention/<key> enforces them now
+// and reports what was done
+func (h *HTTPHandler) handleRetention(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	reports, err := h.a.EnforceRetention(giles.KeyCaller("http", ps.ByName("key")), req.Method == "GET")
+	if err != nil {
+		log.Errorf("Error enforcing retention policies: %v", err)
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	json.NewEncoder(rw).Encode(reports)
+}
+
 func (h *HTTPHandler) handleSingleQuery(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 	var (
 		err error
@@ -124,19 +226,57 @@ func (h *HTTPHandler) handleSingleQuery(rw http.ResponseWriter, req *http.Reques
 
 	querybuffer := make([]byte, req.ContentLength)
 	_, err = req.Body.Read(querybuffer)
-	res, err := h.a.HandleQuery(string(querybuffer))
+	querystring := string(querybuffer)
+	// msgpack clients send the query as a msgpack string
+	if isMsgPack(req.Header.Get("Content-Type")) {
+		if querystring, err = msgpack.DecodeQuery(querybuffer); err != nil {
+			log.Errorf("Error decoding msgpack query: %v", err)
+			rw.WriteHeader(400)
+			rw.Write([]byte(err.Error()))
+			return
+		}
+	}
+	res, err := h.a.HandleQuery(giles.KeyCaller("http", ps.ByName("key")), querystring)
 	if err != nil {
 		log.Errorf("Error evaluating query: %v", err)
 		rw.WriteHeader(500)
 		rw.Write([]byte(err.Error()))
 		return
 	}
-	writer := json.NewEncoder(rw)
-	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
-	err = writer.Encode(res)
+	// msgpack queries get msgpack results; everyone else chooses with Accept
+	var encoder encoders.Encoder
+	if isMsgPack(req.Header.Get("Content-Type")) {
+		encoder, _ = encoders.Get(msgpack.CONTENT_TYPE)
+	} else {
+		encoder = encoders.Negotiate(req.Header.Get("Accept"))
+	}
+	writeQueryResult(rw, encoder, res)
+}
+
+// Encodes the result of a query with the encoder the client asked for. Only
+// data and tag results can be refused with a 406: the other results are those
+// of queries that may already have changed something (set, delete, create
+// ...), so they are sent as JSON if the encoder cannot represent them
+func writeQueryResult(rw http.ResponseWriter, encoder encoders.Encoder, res interface{}) {
+	var buf bytes.Buffer
+	err := encoder.Encode(&buf, res)
+	switch res.(type) {
+	case common.SmapMessageList, common.DistinctResult:
+	default:
+		if err != nil {
+			buf.Reset()
+			encoder, _ = encoders.Get(encoders.JSON_CONTENT_TYPE)
+			err = encoder.Encode(&buf, res)
+		}
+	}
 	if err != nil {
-		log.Errorf("Error converting query results to JSON: %v", err)
+		log.Errorf("Error encoding query results: %v", err)
+		rw.WriteHeader(406)
+		rw.Write([]byte(err.Error()))
+		return
 	}
+	rw.Header().Set("Content-Type", encoder.ContentType())
+	buf.WriteTo(rw)
 }
 
 func (h *HTTPHandler) handleSubscriber(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
@@ -168,6 +308,28 @@ func (h *HTTPHandler) handleSubscriber(rw http.ResponseWriter, req *http.Request
 	h.a.HandleNewSubscriber(subscription, string(querybuffer))
 }
 
+// Subscribes to the query given in the "q" URL parameter and streams the
+// results as Server-Sent Events. See SSESubscriber
+func (h *HTTPHandler) handleSSESubscriber(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	querystring := req.URL.Query().Get("q")
+	if querystring == "" {
+		rw.Header().Set("Access-Control-Allow-Origin", "*")
+		rw.WriteHeader(400)
+		rw.Write([]byte("Missing query parameter q"))
+		return
+	}
+	if len(querystring) > 1024 {
+		log.Errorf("HUGE query string with length %v. Aborting!", len(querystring))
+		rw.WriteHeader(500)
+		rw.Write([]byte("Your query is too big"))
+		return
+	}
+
+	subscription := StartSSESubscriber(rw, req, h.a, querystring)
+
+	h.a.HandleNewSubscriber(subscription, querystring)
+}
+
 func (h *HTTPHandler) handleRepublisher(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 	var (
 		err error
@@ -197,6 +359,20 @@ func (h *HTTPHandler) handleRepublisher(rw http.ResponseWriter, req *http.Reques
 	h.a.HandleNewSubscriber(subscription, "select * where "+string(querybuffer))
 }
 
+// returns true if the Content-Type header names msgpack
+func isMsgPack(header string) bool {
+	mediatype, _, err := mime.ParseMediaType(header)
+	return err == nil && mediatype == msgpack.CONTENT_TYPE
+}
+
+func handleMsgPack(r io.Reader) (common.TieredSmapMessage, error) {
+	buffer, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return msgpack.DecodeMessages(buffer)
+}
+
 func handleJSON(r io.Reader) (decoded common.TieredSmapMessage, err error) {
 	decoder := json.NewDecoder(r)
 	decoder.UseNumber()
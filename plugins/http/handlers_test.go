@@ -5,7 +5,9 @@ import (
 	"github.com/drewolson/testflight"
 	giles "github.com/gtfierro/giles2/archiver"
 	"github.com/gtfierro/giles2/common"
+	"github.com/gtfierro/giles2/common/encoders"
 	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
 	"strings"
 	"testing"
 )
@@ -122,3 +124,27 @@ func TestHandleAdd(t *testing.T) {
 		})
 	}
 }
+
+func TestWriteQueryResult(t *testing.T) {
+	csv, _ := encoders.Get(encoders.CSV_CONTENT_TYPE)
+	lineprotocol, _ := encoders.Get(encoders.LINEPROTOCOL_CONTENT_TYPE)
+
+	rw := httptest.NewRecorder()
+	writeQueryResult(rw, csv, common.DistinctResult{"a", "b"})
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "text/csv; charset=utf-8", rw.Header().Get("Content-Type"))
+	assert.Equal(t, "value\na\nb\n", rw.Body.String())
+
+	// the results of set and delete queries are sent as JSON, as the query
+	// has already been run
+	rw = httptest.NewRecorder()
+	writeQueryResult(rw, csv, common.MutationSummary{Matched: []common.UUID{"aaaa"}})
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "application/json; charset=utf-8", rw.Header().Get("Content-Type"))
+	assert.Contains(t, rw.Body.String(), `"Matched":["aaaa"]`)
+
+	// data and tag results are refused
+	rw = httptest.NewRecorder()
+	writeQueryResult(rw, lineprotocol, common.DistinctResult{"a"})
+	assert.Equal(t, 406, rw.Code)
+}
@@ -0,0 +1,192 @@
+package http
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	giles "github.com/gtfierro/giles2/archiver"
+	"github.com/gtfierro/giles2/common"
+	"github.com/julienschmidt/httprouter"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The import endpoint backfills historical readings. The body is streamed,
+// so it can be of any size, and is either CSV (Content-Type: text/csv) with a
+// header row
+//    uuid,time,value,Metadata/Site,Metadata/Location/City
+//    d24325e6-1d7d-11e2-ad69-a7c2fa8dba61,1351043674000,0,A,Berkeley
+// or newline-delimited JSON (Content-Type: application/x-ndjson)
+//    {"uuid": "d24325e6-1d7d-11e2-ad69-a7c2fa8dba61", "time": 1351043674000, "value": 0, "Metadata": {"Site": "A"}}
+// Metadata columns are optional. Values that are not numbers are stored as
+// object readings. The response is a JSON ImportSummary listing the rows that
+// could not be imported.
+
+const (
+	CSV_CONTENT_TYPE    = "text/csv"
+	NDJSON_CONTENT_TYPE = "application/x-ndjson"
+)
+
+func (h *HTTPHandler) handleImport(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	defer req.Body.Close()
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+
+	mediatype, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil {
+		mediatype = ""
+	}
+
+	importer := h.a.NewImporter(giles.KeyCaller("http", ps.ByName("key")))
+	switch mediatype {
+	case CSV_CONTENT_TYPE:
+		err = importCSV(req.Body, importer)
+	case NDJSON_CONTENT_TYPE:
+		err = importNDJSON(req.Body, importer)
+	default:
+		rw.WriteHeader(415)
+		rw.Write([]byte(fmt.Sprintf("Import needs Content-Type %v or %v", CSV_CONTENT_TYPE, NDJSON_CONTENT_TYPE)))
+		return
+	}
+	// rows read before an error are still imported, so we always report them
+	summary := importer.Finish()
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err != nil {
+		log.Errorf("Error reading import: %v", err)
+		summary.Error = err.Error()
+		rw.WriteHeader(400)
+	}
+	if err = json.NewEncoder(rw).Encode(summary); err != nil {
+		log.Errorf("Error encoding import summary: %v", err)
+	}
+}
+
+// Imports each row of the CSV. Only a missing header or a read error aborts
+// the import; bad rows are recorded in the summary
+func importCSV(r io.Reader, importer *giles.Importer) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("Could not read CSV header (%v)", err)
+	}
+	var (
+		uuidCol, timeCol, valueCol = -1, -1, -1
+		metadataCols               = make(map[int]string)
+	)
+	for i, col := range header {
+		switch {
+		case col == "uuid":
+			uuidCol = i
+		case col == "time":
+			timeCol = i
+		case col == "value":
+			valueCol = i
+		case strings.HasPrefix(col, "Metadata/"):
+			metadataCols[i] = strings.Replace(strings.TrimPrefix(col, "Metadata/"), "/", "|", -1)
+		}
+	}
+	if uuidCol < 0 || timeCol < 0 || valueCol < 0 {
+		return fmt.Errorf("CSV header needs uuid, time and value columns")
+	}
+
+	// the header is row 1
+	for row := 2; ; row++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		} else if _, ok := err.(*csv.ParseError); ok {
+			importer.Error(row, err)
+			continue
+		} else if err != nil {
+			return err
+		}
+		if len(record) != len(header) {
+			importer.Error(row, fmt.Errorf("Expected %v columns but got %v", len(header), len(record)))
+			continue
+		}
+		time, err := strconv.ParseUint(record[timeCol], 10, 64)
+		if err != nil {
+			importer.Error(row, fmt.Errorf("Invalid time %q", record[timeCol]))
+			continue
+		}
+		var value interface{}
+		if record[valueCol] != "" {
+			if f, err := strconv.ParseFloat(record[valueCol], 64); err == nil {
+				value = f
+			} else {
+				value = record[valueCol]
+			}
+		}
+		importRow := giles.ImportRow{UUID: common.UUID(record[uuidCol]), Time: time, Value: value}
+		for col, key := range metadataCols {
+			if record[col] == "" {
+				continue
+			}
+			if importRow.Metadata == nil {
+				importRow.Metadata = make(common.Dict)
+			}
+			importRow.Metadata[key] = record[col]
+		}
+		importer.Add(row, importRow)
+	}
+}
+
+type ndjsonRow struct {
+	UUID     common.UUID            `json:"uuid"`
+	Time     json.Number            `json:"time"`
+	Value    interface{}            `json:"value"`
+	Metadata map[string]interface{} `json:"Metadata"`
+}
+
+// Imports each line as a JSON object. Blank lines are skipped
+func importNDJSON(r io.Reader, importer *giles.Importer) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for row := 1; scanner.Scan(); row++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var decoded ndjsonRow
+		decoder := json.NewDecoder(strings.NewReader(line))
+		decoder.UseNumber()
+		if err := decoder.Decode(&decoded); err != nil {
+			importer.Error(row, err)
+			continue
+		}
+		time, err := strconv.ParseUint(decoded.Time.String(), 10, 64)
+		if err != nil {
+			importer.Error(row, fmt.Errorf("Invalid time %q", decoded.Time))
+			continue
+		}
+		importRow := giles.ImportRow{UUID: decoded.UUID, Time: time, Value: decoded.Value}
+		if num, ok := decoded.Value.(json.Number); ok {
+			if importRow.Value, err = num.Float64(); err != nil {
+				importer.Error(row, fmt.Errorf("Invalid value %q", num))
+				continue
+			}
+		}
+		if len(decoded.Metadata) > 0 {
+			importRow.Metadata = make(common.Dict, len(decoded.Metadata))
+			flattenMetadata(importRow.Metadata, "", decoded.Metadata)
+		}
+		importer.Add(row, importRow)
+	}
+	return scanner.Err()
+}
+
+// nested Metadata objects become '|'-separated keys
+func flattenMetadata(into common.Dict, prefix string, m map[string]interface{}) {
+	for k, v := range m {
+		key := prefix + strings.Replace(k, "/", "|", -1)
+		if nested, ok := v.(map[string]interface{}); ok {
+			flattenMetadata(into, key+"|", nested)
+		} else {
+			into[key] = v
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	giles "github.com/gtfierro/giles2/archiver"
+	"github.com/gtfierro/giles2/common"
+	"github.com/julienschmidt/httprouter"
+	"github.com/satori/go.uuid"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sMAP drivers publish by delivering reports: a driver keeps a list of report
+// subscriptions at <source>/reports and POSTs new readings, as a tiered sMAP
+// object with its collections, to the ReportDeliveryLocation of each. Readings
+// that are not acknowledged with a 200 are kept by the driver and delivered
+// again later. Registering a driver with
+//    curl -XPOST http://localhost:8079/reports/<key> -d '{"Source": "http://driver:8080"}'
+// creates a report on the driver delivering all of its streams ("/+") to
+// /add/<key> on this archiver, and re-creates it if the driver loses it (e.g.
+// after a restart). Registrations are saved in the metadata store, and the
+// reports are maintained again when the archiver restarts. They are removed
+// with
+//    curl -XDELETE http://localhost:8079/reports/<key>/<uuid>
+var REPORT_NAMESPACE_UUID = uuid.FromStringOrNil("3c1e7a8e-a2e6-11e6-80f5-76304dec7eb7")
+
+// how often we check that each registered driver still has its report
+const reportCheckInterval = 60 * time.Second
+
+// a report as understood by a sMAP source's /reports resource
+type Report struct {
+	UUID                   string `json:"uuid"`
+	ReportResource         string
+	ReportDeliveryLocation []string
+	// bounds (in seconds) on how often the driver delivers
+	MinPeriod int64 `json:",omitempty"`
+	MaxPeriod int64 `json:",omitempty"`
+}
+
+// what we report about a registered driver
+type reportStatus struct {
+	// base URL of the sMAP source
+	Source    string
+	Report    Report
+	Installed bool
+	LastError string `json:",omitempty"`
+}
+
+type reportRegistration struct {
+	status reportStatus
+	stop   chan struct{}
+	sync.RWMutex
+}
+
+func (reg *reportRegistration) getStatus() reportStatus {
+	reg.RLock()
+	defer reg.RUnlock()
+	return reg.status
+}
+
+// where registrations are saved; implemented by the archiver
+type reportStore interface {
+	SaveReport(caller string, report common.ReportRegistration) error
+	Reports() ([]common.ReportRegistration, error)
+	RemoveReport(caller, id string) error
+}
+
+type reportRegistry struct {
+	registrations map[string]*reportRegistration
+	store         reportStore
+	client        *http.Client
+	sync.RWMutex
+}
+
+func newReportRegistry(store reportStore) *reportRegistry {
+	return &reportRegistry{
+		registrations: make(map[string]*reportRegistration),
+		store:         store,
+		client:        &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// maintains the reports of the saved registrations
+func (rr *reportRegistry) load() {
+	saved, err := rr.store.Reports()
+	if err != nil {
+		log.Errorf("Could not load report registrations (%v)", err)
+		return
+	}
+	rr.Lock()
+	defer rr.Unlock()
+	for _, saved := range saved {
+		report := Report{
+			UUID:                   saved.ID,
+			ReportResource:         saved.Resource,
+			ReportDeliveryLocation: saved.DeliveryLocation,
+			MinPeriod:              saved.MinPeriod,
+			MaxPeriod:              saved.MaxPeriod,
+		}
+		rr.start(saved.Source, report)
+	}
+}
+
+// POST /reports/:key registers the driver named by Source in the body. If no
+// ReportDeliveryLocation is given, the driver delivers to the /add/:key
+// endpoint of the host the request was made to
+func (h *HTTPHandler) handleRegisterReport(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	defer req.Body.Close()
+	var request struct {
+		Source string
+		Report
+	}
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		writeReportError(rw, 400, err)
+		return
+	}
+	request.Source = strings.TrimSuffix(request.Source, "/")
+	if request.Source == "" {
+		writeReportError(rw, 400, fmt.Errorf("Missing Source"))
+		return
+	}
+	report := request.Report
+	if report.ReportResource == "" {
+		report.ReportResource = "/+"
+	}
+	if len(report.ReportDeliveryLocation) == 0 {
+		report.ReportDeliveryLocation = []string{"http://" + req.Host + "/add/" + ps.ByName("key")}
+	}
+	if report.UUID == "" {
+		report.UUID = uuid.NewV3(REPORT_NAMESPACE_UUID, request.Source+report.ReportResource+strings.Join(report.ReportDeliveryLocation, ",")).String()
+	}
+
+	reg, err := h.reports.register(giles.KeyCaller("http", ps.ByName("key")), request.Source, report)
+	if err != nil {
+		writeReportError(rw, 500, err)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.WriteHeader(201)
+	json.NewEncoder(rw).Encode(reg.getStatus())
+}
+
+// GET /reports lists the registered drivers and whether their reports are
+// currently installed
+func (h *HTTPHandler) handleListReports(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	h.reports.RLock()
+	list := make([]reportStatus, 0, len(h.reports.registrations))
+	for _, reg := range h.reports.registrations {
+		list = append(list, reg.getStatus())
+	}
+	h.reports.RUnlock()
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(rw).Encode(list)
+}
+
+// DELETE /reports/:key/:uuid stops maintaining the report and removes it from
+// the driver
+func (h *HTTPHandler) handleDeleteReport(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	if err := h.reports.unregister(giles.KeyCaller("http", ps.ByName("key")), ps.ByName("uuid")); err != nil {
+		writeReportError(rw, 404, err)
+		return
+	}
+	rw.WriteHeader(204)
+}
+
+// saves the registration and starts maintaining the report
+func (rr *reportRegistry) register(caller, source string, report Report) (*reportRegistration, error) {
+	rr.Lock()
+	defer rr.Unlock()
+	if existing, found := rr.registrations[report.UUID]; found {
+		return existing, nil
+	}
+	saved := common.ReportRegistration{
+		ID:               report.UUID,
+		Source:           source,
+		Resource:         report.ReportResource,
+		DeliveryLocation: report.ReportDeliveryLocation,
+		MinPeriod:        report.MinPeriod,
+		MaxPeriod:        report.MaxPeriod,
+		Created:          time.Now(),
+	}
+	if err := rr.store.SaveReport(caller, saved); err != nil {
+		return nil, err
+	}
+	return rr.start(source, report), nil
+}
+
+// must be called with the lock held
+func (rr *reportRegistry) start(source string, report Report) *reportRegistration {
+	reg := &reportRegistration{status: reportStatus{Source: source, Report: report}, stop: make(chan struct{})}
+	rr.registrations[report.UUID] = reg
+	go rr.maintain(reg)
+	return reg
+}
+
+func (rr *reportRegistry) unregister(caller, id string) error {
+	rr.Lock()
+	reg, found := rr.registrations[id]
+	if !found {
+		rr.Unlock()
+		return fmt.Errorf("No report %v", id)
+	}
+	if err := rr.store.RemoveReport(caller, id); err != nil {
+		rr.Unlock()
+		return err
+	}
+	delete(rr.registrations, id)
+	rr.Unlock()
+	close(reg.stop)
+	// best effort; the driver may already be gone
+	if err := rr.remove(reg); err != nil {
+		log.Warningf("Could not remove report %v from %v (%v)", id, reg.status.Source, err)
+	}
+	return nil
+}
+
+// installs the report on the driver, retrying with backoff until it
+// succeeds, then checks periodically that it is still there
+func (rr *reportRegistry) maintain(reg *reportRegistration) {
+	timer := giles.NewExponentialTimer(int64(reportCheckInterval / time.Second))
+	status := reg.getStatus()
+	for {
+		err := rr.ensure(status.Source, status.Report)
+		reg.Lock()
+		reg.status.Installed = err == nil
+		reg.status.LastError = ""
+		if err != nil {
+			reg.status.LastError = err.Error()
+		}
+		reg.Unlock()
+
+		wait := reportCheckInterval
+		if err != nil {
+			log.Errorf("Could not install report %v on %v (%v)", status.Report.UUID, status.Source, err)
+			timer.Wait(false)
+			wait = 0
+		} else {
+			timer.Reset()
+		}
+		select {
+		case <-reg.stop:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// creates the report on the driver at source unless it already has it
+func (rr *reportRegistry) ensure(source string, report Report) error {
+	url := source + "/reports/" + report.UUID
+	resp, err := rr.client.Get(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == 200:
+		return nil
+	case resp.StatusCode != 404:
+		return fmt.Errorf("GET %v returned %v", url, resp.Status)
+	}
+
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	resp, err = rr.client.Post(source+"/reports", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Creating report on %v returned %v", source, resp.Status)
+	}
+	log.Noticef("Installed report %v on %v", report.UUID, source)
+	return nil
+}
+
+func (rr *reportRegistry) remove(reg *reportRegistration) error {
+	status := reg.getStatus()
+	req, err := http.NewRequest("DELETE", status.Source+"/reports/"+status.Report.UUID, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := rr.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 && resp.StatusCode != 404 {
+		return fmt.Errorf("DELETE returned %v", resp.Status)
+	}
+	return nil
+}
+
+func writeReportError(rw http.ResponseWriter, status int, err error) {
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(map[string]string{"error": err.Error()})
+}
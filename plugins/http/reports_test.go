@@ -0,0 +1,166 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	giles "github.com/gtfierro/giles2/archiver"
+	"github.com/gtfierro/giles2/common"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// the /reports resource of a sMAP source
+type fakeDriver struct {
+	reports map[string]Report
+	sync.Mutex
+}
+
+func (fd *fakeDriver) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	fd.Lock()
+	defer fd.Unlock()
+	id := strings.TrimPrefix(req.URL.Path, "/reports/")
+	switch {
+	case req.Method == "POST" && req.URL.Path == "/reports":
+		var report Report
+		if err := json.NewDecoder(req.Body).Decode(&report); err != nil {
+			rw.WriteHeader(400)
+			return
+		}
+		fd.reports[report.UUID] = report
+		rw.WriteHeader(201)
+	case req.Method == "GET":
+		if _, found := fd.reports[id]; !found {
+			rw.WriteHeader(404)
+			return
+		}
+		json.NewEncoder(rw).Encode(fd.reports[id])
+	case req.Method == "DELETE":
+		delete(fd.reports, id)
+	default:
+		rw.WriteHeader(405)
+	}
+}
+
+func (fd *fakeDriver) get(id string) (Report, bool) {
+	fd.Lock()
+	defer fd.Unlock()
+	report, found := fd.reports[id]
+	return report, found
+}
+
+// keeps the registrations as the metadata store would
+type fakeReportStore struct {
+	saved map[string]common.ReportRegistration
+	// who removed registrations
+	removedBy []string
+	sync.Mutex
+}
+
+func (fs *fakeReportStore) SaveReport(caller string, report common.ReportRegistration) error {
+	fs.Lock()
+	defer fs.Unlock()
+	fs.saved[report.ID] = report
+	return nil
+}
+
+func (fs *fakeReportStore) Reports() ([]common.ReportRegistration, error) {
+	fs.Lock()
+	defer fs.Unlock()
+	var ret []common.ReportRegistration
+	for _, report := range fs.saved {
+		ret = append(ret, report)
+	}
+	return ret, nil
+}
+
+func (fs *fakeReportStore) RemoveReport(caller, id string) error {
+	fs.Lock()
+	defer fs.Unlock()
+	if _, found := fs.saved[id]; !found {
+		return fmt.Errorf("not found")
+	}
+	fs.removedBy = append(fs.removedBy, caller)
+	delete(fs.saved, id)
+	return nil
+}
+
+// waits for the driver to have the report
+func waitInstalled(driver *fakeDriver, id string) bool {
+	for i := 0; i < 100; i++ {
+		if _, installed := driver.get(id); installed {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestRegisterReport(t *testing.T) {
+	driver := &fakeDriver{reports: make(map[string]Report)}
+	server := httptest.NewServer(driver)
+	defer server.Close()
+	store := &fakeReportStore{saved: make(map[string]common.ReportRegistration)}
+	h := newHTTPHandler(nil, store)
+
+	rw := httptest.NewRecorder()
+	h.handler.ServeHTTP(rw, httptest.NewRequest("POST", "/reports/mykey", strings.NewReader(`{"Source": "`+server.URL+`/"}`)))
+	assert.Equal(t, 201, rw.Code)
+	var status reportStatus
+	if !assert.NoError(t, json.NewDecoder(rw.Body).Decode(&status)) {
+		return
+	}
+	assert.Equal(t, server.URL, status.Source)
+	assert.Equal(t, "/+", status.Report.ReportResource)
+	assert.Equal(t, []string{"http://example.com/add/mykey"}, status.Report.ReportDeliveryLocation)
+
+	// the report is installed on the driver in the background
+	assert.True(t, waitInstalled(driver, status.Report.UUID))
+	saved, _ := store.Reports()
+	if assert.Len(t, saved, 1) {
+		assert.Equal(t, server.URL, saved[0].Source)
+		assert.Equal(t, status.Report.ReportDeliveryLocation, saved[0].DeliveryLocation)
+	}
+
+	// after a restart the saved registration is maintained again, and the
+	// report re-created on a driver that lost it
+	driver.Lock()
+	delete(driver.reports, status.Report.UUID)
+	driver.Unlock()
+	restarted := newHTTPHandler(nil, store)
+	restarted.reports.load()
+	assert.True(t, waitInstalled(driver, status.Report.UUID))
+	assert.Len(t, restarted.reports.registrations, 1)
+	close(restarted.reports.registrations[status.Report.UUID].stop)
+
+	// registering again is a no-op
+	rw = httptest.NewRecorder()
+	h.handler.ServeHTTP(rw, httptest.NewRequest("POST", "/reports/mykey", strings.NewReader(`{"Source": "`+server.URL+`"}`)))
+	assert.Equal(t, 201, rw.Code)
+	rw = httptest.NewRecorder()
+	h.handler.ServeHTTP(rw, httptest.NewRequest("GET", "/reports", nil))
+	var list []reportStatus
+	assert.NoError(t, json.NewDecoder(rw.Body).Decode(&list))
+	assert.Len(t, list, 1)
+
+	rw = httptest.NewRecorder()
+	h.handler.ServeHTTP(rw, httptest.NewRequest("DELETE", "/reports/mykey/"+status.Report.UUID, nil))
+	assert.Equal(t, 204, rw.Code)
+	_, installed := driver.get(status.Report.UUID)
+	assert.False(t, installed)
+	saved, _ = store.Reports()
+	assert.Len(t, saved, 0)
+	assert.Equal(t, []string{giles.KeyCaller("http", "mykey")}, store.removedBy)
+
+	rw = httptest.NewRecorder()
+	h.handler.ServeHTTP(rw, httptest.NewRequest("DELETE", "/reports/mykey/"+status.Report.UUID, nil))
+	assert.Equal(t, 404, rw.Code)
+
+	rw = httptest.NewRecorder()
+	h.handler.ServeHTTP(rw, httptest.NewRequest("POST", "/reports/mykey", strings.NewReader(`{}`)))
+	assert.Equal(t, 400, rw.Code)
+}
@@ -0,0 +1,243 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	giles "github.com/gtfierro/giles2/archiver"
+	"github.com/gtfierro/giles2/common"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// how often we send a heartbeat event to idle Server-Sent Events clients
+const sseHeartbeat = 15 * time.Second
+
+// Server-Sent Events event types
+const (
+	SSE_INITIAL   = "initial"
+	SSE_DATA      = "data"
+	SSE_DIFF      = "diff"
+	SSE_EXPIRE    = "expire"
+	SSE_LIVENESS  = "liveness"
+	SSE_ERROR     = "error"
+	SSE_HEARTBEAT = "heartbeat"
+)
+
+// Streams the results of a subscription to an EventSource client. The first
+// result delivered by the broker is sent as an "initial" event; readings are
+// sent as "data" events, changes to the set of matching streams as "diff"
+// events, readings leaving a range relative to now as "expire" events and
+// streams going stale or live again as "liveness" events. The id of each
+// event is the commit time (see archiver/journal.go) of the newest readings
+// the client has been sent, so a client that reconnects with a Last-Event-ID
+// header is caught up on the readings committed since. Readings that arrive
+// before the initial results are held back until the client has been sent
+// those and caught up, so the id never gets ahead of what the client has.
+type SSESubscriber struct {
+	rw           http.ResponseWriter
+	subscription *giles.Subscriber
+	// tells when readings were committed and finds those a resuming client
+	// missed
+	journal sseJournal
+	query   string
+	// commit time of the newest readings sent, the id of our events
+	position uint64
+	// Last-Event-ID of a resuming client, if any
+	lastEventID uint64
+	resuming    bool
+	closed      bool
+	closeC      chan bool
+	sync.Mutex
+}
+
+// what an SSESubscriber needs of the archiver
+type sseJournal interface {
+	Committed(msg *common.SmapMessage) (uint64, bool)
+	LastCommitted() uint64
+	SelectCommittedSince(querystring string, since uint64) (common.SmapMessageList, error)
+}
+
+// Formats a single Server-Sent Event. Empty ids are omitted. Data is JSON
+// encoded and split across data lines as the spec requires
+func formatSSEvent(event, id string, data interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	if id != "" {
+		fmt.Fprintf(&buf, "id: %s\n", id)
+	}
+	fmt.Fprintf(&buf, "event: %s\n", event)
+	for _, line := range bytes.Split(encoded, []byte{'\n'}) {
+		buf.WriteString("data: ")
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+func (sse *SSESubscriber) send(event string, data interface{}) {
+	sse.Lock()
+	defer sse.Unlock()
+	var id string
+	if event != SSE_HEARTBEAT {
+		id = strconv.FormatUint(sse.position, 10)
+	}
+	encoded, err := formatSSEvent(event, id, data)
+	if err != nil {
+		log.Errorf("Error encoding %s event: %v", event, err)
+		return
+	}
+	if sse.closed {
+		return
+	}
+	if _, err = sse.rw.Write(encoded); err != nil {
+		log.Errorf("Error writing %s event: %v", event, err)
+		return
+	}
+	if flusher, ok := sse.rw.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (sse *SSESubscriber) handleError(e error) {
+	if e == nil {
+		return
+	}
+	sse.send(SSE_ERROR, map[string]string{"error": e.Error()})
+}
+
+// moves the position of the client past the message. Messages the journal
+// does not know leave the position where it is, as messages committed before
+// them may not have been sent yet
+func (sse *SSESubscriber) advance(msg *common.SmapMessage) {
+	committed, found := sse.journal.Committed(msg)
+	if !found {
+		return
+	}
+	sse.Lock()
+	if committed > sse.position {
+		sse.position = committed
+	}
+	sse.Unlock()
+}
+
+// sends the readings that arrived before the initial results, leaving out
+// those the client already has
+func (sse *SSESubscriber) sendHeld(held []*common.SmapMessage) {
+	for _, msg := range held {
+		committed, found := sse.journal.Committed(msg)
+		sse.Lock()
+		sent := found && committed <= sse.position
+		sse.Unlock()
+		if sent {
+			continue
+		}
+		sse.advance(msg)
+		sse.send(SSE_DATA, msg)
+	}
+}
+
+// catch up a client that reconnected using Last-Event-ID
+func (sse *SSESubscriber) doReplay() {
+	missed, err := sse.journal.SelectCommittedSince(sse.query, sse.lastEventID)
+	if err != nil {
+		sse.handleError(err)
+		return
+	}
+	if len(missed) > 0 {
+		for _, msg := range missed {
+			sse.advance(msg)
+		}
+		sse.send(SSE_DATA, missed)
+	}
+}
+
+func (sse *SSESubscriber) markClosed() {
+	sse.Lock()
+	sse.closed = true
+	sse.Unlock()
+}
+
+func StartSSESubscriber(rw http.ResponseWriter, req *http.Request, journal sseJournal, querystring string) *giles.Subscriber {
+	return startSSESubscriber(rw, req, journal, querystring).subscription
+}
+
+func startSSESubscriber(rw http.ResponseWriter, req *http.Request, journal sseJournal, querystring string) *SSESubscriber {
+	sse := &SSESubscriber{rw: rw, journal: journal, query: querystring, closeC: make(chan bool, 1)}
+	// the initial results include everything committed so far
+	sse.position = journal.LastCommitted()
+	if lastID := req.Header.Get("Last-Event-ID"); lastID != "" {
+		if since, err := strconv.ParseUint(lastID, 10, 64); err == nil {
+			// the client only gets further once it has been caught up
+			sse.lastEventID = since
+			sse.position = since
+			sse.resuming = true
+		} else {
+			log.Warningf("Ignoring invalid Last-Event-ID %v", lastID)
+		}
+	}
+	sse.subscription = giles.NewSubscriber(sse.closeC, 10, sse.handleError)
+	sse.subscription.ReceiveEvents()
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.Header().Set("Connection", "keep-alive")
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+
+	go func(sse *SSESubscriber, done <-chan struct{}) {
+		var (
+			heartbeat = time.NewTicker(sseHeartbeat)
+			initial   = true
+			// readings delivered before the initial results
+			held []*common.SmapMessage
+		)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-done:
+				log.Debug("SSE client left")
+				sse.markClosed()
+				sse.closeC <- true
+				return
+			case <-heartbeat.C:
+				sse.send(SSE_HEARTBEAT, map[string]int64{"time": time.Now().UnixNano()})
+			case val := <-sse.subscription.C:
+				switch t := val.(type) {
+				case giles.SubscriptionDiff:
+					sse.send(SSE_DIFF, t)
+				case giles.WindowExpiry:
+					sse.send(SSE_EXPIRE, t)
+				case giles.LivenessChange:
+					sse.send(SSE_LIVENESS, t)
+				case *common.SmapMessage:
+					if initial {
+						held = append(held, t)
+						continue
+					}
+					sse.advance(t)
+					sse.send(SSE_DATA, t)
+				default:
+					if !initial {
+						sse.send(SSE_DATA, t)
+						continue
+					}
+					sse.send(SSE_INITIAL, t)
+					if sse.resuming {
+						sse.doReplay()
+					}
+					sse.sendHeld(held)
+					held = nil
+					initial = false
+				}
+			}
+		}
+	}(sse, req.Context().Done())
+
+	return sse
+}
@@ -0,0 +1,174 @@
+package http
+
+import (
+	"bufio"
+	giles "github.com/gtfierro/giles2/archiver"
+	"github.com/gtfierro/giles2/common"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFormatSSEvent(t *testing.T) {
+	for _, test := range []struct {
+		title    string
+		event    string
+		id       string
+		data     interface{}
+		expected string
+	}{
+		{
+			"Heartbeat without id",
+			SSE_HEARTBEAT,
+			"",
+			map[string]int{"time": 1},
+			"event: heartbeat\ndata: {\"time\":1}\n\n",
+		},
+		{
+			"Data with id",
+			SSE_DATA,
+			"1000",
+			[]string{"a", "b"},
+			"id: 1000\nevent: data\ndata: [\"a\",\"b\"]\n\n",
+		},
+		{
+			"Error",
+			SSE_ERROR,
+			"5",
+			map[string]string{"error": "bad query"},
+			"id: 5\nevent: error\ndata: {\"error\":\"bad query\"}\n\n",
+		},
+	} {
+		encoded, err := formatSSEvent(test.event, test.id, test.data)
+		assert.Nil(t, err, test.title)
+		assert.Equal(t, test.expected, string(encoded), test.title)
+	}
+}
+
+// commit times of the messages it knows; the newest commit is 100
+type fakeJournal struct {
+	committed map[*common.SmapMessage]uint64
+	missed    common.SmapMessageList
+	since     uint64
+}
+
+func (fj *fakeJournal) Committed(msg *common.SmapMessage) (uint64, bool) {
+	committed, found := fj.committed[msg]
+	return committed, found
+}
+
+func (fj *fakeJournal) LastCommitted() uint64 {
+	return 100
+}
+
+func (fj *fakeJournal) SelectCommittedSince(querystring string, since uint64) (common.SmapMessageList, error) {
+	fj.since = since
+	return fj.missed, nil
+}
+
+type sseEvent struct {
+	id, event, data string
+}
+
+func TestSSEStream(t *testing.T) {
+	var (
+		// committed late, with a reading older than those sent before
+		late = &common.SmapMessage{UUID: "aaaa", Readings: []common.Reading{&common.SmapNumberReading{Time: 1000, Value: 1}}}
+		live = &common.SmapMessage{UUID: "aaaa", Readings: []common.Reading{&common.SmapNumberReading{Time: 5000, Value: 2}}}
+		// not journaled, e.g. dropped already
+		unknown = &common.SmapMessage{UUID: "aaaa", Readings: []common.Reading{&common.SmapNumberReading{Time: 6000, Value: 3}}}
+		diff    = giles.SubscriptionDiff{Query: "q", Removed: []common.UUID{"aaaa"}}
+		// as the broker delivers them
+		deliveries = []giles.QueryResult{common.SmapMessageList{}, live, diff}
+	)
+	journal := &fakeJournal{committed: map[*common.SmapMessage]uint64{late: 95, live: 150}}
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		sse := startSSESubscriber(rw, req, journal, "select data before now where uuid = 'aaaa'")
+		for _, val := range deliveries {
+			sse.subscription.C <- val
+		}
+		<-sse.closeC
+	}))
+	defer srv.Close()
+
+	stream := func(lastEventID string, count int) []sseEvent {
+		req, _ := http.NewRequest("GET", srv.URL, nil)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		defer resp.Body.Close()
+		assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+		var (
+			events  []sseEvent
+			current sseEvent
+			scanner = bufio.NewScanner(resp.Body)
+		)
+		for len(events) < count && scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				events = append(events, current)
+				current = sseEvent{}
+			case strings.HasPrefix(line, "id: "):
+				current.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				current.event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				current.data = strings.TrimPrefix(line, "data: ")
+			}
+		}
+		return events
+	}
+
+	// ids are the commit time of the newest readings sent
+	events := stream("", 3)
+	if assert.Len(t, events, 3) {
+		assert.Equal(t, sseEvent{"100", SSE_INITIAL, "[]"}, events[0])
+		assert.Equal(t, "150", events[1].id)
+		assert.Equal(t, SSE_DATA, events[1].event)
+		assert.Equal(t, "150", events[2].id)
+		assert.Equal(t, SSE_DIFF, events[2].event)
+	}
+
+	// a resuming client is sent what was committed after its last event,
+	// whatever the timestamps of the readings
+	journal.missed = common.SmapMessageList{late}
+	events = stream("90", 3)
+	assert.Equal(t, uint64(90), journal.since)
+	if assert.Len(t, events, 3) {
+		assert.Equal(t, sseEvent{"90", SSE_INITIAL, "[]"}, events[0])
+		assert.Equal(t, "95", events[1].id)
+		assert.Equal(t, SSE_DATA, events[1].event)
+		assert.Contains(t, events[1].data, `"Readings":[[1000,1]]`)
+		assert.Equal(t, "150", events[2].id)
+	}
+
+	// readings delivered before the initial results are held back until the
+	// client has been caught up, and not sent again if the replay had them
+	journal.missed = common.SmapMessageList{late, live}
+	deliveries = []giles.QueryResult{live, common.SmapMessageList{}, diff}
+	events = stream("90", 3)
+	if assert.Len(t, events, 3) {
+		assert.Equal(t, sseEvent{"90", SSE_INITIAL, "[]"}, events[0])
+		assert.Equal(t, "150", events[1].id)
+		assert.Equal(t, SSE_DATA, events[1].event)
+		assert.Contains(t, events[1].data, `"Readings":[[1000,1]]`)
+		assert.Equal(t, sseEvent{"150", SSE_DIFF, `{"Query":"q","Removed":["aaaa"]}`}, events[2])
+	}
+
+	// messages the journal does not know leave the id where it is
+	journal.missed = nil
+	deliveries = []giles.QueryResult{common.SmapMessageList{}, unknown, diff}
+	events = stream("", 3)
+	if assert.Len(t, events, 3) {
+		assert.Equal(t, "100", events[1].id)
+		assert.Contains(t, events[1].data, `"Readings":[[6000,3]]`)
+		assert.Equal(t, "100", events[2].id)
+	}
+}
@@ -0,0 +1,43 @@
+package http
+
+import (
+	"encoding/json"
+	giles "github.com/gtfierro/giles2/archiver"
+	"github.com/gtfierro/giles2/common"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+)
+
+// Durable subscriptions (see archiver/durable.go) are made through the
+// transports that deliver them, e.g. BOSSWAVE, and listed and ended with
+//    curl http://localhost:8079/api/subscriptions
+//    curl -XDELETE http://localhost:8079/api/subscriptions/<id>
+
+// what the subscription endpoints need of the archiver
+type subscriptionStore interface {
+	DurableSubscriptions() []common.DurableSubscription
+	Unsubscribe(caller, id string) error
+}
+
+func (h *HTTPHandler) handleListSubscriptions(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	serveListSubscriptions(rw, h.a)
+}
+
+func serveListSubscriptions(rw http.ResponseWriter, s subscriptionStore) {
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(rw).Encode(s.DurableSubscriptions())
+}
+
+func (h *HTTPHandler) handleUnsubscribe(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	serveUnsubscribe(rw, h.a, ps.ByName("id"))
+}
+
+func serveUnsubscribe(rw http.ResponseWriter, s subscriptionStore, id string) {
+	if err := s.Unsubscribe(giles.Caller("http", ""), id); err != nil {
+		rw.WriteHeader(404)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	rw.WriteHeader(204)
+}
@@ -0,0 +1,64 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gtfierro/giles2/common"
+	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
+	"testing"
+)
+
+// holds durable subscriptions by id, remembering who ended them
+type fakeSubscriptions struct {
+	subs    map[string]common.DurableSubscription
+	callers []string
+}
+
+func (fs *fakeSubscriptions) DurableSubscriptions() []common.DurableSubscription {
+	var ret []common.DurableSubscription
+	for _, sub := range fs.subs {
+		ret = append(ret, sub)
+	}
+	return ret
+}
+
+func (fs *fakeSubscriptions) Unsubscribe(caller, id string) error {
+	if _, found := fs.subs[id]; !found {
+		return fmt.Errorf("No durable subscription %v", id)
+	}
+	fs.callers = append(fs.callers, caller)
+	delete(fs.subs, id)
+	return nil
+}
+
+func TestServeSubscriptions(t *testing.T) {
+	subs := &fakeSubscriptions{subs: map[string]common.DurableSubscription{
+		"abc": {ID: "abc", Transport: "bosswave", Target: "scratch.ns/client", Query: "select data before now where has uuid", Cursors: map[string]uint64{"room": 5}},
+	}}
+	rw := httptest.NewRecorder()
+	serveListSubscriptions(rw, subs)
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "application/json; charset=utf-8", rw.Header().Get("Content-Type"))
+	var listed []common.DurableSubscription
+	if assert.NoError(t, json.NewDecoder(rw.Body).Decode(&listed)) && assert.Len(t, listed, 1) {
+		assert.Equal(t, "abc", listed[0].ID)
+		assert.Equal(t, "scratch.ns/client", listed[0].Target)
+		assert.Equal(t, map[string]uint64{"room": 5}, listed[0].Cursors)
+	}
+
+	rw = httptest.NewRecorder()
+	serveUnsubscribe(rw, subs, "abc")
+	assert.Equal(t, 204, rw.Code)
+	assert.Empty(t, subs.subs)
+	assert.Len(t, subs.callers, 1)
+
+	rw = httptest.NewRecorder()
+	serveUnsubscribe(rw, subs, "abc")
+	assert.Equal(t, 404, rw.Code)
+	assert.Equal(t, "No durable subscription abc", rw.Body.String())
+
+	rw = httptest.NewRecorder()
+	serveListSubscriptions(rw, subs)
+	assert.Equal(t, "null\n", rw.Body.String())
+}
@@ -0,0 +1,52 @@
+package http
+
+import (
+	"encoding/json"
+	giles "github.com/gtfierro/giles2/archiver"
+	"github.com/gtfierro/giles2/common"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+)
+
+// Webhooks deliver the results of a subscription by POSTing them to a URL
+// (see archiver/webhooks.go). They are managed with
+//    curl -XPOST http://localhost:8079/api/webhooks/<key> -d '{"Query": "select data before now
+//      where Metadata/Type = \"Temperature\"", "Target": "https://example.com/readings", "Secret": "..."}'
+//    curl http://localhost:8079/api/webhooks
+//    curl -XDELETE http://localhost:8079/api/webhooks/<id>
+// Registering answers with the status of the webhook, including its ID.
+
+func (h *HTTPHandler) handleListWebhooks(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(rw).Encode(h.a.Webhooks())
+}
+
+func (h *HTTPHandler) handleRegisterWebhook(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	var hook common.Webhook
+	defer req.Body.Close()
+	if err := json.NewDecoder(req.Body).Decode(&hook); err != nil {
+		log.Errorf("Error decoding webhook: %v", err)
+		rw.WriteHeader(400)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	status, err := h.a.RegisterWebhook(giles.KeyCaller("http", ps.ByName("key")), hook)
+	if err != nil {
+		log.Errorf("Error registering webhook: %v", err)
+		rw.WriteHeader(400)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(rw).Encode(status)
+}
+
+func (h *HTTPHandler) handleRemoveWebhook(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	if err := h.a.RemoveWebhook(giles.Caller("http", ""), ps.ByName("id")); err != nil {
+		rw.WriteHeader(404)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	rw.WriteHeader(204)
+}
@@ -0,0 +1,137 @@
+// Package influx accepts InfluxDB line protocol over HTTP and UDP so equipment
+// that speaks it can archive into Giles directly. Points are written with
+//    curl -XPOST 'http://localhost:8086/write?precision=ms' --data-binary 'cpu,host=a usage=0.5 1351043674000'
+// or sent as UDP datagrams of one or more lines (with nanosecond timestamps).
+// Each field of a measurement + tag set is stored as a separate stream; see
+// PointsToMessages.
+package influx
+
+import (
+	"encoding/json"
+	giles "github.com/gtfierro/giles2/archiver"
+	"github.com/gtfierro/giles2/common"
+	"github.com/julienschmidt/httprouter"
+	"github.com/op/go-logging"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// logger
+var log *logging.Logger
+
+// set up logging facilities
+func init() {
+	log = logging.MustGetLogger("influx")
+	var format = "%{color}%{level} %{time:Jan 02 15:04:05} %{shortfile}%{color:reset} ▶ %{message}"
+	var logBackend = logging.NewLogBackend(os.Stderr, "", 0)
+	logBackendLeveled := logging.AddModuleLevel(logBackend)
+	logging.SetBackend(logBackendLeveled)
+	logging.SetFormatter(logging.MustStringFormatter(format))
+}
+
+// largest datagram we accept
+const maxDatagramSize = 64 * 1024
+
+type InfluxHandler struct {
+	a       *giles.Archiver
+	handler http.Handler
+}
+
+func NewInfluxHandler(a *giles.Archiver) *InfluxHandler {
+	r := httprouter.New()
+	h := &InfluxHandler{a, r}
+	r.POST("/write", h.handleWrite)
+	return h
+}
+
+func Handle(a *giles.Archiver, httpPort, udpPort int) {
+	h := NewInfluxHandler(a)
+	go h.listenUDP(udpPort)
+
+	address, err := net.ResolveTCPAddr("tcp4", "0.0.0.0:"+strconv.Itoa(httpPort))
+	if err != nil {
+		log.Fatalf("Error resolving address %v: %v", "0.0.0.0:"+strconv.Itoa(httpPort), err)
+	}
+	log.Noticef("Starting Influx line protocol on HTTP %v", address.String())
+	srv := &http.Server{
+		Addr:    address.String(),
+		Handler: h.handler,
+	}
+	if err = srv.ListenAndServe(); err != nil {
+		log.Fatalf("Error serving Influx line protocol (%v)", err)
+	}
+}
+
+func (h *InfluxHandler) listenUDP(port int) {
+	addr, err := net.ResolveUDPAddr("udp", ":"+strconv.Itoa(port))
+	if err != nil {
+		log.Fatalf("Error resolving UDP address %v (%v)", port, err)
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		log.Fatalf("Error on listening (%v)", err)
+	}
+	log.Noticef("Starting Influx line protocol on UDP %v", addr.String())
+
+	for {
+		buf := make([]byte, maxDatagramSize)
+		num, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			log.Errorf("Error reading line protocol datagram (%v)", err)
+			continue
+		}
+		go func(body string) {
+			points, errs := ParseLines(body, "", common.GetNow(common.UOT_NS))
+			for _, err := range errs {
+				log.Errorf("Invalid line protocol from %v: %v", from, err)
+			}
+			if err := h.write(giles.Caller("influx", from.String()), points); err != nil {
+				log.Errorf("Error adding line protocol points (%v)", err)
+			}
+		}(string(buf[:num]))
+	}
+}
+
+// Like InfluxDB, valid lines are written even when others fail to parse. The
+// response is 204 if everything was written, otherwise 400 with the errors
+func (h *InfluxHandler) handleWrite(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	defer req.Body.Close()
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		writeError(rw, 400, err.Error())
+		return
+	}
+	points, errs := ParseLines(string(body), req.URL.Query().Get("precision"), common.GetNow(common.UOT_NS))
+	if err = h.write(giles.Caller("influx", req.RemoteAddr), points); err != nil {
+		log.Errorf("Error adding line protocol points (%v)", err)
+		writeError(rw, 500, err.Error())
+		return
+	}
+	if len(errs) > 0 {
+		msg := "partial write:"
+		for _, e := range errs {
+			msg += " " + e.Error() + ";"
+		}
+		writeError(rw, 400, msg)
+		return
+	}
+	rw.WriteHeader(204)
+}
+
+func (h *InfluxHandler) write(caller string, points []Point) error {
+	for _, msg := range PointsToMessages(points) {
+		if err := h.a.AddData(caller, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeError(rw http.ResponseWriter, status int, msg string) {
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(map[string]string{"error": msg})
+}
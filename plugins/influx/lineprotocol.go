@@ -0,0 +1,253 @@
+package influx
+
+import (
+	"fmt"
+	"github.com/gtfierro/giles2/common"
+	"github.com/satori/go.uuid"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Every (measurement, tag set, field) triple is its own stream. Its UUID is a
+// UUIDv3 of the series key under this namespace, so the same series always
+// maps to the same stream
+var NAMESPACE_UUID = uuid.FromStringOrNil("6d4ac3a0-9c1e-11e6-9f33-a24fc0d9649c")
+
+// multipliers to convert timestamps of the given precision to nanoseconds
+var precisions = map[string]uint64{
+	"":   1,
+	"n":  1,
+	"ns": 1,
+	"u":  1e3,
+	"us": 1e3,
+	"ms": 1e6,
+	"s":  1e9,
+	"m":  60 * 1e9,
+	"h":  60 * 60 * 1e9,
+}
+
+var (
+	keyUnescaper    = strings.NewReplacer(`\,`, ",", `\ `, " ", `\=`, "=")
+	stringUnescaper = strings.NewReplacer(`\"`, `"`, `\\`, `\`)
+	pathEscaper     = strings.NewReplacer("/", "|")
+)
+
+// Point is a single parsed line
+//    <measurement>[,<tag>=<value>...] <field>=<value>[,<field>=<value>...] [<timestamp>]
+// Field values are float64 for numbers (including integers), bool or string
+type Point struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      map[string]interface{}
+	// nanoseconds
+	Time uint64
+}
+
+// ParseLines parses every non-empty, non-comment line. Lines without a
+// timestamp are given [now]. Lines that cannot be parsed are returned as
+// errors naming the line number; the remaining lines are still parsed
+func ParseLines(body string, precision string, now uint64) ([]Point, []error) {
+	var (
+		points []Point
+		errs   []error
+	)
+	multiplier, found := precisions[precision]
+	if !found {
+		return nil, []error{fmt.Errorf("Unknown precision %q", precision)}
+	}
+	for num, line := range strings.Split(body, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		point, err := ParseLine(line, multiplier, now)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %v", num+1, err))
+			continue
+		}
+		points = append(points, point)
+	}
+	return points, errs
+}
+
+func ParseLine(line string, multiplier uint64, now uint64) (point Point, err error) {
+	sections := splitUnescaped(line, ' ', true)
+	if len(sections) < 2 || len(sections) > 3 {
+		return point, fmt.Errorf("Expected measurement, fields and optional timestamp")
+	}
+
+	keys := splitUnescaped(sections[0], ',', false)
+	point.Measurement = keyUnescaper.Replace(keys[0])
+	if point.Measurement == "" {
+		return point, fmt.Errorf("Missing measurement")
+	}
+	point.Tags = make(map[string]string, len(keys)-1)
+	for _, tag := range keys[1:] {
+		kv := splitUnescaped(tag, '=', false)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return point, fmt.Errorf("Invalid tag %q", tag)
+		}
+		point.Tags[keyUnescaper.Replace(kv[0])] = keyUnescaper.Replace(kv[1])
+	}
+
+	fields := splitUnescaped(sections[1], ',', true)
+	point.Fields = make(map[string]interface{}, len(fields))
+	for _, field := range fields {
+		kv := splitUnescaped(field, '=', true)
+		if len(kv) != 2 || kv[0] == "" {
+			return point, fmt.Errorf("Invalid field %q", field)
+		}
+		if point.Fields[keyUnescaper.Replace(kv[0])], err = parseFieldValue(kv[1]); err != nil {
+			return point, err
+		}
+	}
+
+	point.Time = now
+	if len(sections) == 3 {
+		ts, err := strconv.ParseInt(sections[2], 10, 64)
+		if err != nil || ts < 0 {
+			return point, fmt.Errorf("Invalid timestamp %q", sections[2])
+		}
+		if uint64(ts) > math.MaxUint64/multiplier {
+			return point, fmt.Errorf("Timestamp %q out of range", sections[2])
+		}
+		point.Time = uint64(ts) * multiplier
+	}
+	return point, nil
+}
+
+func parseFieldValue(value string) (interface{}, error) {
+	switch {
+	case len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"':
+		return stringUnescaper.Replace(value[1 : len(value)-1]), nil
+	case value == "t" || value == "T" || value == "true" || value == "True" || value == "TRUE":
+		return true, nil
+	case value == "f" || value == "F" || value == "false" || value == "False" || value == "FALSE":
+		return false, nil
+	case strings.HasSuffix(value, "i"):
+		i, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid integer %q", value)
+		}
+		return float64(i), nil
+	case strings.HasSuffix(value, "u"):
+		u, err := strconv.ParseUint(value[:len(value)-1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid unsigned integer %q", value)
+		}
+		return float64(u), nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid field value %q", value)
+	}
+	return f, nil
+}
+
+// splits on sep, ignoring separators escaped with a backslash and, if
+// quotes is true, separators inside double quotes. Escapes are kept
+func splitUnescaped(s string, sep byte, quotes bool) []string {
+	var (
+		parts    []string
+		start    int
+		inQuotes bool
+	)
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case quotes && s[i] == '"':
+			inQuotes = !inQuotes
+		case s[i] == sep && !inQuotes:
+			parts = append(parts, s[start:i])
+			start = i + 1
+			// the separator between sections may be repeated
+			if sep == ' ' {
+				for start < len(s) && s[start] == ' ' {
+					start++
+					i++
+				}
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// the canonical series key of a field: measurement, sorted tags and field name
+func seriesKey(point Point, field string) string {
+	tags := make([]string, 0, len(point.Tags))
+	for k, v := range point.Tags {
+		tags = append(tags, k+"="+v)
+	}
+	sort.Strings(tags)
+	return point.Measurement + "," + strings.Join(tags, ",") + " " + field
+}
+
+// the path of a field: the measurement, then a segment per tag in sorted
+// order, then the field, e.g. /cpu/host=a/usage_idle. Slashes in names are
+// replaced with | so each tag stays one segment
+func seriesPath(point Point, field string) string {
+	tags := make([]string, 0, len(point.Tags))
+	for k, v := range point.Tags {
+		tags = append(tags, pathEscaper.Replace(k)+"="+pathEscaper.Replace(v))
+	}
+	sort.Strings(tags)
+	segments := append([]string{pathEscaper.Replace(point.Measurement)}, tags...)
+	return "/" + strings.Join(append(segments, pathEscaper.Replace(field)), "/")
+}
+// converts the points to one sMAP message per stream, at its seriesPath. Tags become
+// converts the points to one sMAP message per stream. Tags become
+// Metadata/Tags/<tag>, and the measurement and field names are kept as
+// Metadata/Influx/Measurement and Metadata/Influx/Field so no tag can clobber
+// them. Numeric fields are numeric streams; strings and booleans are object
+// streams
+func PointsToMessages(points []Point) []*common.SmapMessage {
+	var (
+		messages []*common.SmapMessage
+		byUUID   = make(map[common.UUID]*common.SmapMessage)
+	)
+	for _, point := range points {
+		// visit fields in a fixed order so messages are built deterministically
+		fields := make([]string, 0, len(point.Fields))
+		for field := range point.Fields {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		for _, field := range fields {
+			id := common.UUID(uuid.NewV3(NAMESPACE_UUID, seriesKey(point, field)).String())
+			msg, found := byUUID[id]
+			if !found {
+				msg = newMessage(id, point, field)
+				byUUID[id] = msg
+				messages = append(messages, msg)
+			}
+			switch value := point.Fields[field].(type) {
+			case float64:
+				msg.Readings = append(msg.Readings, &common.SmapNumberReading{Time: point.Time, UoT: common.UOT_NS, Value: value})
+			default:
+				msg.Properties.StreamType = common.OBJECT_STREAM
+				msg.Readings = append(msg.Readings, &common.SmapObjectReading{Time: point.Time, UoT: common.UOT_NS, Value: value})
+			}
+		}
+	}
+	return messages
+}
+
+func newMessage(id common.UUID, point Point, field string) *common.SmapMessage {
+	msg := &common.SmapMessage{
+		UUID:       id,
+		Path:       seriesPath(point, field),
+		Metadata:   make(common.Dict, len(point.Tags)+2),
+		Properties: &common.SmapProperties{UnitOfTime: common.UOT_NS, StreamType: common.NUMERIC_STREAM},
+	}
+	for k, v := range point.Tags {
+		k = strings.Replace(k, ".", "|", -1)
+		k = strings.Replace(k, "/", "|", -1)
+		msg.Metadata["Tags|"+k] = v
+	}
+	msg.Metadata["Influx|Measurement"] = point.Measurement
+	msg.Metadata["Influx|Field"] = field
+	return msg
+}
@@ -0,0 +1,81 @@
+package influx
+
+import (
+	"github.com/gtfierro/giles2/common"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseLine(t *testing.T) {
+	for _, test := range []struct {
+		line     string
+		expected Point
+	}{
+		{
+			"cpu value=1",
+			Point{"cpu", map[string]string{}, map[string]interface{}{"value": 1.0}, 42},
+		},
+		{
+			"cpu,host=a,region=us\\ west usage=0.5,count=3i,up=t 1351043674000",
+			Point{"cpu", map[string]string{"host": "a", "region": "us west"}, map[string]interface{}{"usage": 0.5, "count": 3.0, "up": true}, 1351043674000},
+		},
+		{
+			`door\,front,site=A state="open, then \"closed\"" 1351043674000`,
+			Point{"door,front", map[string]string{"site": "A"}, map[string]interface{}{"state": `open, then "closed"`}, 1351043674000},
+		},
+	} {
+		point, err := ParseLine(test.line, 1, 42)
+		assert.Nil(t, err, test.line)
+		assert.Equal(t, test.expected, point, test.line)
+	}
+}
+
+func TestParseLinesErrors(t *testing.T) {
+	body := "cpu value=1 10\n\n# comment\ncpu\ncpu value=abc\ncpu,host value=1\ncpu value=1 -5\ncpu value=2 20\n"
+	points, errs := ParseLines(body, "s", 0)
+	assert.Len(t, points, 2)
+	assert.Equal(t, uint64(10e9), points[0].Time)
+	assert.Len(t, errs, 4)
+
+	_, errs = ParseLines(body, "fortnights", 0)
+	assert.Len(t, errs, 1)
+
+	// timestamps that overflow nanoseconds are rejected
+	_, errs = ParseLines("cpu usage=1 18446744074", "s", 0)
+	assert.Len(t, errs, 1)
+	points, errs = ParseLines("cpu usage=1 18446744073", "s", 0)
+	assert.Len(t, errs, 0)
+	assert.Equal(t, uint64(18446744073000000000), points[0].Time)
+}
+
+func TestPointsToMessages(t *testing.T) {
+	points, errs := ParseLines("cpu,host=a usage=0.5,state=\"ok\" 1\ncpu,host=a usage=0.7 2\ncpu,host=b usage=0.1 2\n", "", 0)
+	assert.Len(t, errs, 0)
+	messages := PointsToMessages(points)
+	// (host=a, state), (host=a, usage), (host=b, usage)
+	if !assert.Len(t, messages, 3) {
+		return
+	}
+	assert.Equal(t, "/cpu/host=a/state", messages[0].Path)
+	assert.Equal(t, common.OBJECT_STREAM, messages[0].Properties.StreamType)
+	// each series has its own path
+	assert.Equal(t, "/cpu/host=a/usage", messages[1].Path)
+	assert.Equal(t, "/cpu/host=b/usage", messages[2].Path)
+	assert.Len(t, messages[1].Readings, 2)
+	assert.Equal(t, common.Dict{"Tags|host": "a", "Influx|Measurement": "cpu", "Influx|Field": "usage"}, messages[1].Metadata)
+	assert.NotEqual(t, messages[1].UUID, messages[2].UUID)
+
+	// tags named like the measurement and field keys do not replace them
+	points, _ = ParseLines("cpu,Measurement=m,Field=f usage=1 1", "", 0)
+	assert.Equal(t, common.Dict{"Tags|Measurement": "m", "Tags|Field": "f", "Influx|Measurement": "cpu", "Influx|Field": "usage"}, PointsToMessages(points)[0].Metadata)
+
+	// the same series always gets the same UUID, regardless of tag order
+	first, _ := ParseLines("cpu,host=a,dc=x usage=1 3", "", 0)
+	second, _ := ParseLines("cpu,dc=x,host=a usage=2 4", "", 0)
+	assert.Equal(t, PointsToMessages(first)[0].UUID, PointsToMessages(second)[0].UUID)
+	assert.Equal(t, "/cpu/dc=x/host=a/usage", PointsToMessages(second)[0].Path)
+
+	// slashes do not add segments
+	points, _ = ParseLines("disk,mount=/var used=1 1", "", 0)
+	assert.Equal(t, "/disk/mount=|var/used", PointsToMessages(points)[0].Path)
+}
@@ -0,0 +1,157 @@
+// Package mqtt bridges an MQTT broker and the archiver. Messages published
+// on the configured topic filters are turned into readings using
+// objectbuilder expressions, much like a BOSSWAVE ArchiveRequest: with
+//    Topic=sensors/+/temperature
+//    Value=temp
+// the payload {"temp": 21.5} published on sensors/kitchen/temperature is
+// archived as a reading of 21.5 for the stream /sensors/kitchen/temperature/temp.
+// Readings of streams matching a Republish where clause are published back to
+// the broker. Do not republish onto topics that are also archived. MQTT does
+// not tell subscribers who published a message, so archived messages are
+// recorded in the audit log as added by the bridge's own connection:
+// mqtt/<Username or ClientID>@<Broker>.
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	giles "github.com/gtfierro/giles2/archiver"
+	"github.com/gtfierro/giles2/common"
+	"github.com/op/go-logging"
+	"os"
+	"strings"
+)
+
+// logger
+var log *logging.Logger
+
+// set up logging facilities
+func init() {
+	log = logging.MustGetLogger("mqtt")
+	var format = "%{color}%{level} %{time:Jan 02 15:04:05} %{shortfile}%{color:reset} ▶ %{message}"
+	var logBackend = logging.NewLogBackend(os.Stderr, "", 0)
+	logBackendLeveled := logging.AddModuleLevel(logBackend)
+	logging.SetBackend(logBackendLeveled)
+	logging.SetFormatter(logging.MustStringFormatter(format))
+}
+
+// The parts of an MQTT client the bridge uses. Handlers are called with the
+// topic a message was published on, which may differ from the filter
+type Client interface {
+	Subscribe(filter string, handler func(topic string, payload []byte)) error
+	Publish(topic string, payload []byte) error
+}
+
+type Bridge struct {
+	a      *giles.Archiver
+	client Client
+	rule   *ingestRule
+	// who archived messages are added by
+	caller string
+	// where archived messages go; a.AddData unless testing
+	add func(string, *common.SmapMessage) error
+}
+
+func NewBridge(a *giles.Archiver, config *giles.MQTT, client Client) *Bridge {
+	b := &Bridge{a: a, client: client, rule: newIngestRule(config), caller: bridgeCaller(config)}
+	if a != nil {
+		b.add = a.AddData
+	}
+	return b
+}
+
+func bridgeCaller(config *giles.MQTT) string {
+	user := config.Username
+	if user == "" {
+		user = config.ClientID
+	}
+	if user == "" {
+		return giles.Caller("mqtt", config.Broker)
+	}
+	return giles.Caller("mqtt", user+"@"+config.Broker)
+}
+
+func Handle(a *giles.Archiver, config *giles.MQTT) {
+	client, err := newPahoClient(config)
+	if err != nil {
+		log.Fatalf("Could not connect to MQTT broker %v (%v)", config.Broker, err)
+	}
+	log.Noticef("Connected to MQTT broker %v", config.Broker)
+	if err = NewBridge(a, config, client).Start(config); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// subscribes to each topic filter and starts each republish subscription
+func (b *Bridge) Start(config *giles.MQTT) error {
+	for _, filter := range config.Topic {
+		log.Noticef("Archiving MQTT topic %v", filter)
+		if err := b.client.Subscribe(filter, b.handleMessage); err != nil {
+			return fmt.Errorf("Could not subscribe to %v (%v)", filter, err)
+		}
+	}
+	for _, entry := range config.Republish {
+		topic, where, err := parseRepublish(entry)
+		if err != nil {
+			return err
+		}
+		log.Noticef("Republishing %v to MQTT topic %v", where, topic)
+		b.republish(topic, where)
+	}
+	return nil
+}
+
+func (b *Bridge) handleMessage(topic string, payload []byte) {
+	msg, err := b.rule.message(topic, payload)
+	if err != nil {
+		log.Errorf("Could not archive message on %v (%v)", topic, err)
+		return
+	}
+	if err = b.add(b.caller, msg); err != nil {
+		log.Errorf("Could not add data from %v (%v)", topic, err)
+	}
+}
+
+// splits a Republish entry into its topic and where clause
+func parseRepublish(entry string) (topic, where string, err error) {
+	parts := strings.SplitN(strings.TrimSpace(entry), " ", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+		return "", "", fmt.Errorf("Republish entry %q must be \"<topic> <where clause>\"", entry)
+	}
+	if strings.ContainsAny(parts[0], "+#") {
+		return "", "", fmt.Errorf("Cannot republish to wildcard topic %v", parts[0])
+	}
+	return strings.TrimSuffix(parts[0], "/"), strings.TrimSpace(parts[1]), nil
+}
+
+// starts a Broker subscription for the where clause. Republish subscriptions
+// last as long as the archiver
+func (b *Bridge) republish(topic, where string) {
+	closeC := make(chan bool, 1)
+	sub := giles.NewSubscriber(closeC, 10, func(e error) {
+		if e != nil {
+			log.Errorf("Republish subscription %v failed (%v)", where, e)
+		}
+	})
+	go b.forward(topic, sub)
+	go b.a.HandleNewSubscriber(sub, "select * where "+where)
+}
+
+// publishes each message delivered to the subscription to <topic>/<uuid>.
+// The initial metadata result is not forwarded
+func (b *Bridge) forward(topic string, sub *giles.Subscriber) {
+	for val := range sub.C {
+		msg, ok := val.(*common.SmapMessage)
+		if !ok || len(msg.Readings) == 0 {
+			continue
+		}
+		payload, err := json.Marshal(msg)
+		if err != nil {
+			log.Errorf("Error encoding message %v", err)
+			continue
+		}
+		if err = b.client.Publish(topic+"/"+string(msg.UUID), payload); err != nil {
+			log.Errorf("Could not publish to %v (%v)", topic, err)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package mqtt
+
+import (
+	"encoding/json"
+	giles "github.com/gtfierro/giles2/archiver"
+	"github.com/gtfierro/giles2/common"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// an in-process broker delivering each publish to matching subscriptions
+type memoryBroker struct {
+	subscriptions map[string]func(string, []byte)
+	published     map[string][]byte
+	sync.Mutex
+}
+
+func newMemoryBroker() *memoryBroker {
+	return &memoryBroker{
+		subscriptions: make(map[string]func(string, []byte)),
+		published:     make(map[string][]byte),
+	}
+}
+
+func (mb *memoryBroker) Subscribe(filter string, handler func(string, []byte)) error {
+	mb.Lock()
+	mb.subscriptions[filter] = handler
+	mb.Unlock()
+	return nil
+}
+
+func (mb *memoryBroker) Publish(topic string, payload []byte) error {
+	mb.Lock()
+	mb.published[topic] = payload
+	var handlers []func(string, []byte)
+	for filter, handler := range mb.subscriptions {
+		if topicMatches(filter, topic) {
+			handlers = append(handlers, handler)
+		}
+	}
+	mb.Unlock()
+	for _, handler := range handlers {
+		handler(topic, payload)
+	}
+	return nil
+}
+
+func topicMatches(filter, topic string) bool {
+	f, t := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i, level := range f {
+		if level == "#" {
+			return true
+		}
+		if i >= len(t) || (level != "+" && level != t[i]) {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+func TestBridgeIngest(t *testing.T) {
+	broker := newMemoryBroker()
+	var added []*common.SmapMessage
+	config := &giles.MQTT{Broker: "tcp://broker:1883", Username: "giles", Topic: []string{"sensors/+/temperature"}, Value: "temp", Time: "time"}
+	b := NewBridge(nil, config, broker)
+	b.add = func(caller string, msg *common.SmapMessage) error {
+		// publishers are anonymous, so the bridge is the caller
+		assert.Equal(t, "mqtt/giles@tcp://broker:1883", caller)
+		added = append(added, msg)
+		return nil
+	}
+	assert.NoError(t, b.Start(config))
+
+	broker.Publish("sensors/kitchen/temperature", []byte(`{"temp": 21.5, "time": 1351043674000}`))
+	broker.Publish("sensors/garage/temperature", []byte(`{"temp": 12, "time": "2016-11-01T12:00:00Z"}`))
+	broker.Publish("sensors/garage/humidity", []byte(`{"temp": 40}`))
+	broker.Publish("sensors/attic/temperature", []byte(`{"humidity": 40}`))
+
+	if assert.Len(t, added, 2) {
+		kitchen := added[0]
+		assert.Equal(t, "/sensors/kitchen/temperature/temp", kitchen.Path)
+		assert.Equal(t, "sensors/kitchen/temperature", kitchen.Metadata["Topic"])
+		assert.Equal(t, common.UOT_MS, kitchen.Properties.UnitOfTime)
+		if assert.Len(t, kitchen.Readings, 1) {
+			assert.Equal(t, 21.5, kitchen.Readings[0].(*common.SmapNumberReading).Value)
+			assert.Equal(t, uint64(1351043674000), kitchen.Readings[0].GetTime())
+		}
+
+		garage := added[1]
+		assert.NotEqual(t, kitchen.UUID, garage.UUID)
+		assert.Equal(t, common.UOT_NS, garage.Properties.UnitOfTime)
+		expected, _ := time.Parse(time.RFC3339, "2016-11-01T12:00:00Z")
+		assert.Equal(t, uint64(expected.UnixNano()), garage.Readings[0].GetTime())
+	}
+
+	// the same topic is always the same stream
+	broker.Publish("sensors/kitchen/temperature", []byte(`{"temp": 22}`))
+	if assert.Len(t, added, 3) {
+		assert.Equal(t, added[0].UUID, added[2].UUID)
+	}
+}
+
+func TestIngestRule(t *testing.T) {
+	rule := newIngestRule(&giles.MQTT{UUID: "id", Value: "state"})
+
+	msg, err := rule.message("lights/1", []byte(`{"id": "aaaa", "state": "on"}`))
+	if assert.NoError(t, err) {
+		assert.Equal(t, common.UUID("aaaa"), msg.UUID)
+		assert.Equal(t, "/lights/1/state", msg.Path)
+		assert.Equal(t, common.OBJECT_STREAM, msg.Properties.StreamType)
+	}
+	_, err = rule.message("lights/1", []byte(`{"state": "on"}`))
+	assert.Error(t, err)
+	_, err = rule.message("lights/1", []byte(`{"id": "aaaa"}`))
+	assert.Error(t, err)
+
+	// without a Value expression the whole payload is the value
+	rule = newIngestRule(&giles.MQTT{})
+	msg, err = rule.message("meters/1", []byte("104.5"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, 104.5, msg.Readings[0].(*common.SmapNumberReading).Value)
+	}
+	msg, err = rule.message("lights/1", []byte("on"))
+	if assert.NoError(t, err) {
+		assert.True(t, msg.Readings[0].IsObject())
+	}
+}
+
+func TestParseRepublish(t *testing.T) {
+	topic, where, err := parseRepublish("giles/site-a/ Metadata/Site = 'A'")
+	assert.NoError(t, err)
+	assert.Equal(t, "giles/site-a", topic)
+	assert.Equal(t, "Metadata/Site = 'A'", where)
+
+	_, _, err = parseRepublish("giles/site-a")
+	assert.Error(t, err)
+	_, _, err = parseRepublish("giles/# Metadata/Site = 'A'")
+	assert.Error(t, err)
+}
+
+func TestBridgeForward(t *testing.T) {
+	broker := newMemoryBroker()
+	b := NewBridge(nil, &giles.MQTT{}, broker)
+	sub := giles.NewSubscriber(make(chan bool, 1), 10, func(error) {})
+
+	sub.QueueToSend(common.SmapMessageList{{UUID: "aaaa", Path: "/a"}})
+	sub.QueueToSend(&common.SmapMessage{UUID: "aaaa", Readings: []common.Reading{&common.SmapNumberReading{Time: 1351043674000, Value: 1}}})
+	close(sub.C)
+	b.forward("giles/site-a", sub)
+
+	assert.Len(t, broker.published, 1)
+	var msg map[string]interface{}
+	if assert.NoError(t, json.Unmarshal(broker.published["giles/site-a/aaaa"], &msg)) {
+		assert.Equal(t, "aaaa", msg["uuid"])
+		assert.Len(t, msg["Readings"], 1)
+	}
+}
@@ -0,0 +1,68 @@
+package mqtt
+
+import (
+	paho "github.com/eclipse/paho.mqtt.golang"
+	giles "github.com/gtfierro/giles2/archiver"
+	"sync"
+	"time"
+)
+
+// Client backed by the Paho library. Subscriptions are remembered and made
+// again whenever the connection to the broker is re-established
+type pahoClient struct {
+	client   paho.Client
+	qos      byte
+	handlers map[string]paho.MessageHandler
+	sync.Mutex
+}
+
+func newPahoClient(config *giles.MQTT) (*pahoClient, error) {
+	pc := &pahoClient{
+		qos:      byte(config.QoS),
+		handlers: make(map[string]paho.MessageHandler),
+	}
+	opts := paho.NewClientOptions().
+		AddBroker(config.Broker).
+		SetClientID(config.ClientID).
+		SetUsername(config.Username).
+		SetPassword(config.Password).
+		SetAutoReconnect(true).
+		SetMaxReconnectInterval(30 * time.Second).
+		SetOnConnectHandler(pc.resubscribe).
+		SetConnectionLostHandler(func(_ paho.Client, err error) {
+			log.Errorf("Lost connection to MQTT broker (%v)", err)
+		})
+	pc.client = paho.NewClient(opts)
+	if token := pc.client.Connect(); token.Wait() && token.Error() != nil {
+		return nil, token.Error()
+	}
+	return pc, nil
+}
+
+func (pc *pahoClient) resubscribe(client paho.Client) {
+	pc.Lock()
+	defer pc.Unlock()
+	for filter, handler := range pc.handlers {
+		if token := client.Subscribe(filter, pc.qos, handler); token.Wait() && token.Error() != nil {
+			log.Errorf("Could not resubscribe to %v (%v)", filter, token.Error())
+		}
+	}
+}
+
+func (pc *pahoClient) Subscribe(filter string, handler func(topic string, payload []byte)) error {
+	callback := func(_ paho.Client, msg paho.Message) {
+		handler(msg.Topic(), msg.Payload())
+	}
+	pc.Lock()
+	pc.handlers[filter] = callback
+	pc.Unlock()
+	token := pc.client.Subscribe(filter, pc.qos, callback)
+	token.Wait()
+	return token.Error()
+}
+
+func (pc *pahoClient) Publish(topic string, payload []byte) error {
+	token := pc.client.Publish(topic, pc.qos, false, payload)
+	token.Wait()
+	return token.Error()
+}
@@ -0,0 +1,163 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	giles "github.com/gtfierro/giles2/archiver"
+	"github.com/gtfierro/giles2/common"
+	"github.com/gtfierro/ob"
+	"github.com/satori/go.uuid"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Unless a UUID expression is given, each topic is a stream with a UUIDv3 of
+// the topic and Value expression under this namespace
+var NAMESPACE_UUID = uuid.FromStringOrNil("0b3ab4c2-a2d4-11e6-80f5-76304dec7eb7")
+
+// The expressions from the [MQTT] section, parsed once and applied to every
+// message received on any of the topic filters
+type ingestRule struct {
+	Value     string
+	value     []ob.Operation
+	UUID      string
+	uuid      []ob.Operation
+	Time      string
+	time      []ob.Operation
+	TimeParse string
+}
+
+func newIngestRule(config *giles.MQTT) *ingestRule {
+	rule := &ingestRule{
+		Value:     config.Value,
+		UUID:      config.UUID,
+		Time:      config.Time,
+		TimeParse: config.TimeParse,
+	}
+	if rule.Value != "" {
+		rule.value = ob.Parse(rule.Value)
+	}
+	if rule.UUID != "" {
+		rule.uuid = ob.Parse(rule.UUID)
+	}
+	if rule.Time != "" {
+		if rule.TimeParse == "" {
+			rule.TimeParse = time.RFC3339
+		}
+		rule.time = ob.Parse(rule.Time)
+	}
+	return rule
+}
+
+// Payloads are JSON. Anything else (e.g. a bare "on") is taken as a string
+func decodePayload(payload []byte) interface{} {
+	var thing interface{}
+	if err := json.Unmarshal(payload, &thing); err != nil {
+		return strings.TrimSpace(string(payload))
+	}
+	return thing
+}
+
+// objectbuilder returns the object itself when a key is missing, so an
+// expression found something only if it resolved to a non-object
+func found(v interface{}) bool {
+	_, isObject := v.(map[string]interface{})
+	return v != nil && !isObject
+}
+
+// builds the message archiving the payload received on topic. Numbers are
+// numeric readings; strings, booleans and arrays are object readings
+func (rule *ingestRule) message(topic string, payload []byte) (*common.SmapMessage, error) {
+	thing := decodePayload(payload)
+	value := thing
+	if len(rule.value) > 0 {
+		value = ob.Eval(rule.value, thing)
+	}
+	if !found(value) {
+		return nil, fmt.Errorf("No value for %q", rule.Value)
+	}
+
+	msg := &common.SmapMessage{
+		Path:       rule.path(topic),
+		Metadata:   common.Dict{"Topic": topic},
+		Properties: &common.SmapProperties{StreamType: common.NUMERIC_STREAM},
+	}
+	id, err := rule.getUUID(topic, thing)
+	if err != nil {
+		return nil, err
+	}
+	msg.UUID = id
+	rdgTime, uot, err := rule.getTime(thing)
+	if err != nil {
+		return nil, err
+	}
+	msg.Properties.UnitOfTime = uot
+
+	switch t := value.(type) {
+	case float64:
+		msg.Readings = []common.Reading{&common.SmapNumberReading{Time: rdgTime, UoT: uot, Value: t}}
+	case int64:
+		msg.Readings = []common.Reading{&common.SmapNumberReading{Time: rdgTime, UoT: uot, Value: float64(t)}}
+	case uint64:
+		msg.Readings = []common.Reading{&common.SmapNumberReading{Time: rdgTime, UoT: uot, Value: float64(t)}}
+	default:
+		msg.Properties.StreamType = common.OBJECT_STREAM
+		msg.Readings = []common.Reading{&common.SmapObjectReading{Time: rdgTime, UoT: uot, Value: t}}
+	}
+	return msg, nil
+}
+
+func (rule *ingestRule) path(topic string) string {
+	path := "/" + strings.Trim(topic, "/")
+	if rule.Value != "" {
+		path += "/" + rule.Value
+	}
+	return path
+}
+
+func (rule *ingestRule) getUUID(topic string, thing interface{}) (common.UUID, error) {
+	if len(rule.uuid) == 0 {
+		return common.UUID(uuid.NewV3(NAMESPACE_UUID, topic+rule.Value).String()), nil
+	}
+	id, ok := ob.Eval(rule.uuid, thing).(string)
+	if !ok || id == "" {
+		return "", fmt.Errorf("No UUID for %q", rule.UUID)
+	}
+	return common.UUID(id), nil
+}
+
+// returns the time of the reading and its unit. Without a Time expression,
+// or if it finds nothing, this is the server time in nanoseconds. Numeric
+// timestamps may be in any unit of time; strings are parsed with TimeParse
+func (rule *ingestRule) getTime(thing interface{}) (uint64, common.UnitOfTime, error) {
+	if len(rule.time) == 0 {
+		return common.GetNow(common.UOT_NS), common.UOT_NS, nil
+	}
+	evaluated := ob.Eval(rule.time, thing)
+	if !found(evaluated) {
+		return common.GetNow(common.UOT_NS), common.UOT_NS, nil
+	}
+	var ts uint64
+	switch t := evaluated.(type) {
+	case string:
+		if num, err := strconv.ParseUint(t, 10, 64); err == nil {
+			ts = num
+			break
+		}
+		parsed, err := time.Parse(rule.TimeParse, t)
+		if err != nil {
+			return 0, 0, fmt.Errorf("Could not parse time %q (%v)", t, err)
+		}
+		return uint64(parsed.UnixNano()), common.UOT_NS, nil
+	case float64:
+		ts = uint64(t)
+	case int64:
+		ts = uint64(t)
+	case uint64:
+		ts = t
+	default:
+		return 0, 0, fmt.Errorf("Invalid time %v", t)
+	}
+	return ts, common.GuessTimeUnit(ts), nil
+}
@@ -0,0 +1,30 @@
+package msgpack
+
+import (
+	"github.com/gtfierro/giles2/common/encoders"
+	"io"
+)
+
+const CONTENT_TYPE = "application/msgpack"
+
+// makes msgpack results available to every interface that negotiates
+// encoders
+func init() {
+	encoders.Register(CONTENT_TYPE, func(map[string]string) encoders.Encoder { return Encoder{} })
+}
+
+// Encoder writes query results as msgpack. See EncodeResult
+type Encoder struct{}
+
+func (enc Encoder) ContentType() string {
+	return CONTENT_TYPE
+}
+
+func (enc Encoder) Encode(w io.Writer, res interface{}) error {
+	encoded, err := EncodeResult(res)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(encoded)
+	return err
+}
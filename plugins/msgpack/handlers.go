@@ -8,8 +8,27 @@
 //  message:
 //      metadata => map (flat key/value)
 //      properties => map (flat key/value)
-//      readings => array
+//      readings => array of [time, value] (value is a number or any object)
+//      actuator => map
 //      uuid => string?
+//      contents => array of paths (collections only)
+//
+// Clients can also subscribe to readings over the same UDP port by sending a
+// map with a where clause and an optional lease in seconds:
+//  map:
+//      Subscribe => string (e.g. "Metadata/Type = 'Temperature'")
+//      Lease => int (defaults to 60)
+// The archiver replies with a map holding Subscribed (the where clause), the
+// Lease granted and a Nonce, or with Subscribe and an Error if the where
+// clause is invalid. The client confirms the subscription by resending the
+// Subscribe message with the Nonce; until it does, within 10 seconds, nothing
+// is sent to its address but acks. Matching readings are then sent back to the
+// client's address as msgpack maps (uuid, Path, Readings). The subscription
+// ends when its lease runs out, so clients renew it by resending the Subscribe
+// message with the Nonce. Sending
+//  map:
+//      Unsubscribe => string (the where clause)
+// ends it immediately.
 package msgpack
 
 import (
@@ -37,31 +56,33 @@ func init() {
 	logging.SetFormatter(logging.MustStringFormatter(format))
 }
 
+// largest datagram we can receive
+const maxDatagramSize = 65535
+
 type MsgPackUdpHandler struct {
-	a       *giles.Archiver
+	a *giles.Archiver
+	// the archiver, as far as subscriptions need it
+	broker  subscriptionBroker
+	conn    *net.UDPConn
 	bufpool sync.Pool
-	msgpool sync.Pool
 	counter uint64
+
+	// (client address, where clause) -> subscription
+	subscriptions     map[string]*udpSubscription
+	subscriptionsLock sync.Mutex
 }
 
 func HandleUDP4(a *giles.Archiver, port int) {
 	h := &MsgPackUdpHandler{
-		a: a,
+		a:      a,
+		broker: a,
 		bufpool: sync.Pool{
 			New: func() interface{} {
-				return make([]byte, 1024)
+				return make([]byte, maxDatagramSize)
 			},
 		},
-		msgpool: sync.Pool{
-			New: func() interface{} {
-				return &common.SmapMessage{
-					Actuator: make(common.Dict),
-					Metadata: make(common.Dict),
-					Readings: make([]common.Reading, 0),
-				}
-			},
-		},
-		counter: 0,
+		counter:       0,
+		subscriptions: make(map[string]*udpSubscription),
 	}
 	go func() {
 		var t = time.NewTicker(1 * time.Second)
@@ -76,7 +97,7 @@ func HandleUDP4(a *giles.Archiver, port int) {
 	if err != nil {
 		log.Fatalf("Error resolving UDP address for msgpack %v", err)
 	}
-	conn, err := net.ListenUDP("udp6", udpAddr)
+	h.conn, err = net.ListenUDP("udp6", udpAddr)
 	if err != nil {
 		log.Fatalf("Error on listening (%v)", err)
 	}
@@ -85,71 +106,76 @@ func HandleUDP4(a *giles.Archiver, port int) {
 
 	for {
 		buf := h.bufpool.Get().([]byte)
-		num, from, err := conn.ReadFromUDP(buf)
-		go h.handleAdd(buf, num, from, err)
+		num, from, err := h.conn.ReadFromUDP(buf)
+		go h.handlePacket(buf, num, from, err)
 	}
 }
 
-func (h *MsgPackUdpHandler) handleAdd(buffer []byte, num int, from *net.UDPAddr, err error) {
+// decodes the packet and hands it to the add or subscription handler
+func (h *MsgPackUdpHandler) handlePacket(buffer []byte, num int, from *net.UDPAddr, err error) {
+	defer h.bufpool.Put(buffer)
+	if err != nil {
+		log.Debugf("Got err handling MsgPack packet %v", err)
+		return
+	}
+
+	msgMap, err := doDecode(buffer[:num])
 	if err != nil {
-		log.Debugf("Got err handling MsgPack packet", err)
+		log.Errorf("Error decoding msgpack %v", err)
 		return
 	}
 
-	msg, err := h.decode(buffer)
-	if err == nil {
-		h.a.AddData(msg)
-		atomic.AddUint64(&h.counter, 1)
+	if isSubscription(msgMap) {
+		h.handleSubscription(msgMap, from)
+	} else {
+		h.handleAdd(msgMap, from)
 	}
-	msg.Metadata = common.Dict{}
-	h.msgpool.Put(msg)
-	h.bufpool.Put(buffer)
 }
 
-func (h *MsgPackUdpHandler) handleSubscription(buffer []byte, num int, from *net.UDPAddr, err error) {
+func (h *MsgPackUdpHandler) handleAdd(msgMap map[string]interface{}, from *net.UDPAddr) {
+	added, err := addMessages(h.a, giles.Caller("msgpack", from.String()), msgMap)
+	atomic.AddUint64(&h.counter, uint64(added))
 	if err != nil {
-		log.Debugf("Got err handling MsgPack packet", err)
-		return
+		log.Errorf("Error adding data %v", err)
 	}
 }
 
-func Fuzz(data []byte) int {
-	h := &MsgPackUdpHandler{
-		bufpool: sync.Pool{
-			New: func() interface{} {
-				return make([]byte, 1024)
-			},
-		},
-		msgpool: sync.Pool{
-			New: func() interface{} {
-				return &common.SmapMessage{
-					Actuator: make(common.Dict),
-					Metadata: make(common.Dict),
-					Readings: make([]common.Reading, 0),
-				}
-			},
-		},
-		counter: 0,
+// adds the streams and collections in a decoded packet or frame on behalf of
+// caller. Returns the number of streams added
+func addMessages(a *giles.Archiver, caller string, msgMap map[string]interface{}) (int, error) {
+	messages, err := decodeMessages(msgMap)
+	if err != nil {
+		return 0, err
 	}
-	msg, err := h.decode(data)
+	return a.AddTiered(caller, messages)
+}
+
+func Fuzz(data []byte) int {
+	msg, err := decode(data)
 	if msg == nil || err != nil {
 		return 1
 	}
 	return 0
 }
 
-func (h *MsgPackUdpHandler) decode(buffer []byte) (*common.SmapMessage, error) {
-	var (
-		uuid string
-	)
-	msg := h.msgpool.Get().(*common.SmapMessage)
-
+func decode(buffer []byte) (*common.SmapMessage, error) {
 	msgMap, err := doDecode(buffer)
-
 	if err != nil {
 		log.Errorf("Error decoding msgpack %v", err)
 		return nil, err
 	}
+	return decodeMessage(msgMap)
+}
+
+// Messages are not pooled: the archiver forwards them to subscribers, which
+// may still be encoding them after AddData returns. As with JSON, the uuid and
+// readings are optional, so collections and metadata updates can be sent
+func decodeMessage(msgMap map[string]interface{}) (*common.SmapMessage, error) {
+	var (
+		uuid string
+		err  error
+	)
+	msg := new(common.SmapMessage)
 
 	// get Path
 	if msg.Path, err = getStringValue(msgMap, "Path"); err != nil {
@@ -157,16 +183,21 @@ func (h *MsgPackUdpHandler) decode(buffer []byte) (*common.SmapMessage, error) {
 	}
 
 	// get UUID
-	if uuid, err = getStringValue(msgMap, "uuid"); err != nil {
+	if uuid, err = getStringValue(msgMap, "uuid"); err != nil && err != KeyNotFound {
 		return msg, err
 	}
 	msg.UUID = common.UUID(uuid)
 
+	// get Contents of collections
+	if msg.Contents, err = getContents(msgMap); err != nil {
+		return msg, err
+	}
+
 	// test for readings
 	rdgs, err := getReadings(msgMap)
 	if err != nil && err != ReadingsNotFound {
 		return msg, err // return early if we found readings and it still gave error
-	} else if err == ReadingsNotFound { // otherwise look for Value field
+	} else if _, found := msgMap["Value"]; err == ReadingsNotFound && found { // otherwise look for Value field
 		var value float64
 		if value, err = getValue(msgMap); err != nil {
 			return msg, err
@@ -184,6 +215,14 @@ func (h *MsgPackUdpHandler) decode(buffer []byte) (*common.SmapMessage, error) {
 		msg.Metadata = md
 	}
 
+	//get Actuator
+	act, err := getActuator(msgMap)
+	if err != nil && err != ActuatorNotFound {
+		return msg, err
+	} else if err == nil {
+		msg.Actuator = act
+	}
+
 	//get Properties
 	props, err := getProperties(msgMap)
 	if err != nil && err != PropertiesNotFound {
@@ -0,0 +1,244 @@
+package msgpack
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	giles "github.com/gtfierro/giles2/archiver"
+	"github.com/gtfierro/giles2/common"
+	"gopkg.in/vmihailenco/msgpack.v2"
+	"net"
+	"sync"
+	"time"
+)
+
+// lease given to subscriptions that don't ask for one, and the longest
+// lease we will grant
+const (
+	defaultLease = 60 * time.Second
+	maxLease     = 10 * time.Minute
+)
+
+// how long a client has to confirm a subscription by echoing the nonce of the
+// ack. Until then nothing but acks is sent to its address, so a datagram with
+// a forged source address cannot have readings streamed to someone else
+const confirmTimeout = 10 * time.Second
+
+// what subscriptions need of the archiver
+type subscriptionBroker interface {
+	CheckQuery(querystring string) error
+	HandleNewSubscriber(subscriber *giles.Subscriber, querystring string) error
+}
+
+type udpSubscription struct {
+	addr  *net.UDPAddr
+	where string
+	// echoed by the client to confirm the subscription and renew it
+	nonce        uint32
+	confirmed    bool
+	lease        *time.Timer
+	closeC       chan bool
+	stop         chan struct{}
+	stopOnce     sync.Once
+	subscription *giles.Subscriber
+}
+
+func (us *udpSubscription) close() {
+	us.stopOnce.Do(func() {
+		us.lease.Stop()
+		us.closeC <- true
+		close(us.stop)
+	})
+}
+
+// returns true if the decoded packet is a Subscribe or Unsubscribe request
+// rather than a set of readings
+func isSubscription(msgMap map[string]interface{}) bool {
+	_, sub := msgMap["Subscribe"]
+	_, unsub := msgMap["Unsubscribe"]
+	return sub || unsub
+}
+
+// lease requested by the client, bounded by maxLease
+func getLease(msgMap map[string]interface{}) time.Duration {
+	secs, ok := getNumber(msgMap["Lease"])
+	if !ok || secs <= 0 {
+		return defaultLease
+	}
+	lease := time.Duration(secs * float64(time.Second))
+	if lease > maxLease {
+		return maxLease
+	}
+	return lease
+}
+
+func subscriptionKey(from *net.UDPAddr, where string) string {
+	return from.String() + "|" + where
+}
+
+// the nonce echoed by the client, if any
+func getNonce(msgMap map[string]interface{}) (nonce uint32, found bool) {
+	num, ok := getNumber(msgMap["Nonce"])
+	if !ok || num < 0 || num > float64(^uint32(0)) {
+		return 0, false
+	}
+	return uint32(num), true
+}
+
+func newNonce() uint32 {
+	var buf [4]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		panic(err)
+	}
+	return binary.BigEndian.Uint32(buf[:])
+}
+
+func (h *MsgPackUdpHandler) handleSubscription(msgMap map[string]interface{}, from *net.UDPAddr) {
+	if where, err := getStringValue(msgMap, "Unsubscribe"); err == nil {
+		h.unsubscribe(from, where)
+		return
+	}
+	where, err := getStringValue(msgMap, "Subscribe")
+	if err != nil {
+		log.Errorf("Invalid subscription from %v (%v)", from, err)
+		return
+	}
+	nonce, hasNonce := getNonce(msgMap)
+	h.subscribe(from, where, getLease(msgMap), nonce, hasNonce)
+}
+
+// starts a subscription for the client, confirms it once the client echoes
+// the nonce of the ack, or renews the lease of a confirmed one
+func (h *MsgPackUdpHandler) subscribe(from *net.UDPAddr, where string, lease time.Duration, nonce uint32, hasNonce bool) {
+	key := subscriptionKey(from, where)
+	h.subscriptionsLock.Lock()
+	if us, found := h.subscriptions[key]; found {
+		if hasNonce && nonce != us.nonce {
+			h.subscriptionsLock.Unlock()
+			log.Warningf("Wrong nonce for subscription %v from %v", where, from)
+			return
+		}
+		// the ack of an unconfirmed subscription may have been lost
+		if !hasNonce {
+			h.subscriptionsLock.Unlock()
+			if !us.confirmed {
+				h.sendAck(from, where, lease, us.nonce)
+			}
+			return
+		}
+		us.lease.Reset(lease)
+		start := !us.confirmed
+		us.confirmed = true
+		h.subscriptionsLock.Unlock()
+		h.sendAck(from, where, lease, us.nonce)
+		if start {
+			go h.forward(us)
+			go h.broker.HandleNewSubscriber(us.subscription, "select * where "+where)
+		}
+		return
+	}
+	h.subscriptionsLock.Unlock()
+	if err := h.broker.CheckQuery("select * where " + where); err != nil {
+		h.sendError(from, where, err)
+		return
+	}
+	us := &udpSubscription{
+		addr:   from,
+		where:  where,
+		nonce:  newNonce(),
+		closeC: make(chan bool, 1),
+		stop:   make(chan struct{}),
+	}
+	us.subscription = giles.NewSubscriber(us.closeC, 10, func(e error) {
+		if e == nil {
+			return
+		}
+		log.Errorf("Subscription %v from %v failed (%v)", where, from, e)
+		h.remove(key, us)
+	})
+	us.lease = time.AfterFunc(confirmTimeout, func() {
+		log.Debugf("Lease expired for subscription %v from %v", where, from)
+		h.remove(key, us)
+	})
+	h.subscriptionsLock.Lock()
+	if _, found := h.subscriptions[key]; found {
+		// raced with another Subscribe from the same client
+		h.subscriptionsLock.Unlock()
+		us.lease.Stop()
+		return
+	}
+	h.subscriptions[key] = us
+	h.subscriptionsLock.Unlock()
+
+	h.sendAck(from, where, lease, us.nonce)
+}
+
+func (h *MsgPackUdpHandler) unsubscribe(from *net.UDPAddr, where string) {
+	key := subscriptionKey(from, where)
+	h.subscriptionsLock.Lock()
+	us, found := h.subscriptions[key]
+	h.subscriptionsLock.Unlock()
+	if found {
+		h.remove(key, us)
+	}
+}
+
+func (h *MsgPackUdpHandler) remove(key string, us *udpSubscription) {
+	h.subscriptionsLock.Lock()
+	if cur, found := h.subscriptions[key]; found && cur == us {
+		delete(h.subscriptions, key)
+	}
+	h.subscriptionsLock.Unlock()
+	us.close()
+}
+
+// sends readings delivered to the subscription back to the client. The
+// initial metadata result is not forwarded because it rarely fits in a
+// datagram
+func (h *MsgPackUdpHandler) forward(us *udpSubscription) {
+	for {
+		select {
+		case <-us.stop:
+			return
+		case val := <-us.subscription.C:
+			msg, ok := val.(*common.SmapMessage)
+			if !ok {
+				continue
+			}
+			packet, err := encodeReadings(msg)
+			if err != nil {
+				log.Errorf("Error encoding readings %v", err)
+				continue
+			}
+			if _, err = h.conn.WriteToUDP(packet, us.addr); err != nil {
+				log.Errorf("Error sending readings to %v (%v)", us.addr, err)
+			}
+		}
+	}
+}
+
+func (h *MsgPackUdpHandler) sendAck(to *net.UDPAddr, where string, lease time.Duration, nonce uint32) {
+	h.sendReply(to, map[string]interface{}{
+		"Subscribed": where,
+		"Lease":      int64(lease / time.Second),
+		"Nonce":      nonce,
+	})
+}
+
+// tells the client that its subscription was refused
+func (h *MsgPackUdpHandler) sendError(to *net.UDPAddr, where string, e error) {
+	h.sendReply(to, map[string]interface{}{
+		"Subscribe": where,
+		"Error":     e.Error(),
+	})
+}
+
+func (h *MsgPackUdpHandler) sendReply(to *net.UDPAddr, reply map[string]interface{}) {
+	packet, err := msgpack.Marshal(reply)
+	if err != nil {
+		log.Errorf("Error encoding reply %v", err)
+		return
+	}
+	if _, err = h.conn.WriteToUDP(packet, to); err != nil {
+		log.Errorf("Error sending reply to %v (%v)", to, err)
+	}
+}
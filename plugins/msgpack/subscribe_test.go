@@ -0,0 +1,138 @@
+package msgpack
+
+import (
+	"fmt"
+	giles "github.com/gtfierro/giles2/archiver"
+	"github.com/gtfierro/giles2/common"
+	"gopkg.in/vmihailenco/msgpack.v2"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// accepts any where clause but "bad", and delivers one reading to each
+// subscriber
+type fakeBroker struct {
+	started chan string
+}
+
+func (fb *fakeBroker) CheckQuery(querystring string) error {
+	if strings.Contains(querystring, "bad") {
+		return fmt.Errorf("bad where clause")
+	}
+	return nil
+}
+
+func (fb *fakeBroker) HandleNewSubscriber(subscriber *giles.Subscriber, querystring string) error {
+	fb.started <- querystring
+	return subscriber.QueueToSend(&common.SmapMessage{Path: "/sensor0", UUID: "aaaa", Readings: []common.Reading{&common.SmapNumberReading{Time: 1351043674000, Value: 1}}})
+}
+
+func TestUDPSubscriptions(t *testing.T) {
+	listen := func() *net.UDPConn {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	broker := &fakeBroker{started: make(chan string, 10)}
+	h := &MsgPackUdpHandler{broker: broker, conn: listen(), subscriptions: make(map[string]*udpSubscription)}
+	defer h.conn.Close()
+	client := listen()
+	defer client.Close()
+	from := client.LocalAddr().(*net.UDPAddr)
+
+	send := func(request map[string]interface{}) {
+		packet, err := msgpack.Marshal(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.handlePacket(packet, len(packet), from, nil)
+	}
+	// the next datagram sent to the client, or nil if there is none
+	receive := func(wait time.Duration) map[string]interface{} {
+		buf := make([]byte, maxDatagramSize)
+		client.SetReadDeadline(time.Now().Add(wait))
+		n, _, err := client.ReadFromUDP(buf)
+		if err != nil {
+			return nil
+		}
+		reply, err := doDecode(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+	subscribed := func() int {
+		h.subscriptionsLock.Lock()
+		defer h.subscriptionsLock.Unlock()
+		return len(h.subscriptions)
+	}
+
+	// invalid where clauses are refused rather than acked
+	send(map[string]interface{}{"Subscribe": "bad"})
+	if reply := receive(time.Second); reply == nil || reply["Error"] != "bad where clause" {
+		t.Errorf("Expected an error, got %v", reply)
+	}
+	if subscribed() != 0 {
+		t.Error("The invalid subscription should not be kept")
+	}
+
+	// nothing but the ack is sent until the client echoes its nonce
+	where := "Metadata/Type = 'Temperature'"
+	send(map[string]interface{}{"Subscribe": where})
+	ack := receive(time.Second)
+	if ack == nil || ack["Subscribed"] != where {
+		t.Fatalf("Expected an ack, got %v", ack)
+	}
+	nonce, _ := getNonce(ack)
+	send(map[string]interface{}{"Subscribe": where, "Nonce": uint64(nonce) + 1})
+	if reply := receive(100 * time.Millisecond); reply != nil {
+		t.Errorf("Expected nothing for a wrong nonce, got %v", reply)
+	}
+	if len(broker.started) != 0 {
+		t.Error("The subscription should not start before it is confirmed")
+	}
+
+	// confirming starts the subscription
+	send(map[string]interface{}{"Subscribe": where, "Nonce": ack["Nonce"], "Lease": 30})
+	if reply := receive(time.Second); reply == nil || fmt.Sprint(reply["Lease"]) != "30" {
+		t.Errorf("Expected an ack with the lease, got %v", reply)
+	}
+	select {
+	case query := <-broker.started:
+		if query != "select * where "+where {
+			t.Errorf("Bad query %v", query)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The subscription did not start")
+	}
+	if reply := receive(time.Second); reply == nil || reply["uuid"] != "aaaa" {
+		t.Errorf("Expected readings, got %v", reply)
+	}
+
+	// renewing acks again, and unsubscribing ends it
+	send(map[string]interface{}{"Subscribe": where, "Nonce": ack["Nonce"]})
+	if reply := receive(time.Second); reply == nil || reply["Subscribed"] != where {
+		t.Errorf("Expected an ack, got %v", reply)
+	}
+	send(map[string]interface{}{"Unsubscribe": where})
+	if subscribed() != 0 {
+		t.Error("The subscription should have ended")
+	}
+
+	// subscriptions end when their lease runs out
+	send(map[string]interface{}{"Subscribe": where})
+	ack = receive(time.Second)
+	send(map[string]interface{}{"Subscribe": where, "Nonce": ack["Nonce"], "Lease": 0.05})
+	receive(time.Second)
+	<-broker.started
+	for i := 0; i < 100 && subscribed() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if subscribed() != 0 {
+		t.Error("The subscription should have expired")
+	}
+}
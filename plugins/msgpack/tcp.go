@@ -0,0 +1,132 @@
+package msgpack
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	giles "github.com/gtfierro/giles2/archiver"
+	"gopkg.in/vmihailenco/msgpack.v2"
+	"io"
+	"net"
+	"strconv"
+)
+
+// MsgPack over TCP removes the size limit of a UDP datagram. Each frame on the
+// connection is a 4-byte big-endian length followed by that many bytes of
+// msgpack. A client sends either a set of readings (in the same form as over
+// UDP) or a query:
+//  map:
+//      Query => string
+// and receives one frame in reply for every frame it sends: the encoded query
+// results, a map {Added => count} for readings, or {Error => string}.
+
+// largest frame we will read from a client
+const MaxFrameSize = 16 << 20
+
+// ReadFrame reads a single length-prefixed frame
+func ReadFrame(r io.Reader) ([]byte, error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	if length > MaxFrameSize {
+		return nil, fmt.Errorf("Frame of %v bytes is larger than the maximum %v", length, MaxFrameSize)
+	}
+	frame := make([]byte, length)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// WriteFrame writes the buffer prefixed with its length
+func WriteFrame(w io.Writer, frame []byte) error {
+	if err := binary.Write(w, binary.BigEndian, uint32(len(frame))); err != nil {
+		return err
+	}
+	_, err := w.Write(frame)
+	return err
+}
+
+type MsgPackTCPHandler struct {
+	a        *giles.Archiver
+	addr     *net.TCPAddr
+	listener *net.TCPListener
+}
+
+func HandleTCP(a *giles.Archiver, port int) {
+	var err error
+	h := &MsgPackTCPHandler{a: a}
+	h.addr, err = net.ResolveTCPAddr("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		log.Fatalf("Error resolving MsgPack TCP address %v (%v)", port, err)
+	}
+	h.listener, err = net.ListenTCP("tcp", h.addr)
+	if err != nil {
+		log.Fatalf("Error listening to TCP (%v)", err)
+	}
+
+	log.Noticef("Starting MsgPack on TCP %v", h.addr.String())
+
+	for {
+		conn, err := h.listener.Accept()
+		if err != nil {
+			log.Errorf("Error accepting MsgPack TCP connection (%v)", err)
+			continue
+		}
+		go h.handleConn(conn)
+	}
+}
+
+func (h *MsgPackTCPHandler) handleConn(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		frame, err := ReadFrame(reader)
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			log.Errorf("Error reading MsgPack frame (%v)", err)
+			return
+		}
+		reply, err := h.handleFrame(giles.Caller("msgpack", conn.RemoteAddr().String()), frame)
+		if err != nil {
+			reply, err = msgpack.Marshal(map[string]interface{}{"Error": err.Error()})
+			if err != nil {
+				log.Errorf("Error encoding error reply (%v)", err)
+				return
+			}
+		}
+		if err = WriteFrame(conn, reply); err != nil {
+			log.Errorf("Error writing MsgPack frame (%v)", err)
+			return
+		}
+	}
+}
+
+// evaluates a query or adds the readings in the frame on behalf of caller and
+// returns the encoded reply
+func (h *MsgPackTCPHandler) handleFrame(caller string, frame []byte) ([]byte, error) {
+	msgMap, err := doDecode(frame)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, found := msgMap["Query"]; found {
+		query, err := getStringValue(msgMap, "Query")
+		if err != nil {
+			return nil, err
+		}
+		res, err := h.a.HandleQuery(caller, query)
+		if err != nil {
+			return nil, err
+		}
+		return EncodeResult(res)
+	}
+
+	added, err := addMessages(h.a, caller, msgMap)
+	if err != nil {
+		return nil, err
+	}
+	return msgpack.Marshal(map[string]interface{}{"Added": added})
+}
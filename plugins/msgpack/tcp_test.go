@@ -0,0 +1,100 @@
+package msgpack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/gtfierro/giles2/common"
+	"gopkg.in/vmihailenco/msgpack.v2"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	for _, payload := range [][]byte{[]byte("first"), []byte{}, bytes.Repeat([]byte("x"), 4096)} {
+		if err := WriteFrame(&buf, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, expected := range []int{5, 0, 4096} {
+		frame, err := ReadFrame(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(frame) != expected {
+			t.Errorf("Expected frame of %v bytes, got %v", expected, len(frame))
+		}
+	}
+}
+
+func TestReadFrameTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(MaxFrameSize+1))
+	if _, err := ReadFrame(&buf); err == nil {
+		t.Error("Expected error for oversized frame")
+	}
+}
+
+func TestDecodeMessages(t *testing.T) {
+	for _, test := range []struct {
+		title string
+		input map[string]interface{}
+	}{
+		{
+			"Single message",
+			map[string]interface{}{
+				"Path":     "/sensor0",
+				"uuid":     "d24325e6-1d7d-11e2-ad69-a7c2fa8dba61",
+				"Readings": []interface{}{[]interface{}{uint64(1351043674000), 1.0}},
+			},
+		},
+		{
+			"Path to message",
+			map[string]interface{}{
+				"/sensor0": map[string]interface{}{
+					"uuid":     "d24325e6-1d7d-11e2-ad69-a7c2fa8dba61",
+					"Readings": []interface{}{[]interface{}{uint64(1351043674000), 1.0}},
+				},
+			},
+		},
+	} {
+		buf, err := msgpack.Marshal(test.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages, err := DecodeMessages(buf)
+		if err != nil {
+			t.Errorf("%v: unexpected error %v", test.title, err)
+			continue
+		}
+		msg, found := messages["/sensor0"]
+		if !found || msg.Path != "/sensor0" || len(msg.Readings) != 1 {
+			t.Errorf("%v: bad decode %v", test.title, messages)
+		}
+	}
+}
+
+func TestEncodeResult(t *testing.T) {
+	res := common.SmapMessageList{
+		{
+			Path:     "/sensor0",
+			UUID:     common.UUID("d24325e6-1d7d-11e2-ad69-a7c2fa8dba61"),
+			Metadata: common.Dict{"Site": "A"},
+			Readings: []common.Reading{&common.SmapNumberReading{Time: 1351043674000, Value: 1}},
+		},
+	}
+	buf, err := EncodeResult(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded []map[string]interface{}
+	if err = msgpack.Unmarshal(buf, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != 1 || decoded[0]["uuid"] != string(res[0].UUID) {
+		t.Fatalf("Bad encoding %v", decoded)
+	}
+	readings, ok := decoded[0]["Readings"].([]interface{})
+	if !ok || len(readings) != 1 {
+		t.Errorf("Bad readings %v", decoded[0]["Readings"])
+	}
+}
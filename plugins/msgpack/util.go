@@ -3,6 +3,7 @@ package msgpack
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"github.com/gtfierro/giles2/common"
 	"gopkg.in/vmihailenco/msgpack.v2"
 	"strings"
@@ -13,6 +14,10 @@ var KeyWasNotString = errors.New("Key wasn't a string")
 var ReadingsNotFound = errors.New("Readings not found")
 var MetadataNotFound = errors.New("Metadata not found")
 var PropertiesNotFound = errors.New("Properties not found")
+var ActuatorNotFound = errors.New("Actuator not found")
+var InvalidReading = errors.New("Reading must be a [time, value] array")
+var InvalidTimestamp = errors.New("Reading timestamp must be a non-negative number")
+var InvalidContents = errors.New("Contents must be a list of paths")
 
 func getStringValue(msg map[string]interface{}, key string) (string, error) {
 	if val, found := msg[key]; found {
@@ -41,13 +46,113 @@ func getReadings(msg map[string]interface{}) ([]common.Reading, error) {
 		return ret, ReadingsNotFound
 	}
 
+	ret = make([]common.Reading, 0, len(readings))
 	for _, rdg := range readings {
-		log.Debugf("got rdg %#v", rdg)
+		pair, ok := rdg.([]interface{})
+		if !ok || len(pair) != 2 {
+			return ret, InvalidReading
+		}
+		time, err := getTimestamp(pair[0])
+		if err != nil {
+			return ret, err
+		}
+		uot := common.GuessTimeUnit(time)
+		if value, isNumber := getNumber(pair[1]); isNumber {
+			ret = append(ret, &common.SmapNumberReading{Time: time, UoT: uot, Value: value})
+		} else {
+			ret = append(ret, &common.SmapObjectReading{Time: time, UoT: uot, Value: pair[1]})
+		}
 	}
 
 	return ret, nil
 }
 
+// converts any of the msgpack numeric types to a uint64 timestamp
+func getTimestamp(val interface{}) (uint64, error) {
+	switch t := val.(type) {
+	case uint64:
+		return t, nil
+	case int64:
+		if t >= 0 {
+			return uint64(t), nil
+		}
+	case float64:
+		if t >= 0 {
+			return uint64(t), nil
+		}
+	case float32:
+		if t >= 0 {
+			return uint64(t), nil
+		}
+	}
+	return 0, InvalidTimestamp
+}
+
+// converts any of the msgpack numeric types to a float64. Returns false if
+// the value is not a number
+func getNumber(val interface{}) (float64, bool) {
+	switch t := val.(type) {
+	case float64:
+		return t, true
+	case float32:
+		return float64(t), true
+	case uint64:
+		return float64(t), true
+	case int64:
+		return float64(t), true
+	}
+	return 0, false
+}
+
+// Actuator descriptions are nested maps, e.g.
+//  {"Model": "discrete", "States": ["on", "off"]}
+// Nested keys are flattened with '|' like the Metadata keys are.
+func getActuator(msg map[string]interface{}) (common.Dict, error) {
+	var actuator common.Dict
+	act, found := msg["Actuator"]
+	if !found {
+		return actuator, ActuatorNotFound
+	}
+	actmap, ok := act.(map[string]interface{})
+	if !ok {
+		return actuator, ActuatorNotFound
+	}
+	actuator = make(common.Dict, len(actmap))
+	flattenInto(actuator, "", actmap)
+	return actuator, nil
+}
+
+func flattenInto(d common.Dict, prefix string, m map[string]interface{}) {
+	for k, v := range m {
+		k = strings.Replace(k, ".", "|", -1)
+		k = strings.Replace(k, "/", "|", -1)
+		if nested, ok := v.(map[string]interface{}); ok {
+			flattenInto(d, prefix+k+"|", nested)
+		} else {
+			d[prefix+k] = v
+		}
+	}
+}
+
+// returns the paths listed in the Contents of a collection, if any
+func getContents(msg map[string]interface{}) ([]string, error) {
+	val, found := msg["Contents"]
+	if !found {
+		return nil, nil
+	}
+	list, ok := val.([]interface{})
+	if !ok {
+		return nil, InvalidContents
+	}
+	contents := make([]string, len(list))
+	for i, item := range list {
+		if contents[i], ok = item.(string); !ok {
+			return nil, InvalidContents
+		}
+	}
+	return contents, nil
+}
+
 func getMetadata(msg map[string]interface{}) (common.Dict, error) {
 	var metadata common.Dict
 	if md, found := msg["Metadata"]; found {
@@ -105,27 +210,154 @@ func getProperties(msg map[string]interface{}) (properties *common.SmapPropertie
 					properties.StreamType = common.OBJECT_STREAM
 				}
 			}
+			if tz, found := propmap["Timezone"]; found {
+				if properties.Timezone, ok = tz.(string); !ok {
+					err = errors.New("Timezone was not string")
+				}
+			}
+			if rt, found := propmap["ReadingType"]; found {
+				if properties.ReadingType, ok = rt.(string); !ok {
+					err = errors.New("ReadingType was not string")
+				}
+			}
 		}
-		return properties, nil
+		return properties, err
 	}
 	return properties, PropertiesNotFound
 }
 
 func getValue(msg map[string]interface{}) (float64, error) {
 	if val, found := msg["Value"]; found {
-		if f64, ok := val.(float64); ok {
+		if f64, ok := getNumber(val); ok {
 			return f64, nil
-		} else if u64, ok := val.(uint64); ok {
-			return float64(u64), nil
-		} else if i64, ok := val.(int64); ok {
-			return float64(i64), nil
-		} else {
-			return float64(0), ReadingsNotFound
 		}
+		return float64(0), ReadingsNotFound
 	}
 	return float64(0), ReadingsNotFound
 }
 
+// encodes the readings of a message as a msgpack map
+//  uuid => string
+//  Path => string
+//  Readings => [[time, value], ...]
+func encodeReadings(msg *common.SmapMessage) ([]byte, error) {
+	return msgpack.Marshal(map[string]interface{}{
+		"uuid":     string(msg.UUID),
+		"Path":     msg.Path,
+		"Readings": readingsToArray(msg.Readings),
+	})
+}
+
+func readingsToArray(readings []common.Reading) []interface{} {
+	ret := make([]interface{}, len(readings))
+	for i, rdg := range readings {
+		ret[i] = []interface{}{rdg.GetTime(), rdg.GetValue()}
+	}
+	return ret
+}
+
+// converts a message to the same map layout we accept as input, omitting
+// empty fields
+func messageToMap(msg *common.SmapMessage) map[string]interface{} {
+	m := make(map[string]interface{})
+	if msg.Path != "" {
+		m["Path"] = msg.Path
+	}
+	if msg.UUID != "" {
+		m["uuid"] = string(msg.UUID)
+	}
+	if len(msg.Metadata) > 0 {
+		m["Metadata"] = map[string]interface{}(msg.Metadata)
+	}
+	if len(msg.Actuator) > 0 {
+		m["Actuator"] = map[string]interface{}(msg.Actuator)
+	}
+	if msg.Properties != nil && !msg.Properties.IsEmpty() {
+		props := make(map[string]interface{})
+		if msg.Properties.UnitOfTime != 0 {
+			props["UnitofTime"] = msg.Properties.UnitOfTime.String()
+		}
+		if msg.Properties.UnitOfMeasure != "" {
+			props["UnitofMeasure"] = msg.Properties.UnitOfMeasure
+		}
+		if msg.Properties.StreamType != 0 {
+			props["StreamType"] = msg.Properties.StreamType.String()
+		}
+		if msg.Properties.Timezone != "" {
+			props["Timezone"] = msg.Properties.Timezone
+		}
+		if msg.Properties.ReadingType != "" {
+			props["ReadingType"] = msg.Properties.ReadingType
+		}
+		m["Properties"] = props
+	}
+	if len(msg.Readings) > 0 {
+		m["Readings"] = readingsToArray(msg.Readings)
+	}
+	return m
+}
+
+// EncodeResult encodes a query result as msgpack. Messages are encoded as
+// maps with the same keys we accept in adds; other results (e.g. the list
+// returned by a distinct query) are encoded directly
+func EncodeResult(res interface{}) ([]byte, error) {
+	switch t := res.(type) {
+	case common.SmapMessageList:
+		list := make([]interface{}, len(t))
+		for i, msg := range t {
+			list[i] = messageToMap(msg)
+		}
+		return msgpack.Marshal(list)
+	case *common.SmapMessage:
+		return msgpack.Marshal(messageToMap(t))
+	}
+	return msgpack.Marshal(res)
+}
+
+// DecodeMessages decodes a msgpack buffer containing either a single message
+// (a map with a Path key) or a map of path => message, like the JSON
+// interfaces accept
+func DecodeMessages(buffer []byte) (common.TieredSmapMessage, error) {
+	msgMap, err := doDecode(buffer)
+	if err != nil {
+		return nil, err
+	}
+	return decodeMessages(msgMap)
+}
+
+// DecodeQuery decodes a query sent as a msgpack string
+func DecodeQuery(buffer []byte) (query string, err error) {
+	err = msgpack.Unmarshal(buffer, &query)
+	return
+}
+
+func decodeMessages(msgMap map[string]interface{}) (common.TieredSmapMessage, error) {
+	decoded := make(common.TieredSmapMessage)
+	if _, found := msgMap["Path"]; found {
+		msg, err := decodeMessage(msgMap)
+		if err != nil {
+			return nil, err
+		}
+		decoded[msg.Path] = msg
+		return decoded, nil
+	}
+	for path, val := range msgMap {
+		inner, ok := val.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Message for path %v was not a map", path)
+		}
+		if _, found := inner["Path"]; !found {
+			inner["Path"] = path
+		}
+		msg, err := decodeMessage(inner)
+		if err != nil {
+			return nil, err
+		}
+		decoded[path] = msg
+	}
+	return decoded, nil
+}
+
 func doDecode(buffer []byte) (map[string]interface{}, error) {
 	var msgMap map[string]interface{}
 	decoder := msgpack.NewDecoder(bytes.NewBuffer(buffer))
@@ -0,0 +1,134 @@
+package msgpack
+
+import (
+	"github.com/gtfierro/giles2/common"
+	"gopkg.in/vmihailenco/msgpack.v2"
+	"testing"
+)
+
+func TestGetReadings(t *testing.T) {
+	buf, err := msgpack.Marshal(map[string]interface{}{
+		"Readings": []interface{}{
+			[]interface{}{uint64(1351043674000), 12.5},
+			[]interface{}{int64(1351043675000), map[string]interface{}{"state": "on"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgMap, err := doDecode(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readings, err := getReadings(msgMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(readings) != 2 {
+		t.Fatalf("Expected 2 readings, got %v", len(readings))
+	}
+	if num, ok := readings[0].(*common.SmapNumberReading); !ok || num.Value != 12.5 || num.Time != 1351043674000 {
+		t.Errorf("Bad numeric reading %v", readings[0])
+	}
+	if _, ok := readings[1].(*common.SmapObjectReading); !ok {
+		t.Errorf("Expected object reading, got %T", readings[1])
+	}
+}
+
+func TestGetReadingsInvalid(t *testing.T) {
+	for _, test := range []struct {
+		readings interface{}
+		err      error
+	}{
+		{[]interface{}{int64(1)}, InvalidReading},
+		{[]interface{}{[]interface{}{int64(1)}}, InvalidReading},
+		{[]interface{}{[]interface{}{int64(-1), 2.0}}, InvalidTimestamp},
+		{[]interface{}{[]interface{}{"now", 2.0}}, InvalidTimestamp},
+	} {
+		_, err := getReadings(map[string]interface{}{"Readings": test.readings})
+		if err != test.err {
+			t.Errorf("Readings %v: expected %v, got %v", test.readings, test.err, err)
+		}
+	}
+}
+
+func TestGetPropertiesInvalid(t *testing.T) {
+	for _, props := range []map[string]interface{}{
+		{"Timezone": int64(8)},
+		{"ReadingType": true},
+		{"UnitofTime": "fortnights"},
+	} {
+		if _, err := getProperties(map[string]interface{}{"Properties": props}); err == nil {
+			t.Errorf("Properties %v: expected an error", props)
+		}
+	}
+	properties, err := getProperties(map[string]interface{}{"Properties": map[string]interface{}{"Timezone": "America/Los_Angeles"}})
+	if err != nil || properties.Timezone != "America/Los_Angeles" {
+		t.Errorf("Bad properties %v (%v)", properties, err)
+	}
+}
+
+func TestGetActuator(t *testing.T) {
+	msgMap := map[string]interface{}{
+		"Actuator": map[string]interface{}{
+			"Model":  "discrete",
+			"States": []interface{}{"on", "off"},
+			"Range":  map[string]interface{}{"Min": int64(0)},
+		},
+	}
+	act, err := getActuator(msgMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if act["Model"] != "discrete" {
+		t.Errorf("Bad Model %v", act["Model"])
+	}
+	if act["Range|Min"] != int64(0) {
+		t.Errorf("Nested key not flattened %v", act)
+	}
+	if _, err = getActuator(map[string]interface{}{}); err != ActuatorNotFound {
+		t.Errorf("Expected ActuatorNotFound, got %v", err)
+	}
+}
+
+func TestDecodeTieredCollection(t *testing.T) {
+	buf, err := msgpack.Marshal(map[string]interface{}{
+		"/building": map[string]interface{}{
+			"Contents": []interface{}{"sensor0"},
+			"Metadata": map[string]interface{}{"Site": "Soda"},
+		},
+		"/building/sensor0": map[string]interface{}{
+			"uuid":     "d24325e6-1d7d-11e2-ad69-a7c2fa8dba61",
+			"Readings": []interface{}{[]interface{}{uint64(1351043674000), 1.0}},
+		},
+		// a metadata update without readings
+		"/building/sensor1": map[string]interface{}{
+			"uuid":     "e24325e6-1d7d-11e2-ad69-a7c2fa8dba61",
+			"Metadata": map[string]interface{}{"Type": "Temperature"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages, err := DecodeMessages(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	collection, found := messages["/building"]
+	if !found || collection.UUID != "" || len(collection.Contents) != 1 || collection.Metadata["Site"] != "Soda" {
+		t.Errorf("Bad collection %v", collection)
+	}
+	if collection.IsTimeseries() {
+		t.Error("The collection should not be a timeseries")
+	}
+	if msg := messages["/building/sensor0"]; msg == nil || len(msg.Readings) != 1 {
+		t.Errorf("Bad stream %v", msg)
+	}
+	if msg := messages["/building/sensor1"]; msg == nil || len(msg.Readings) != 0 || msg.Metadata["Type"] != "Temperature" {
+		t.Errorf("Bad metadata update %v", msg)
+	}
+	if _, err := decodeMessage(map[string]interface{}{"Path": "/s", "Contents": "sensor0"}); err != InvalidContents {
+		t.Errorf("Expected InvalidContents, got %v", err)
+	}
+}
+
@@ -6,11 +6,13 @@ import (
 	"fmt"
 	giles "github.com/gtfierro/giles2/archiver"
 	"github.com/gtfierro/giles2/common"
+	"github.com/gtfierro/giles2/common/encoders"
 	"github.com/op/go-logging"
 	"io"
 	"net"
 	"os"
 	"strconv"
+	"strings"
 )
 
 // logger
@@ -105,14 +107,11 @@ func (tcp *TCPJSONHandler) handleAdd(conn net.Conn) {
 		tcp.errors <- err
 		return
 	}
-	messages.CollapseToTimeseries()
-	for _, msg := range messages {
-		if addErr := tcp.a.AddData(msg); addErr != nil {
-			log.Errorf("Error handling JSON: %v", err)
-			tcp.errors <- err
-			conn.Close()
-			return
-		}
+	if _, err = tcp.a.AddTiered(giles.Caller("tcpjson", conn.RemoteAddr().String()), messages); err != nil {
+		log.Errorf("Error handling JSON: %v", err)
+		tcp.errors <- err
+		conn.Close()
+		return
 	}
 
 }
@@ -138,17 +137,33 @@ func (tcp *TCPJSONHandler) handleQuery(conn net.Conn) {
 		tcp.errors <- err
 		return
 	}
-	res, err := tcp.a.HandleQuery(string(querybuffer))
+	accept, query := splitAccept(string(querybuffer[:n]))
+	res, err := tcp.a.HandleQuery(giles.Caller("tcpjson", conn.RemoteAddr().String()), query)
 	if err != nil {
 		log.Errorf("Error evaluating query: %v", err)
 		tcp.errors <- err
 		return
 	}
-	writer := json.NewEncoder(conn)
-	err = writer.Encode(res)
+	err = encoders.Negotiate(accept).Encode(conn, res)
 	if err != nil {
-		log.Errorf("Error converting query results to JSON: %v", err)
+		log.Errorf("Error encoding query results: %v", err)
+	}
+}
+
+// Queries may start with an "Accept: <media type>" line choosing the format
+// of the results (see the encoders package), e.g.
+//    Accept: text/csv
+//    select data before now limit 10 where Metadata/Site = 'A'
+// Returns the media type and the rest of the query
+func splitAccept(query string) (string, string) {
+	if !strings.HasPrefix(strings.ToLower(query), "accept:") {
+		return "", query
+	}
+	newline := strings.Index(query, "\n")
+	if newline < 0 {
+		return strings.TrimSpace(query[len("accept:"):]), ""
 	}
+	return strings.TrimSpace(query[len("accept:"):newline]), query[newline+1:]
 }
 
 func (tcp *TCPJSONHandler) listenSubscribe() {
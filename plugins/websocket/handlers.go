@@ -1,11 +1,13 @@
 package websocket
 
 import (
+	"encoding/json"
 	"github.com/gorilla/websocket"
 	giles "github.com/gtfierro/giles2/archiver"
 	"github.com/gtfierro/giles2/common"
 	"github.com/julienschmidt/httprouter"
 	"github.com/op/go-logging"
+	"io"
 	"net"
 	"net/http"
 	"os"
@@ -41,6 +43,8 @@ func NewWebSocketHandler(a *giles.Archiver) *WebSocketHandler {
 	h := &WebSocketHandler{a, r}
 	r.GET("/add/:key", h.handleAdd)
 	r.GET("/republish", h.handleRepublish)
+	r.GET("/api/ws", h.handleProtocol)
+	r.GET("/api/ws/:key", h.handleProtocol)
 
 	go m.start()
 
@@ -66,6 +70,7 @@ func Handle(a *giles.Archiver, port int) {
 func (h *WebSocketHandler) handleAdd(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 	var (
 		messages common.TieredSmapMessage
+		reader   io.Reader
 		err      error
 	)
 	rw.Header().Set("Content-Type", "application/json")
@@ -75,16 +80,25 @@ func (h *WebSocketHandler) handleAdd(rw http.ResponseWriter, req *http.Request,
 		log.Errorf("Error establishing websocket: %v", err)
 		return
 	}
+	defer ws.Close()
+	ws.SetReadLimit(maxFrameSize)
 
 	for {
-		err = ws.ReadJSON(messages)
-		if err != nil {
+		if _, reader, err = ws.NextReader(); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Errorf("Error reading from websocket: %v", err)
+			}
+			return
+		}
+		if messages, err = handleJSON(reader); err != nil {
 			log.Errorf("Error reading JSON: %v", err)
-			ws.Close()
+			return
+		}
+		if _, err = h.a.AddTiered(giles.KeyCaller("websocket", ps.ByName("key")), messages); err != nil {
+			log.Errorf("Error adding data: %v", err)
 			return
 		}
 	}
-
 }
 
 func (h *WebSocketHandler) handleRepublish(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
@@ -106,6 +120,16 @@ func (h *WebSocketHandler) handleRepublish(rw http.ResponseWriter, req *http.Req
 	h.a.HandleNewSubscriber(subscription, "select * where "+string(msg))
 }
 
+func handleJSON(r io.Reader) (decoded common.TieredSmapMessage, err error) {
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	err = decoder.Decode(&decoded)
+	for path, msg := range decoded {
+		msg.Path = path
+	}
+	return
+}
+
 type manager struct {
 	// registered connections
 	subscribers map[*WebSocketSubscriber]bool
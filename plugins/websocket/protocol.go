@@ -0,0 +1,324 @@
+package websocket
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	giles "github.com/gtfierro/giles2/archiver"
+	"github.com/gtfierro/giles2/common"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The protocol endpoint multiplexes adds, queries and any number of named
+// subscriptions over a single WebSocket. Every frame in either direction is a
+// JSON object. Clients send requests such as
+//    {"type": "add", "id": "1", "data": {"/sensor0": {"uuid": "...", "Readings": [[1351043674000, 0]]}}}
+//    {"type": "query", "id": "2", "query": "select * where Metadata/Site = 'A'"}
+//    {"type": "subscribe", "id": "3", "name": "temps", "query": "select * where Metadata/Type = 'Temperature'"}
+//    {"type": "unsubscribe", "id": "4", "name": "temps"}
+//    {"type": "ping", "id": "5"}
+// and the server answers each request with an "ack", "result", "pong" or
+// "error" frame carrying the same id. Subscriptions deliver "initial", "data",
+// "diff", "expire" and "liveness" frames tagged with the name of the
+// subscription.
+
+// request types
+const (
+	ADD_REQUEST         = "add"
+	QUERY_REQUEST       = "query"
+	SUBSCRIBE_REQUEST   = "subscribe"
+	UNSUBSCRIBE_REQUEST = "unsubscribe"
+	PING_REQUEST        = "ping"
+)
+
+// response types
+const (
+	ACK_RESPONSE      = "ack"
+	RESULT_RESPONSE   = "result"
+	PONG_RESPONSE     = "pong"
+	ERROR_RESPONSE    = "error"
+	INITIAL_RESPONSE  = "initial"
+	DATA_RESPONSE     = "data"
+	DIFF_RESPONSE     = "diff"
+	EXPIRE_RESPONSE   = "expire"
+	LIVENESS_RESPONSE = "liveness"
+)
+
+// largest frame we accept from a client. Adds can carry many readings
+const maxFrameSize = 1 << 20
+
+type Request struct {
+	Type string `json:"type"`
+	// chosen by the client and echoed in the response
+	ID string `json:"id,omitempty"`
+	// name of the subscription for subscribe/unsubscribe
+	Name  string `json:"name,omitempty"`
+	Query string `json:"query,omitempty"`
+	// sMAP message for add
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+type Response struct {
+	Type  string      `json:"type"`
+	ID    string      `json:"id,omitempty"`
+	Name  string      `json:"name,omitempty"`
+	Data  interface{} `json:"data,omitempty"`
+	Error string      `json:"error,omitempty"`
+}
+
+type protocolSubscription struct {
+	name         string
+	closeC       chan bool
+	stop         chan struct{}
+	stopOnce     sync.Once
+	subscription *giles.Subscriber
+}
+
+func (ps *protocolSubscription) close() {
+	ps.stopOnce.Do(func() {
+		ps.closeC <- true
+		close(ps.stop)
+	})
+}
+
+// what the protocol needs of the archiver
+type protocolArchiver interface {
+	AddTiered(caller string, messages common.TieredSmapMessage) (int, error)
+	HandleQuery(caller, querystring string) (giles.QueryResult, error)
+	CheckQuery(querystring string) error
+	HandleNewSubscriber(subscriber *giles.Subscriber, querystring string) error
+}
+
+type protocolConnection struct {
+	a protocolArchiver
+	// who queries and adds are made by, for the audit log
+	caller    string
+	ws        *websocket.Conn
+	writeLock sync.Mutex
+	// name -> subscription
+	subscriptions map[string]*protocolSubscription
+	subLock       sync.Mutex
+	done          chan struct{}
+}
+
+func (h *WebSocketHandler) handleProtocol(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	serveProtocol(rw, req, h.a, giles.KeyCaller("websocket", ps.ByName("key")))
+}
+
+func serveProtocol(rw http.ResponseWriter, req *http.Request, a protocolArchiver, caller string) {
+	ws, err := upgrader.Upgrade(rw, req, nil)
+	if err != nil {
+		log.Errorf("Error establishing websocket: %v", err)
+		return
+	}
+	conn := &protocolConnection{
+		a:             a,
+		caller:        caller,
+		ws:            ws,
+		subscriptions: make(map[string]*protocolSubscription),
+		done:          make(chan struct{}),
+	}
+	conn.serve()
+}
+
+func (conn *protocolConnection) serve() {
+	defer conn.close()
+	conn.ws.SetReadLimit(maxFrameSize)
+	conn.ws.SetReadDeadline(time.Now().Add(pongPeriod))
+	conn.ws.SetPongHandler(func(string) error {
+		return conn.ws.SetReadDeadline(time.Now().Add(pongPeriod))
+	})
+	go conn.keepalive()
+
+	for {
+		var request Request
+		_, frame, err := conn.ws.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Errorf("Error reading from websocket: %v", err)
+			}
+			return
+		}
+		// any frame from the client shows it is still alive
+		conn.ws.SetReadDeadline(time.Now().Add(pongPeriod))
+		if err := json.Unmarshal(frame, &request); err != nil {
+			conn.send(Response{Type: ERROR_RESPONSE, Error: fmt.Sprintf("Could not decode request (%v)", err)})
+			continue
+		}
+		conn.handleRequest(&request)
+	}
+}
+
+func (conn *protocolConnection) handleRequest(request *Request) {
+	var err error
+	switch request.Type {
+	case ADD_REQUEST:
+		err = conn.handleAdd(request)
+	case QUERY_REQUEST:
+		var res giles.QueryResult
+		if res, err = conn.a.HandleQuery(conn.caller, request.Query); err == nil {
+			conn.send(Response{Type: RESULT_RESPONSE, ID: request.ID, Data: res})
+			return
+		}
+	case SUBSCRIBE_REQUEST:
+		// acknowledged by subscribe so the ack precedes the initial results
+		if err = conn.subscribe(request); err == nil {
+			return
+		}
+	case UNSUBSCRIBE_REQUEST:
+		err = conn.unsubscribe(request.Name)
+	case PING_REQUEST:
+		conn.send(Response{Type: PONG_RESPONSE, ID: request.ID})
+		return
+	default:
+		err = fmt.Errorf("Unknown request type %q", request.Type)
+	}
+	if err != nil {
+		conn.send(Response{Type: ERROR_RESPONSE, ID: request.ID, Name: request.Name, Error: err.Error()})
+		return
+	}
+	conn.send(Response{Type: ACK_RESPONSE, ID: request.ID, Name: request.Name})
+}
+
+func (conn *protocolConnection) handleAdd(request *Request) error {
+	messages, err := handleJSON(bytes.NewReader(request.Data))
+	if err != nil {
+		return err
+	}
+	_, err = conn.a.AddTiered(conn.caller, messages)
+	return err
+}
+
+func (conn *protocolConnection) subscribe(request *Request) error {
+	name := request.Name
+	if name == "" {
+		return fmt.Errorf("Subscription needs a name")
+	}
+	if err := conn.a.CheckQuery(request.Query); err != nil {
+		return err
+	}
+	ps := &protocolSubscription{
+		name:   name,
+		closeC: make(chan bool, 1),
+		stop:   make(chan struct{}),
+	}
+	ps.subscription = giles.NewSubscriber(ps.closeC, 10, func(e error) {
+		if e == nil {
+			return
+		}
+		conn.send(Response{Type: ERROR_RESPONSE, Name: name, Error: e.Error()})
+		conn.remove(ps)
+	})
+	ps.subscription.ReceiveEvents()
+
+	conn.subLock.Lock()
+	if _, found := conn.subscriptions[name]; found {
+		conn.subLock.Unlock()
+		return fmt.Errorf("Subscription %q already exists", name)
+	}
+	conn.subscriptions[name] = ps
+	conn.subLock.Unlock()
+
+	conn.send(Response{Type: ACK_RESPONSE, ID: request.ID, Name: name})
+	go conn.forward(ps)
+	go conn.a.HandleNewSubscriber(ps.subscription, request.Query)
+	return nil
+}
+
+func (conn *protocolConnection) unsubscribe(name string) error {
+	conn.subLock.Lock()
+	ps, found := conn.subscriptions[name]
+	conn.subLock.Unlock()
+	if !found {
+		return fmt.Errorf("No subscription named %q", name)
+	}
+	conn.remove(ps)
+	return nil
+}
+
+// removes the subscription from this connection and tells the broker to
+// clean it up
+func (conn *protocolConnection) remove(ps *protocolSubscription) {
+	conn.subLock.Lock()
+	if cur, found := conn.subscriptions[ps.name]; found && cur == ps {
+		delete(conn.subscriptions, ps.name)
+	}
+	conn.subLock.Unlock()
+	ps.close()
+}
+
+// delivers the results of a subscription to the client, tagged with the
+// subscription's name
+func (conn *protocolConnection) forward(ps *protocolSubscription) {
+	initial := true
+	for {
+		select {
+		case <-ps.stop:
+			return
+		case val := <-ps.subscription.C:
+			resp := Response{Name: ps.name, Data: val}
+			switch val.(type) {
+			case giles.SubscriptionDiff:
+				resp.Type = DIFF_RESPONSE
+			case giles.WindowExpiry:
+				resp.Type = EXPIRE_RESPONSE
+			case giles.LivenessChange:
+				resp.Type = LIVENESS_RESPONSE
+			case *common.SmapMessage:
+				resp.Type = DATA_RESPONSE
+			default:
+				if initial {
+					resp.Type = INITIAL_RESPONSE
+					initial = false
+				} else {
+					resp.Type = DATA_RESPONSE
+				}
+			}
+			conn.send(resp)
+		}
+	}
+}
+
+func (conn *protocolConnection) send(resp Response) {
+	conn.writeLock.Lock()
+	defer conn.writeLock.Unlock()
+	conn.ws.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := conn.ws.WriteJSON(resp); err != nil {
+		log.Errorf("Error writing to websocket: %v", err)
+	}
+}
+
+// pings the client so dead connections are noticed by the read deadline
+func (conn *protocolConnection) keepalive() {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-conn.done:
+			return
+		case <-ticker.C:
+			if err := conn.ws.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(writeWait)); err != nil {
+				log.Errorf("web socket error %v", err)
+				return
+			}
+		}
+	}
+}
+
+func (conn *protocolConnection) close() {
+	close(conn.done)
+	conn.subLock.Lock()
+	subscriptions := make([]*protocolSubscription, 0, len(conn.subscriptions))
+	for _, ps := range conn.subscriptions {
+		subscriptions = append(subscriptions, ps)
+	}
+	conn.subLock.Unlock()
+	for _, ps := range subscriptions {
+		conn.remove(ps)
+	}
+	conn.ws.Close()
+}
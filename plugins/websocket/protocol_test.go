@@ -0,0 +1,157 @@
+package websocket
+
+import (
+	"fmt"
+	"github.com/gorilla/websocket"
+	giles "github.com/gtfierro/giles2/archiver"
+	"github.com/gtfierro/giles2/common"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProtocolRequests(t *testing.T) {
+	h := &WebSocketHandler{}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		h.handleProtocol(rw, req, nil)
+	}))
+	defer server.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Could not dial protocol endpoint: %v", err)
+	}
+	defer ws.Close()
+
+	for _, test := range []struct {
+		title    string
+		request  string
+		expected Response
+	}{
+		{
+			"Ping",
+			`{"type": "ping", "id": "1"}`,
+			Response{Type: PONG_RESPONSE, ID: "1"},
+		},
+		{
+			"Malformed JSON",
+			`{"type": "ping"`,
+			Response{Type: ERROR_RESPONSE, Error: "Could not decode request (unexpected end of JSON input)"},
+		},
+		{
+			"Unknown type",
+			`{"type": "frobnicate", "id": "2"}`,
+			Response{Type: ERROR_RESPONSE, ID: "2", Error: `Unknown request type "frobnicate"`},
+		},
+		{
+			"Subscribe without name",
+			`{"type": "subscribe", "id": "3", "query": "select *"}`,
+			Response{Type: ERROR_RESPONSE, ID: "3", Error: "Subscription needs a name"},
+		},
+		{
+			"Unsubscribe unknown",
+			`{"type": "unsubscribe", "id": "4", "name": "temps"}`,
+			Response{Type: ERROR_RESPONSE, ID: "4", Name: "temps", Error: `No subscription named "temps"`},
+		},
+	} {
+		if err := ws.WriteMessage(websocket.TextMessage, []byte(test.request)); err != nil {
+			t.Fatalf("%s: could not write request: %v", test.title, err)
+		}
+		var resp Response
+		if err := ws.ReadJSON(&resp); err != nil {
+			t.Fatalf("%s: could not read response: %v", test.title, err)
+		}
+		if resp != test.expected {
+			t.Errorf("%s: response should be %+v but was %+v", test.title, test.expected, resp)
+		}
+	}
+}
+
+type fakeArchiver struct {
+	added   common.TieredSmapMessage
+	caller  string
+	queries []string
+}
+
+func (fa *fakeArchiver) AddTiered(caller string, messages common.TieredSmapMessage) (int, error) {
+	fa.caller, fa.added = caller, messages
+	return len(messages), nil
+}
+
+func (fa *fakeArchiver) HandleQuery(caller, querystring string) (giles.QueryResult, error) {
+	if querystring != "select distinct Metadata/Site" {
+		return nil, fmt.Errorf("bad query")
+	}
+	return common.DistinctResult{"A", "B"}, nil
+}
+
+func (fa *fakeArchiver) CheckQuery(querystring string) error {
+	if !strings.HasPrefix(querystring, "select") {
+		return fmt.Errorf("bad query")
+	}
+	return nil
+}
+
+// delivers the initial results and a reading, as the broker would
+func (fa *fakeArchiver) HandleNewSubscriber(sub *giles.Subscriber, querystring string) error {
+	sub.BlockSend(common.SmapMessageList{})
+	sub.BlockSend(&common.SmapMessage{UUID: "aaaa"})
+	return nil
+}
+
+func TestProtocolSession(t *testing.T) {
+	fa := &fakeArchiver{}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		serveProtocol(rw, req, fa, "websocket/test")
+	}))
+	defer server.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Could not dial protocol endpoint: %v", err)
+	}
+	defer ws.Close()
+	exchange := func(request string, count int) []string {
+		assert.NoError(t, ws.WriteMessage(websocket.TextMessage, []byte(request)))
+		var frames []string
+		for i := 0; i < count; i++ {
+			_, frame, err := ws.ReadMessage()
+			if !assert.NoError(t, err) {
+				break
+			}
+			frames = append(frames, string(frame))
+		}
+		return frames
+	}
+
+	assert.Equal(t, []string{`{"type":"ack","id":"1"}` + "\n"},
+		exchange(`{"type": "add", "id": "1", "data": {"/sensor0": {"uuid": "aaaa", "Readings": [[1351043674000, 0]]}}}`, 1))
+	assert.Equal(t, "websocket/test", fa.caller)
+	if assert.Contains(t, fa.added, "/sensor0") {
+		assert.Equal(t, "/sensor0", fa.added["/sensor0"].Path)
+		assert.Len(t, fa.added["/sensor0"].Readings, 1)
+	}
+
+	assert.Equal(t, []string{`{"type":"result","id":"2","data":["A","B"]}` + "\n"},
+		exchange(`{"type": "query", "id": "2", "query": "select distinct Metadata/Site"}`, 1))
+	assert.Equal(t, []string{`{"type":"error","id":"3","error":"bad query"}` + "\n"},
+		exchange(`{"type": "query", "id": "3", "query": "selec"}`, 1))
+
+	// a subscription is acknowledged before its results, which carry its name
+	assert.Equal(t, []string{
+		`{"type":"ack","id":"4","name":"temps"}` + "\n",
+		`{"type":"initial","name":"temps","data":[]}` + "\n",
+		`{"type":"data","name":"temps","data":{"uuid":"aaaa"}}` + "\n",
+	}, exchange(`{"type": "subscribe", "id": "4", "name": "temps", "query": "select data before now"}`, 3))
+	assert.Equal(t, []string{`{"type":"error","id":"5","name":"temps","error":"Subscription \"temps\" already exists"}` + "\n"},
+		exchange(`{"type": "subscribe", "id": "5", "name": "temps", "query": "select data before now"}`, 1))
+	// a query that does not parse is only answered with an error
+	assert.Equal(t, []string{`{"type":"error","id":"6","name":"bad","error":"bad query"}` + "\n"},
+		exchange(`{"type": "subscribe", "id": "6", "name": "bad", "query": "selec"}`, 1))
+	assert.Equal(t, []string{`{"type":"ack","id":"7","name":"temps"}` + "\n"},
+		exchange(`{"type": "unsubscribe", "id": "7", "name": "temps"}`, 1))
+	assert.Equal(t, []string{`{"type":"pong","id":"8"}` + "\n"},
+		exchange(`{"type": "ping", "id": "8"}`, 1))
+}